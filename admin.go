@@ -0,0 +1,452 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/docker/go-connections/sockets"
+	"golang.org/x/net/context"
+)
+
+const defaultRecentDecisions = 1000
+
+// adminConf enables the admin API, served on a local socket to the clients
+// presenting the token of TokenFile.
+type adminConf struct {
+	// Socket is the unix socket, or named pipe on Windows, of the API.
+	Socket string `yaml:"socket"`
+	// TokenFile holds the bearer token clients must present.
+	TokenFile string `yaml:"token-file"`
+	// RecentDecisions is how many decisions are kept for /decisions,
+	// 1000 by default.
+	RecentDecisions int `yaml:"recent-decisions"`
+	// Debug serves the pprof handlers and a runtime status page under
+	// /debug.
+	Debug bool `yaml:"debug"`
+	// HealthAddress is a TCP address, host:port, /healthz and /readyz are
+	// served on too, for monitoring which can't reach the socket.
+	HealthAddress string `yaml:"health-address"`
+}
+
+func (c adminConf) validate() error {
+	if c.TokenFile == "" {
+		return errors.New("admin: token-file is required")
+	}
+	if strings.HasPrefix(c.Socket, "tcp://") {
+		return errors.New("admin: socket must be local")
+	}
+	if c.RecentDecisions < 0 {
+		return errors.New("admin: recent-decisions must be positive")
+	}
+	if c.HealthAddress != "" {
+		if _, _, err := net.SplitHostPort(c.HealthAddress); err != nil {
+			return fmt.Errorf("admin: health-address: %v", err)
+		}
+	}
+	return nil
+}
+
+func (c adminConf) socket() string {
+	if c.Socket == "" {
+		return defaultAdminSocket
+	}
+	return c.Socket
+}
+
+// recentDecisions is an audit sink keeping the last decisions in memory.
+type recentDecisions struct {
+	mu   sync.Mutex
+	recs []auditRecord
+	next int
+	full bool
+}
+
+func newRecentDecisions(n int) *recentDecisions {
+	if n == 0 {
+		n = defaultRecentDecisions
+	}
+	return &recentDecisions{recs: make([]auditRecord, n)}
+}
+
+func (r *recentDecisions) send(rec *auditRecord) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.recs[r.next] = *rec
+	r.next = (r.next + 1) % len(r.recs)
+	if r.next == 0 {
+		r.full = true
+	}
+	return nil
+}
+
+// len returns how many decisions are kept.
+func (r *recentDecisions) len() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.full {
+		return len(r.recs)
+	}
+	return r.next
+}
+
+// last returns up to n decisions, the newest first.
+func (r *recentDecisions) last(n int) []auditRecord {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	count := r.next
+	if r.full {
+		count = len(r.recs)
+	}
+	if n <= 0 || n > count {
+		n = count
+	}
+	recs := make([]auditRecord, 0, n)
+	for i := 1; i <= n; i++ {
+		recs = append(recs, r.recs[(r.next-i+len(r.recs))%len(r.recs)])
+	}
+	return recs
+}
+
+// adminAPI serves the admin API of the plugin.
+type adminAPI struct {
+	p     *trustPlugin
+	token []byte
+	debug bool
+}
+
+func newAdminAPI(p *trustPlugin, c adminConf) (*adminAPI, error) {
+	data, err := ioutil.ReadFile(c.TokenFile)
+	if err != nil {
+		return nil, fmt.Errorf("admin: %v", err)
+	}
+	token := []byte(strings.TrimSpace(string(data)))
+	if len(token) == 0 {
+		return nil, fmt.Errorf("admin: %s is empty", c.TokenFile)
+	}
+	return &adminAPI{p: p, token: token, debug: c.Debug}, nil
+}
+
+func (a *adminAPI) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/version", a.handleVersion)
+	mux.HandleFunc("/reload", a.handleReload)
+	mux.HandleFunc("/enforcement", a.handleEnforcement)
+	mux.HandleFunc("/decisions", a.handleDecisions)
+	mux.HandleFunc("/pins", a.handlePins)
+	mux.HandleFunc("/stats", a.handleStats)
+	mux.HandleFunc("/daemon-info", a.handleDaemonInfo)
+	mux.HandleFunc("/history", a.handleHistory)
+	mux.HandleFunc("/history/hosts", a.handleHistory)
+	mux.HandleFunc("/timeline", a.handleTimeline)
+	if a.debug {
+		a.registerDebug(mux)
+	}
+	// Monitoring probes the health endpoints without the token.
+	health := a.p.healthHandler()
+	authenticated := a.authenticate(mux)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/healthz" || r.URL.Path == "/readyz" {
+			health.ServeHTTP(w, r)
+			return
+		}
+		authenticated.ServeHTTP(w, r)
+	})
+}
+
+// authenticate only lets through the requests bearing the token.
+func (a *adminAPI) authenticate(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), a.token) != 1 {
+			logrus.WithField("audit", "admin-denied").Warnf("admin: unauthenticated %s %s", r.Method, r.URL.Path)
+			writeAdminError(w, http.StatusUnauthorized, "invalid or missing token")
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+func (a *adminAPI) handleVersion(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, "GET") {
+		return
+	}
+	writeAdminJSON(w, struct {
+		Version   string `json:"version"`
+		GitCommit string `json:"git_commit,omitempty"`
+		GoVersion string `json:"go_version"`
+		Platform  string `json:"platform"`
+	}{version, gitCommit, runtime.Version(), runtime.GOOS + "/" + runtime.GOARCH})
+}
+
+func (a *adminAPI) handleReload(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, "POST") {
+		return
+	}
+	logrus.WithField("audit", "admin").Info("reload: requested through the admin API")
+	if err := a.p.reload(); err != nil {
+		logrus.Errorf("reload: rejected, keeping the current configuration and policy: %v", err)
+		writeAdminError(w, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+	logrus.Info("reload: new configuration and policy in effect")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Enforcement states of the admin API.
+var toggleStates = map[string]int32{
+	"config":   toggleConfig,
+	"enabled":  toggleEnabled,
+	"disabled": toggleDisabled,
+}
+
+// enforcement returns the runtime enforcement state on GET and sets it on
+// POST: enabled, disabled, or config to go back to the configuration.
+func (a *adminAPI) handleEnforcement(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, "GET", "POST") {
+		return
+	}
+	var state struct {
+		State   string `json:"state"`
+		Enabled bool   `json:"enabled"`
+	}
+	if r.Method == "POST" {
+		if err := json.NewDecoder(r.Body).Decode(&state); err != nil {
+			writeAdminError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		v, ok := toggleStates[state.State]
+		if !ok {
+			writeAdminError(w, http.StatusBadRequest, fmt.Sprintf("invalid state %q", state.State))
+			return
+		}
+		a.p.toggle.set(v)
+		logrus.WithField("audit", "admin").Warnf("enforcement set to %s through the admin API", state.State)
+	}
+	v := a.p.toggle.get()
+	for name, s := range toggleStates {
+		if s == v {
+			state.State = name
+		}
+	}
+	state.Enabled = a.p.toggle.enabled(a.p.snapshots.load().config)
+	writeAdminJSON(w, state)
+}
+
+// decisions returns the last decisions, the newest first, up to the limit
+// parameter if any.
+func (a *adminAPI) handleDecisions(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, "GET") {
+		return
+	}
+	limit := 0
+	if s := r.URL.Query().Get("limit"); s != "" {
+		var err error
+		if limit, err = strconv.Atoi(s); err != nil || limit < 0 {
+			writeAdminError(w, http.StatusBadRequest, fmt.Sprintf("invalid limit %q", s))
+			return
+		}
+	}
+	writeAdminJSON(w, a.p.recent.last(limit))
+}
+
+// handlePins returns the pins matching the query or, on DELETE, prunes them.
+// Pruning needs a filter, or all=true to empty the database.
+func (a *adminAPI) handlePins(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, "GET", "DELETE") {
+		return
+	}
+	q := r.URL.Query()
+	f, err := parsePinFilter(q)
+	if err != nil {
+		writeAdminError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if r.Method == "GET" {
+		writeAdminJSON(w, a.p.pins.list(f))
+		return
+	}
+	if f.empty() && q.Get("all") != "true" {
+		writeAdminError(w, http.StatusBadRequest, "pruning needs reference, repository or older-than, or all=true")
+		return
+	}
+	n, err := a.p.pins.prune(f)
+	if err != nil {
+		writeAdminError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	logrus.Infof("admin: pruned %d pins", n)
+	writeAdminJSON(w, struct {
+		Pruned int `json:"pruned"`
+	}{n})
+}
+
+// handleStats returns the summary of the counters since startup.
+func (a *adminAPI) handleStats(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, "GET") {
+		return
+	}
+	writeAdminJSON(w, a.p.statsSummary())
+}
+
+// handleHistory returns the decisions of the history matching the query,
+// or on /history/hosts the hosts they were taken on.
+func (a *adminAPI) handleHistory(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, "GET") {
+		return
+	}
+	if a.p.history == nil {
+		writeAdminError(w, http.StatusNotFound, "history isn't enabled")
+		return
+	}
+	q, err := parseHistoryQuery(r.URL.Query())
+	if err != nil {
+		writeAdminError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if r.URL.Path == "/history/hosts" {
+		writeAdminJSON(w, a.p.history.hosts(q))
+		return
+	}
+	writeAdminJSON(w, a.p.history.query(q))
+}
+
+// handleTimeline returns the timeline of the digest parameter since the
+// since parameter, a duration or an RFC 3339 time, from the decisions of the
+// audit log, else the recent ones.
+func (a *adminAPI) handleTimeline(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, "GET") {
+		return
+	}
+	q := r.URL.Query()
+	digest := q.Get("digest")
+	if digest == "" {
+		writeAdminError(w, http.StatusBadRequest, "digest is required")
+		return
+	}
+	since := time.Now().Add(-defaultTimelineSince)
+	if s := q.Get("since"); s != "" {
+		if d, err := time.ParseDuration(s); err == nil {
+			since = time.Now().Add(-d)
+		} else if since, err = time.Parse(time.RFC3339, s); err != nil {
+			writeAdminError(w, http.StatusBadRequest, fmt.Sprintf("invalid since %q, a duration or an RFC 3339 time", s))
+			return
+		}
+	}
+	cfg := a.p.snapshots.load().config
+	var records []auditRecord
+	if cfg.AuditLog != "" {
+		var err error
+		if records, err = readAuditRecords(cfg.AuditLog); err != nil {
+			writeAdminError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+	} else {
+		records = a.p.recent.last(0)
+	}
+	ctx, cancel := cfg.Timeouts.daemonContext(context.Background())
+	defer cancel()
+	entries, err := buildTimeline(ctx, a.p.client, records, digest, since)
+	if err != nil {
+		writeAdminError(w, http.StatusBadGateway, err.Error())
+		return
+	}
+	writeAdminJSON(w, entries)
+}
+
+func allowMethod(w http.ResponseWriter, r *http.Request, methods ...string) bool {
+	for _, m := range methods {
+		if r.Method == m {
+			return true
+		}
+	}
+	w.Header().Set("Allow", strings.Join(methods, ", "))
+	writeAdminError(w, http.StatusMethodNotAllowed, r.Method+" not allowed")
+	return false
+}
+
+func writeAdminJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		logrus.Errorf("admin: %v", err)
+	}
+}
+
+func writeAdminError(w http.ResponseWriter, code int, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(struct {
+		Message string `json:"message"`
+	}{msg})
+}
+
+// adminGet gets path from the admin API configured by c and decodes the
+// answer into v.
+func adminGet(c adminConf, path string, v interface{}) error {
+	token, err := ioutil.ReadFile(c.TokenFile)
+	if err != nil {
+		return err
+	}
+	proto, addr := "unix", strings.TrimPrefix(c.socket(), "unix://")
+	if strings.HasPrefix(addr, "npipe://") {
+		proto, addr = "npipe", strings.TrimPrefix(addr, "npipe://")
+	}
+	tr := new(http.Transport)
+	if err := sockets.ConfigureTransport(tr, proto, addr); err != nil {
+		return err
+	}
+	req, err := http.NewRequest("GET", "http://admin"+path, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	resp, err := (&http.Client{Transport: tr, Timeout: 10 * time.Second}).Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		var e struct {
+			Message string `json:"message"`
+		}
+		json.NewDecoder(resp.Body).Decode(&e)
+		return fmt.Errorf("%s: %s %s", path, resp.Status, e.Message)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// serveAdmin serves the admin API of p as configured by c. It returns once
+// the socket is listening.
+func serveAdmin(p *trustPlugin, c adminConf) error {
+	api, err := newAdminAPI(p, c)
+	if err != nil {
+		return err
+	}
+	l, err := localListener(c.socket())
+	if err != nil {
+		return fmt.Errorf("admin: %v", err)
+	}
+	logrus.Infof("admin: serving on %s", l.Addr())
+	if c.HealthAddress != "" {
+		if err := serveHealth(p, c.HealthAddress); err != nil {
+			l.Close()
+			return err
+		}
+	}
+	go func() {
+		if err := http.Serve(l, api.handler()); err != nil {
+			logrus.Errorf("admin: %v", err)
+		}
+	}()
+	return nil
+}
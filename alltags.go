@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+
+	"github.com/containers/image/docker"
+	"github.com/containers/image/types"
+	"github.com/docker/docker/reference"
+	"github.com/docker/go-plugins-helpers/authorization"
+)
+
+const defaultAllTagsMax = 100
+
+// allTagsConf configures pulls of all the tags of a repository.
+type allTagsConf struct {
+	// Require is a regular expression matching the tags which must
+	// verify, all of them if empty. Other tags are pulled unverified.
+	Require string `yaml:"require"`
+	// Max is the number of tags above which such pulls are denied rather
+	// than verified, 100 by default.
+	Max int `yaml:"max"`
+}
+
+// pullAllTags verifies every tag of the repository ref and allows the pull
+// only if all the required ones pass.
+func (p *trustPlugin) pullAllTags(snap *snapshot, ref reference.Named, rec *auditRecord) authorization.Response {
+	rec.Reference = ref.String()
+	cfg := snap.config.AllTags
+	var require *regexp.Regexp
+	if cfg.Require != "" {
+		var err error
+		if require, err = regexp.Compile(cfg.Require); err != nil {
+			return errResponse(codeInternal, fmt.Errorf("invalid all-tags require expression: %v", err))
+		}
+	}
+	max := cfg.Max
+	if max <= 0 {
+		max = defaultAllTagsMax
+	}
+	tags, err := repositoryTags(p.systemContext(rec.ctx, snap.config, ref.Hostname()), reference.WithDefaultTag(ref))
+	if err != nil {
+		return errResponse(codeRegistryError, err)
+	}
+	if len(tags) > max {
+		return newTrustError(codeAllTags, "%s has %d tags, more than the %d which can be verified", ref, len(tags), max).response()
+	}
+	for _, tag := range tags {
+		if require != nil && !require.MatchString(tag) {
+			rec.log().Debugf("all tags pull of %s: not verifying %s", ref, tag)
+			continue
+		}
+		tagged, err := reference.WithTag(ref, tag)
+		if err != nil {
+			return errResponse(codeInvalidReference, err)
+		}
+		if _, terr := p.verifyImage(rec.ctx, snap, tagged, rec.span); terr != nil {
+			return terr.response()
+		}
+	}
+	return authorization.Response{Allow: true}
+}
+
+// repositoryTags lists the tags of the repository of ref from its registry,
+// fetched with sys.
+func repositoryTags(sys *types.SystemContext, ref reference.Named) ([]string, error) {
+	imgRef, err := docker.NewReference(ref)
+	if err != nil {
+		return nil, err
+	}
+	img, err := imgRef.NewImage(sys)
+	if err != nil {
+		return nil, err
+	}
+	defer img.Close()
+	dimg, ok := img.(*docker.Image)
+	if !ok {
+		return nil, fmt.Errorf("%s isn't a docker image", ref)
+	}
+	return dimg.GetRepositoryTags()
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/containers/image/manifest"
+	"github.com/containers/image/signature"
+	"github.com/containers/image/types"
+	"github.com/docker/docker/reference"
+	"github.com/projectatomic/container-trust-plugin/pkg/trust"
+)
+
+// approvedDigestsConf points to a signed list of approved digests, a simple
+// trust model for teams which don't sign images: the file is a GPG signed
+// (not detached, as produced by "gpg --sign") JSON document such as
+//
+//	{"images": {"registry.example.com/team/app": ["sha256:..."]}}
+//
+// Repositories listed there are allowed only by one of their listed
+// digests, without looking at image signatures.
+type approvedDigestsConf struct {
+	Path    string `yaml:"path"`
+	Keyring string `yaml:"keyring"`
+}
+
+type approvedDigests struct {
+	Images map[string][]string `json:"images"`
+}
+
+// loadApprovedDigests verifies the approved digests file against the
+// keyring and returns its contents, with repository names normalized.
+func loadApprovedDigests(c approvedDigestsConf) (*approvedDigests, error) {
+	signed, err := ioutil.ReadFile(c.Path)
+	if err != nil {
+		return nil, err
+	}
+	keyring, err := ioutil.ReadFile(c.Keyring)
+	if err != nil {
+		return nil, err
+	}
+	home, err := importKeyring(keyring)
+	defer home.remove()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", c.Keyring, err)
+	}
+	contents, _, err := home.verify(signed)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", c.Path, err)
+	}
+	var a approvedDigests
+	if err := json.Unmarshal(contents, &a); err != nil {
+		return nil, fmt.Errorf("%s: %v", c.Path, err)
+	}
+	normalized := make(map[string][]string, len(a.Images))
+	for name, digests := range a.Images {
+		ref, err := reference.WithName(name)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", c.Path, err)
+		}
+		if ref, err = trust.NormalizeReference(ref); err != nil {
+			return nil, err
+		}
+		normalized[ref.FullName()] = append(normalized[ref.FullName()], digests...)
+	}
+	a.Images = normalized
+	return &a, nil
+}
+
+// covers tells whether ref's repository is listed.
+func (a *approvedDigests) covers(ref reference.Named) bool {
+	if a == nil {
+		return false
+	}
+	_, ok := a.Images[ref.FullName()]
+	return ok
+}
+
+// allows tells whether img, pulled as ref, is one of the approved digests.
+func (a *approvedDigests) allows(ref reference.Named, img types.Image) (bool, error) {
+	m, _, err := img.Manifest()
+	if err != nil {
+		return false, err
+	}
+	digest, err := manifest.Digest(m)
+	if err != nil {
+		return false, err
+	}
+	for _, d := range a.Images[ref.FullName()] {
+		if d == digest {
+			return true, nil
+		}
+	}
+	return false, signature.PolicyRequirementError(fmt.Sprintf("digest %s isn't in the approved digests of %s", digest, ref.FullName()))
+}
+
+// evaluate decides whether img, pulled as ref, is allowed: by the approved
+// digests when they cover ref, by the registry overrides when its registry
+// allows unsigned images, by the signature policy, the maximum signature age
+// and the signature thresholds otherwise.
+func evaluate(snap *snapshot, ref reference.Named, img types.Image) (bool, error) {
+	if snap.approved.covers(ref) {
+		return snap.approved.allows(ref, img)
+	}
+	if snap.config.override(ref).AllowUnsigned {
+		return true, nil
+	}
+	allowed, err := snap.contexts.isRunningImageAllowed(img)
+	if snap.candidate != nil {
+		compareCandidate(snap.candidateContexts, ref, img, allowed)
+	}
+	if allowed && snap.config.MaxSignatureAge > 0 {
+		if err := checkSignatureAge(snap.keyrings, snap.policy, img, snap.config.MaxSignatureAge); err != nil {
+			return false, err
+		}
+	}
+	if allowed {
+		if err := checkThresholds(snap.keyrings, snap.config.SignatureThresholds, ref, img); err != nil {
+			return false, err
+		}
+	}
+	return allowed, err
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/containers/image/docker"
+	"github.com/containers/image/signature"
+	"github.com/docker/go-plugins-helpers/authorization"
+	"github.com/projectatomic/container-trust-plugin/pkg/trust"
+	"golang.org/x/net/context"
+)
+
+// auditRecord is a single decision taken by the plugin, written as one JSON
+// line to the audit log.
+type auditRecord struct {
+	Time time.Time `json:"time"`
+	// ID correlates the record with the log lines and the deny message of
+	// the request.
+	ID        string `json:"id"`
+	Phase     string `json:"phase,omitempty"`
+	User      string `json:"user,omitempty"`
+	Method    string `json:"method"`
+	URI       string `json:"uri"`
+	Reference string `json:"reference,omitempty"`
+	Digest    string `json:"digest,omitempty"`
+	Allowed   bool   `json:"allowed"`
+	Code      string `json:"code,omitempty"`
+	Message   string `json:"message,omitempty"`
+	// Mode is audit, exempt or break-glass when the denial recorded wasn't
+	// enforced, because of the enforcement mode, of the profile of the user
+	// or of a break-glass grant.
+	Mode string `json:"mode,omitempty"`
+	// AuthN is how the daemon authenticated the user.
+	AuthN string `json:"authn,omitempty"`
+	// Profile is the policy profile of the user.
+	Profile string `json:"profile,omitempty"`
+	// OverrideBy and OverrideReason are who granted the break-glass
+	// override of the denial and why.
+	OverrideBy     string `json:"override_by,omitempty"`
+	OverrideReason string `json:"override_reason,omitempty"`
+	// PolicyScope is the scope of the signature policy applying to the
+	// image, transport:scope or default.
+	PolicyScope string `json:"policy_scope,omitempty"`
+	// Warning is attached to the response without affecting the decision.
+	// Docker only shows the messages of denials, allowed requests' are
+	// only recorded.
+	Warning string `json:"warning,omitempty"`
+	// LatencyMS is how long the decision took, in milliseconds.
+	LatencyMS float64 `json:"latency_ms"`
+
+	// start is when the request was received.
+	start time.Time
+	// intercepted is set once the request is known to be subject to
+	// verification; other requests aren't audited.
+	intercepted bool
+	// span traces the request, nil if it isn't traced.
+	span *span
+	// ctx bounds the network operations taken for the decision.
+	ctx context.Context
+	// endpoint names the interceptor, or the matcher, which handled the
+	// request.
+	endpoint string
+}
+
+func newAuditRecord(req authorization.Request) *auditRecord {
+	now := time.Now()
+	return &auditRecord{
+		ID:     newCorrelationID(),
+		start:  now,
+		ctx:    context.Background(),
+		Time:   now.UTC(),
+		Phase:  phaseRequest,
+		User:   req.User,
+		AuthN:  req.UserAuthNMethod,
+		Method: req.RequestMethod,
+		URI:    req.RequestURI,
+	}
+}
+
+// newCorrelationID returns a random ID for a request.
+func newCorrelationID() string {
+	var id [8]byte
+	rand.Read(id[:])
+	return hex.EncodeToString(id[:])
+}
+
+// log returns the logger of the request of r, whose lines carry its ID.
+func (r *auditRecord) log() *logrus.Entry {
+	return logrus.WithField("id", r.ID)
+}
+
+// auditSink is a destination for decision records.
+type auditSink interface {
+	send(rec *auditRecord) error
+}
+
+// auditLog dispatches decision records to the configured sinks. A nil
+// auditLog discards them.
+type auditLog struct {
+	sinks []auditSink
+}
+
+func newAuditLog(cfg conf) (*auditLog, error) {
+	l := &auditLog{}
+	if cfg.AuditLog != "" {
+		f, err := newFileSink(cfg.AuditLog, cfg.AuditLogRotation)
+		if err != nil {
+			return nil, err
+		}
+		l.sinks = append(l.sinks, f)
+	}
+	if cfg.AuditStderr {
+		l.sinks = append(l.sinks, &writerSink{w: os.Stderr})
+	}
+	for _, c := range cfg.AuditSinks {
+		s, err := newAuditSink(c)
+		if err != nil {
+			return nil, err
+		}
+		l.sinks = append(l.sinks, s)
+	}
+	for _, c := range cfg.Notifications {
+		n, err := newNotifier(c)
+		if err != nil {
+			return nil, err
+		}
+		l.sinks = append(l.sinks, newAsyncSink(n))
+	}
+	if len(l.sinks) == 0 {
+		return nil, nil
+	}
+	return l, nil
+}
+
+// add adds s to the sinks of l, creating l if it's nil.
+func (l *auditLog) add(s auditSink) *auditLog {
+	if l == nil {
+		l = &auditLog{}
+	}
+	l.sinks = append(l.sinks, s)
+	return l
+}
+
+// record completes rec with the outcome in res and sends it to every sink.
+func (l *auditLog) record(rec *auditRecord, res authorization.Response) {
+	if l == nil || !rec.intercepted {
+		return
+	}
+	rec.Allowed = res.Allow
+	if !rec.start.IsZero() {
+		rec.LatencyMS = float64(time.Since(rec.start)) / float64(time.Millisecond)
+	}
+	if !res.Allow && rec.Phase == phaseRequest {
+		msg := res.Err
+		if msg == "" {
+			msg = res.Msg
+		}
+		rec.Code, rec.Message = splitCode(msg)
+	}
+	for _, s := range l.sinks {
+		if err := s.send(rec); err != nil {
+			logrus.Errorf("unable to write audit record: %v", err)
+		}
+	}
+}
+
+// auditRotationConf configures the rotation of the audit log: once it
+// would grow past MaxSize bytes it's renamed to audit.log.1, the previous
+// ones shifted up to MaxBackups, and a new one is started.
+type auditRotationConf struct {
+	MaxSize    int64 `yaml:"max-size"`
+	MaxBackups int   `yaml:"max-backups"`
+}
+
+// fileSink appends records as JSON lines to a file.
+type fileSink struct {
+	path     string
+	rotation auditRotationConf
+
+	mu   sync.Mutex
+	f    *os.File
+	size int64
+}
+
+func newFileSink(path string, rotation auditRotationConf) (*fileSink, error) {
+	s := &fileSink{path: path, rotation: rotation}
+	if err := s.open(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *fileSink) open() error {
+	f, err := os.OpenFile(s.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	s.f, s.size = f, fi.Size()
+	return nil
+}
+
+func (s *fileSink) send(rec *auditRecord) error {
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if max := s.rotation.MaxSize; max > 0 && s.size > 0 && s.size+int64(len(data)) > max {
+		if err := s.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := s.f.Write(data)
+	s.size += int64(n)
+	return err
+}
+
+// rotate shifts the backups, renames the log to the first one and starts a
+// new log. Must be called with s.mu held.
+func (s *fileSink) rotate() error {
+	if err := s.f.Close(); err != nil {
+		return err
+	}
+	if s.rotation.MaxBackups > 0 {
+		for i := s.rotation.MaxBackups - 1; i > 0; i-- {
+			old := fmt.Sprintf("%s.%d", s.path, i)
+			if err := os.Rename(old, fmt.Sprintf("%s.%d", s.path, i+1)); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+		if err := os.Rename(s.path, s.path+".1"); err != nil {
+			return err
+		}
+	} else if err := os.Remove(s.path); err != nil {
+		return err
+	}
+	return s.open()
+}
+
+// writerSink writes records as JSON lines to w, e.g. stderr.
+type writerSink struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (s *writerSink) send(rec *auditRecord) error {
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err = s.w.Write(append(data, '\n'))
+	return err
+}
+
+// policyScopeOf returns the scope of policy applying to the image
+// reference, "" if reference isn't one.
+func policyScopeOf(policy *signature.Policy, reference string) string {
+	ref, err := trust.ParseImageReference(reference)
+	if err != nil {
+		return ""
+	}
+	imgRef, err := docker.NewReference(ref)
+	if err != nil {
+		return ""
+	}
+	scope, _ := policyScope(policy, imgRef)
+	return scope
+}
+
+// splitCode splits a denial message produced by trustError back into its
+// code and human message.
+func splitCode(msg string) (string, string) {
+	if i := strings.Index(msg, ": "); i > 0 && strings.HasPrefix(msg, "TRUST_") {
+		return msg[:i], msg[i+2:]
+	}
+	return "", msg
+}
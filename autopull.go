@@ -0,0 +1,108 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/docker/docker/reference"
+	"github.com/docker/engine-api/types"
+	"github.com/projectatomic/container-trust-plugin/pkg/trust"
+	"golang.org/x/net/context"
+)
+
+// Labels recording the verification decision on images tagged by AutoPull,
+// surfaced by "docker inspect".
+const (
+	labelVerifiedBy = "io.projectatomic.trust.verified-by"
+	labelDigest     = "io.projectatomic.trust.digest"
+	labelVerifiedAt = "io.projectatomic.trust.verified-at"
+)
+
+// autoPull pulls the verified digest of ref and tags it as ref, so users
+// can keep pulling by tag while only verified content ever lands on the
+// host. With annotate the tag points to a trivial image built on top of the
+// verified one, carrying the decision as labels. registryAuth is the
+// X-Registry-Auth header to pull with, if any.
+func (p *trustPlugin) autoPull(ctx context.Context, ref reference.NamedTagged, digest string, m []byte, mimeType string, plat trust.Platform, registryAuth string, annotate bool) error {
+	pulled, err := trust.PullDigest(ctx, p.client, ref, digest, m, mimeType, plat, registryAuth)
+	if err != nil {
+		return err
+	}
+	canonical := ref.FullName() + "@" + pulled
+	logrus.Debugf("pulled %s for %s", canonical, ref)
+	if annotate {
+		return p.annotate(ctx, canonical, ref, pulled)
+	}
+	return p.client.ImageTag(ctx, canonical, ref.String())
+}
+
+// annotate builds "FROM canonical" with the decision labels and tags the
+// result as ref. The layers are shared with the verified image, only the
+// image config differs.
+func (p *trustPlugin) annotate(ctx context.Context, canonical string, ref reference.NamedTagged, digest string) error {
+	return p.labelImage(ctx, canonical, ref.String(), map[string]string{
+		labelVerifiedBy: pluginIdentity(),
+		labelDigest:     digest,
+		labelVerifiedAt: time.Now().UTC().Format(time.RFC3339),
+	})
+}
+
+// pluginIdentity names this plugin instance in labels.
+func pluginIdentity() string {
+	id := pluginName
+	if host, err := os.Hostname(); err == nil {
+		id += "@" + host
+	}
+	return id
+}
+
+// labelImage builds "FROM image" with labels and tags the result as tag.
+// The build is registered as the plugin's own, and labeled with its nonce,
+// so that it isn't denied for its build context being unavailable.
+func (p *trustPlugin) labelImage(ctx context.Context, image, tag string, labels map[string]string) error {
+	buildContext, err := dockerfileContext("FROM " + image + "\n")
+	if err != nil {
+		return err
+	}
+	nonce, done := p.builds.add(tag)
+	defer done()
+	withNonce := map[string]string{labelBuildNonce: nonce}
+	for k, v := range labels {
+		withNonce[k] = v
+	}
+	labels = withNonce
+	res, err := p.client.ImageBuild(ctx, buildContext, types.ImageBuildOptions{
+		Tags:   []string{tag},
+		Remove: true,
+		Labels: labels,
+	})
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if err := trust.DrainJSONStream(res.Body); err != nil {
+		return fmt.Errorf("labeling %s: %v", tag, err)
+	}
+	return nil
+}
+
+// dockerfileContext returns a build context made of a single Dockerfile.
+func dockerfileContext(dockerfile string) (io.Reader, error) {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	if err := tw.WriteHeader(&tar.Header{Name: "Dockerfile", Mode: 0644, Size: int64(len(dockerfile))}); err != nil {
+		return nil, err
+	}
+	if _, err := tw.Write([]byte(dockerfile)); err != nil {
+		return nil, err
+	}
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+	return &buf, nil
+}
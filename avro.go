@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"math"
+	"time"
+)
+
+// auditAvroSchema is the Avro schema of decision records.
+const auditAvroSchema = `{
+  "type": "record",
+  "name": "Decision",
+  "namespace": "io.projectatomic.trust",
+  "fields": [
+    {"name": "time", "type": "string"},
+    {"name": "phase", "type": "string"},
+    {"name": "user", "type": "string"},
+    {"name": "method", "type": "string"},
+    {"name": "uri", "type": "string"},
+    {"name": "reference", "type": "string"},
+    {"name": "digest", "type": "string"},
+    {"name": "allowed", "type": "boolean"},
+    {"name": "code", "type": "string"},
+    {"name": "message", "type": "string"},
+    {"name": "mode", "type": "string", "default": ""},
+    {"name": "authn", "type": "string", "default": ""},
+    {"name": "profile", "type": "string", "default": ""},
+    {"name": "override_by", "type": "string", "default": ""},
+    {"name": "override_reason", "type": "string", "default": ""},
+    {"name": "policy_scope", "type": "string", "default": ""},
+    {"name": "latency_ms", "type": "double", "default": 0},
+    {"name": "id", "type": "string", "default": ""}
+  ]
+}`
+
+// avroValue returns rec as a value matching auditAvroSchema, field order
+// included.
+func avroValue(rec *auditRecord) map[string]interface{} {
+	return map[string]interface{}{
+		"time":            rec.Time.Format(time.RFC3339Nano),
+		"phase":           rec.Phase,
+		"user":            rec.User,
+		"method":          rec.Method,
+		"uri":             rec.URI,
+		"reference":       rec.Reference,
+		"digest":          rec.Digest,
+		"allowed":         rec.Allowed,
+		"code":            rec.Code,
+		"message":         rec.Message,
+		"mode":            rec.Mode,
+		"authn":           rec.AuthN,
+		"profile":         rec.Profile,
+		"override_by":     rec.OverrideBy,
+		"override_reason": rec.OverrideReason,
+		"policy_scope":    rec.PolicyScope,
+		"latency_ms":      rec.LatencyMS,
+		"id":              rec.ID,
+	}
+}
+
+// encodeRecord encodes rec with schema, json or avro (binary encoding).
+func encodeRecord(schema string, rec *auditRecord) ([]byte, error) {
+	if schema != "avro" {
+		return json.Marshal(rec)
+	}
+	var buf bytes.Buffer
+	for _, s := range []string{
+		rec.Time.Format(time.RFC3339Nano), rec.Phase, rec.User, rec.Method,
+		rec.URI, rec.Reference, rec.Digest,
+	} {
+		avroString(&buf, s)
+	}
+	if rec.Allowed {
+		buf.WriteByte(1)
+	} else {
+		buf.WriteByte(0)
+	}
+	avroString(&buf, rec.Code)
+	avroString(&buf, rec.Message)
+	avroString(&buf, rec.Mode)
+	avroString(&buf, rec.AuthN)
+	avroString(&buf, rec.Profile)
+	avroString(&buf, rec.OverrideBy)
+	avroString(&buf, rec.OverrideReason)
+	avroString(&buf, rec.PolicyScope)
+	// Avro doubles are little-endian IEEE 754.
+	var d [8]byte
+	binary.LittleEndian.PutUint64(d[:], math.Float64bits(rec.LatencyMS))
+	buf.Write(d[:])
+	avroString(&buf, rec.ID)
+	return buf.Bytes(), nil
+}
+
+// avroString writes s as an Avro string: its zig-zag varint encoded length
+// followed by its bytes.
+func avroString(buf *bytes.Buffer, s string) {
+	var n [binary.MaxVarintLen64]byte
+	buf.Write(n[:binary.PutVarint(n[:], int64(len(s)))])
+	buf.WriteString(s)
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/docker/go-plugins-helpers/authorization"
+)
+
+// credentialHeaders are the request headers left out of the recorded
+// requests.
+var credentialHeaders = []string{"Authorization", "X-Registry-Auth", "X-Registry-Config"}
+
+// requestRecorder appends the requests the plugin is asked about to a file,
+// one JSON authorization.Request per line, for "container-trust-plugin
+// bench" to replay them.
+type requestRecorder struct {
+	mu sync.Mutex
+	f  *os.File
+}
+
+func newRequestRecorder(path string) (*requestRecorder, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &requestRecorder{f: f}, nil
+}
+
+// record appends req without its credentials.
+func (r *requestRecorder) record(req authorization.Request) {
+	if len(req.RequestHeaders) > 0 {
+		headers := make(map[string]string, len(req.RequestHeaders))
+		for k, v := range req.RequestHeaders {
+			headers[k] = v
+		}
+		for _, h := range credentialHeaders {
+			for k := range headers {
+				if http.CanonicalHeaderKey(k) == h {
+					delete(headers, k)
+				}
+			}
+		}
+		req.RequestHeaders = headers
+	}
+	data, err := json.Marshal(req)
+	if err != nil {
+		logrus.Errorf("unable to record request: %v", err)
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, err := r.f.Write(append(data, '\n')); err != nil {
+		logrus.Errorf("unable to record request: %v", err)
+	}
+}
+
+// readRecordedRequests reads the requests recorded in path.
+func readRecordedRequests(path string) ([]authorization.Request, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var reqs []authorization.Request
+	sc := bufio.NewScanner(f)
+	// Request bodies, e.g. container configs, make for long lines.
+	sc.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	for line := 1; sc.Scan(); line++ {
+		if len(sc.Bytes()) == 0 {
+			continue
+		}
+		var req authorization.Request
+		if err := json.Unmarshal(sc.Bytes(), &req); err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", path, line, err)
+		}
+		reqs = append(reqs, req)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	return reqs, nil
+}
+
+// benchReport is the outcome of a bench run.
+type benchReport struct {
+	Requests    int     `json:"requests"`
+	Concurrency int     `json:"concurrency"`
+	Allowed     int     `json:"allowed"`
+	Denied      int     `json:"denied"`
+	Seconds     float64 `json:"seconds"`
+	// Throughput is in requests per second.
+	Throughput float64 `json:"throughput"`
+	// The latencies are in milliseconds.
+	MeanMS float64 `json:"mean_ms"`
+	P50MS  float64 `json:"p50_ms"`
+	P90MS  float64 `json:"p90_ms"`
+	P99MS  float64 `json:"p99_ms"`
+	P999MS float64 `json:"p999_ms"`
+	MaxMS  float64 `json:"max_ms"`
+}
+
+// percentile returns the q quantile of the sorted latencies, in
+// milliseconds, picking the nearest rank.
+func percentile(sorted []time.Duration, q float64) float64 {
+	if len(sorted) == 0 {
+		return 0
+	}
+	i := int(q*float64(len(sorted))+0.5) - 1
+	if i < 0 {
+		i = 0
+	}
+	if i >= len(sorted) {
+		i = len(sorted) - 1
+	}
+	return durationMS(sorted[i])
+}
+
+func durationMS(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// replay hands reqs to p in turn, count requests in total, concurrency at a
+// time, and reports how long they took.
+func replay(p *trustPlugin, reqs []authorization.Request, count, concurrency int) benchReport {
+	latencies := make([]time.Duration, count)
+	allowed := make([]bool, count)
+	next := make(chan int)
+	var wg sync.WaitGroup
+	start := time.Now()
+	for w := 0; w < concurrency; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				t := time.Now()
+				res := p.AuthZReq(reqs[i%len(reqs)])
+				latencies[i] = time.Since(t)
+				allowed[i] = res.Allow
+			}
+		}()
+	}
+	for i := 0; i < count; i++ {
+		next <- i
+	}
+	close(next)
+	wg.Wait()
+	elapsed := time.Since(start)
+
+	r := benchReport{Requests: count, Concurrency: concurrency, Seconds: elapsed.Seconds()}
+	var total time.Duration
+	for i, l := range latencies {
+		total += l
+		if allowed[i] {
+			r.Allowed++
+		} else {
+			r.Denied++
+		}
+	}
+	sort.Sort(durations(latencies))
+	if count > 0 {
+		r.Throughput = float64(count) / elapsed.Seconds()
+		r.MeanMS = durationMS(total) / float64(count)
+		r.MaxMS = durationMS(latencies[count-1])
+	}
+	r.P50MS = percentile(latencies, 0.5)
+	r.P90MS = percentile(latencies, 0.9)
+	r.P99MS = percentile(latencies, 0.99)
+	r.P999MS = percentile(latencies, 0.999)
+	return r
+}
+
+type durations []time.Duration
+
+func (d durations) Len() int           { return len(d) }
+func (d durations) Less(i, j int) bool { return d[i] < d[j] }
+func (d durations) Swap(i, j int)      { d[i], d[j] = d[j], d[i] }
+
+// newBenchPlugin returns a plugin set up from the configuration which
+// leaves the host and the plugin serving on it alone: it reads from the
+// daemon and the registries, but works on in-memory copies of the pinning
+// and TOFU databases, records and notifies nothing and, unless the daemon is
+// given explicitly with --host, doesn't AutoPull.
+func newBenchPlugin() (*trustPlugin, error) {
+	snap, err := loadSnapshot()
+	if err != nil {
+		return nil, err
+	}
+	client, err := newDockerClient(*flDockerHost, *flCertPath, *flTLSVerify)
+	if err != nil {
+		return nil, err
+	}
+	setupRegistryConnections(snap.config.RegistryConnections)
+	p := newOfflinePlugin()
+	p.client = client
+	pinStorePath := snap.config.PinStore
+	if pinStorePath == "" {
+		pinStorePath = defaultPinStorePath
+	}
+	if p.pins, err = newPinStore(pinStorePath); err != nil {
+		return nil, err
+	}
+	p.pins.path = ""
+	if t := snap.config.TOFU; t != nil {
+		if p.tofu, err = newTOFUStore(t.store()); err != nil {
+			return nil, err
+		}
+		p.tofu.path = ""
+	}
+	if snap.config.AutoPull && !flagSet("host") {
+		logrus.Warn("bench: AutoPull disabled, it would pull and tag images on the host, pass --host explicitly to AutoPull with that daemon")
+		snap.config.AutoPull = false
+	}
+	p.snapshots.store(snap)
+	setupProxy(func() conf { return p.snapshots.load().config })
+	return p, nil
+}
+
+// flagSet tells whether the global flag name was set, on the command line or
+// in the environment.
+func flagSet(name string) bool {
+	if _, ok := os.LookupEnv(envName(name)); ok {
+		return true
+	}
+	set := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
+}
+
+// runBench replays recorded requests against a plugin set up from the
+// configuration, in process, isolated from the host, and prints the latency percentiles of its
+// decisions.
+func runBench(args []string) error {
+	fs := flag.NewFlagSet("bench", flag.ContinueOnError)
+	concurrency := fs.Int("concurrency", 8, "How many requests are replayed at once")
+	count := fs.Int("requests", 0, "How many requests are replayed in total, cycling through the recorded ones, all of them once by default")
+	warmup := fs.Int("warmup", 0, "How many requests are replayed first without being measured, to fill the caches")
+	asJSON := fs.Bool("json", false, "Print the report as JSON")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return errors.New("usage: container-trust-plugin bench [flags] REQUESTS-FILE")
+	}
+	if *concurrency < 1 || *count < 0 || *warmup < 0 {
+		return errors.New("bench: concurrency must be positive, requests and warmup can't be negative")
+	}
+	reqs, err := readRecordedRequests(fs.Arg(0))
+	if err != nil {
+		return fmt.Errorf("bench: %v", err)
+	}
+	if len(reqs) == 0 {
+		return fmt.Errorf("bench: no requests recorded in %s", fs.Arg(0))
+	}
+	if *count == 0 {
+		*count = len(reqs)
+	}
+	p, err := newBenchPlugin()
+	if err != nil {
+		return err
+	}
+	if *warmup > 0 {
+		replay(p, reqs, *warmup, *concurrency)
+	}
+	r := replay(p, reqs, *count, *concurrency)
+	if *asJSON {
+		return json.NewEncoder(os.Stdout).Encode(r)
+	}
+	fmt.Printf("%d requests, %d at a time, in %.2fs: %.1f requests/s\n", r.Requests, r.Concurrency, r.Seconds, r.Throughput)
+	fmt.Printf("allowed %d, denied %d\n", r.Allowed, r.Denied)
+	fmt.Printf("latency mean %.2fms, p50 %.2fms, p90 %.2fms, p99 %.2fms, p99.9 %.2fms, max %.2fms\n", r.MeanMS, r.P50MS, r.P90MS, r.P99MS, r.P999MS, r.MaxMS)
+	return nil
+}
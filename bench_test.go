@@ -0,0 +1,137 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/docker/go-plugins-helpers/authorization"
+)
+
+// benchRequests are a mix of the requests a build farm sends, none of them
+// reaching a registry with the plugin of newTestPlugin.
+var benchRequests = []authorization.Request{
+	{RequestMethod: "GET", RequestURI: "/v1.40/_ping"},
+	{RequestMethod: "GET", RequestURI: "/v1.40/containers/json"},
+	{RequestMethod: "POST", RequestURI: "/v1.40/containers/web/wait"},
+	{RequestMethod: "POST", RequestURI: "/v1.24/images/create?fromImage=denied.example.com/app&tag=1"},
+	{RequestMethod: "POST", RequestURI: "/images/create?fromImage=example.com/app"},
+	{RequestMethod: "POST", RequestURI: "/v1.40/build?version=2"},
+}
+
+func newTestBenchPlugin() *trustPlugin {
+	return newTestPlugin(conf{Registries: registriesConf{Deny: []string{"denied.example.com"}}})
+}
+
+func TestPercentile(t *testing.T) {
+	var sorted []time.Duration
+	for i := 1; i <= 100; i++ {
+		sorted = append(sorted, time.Duration(i)*time.Millisecond)
+	}
+	tests := []struct {
+		q  float64
+		ms float64
+	}{
+		{0, 1},
+		{0.5, 50},
+		{0.9, 90},
+		{0.99, 99},
+		{0.999, 100},
+		{1, 100},
+	}
+	for _, tt := range tests {
+		if ms := percentile(sorted, tt.q); ms != tt.ms {
+			t.Errorf("percentile(1..100ms, %v) = %vms, want %vms", tt.q, ms, tt.ms)
+		}
+	}
+	if ms := percentile(nil, 0.5); ms != 0 {
+		t.Errorf("percentile of no latencies = %vms, want 0", ms)
+	}
+}
+
+func TestRecordedRequests(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "requests.jsonl")
+	r, err := newRequestRecorder(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.record(authorization.Request{
+		User:           "alice",
+		RequestMethod:  "POST",
+		RequestURI:     "/v1.40/images/create?fromImage=busybox&tag=latest",
+		RequestHeaders: map[string]string{"X-Registry-Auth": "secret", "authorization": "Basic secret", "User-Agent": "docker"},
+	})
+	r.record(authorization.Request{RequestMethod: "POST", RequestURI: "/containers/create", RequestBody: []byte(`{"Image":"busybox"}`)})
+	r.f.Close()
+
+	reqs, err := readRecordedRequests(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reqs) != 2 {
+		t.Fatalf("read %d requests, want 2", len(reqs))
+	}
+	if reqs[0].User != "alice" || reqs[0].RequestURI != "/v1.40/images/create?fromImage=busybox&tag=latest" {
+		t.Errorf("first request read as %+v", reqs[0])
+	}
+	if len(reqs[0].RequestHeaders) != 1 || reqs[0].RequestHeaders["User-Agent"] != "docker" {
+		t.Errorf("recorded headers %v, want the credentials left out", reqs[0].RequestHeaders)
+	}
+	if string(reqs[1].RequestBody) != `{"Image":"busybox"}` {
+		t.Errorf("recorded body %q", reqs[1].RequestBody)
+	}
+}
+
+func TestReadRecordedRequestsMalformed(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "requests.jsonl")
+	data := `{"RequestMethod":"GET","RequestUri":"/_ping"}` + "\n\n" + `{"RequestMethod":` + "\n"
+	if err := ioutil.WriteFile(path, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+	_, err := readRecordedRequests(path)
+	if err == nil || !strings.HasPrefix(err.Error(), path+":3: ") {
+		t.Errorf("reading malformed requests: %v, want an error at line 3", err)
+	}
+}
+
+func TestReplay(t *testing.T) {
+	p := newTestBenchPlugin()
+	count := 5 * len(benchRequests)
+	r := replay(p, benchRequests, count, 4)
+	if r.Requests != count || r.Concurrency != 4 {
+		t.Errorf("replayed %d requests %d at a time, want %d 4 at a time", r.Requests, r.Concurrency, count)
+	}
+	// The first three requests are allowed, the others denied.
+	if r.Allowed != 15 || r.Denied != 15 {
+		t.Errorf("allowed %d, denied %d, want 15 and 15", r.Allowed, r.Denied)
+	}
+	if r.P50MS > r.P90MS || r.P90MS > r.P99MS || r.P99MS > r.P999MS || r.P999MS > r.MaxMS {
+		t.Errorf("latency percentiles out of order: %+v", r)
+	}
+}
+
+func BenchmarkAuthZReqParallel(b *testing.B) {
+	p := newTestBenchPlugin()
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		for i := 0; pb.Next(); i++ {
+			p.AuthZReq(benchRequests[i%len(benchRequests)])
+		}
+	})
+}
+
+func BenchmarkReplay(b *testing.B) {
+	for _, concurrency := range []int{1, 8, 64} {
+		b.Run(fmt.Sprintf("concurrency %d", concurrency), func(b *testing.B) {
+			p := newTestBenchPlugin()
+			b.ReportAllocs()
+			b.ResetTimer()
+			r := replay(p, benchRequests, b.N, concurrency)
+			b.ReportMetric(r.P50MS, "p50-ms")
+			b.ReportMetric(r.P99MS, "p99-ms")
+		})
+	}
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"strings"
+
+	"github.com/docker/go-plugins-helpers/authorization"
+)
+
+// maxRequestBody is the largest request body the plugin decodes. The daemon
+// itself doesn't forward bodies larger than this to plugins.
+const maxRequestBody = 1 << 20
+
+var errNoBody = errors.New("request body unavailable")
+
+// requestHeader returns the value of the named header of req.
+func requestHeader(req authorization.Request, name string) string {
+	for k, v := range req.RequestHeaders {
+		if strings.EqualFold(k, name) {
+			return v
+		}
+	}
+	return ""
+}
+
+// requestBody returns the body of req, refusing bodies larger than
+// maxRequestBody.
+func requestBody(req authorization.Request) ([]byte, error) {
+	if len(req.RequestBody) == 0 {
+		return nil, errNoBody
+	}
+	if len(req.RequestBody) > maxRequestBody {
+		return nil, fmt.Errorf("request body larger than %d bytes", maxRequestBody)
+	}
+	return req.RequestBody, nil
+}
+
+// decodeJSONBody decodes the JSON body of req into v.
+func decodeJSONBody(req authorization.Request, v interface{}) error {
+	if ct := requestHeader(req, "Content-Type"); ct != "" {
+		if mt, _, err := mime.ParseMediaType(ct); err != nil || mt != "application/json" {
+			return fmt.Errorf("unexpected request content type %q", ct)
+		}
+	}
+	body, err := requestBody(req)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(body, v)
+}
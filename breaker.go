@@ -0,0 +1,175 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/containers/image/types"
+)
+
+const (
+	defaultBreakerFailures = 5
+	defaultBreakerCooldown = 30 * time.Second
+)
+
+// breakerConf stops contacting a registry whose fetches keep failing for a
+// while, failing its verifications straight away instead.
+type breakerConf struct {
+	// Failures is how many fetches in a row must fail, after their
+	// retries, to trip the breaker of a registry, 5 by default.
+	Failures int `yaml:"failures"`
+	// Cooldown is how long the registry isn't contacted once the breaker
+	// tripped, 30s by default. A single fetch is let through then, closing
+	// the breaker if it succeeds.
+	Cooldown time.Duration `yaml:"cooldown"`
+}
+
+func (c *breakerConf) validate() error {
+	if c.Failures < 0 || c.Cooldown < 0 {
+		return fmt.Errorf("circuit-breaker: failures and cooldown can't be negative")
+	}
+	return nil
+}
+
+func (c *breakerConf) failures() int {
+	if c.Failures == 0 {
+		return defaultBreakerFailures
+	}
+	return c.Failures
+}
+
+func (c *breakerConf) cooldown() time.Duration {
+	if c.Cooldown == 0 {
+		return defaultBreakerCooldown
+	}
+	return c.Cooldown
+}
+
+// breaker is the state of a registry which failed lately.
+type breaker struct {
+	failures int
+	// opened is when the breaker tripped, zero while it's closed.
+	opened time.Time
+	// probing is set while the fetch let through after the cooldown is in
+	// progress.
+	probing bool
+}
+
+// registryBreakers are the circuit breakers of the registries, by hostname.
+// Registries which didn't fail lately have none.
+type registryBreakers struct {
+	mu       sync.Mutex
+	breakers map[string]*breaker
+}
+
+func newRegistryBreakers() *registryBreakers {
+	return &registryBreakers{breakers: make(map[string]*breaker)}
+}
+
+// allow tells whether host may be contacted.
+func (r *registryBreakers) allow(c *breakerConf, host string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	b, ok := r.breakers[host]
+	if !ok || b.opened.IsZero() {
+		return nil
+	}
+	if retry := b.opened.Add(c.cooldown()); time.Now().Before(retry) || b.probing {
+		terr := newTrustError(codeRegistryError, "registry %s failed %d times in a row, not contacting it before %s", host, b.failures, retry.Format(time.RFC3339))
+		terr.unreachable = true
+		return terr
+	}
+	b.probing = true
+	return nil
+}
+
+// record updates the breaker of host with the outcome of a fetch. Only
+// transient errors and timeouts count as failures: a registry answering
+// 404 is up.
+func (r *registryBreakers) record(c *breakerConf, host string, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	b, ok := r.breakers[host]
+	if !transient(err) && !isTimeout(err) {
+		if ok && !b.opened.IsZero() {
+			logrus.Infof("circuit-breaker: %s recovered", host)
+		}
+		delete(r.breakers, host)
+		return
+	}
+	if !ok {
+		b = &breaker{}
+		r.breakers[host] = b
+	}
+	b.failures++
+	switch {
+	case b.probing:
+		b.probing = false
+		b.opened = time.Now()
+	case b.opened.IsZero() && b.failures >= c.failures():
+		b.opened = time.Now()
+		logrus.Warnf("circuit-breaker: %s failed %d times in a row, not contacting it for %s: %v", host, b.failures, c.cooldown(), err)
+	}
+}
+
+// states returns the registries whose breaker is open, and when it tripped.
+func (r *registryBreakers) states() map[string]time.Time {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	states := make(map[string]time.Time)
+	for host, b := range r.breakers {
+		if !b.opened.IsZero() {
+			states[host] = b.opened.UTC()
+		}
+	}
+	return states
+}
+
+func isTimeout(err error) bool {
+	te, ok := err.(*trustError)
+	return ok && te.Code == codeTimeout
+}
+
+// breakerImage guards the registry accesses of an image with the breaker of
+// its registry.
+type breakerImage struct {
+	types.Image
+	breakers *registryBreakers
+	conf     *breakerConf
+	host     string
+}
+
+// withBreaker wraps img so that its registry isn't contacted while its
+// breaker is open.
+func withBreaker(img types.Image, r *registryBreakers, c *breakerConf) types.Image {
+	return &breakerImage{Image: img, breakers: r, conf: c, host: img.Reference().DockerReference().Hostname()}
+}
+
+func (i *breakerImage) Manifest() ([]byte, string, error) {
+	if err := i.breakers.allow(i.conf, i.host); err != nil {
+		return nil, "", err
+	}
+	m, mimeType, err := i.Image.Manifest()
+	i.breakers.record(i.conf, i.host, err)
+	return m, mimeType, err
+}
+
+func (i *breakerImage) Inspect() (*types.ImageInspectInfo, error) {
+	if err := i.breakers.allow(i.conf, i.host); err != nil {
+		return nil, err
+	}
+	info, err := i.Image.Inspect()
+	i.breakers.record(i.conf, i.host, err)
+	return info, err
+}
+
+func (i *breakerImage) Signatures() ([][]byte, error) {
+	if err := i.breakers.allow(i.conf, i.host); err != nil {
+		return nil, err
+	}
+	sigs, err := i.Image.Signatures()
+	i.breakers.record(i.conf, i.host, err)
+	return sigs, err
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/docker/docker/reference"
+	"github.com/docker/go-plugins-helpers/authorization"
+	"github.com/projectatomic/container-trust-plugin/pkg/trust"
+)
+
+var defaultBreakGlassStorePath = filepath.Join(stateDir, "break-glass.json")
+
+const (
+	defaultBreakGlassMaxDuration = 24 * time.Hour
+	// modeBreakGlass is the mode of audit records of denials lifted by a
+	// break-glass grant.
+	modeBreakGlass = "break-glass"
+)
+
+// breakGlassConf configures break-glass grants, which lift the denials of
+// an image for a limited time.
+type breakGlassConf struct {
+	// Store is the path of the grants file.
+	Store string `yaml:"store"`
+	// MaxDuration is the longest time window of a grant, 24h by default.
+	// Longer grants are ignored.
+	MaxDuration time.Duration `yaml:"max-duration"`
+}
+
+func (c breakGlassConf) store() string {
+	if c.Store == "" {
+		return defaultBreakGlassStorePath
+	}
+	return c.Store
+}
+
+func (c breakGlassConf) maxDuration() time.Duration {
+	if c.MaxDuration <= 0 {
+		return defaultBreakGlassMaxDuration
+	}
+	return c.MaxDuration
+}
+
+// breakGlassGrant lifts the denials of Image, a repository, a tag or a
+// digest, from Created until Expires.
+type breakGlassGrant struct {
+	Image   string    `json:"image"`
+	By      string    `json:"by"`
+	Reason  string    `json:"reason"`
+	Created time.Time `json:"created"`
+	Expires time.Time `json:"expires"`
+}
+
+// covers tells whether g applies to ref at now.
+func (g breakGlassGrant) covers(ref reference.Named, now time.Time, max time.Duration) bool {
+	if now.Before(g.Created) || !now.Before(g.Expires) || g.Expires.Sub(g.Created) > max {
+		return false
+	}
+	granted, err := trust.ParseNormalizedReference(g.Image)
+	if err != nil || granted.FullName() != ref.FullName() {
+		return false
+	}
+	switch gr := granted.(type) {
+	case reference.Canonical:
+		c, ok := ref.(reference.Canonical)
+		return ok && c.Digest() == gr.Digest()
+	case reference.NamedTagged:
+		t, ok := ref.(reference.NamedTagged)
+		return ok && t.Tag() == gr.Tag()
+	}
+	return true
+}
+
+func readBreakGlassGrants(path string) ([]breakGlassGrant, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var grants []breakGlassGrant
+	if err := json.Unmarshal(data, &grants); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return grants, nil
+}
+
+func writeBreakGlassGrants(path string, grants []breakGlassGrant) error {
+	data, err := json.MarshalIndent(grants, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// breakGlass lets through the request denied by res if a grant covers the
+// image it's about, recording who granted it and why.
+func breakGlass(cfg breakGlassConf, rec *auditRecord, res authorization.Response) (authorization.Response, bool) {
+	if res.Allow || rec.Reference == "" {
+		return res, false
+	}
+	ref, err := trust.ParseNormalizedReference(rec.Reference)
+	if err != nil {
+		return res, false
+	}
+	if _, ok := ref.(reference.Canonical); !ok && rec.Digest != "" {
+		if dgst, err := trust.ParseImageReference(ref.FullName() + "@" + rec.Digest); err == nil {
+			// Grants by digest apply to tags resolved to it as well.
+			if g, ok := findBreakGlassGrant(cfg, dgst); ok {
+				return applyBreakGlass(g, rec, res), true
+			}
+		}
+	}
+	if g, ok := findBreakGlassGrant(cfg, ref); ok {
+		return applyBreakGlass(g, rec, res), true
+	}
+	return res, false
+}
+
+func findBreakGlassGrant(cfg breakGlassConf, ref reference.Named) (breakGlassGrant, bool) {
+	grants, err := readBreakGlassGrants(cfg.store())
+	if err != nil {
+		return breakGlassGrant{}, false
+	}
+	now := time.Now()
+	for _, g := range grants {
+		if g.covers(ref, now, cfg.maxDuration()) {
+			return g, true
+		}
+	}
+	return breakGlassGrant{}, false
+}
+
+func applyBreakGlass(g breakGlassGrant, rec *auditRecord, res authorization.Response) authorization.Response {
+	msg := res.Err
+	if msg == "" {
+		msg = res.Msg
+	}
+	rec.Mode = modeBreakGlass
+	rec.OverrideBy = g.By
+	rec.OverrideReason = g.Reason
+	rec.Warning = fmt.Sprintf("allowed by break-glass grant of %s until %s (%s): %s", g.By, g.Expires.Format(time.RFC3339), g.Reason, msg)
+	return authorization.Response{Allow: true}
+}
+
+// runBreakGlass manages break-glass grants.
+func runBreakGlass(args []string) error {
+	usage := errors.New("usage: break-glass grant --image IMAGE --duration 1h --reason REASON | list | revoke --image IMAGE")
+	if len(args) == 0 {
+		return usage
+	}
+	snap, err := loadSnapshot()
+	if err != nil {
+		return err
+	}
+	cfg := snap.config.BreakGlass
+	fs := flag.NewFlagSet("break-glass "+args[0], flag.ContinueOnError)
+	image := fs.String("image", "", "Image the grant applies to: a repository, a tag or a digest")
+	duration := fs.Duration("duration", time.Hour, "How long the grant lasts")
+	reason := fs.String("reason", "", "Why the grant is needed, recorded with every use")
+	by := fs.String("by", breakGlassUser(), "Who grants it")
+	if err := fs.Parse(args[1:]); err != nil {
+		return err
+	}
+	grants, err := readBreakGlassGrants(cfg.store())
+	if err != nil {
+		return err
+	}
+	now := time.Now().UTC()
+	switch args[0] {
+	case "grant":
+		if *image == "" || *reason == "" || *by == "" {
+			return errors.New("--image, --reason and --by are required")
+		}
+		if *duration <= 0 || *duration > cfg.maxDuration() {
+			return fmt.Errorf("--duration must be positive and at most %s", cfg.maxDuration())
+		}
+		if _, err := trust.ParseNormalizedReference(*image); err != nil {
+			return err
+		}
+		grants = append(grants, breakGlassGrant{Image: *image, By: *by, Reason: *reason, Created: now, Expires: now.Add(*duration)})
+	case "revoke":
+		if *image == "" {
+			return errors.New("--image is required")
+		}
+		kept := grants[:0]
+		for _, g := range grants {
+			if g.Image != *image {
+				kept = append(kept, g)
+			}
+		}
+		grants = kept
+	case "list":
+		for _, g := range grants {
+			if now.Before(g.Expires) {
+				fmt.Printf("%s\tby=%s\tuntil=%s\treason=%s\n", g.Image, g.By, g.Expires.Format(time.RFC3339), g.Reason)
+			}
+		}
+		return nil
+	default:
+		return usage
+	}
+	// Expired grants are dropped whenever the file is written.
+	active := grants[:0]
+	for _, g := range grants {
+		if now.Before(g.Expires) {
+			active = append(active, g)
+		}
+	}
+	return writeBreakGlassGrants(cfg.store(), active)
+}
+
+// breakGlassUser is the user running the command, the one behind sudo if
+// any.
+func breakGlassUser() string {
+	if u := os.Getenv("SUDO_USER"); u != "" {
+		return u
+	}
+	return os.Getenv("USER")
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/docker/go-plugins-helpers/authorization"
+	"github.com/projectatomic/container-trust-plugin/pkg/trust"
+)
+
+// buildKitVersion is the builder version parameter of BuildKit builds.
+const buildKitVersion = "2"
+
+var (
+	argRegExp = regexp.MustCompile(`\$(\{([A-Za-z_][A-Za-z0-9_]*)\}|([A-Za-z_][A-Za-z0-9_]*))`)
+)
+
+// build checks the base images named by the FROM instructions of the
+// Dockerfile being built.
+func (p *trustPlugin) build(snap *snapshot, req authorization.Request, m routeMatch, rec *auditRecord) authorization.Response {
+	q := m.query
+	if p.builds.owns(q) {
+		return authorization.Response{Allow: true}
+	}
+	rec.intercepted = true
+	if q.Get("version") == buildKitVersion {
+		// BuildKit gets the Dockerfile and resolves base images over a
+		// session the plugin has no view of.
+		if snap.config.AllowUncheckedBuilds {
+			rec.Warning = "BuildKit build, base images weren't verified"
+			return authorization.Response{Allow: true}
+		}
+		return newTrustError(codeUnverifiable, "base images of BuildKit builds can't be verified, build with DOCKER_BUILDKIT=0").response()
+	}
+	body, err := requestBody(req)
+	if err == errNoBody {
+		// The daemon only forwards JSON bodies to authorization plugins,
+		// so most of the time the build context isn't available.
+		if snap.config.AllowUncheckedBuilds {
+			rec.Warning = "build context unavailable, base images weren't verified"
+			return authorization.Response{Allow: true}
+		}
+		return newTrustError(codeUnverifiable, "build context unavailable, base images can't be verified").response()
+	}
+	if err != nil {
+		return errResponse(codeInvalidRequest, err)
+	}
+	name := q.Get("dockerfile")
+	if name == "" {
+		name = "Dockerfile"
+	}
+	dockerfile, err := readDockerfile(body, name)
+	if err != nil {
+		return errResponse(codeInvalidRequest, err)
+	}
+	var buildArgs map[string]string
+	if s := q.Get("buildargs"); s != "" {
+		if err := json.Unmarshal([]byte(s), &buildArgs); err != nil {
+			return errResponse(codeInvalidRequest, err)
+		}
+	}
+	images, err := baseImages(dockerfile, buildArgs)
+	if err != nil {
+		return errResponse(codeInvalidRequest, err)
+	}
+	for _, image := range images {
+		ref, err := trust.ParseImageReference(image)
+		if err != nil {
+			return errResponse(codeInvalidReference, err)
+		}
+		rec.Reference = ref.String()
+		dgst, terr := p.verifyImage(rec.ctx, snap, ref, rec.span)
+		if terr != nil {
+			terr.Msg = "base image " + terr.Msg
+			return terr.response()
+		}
+		rec.Digest = dgst
+	}
+	return authorization.Response{Allow: true}
+}
+
+// readDockerfile finds the named Dockerfile in a build context, a possibly
+// compressed tarball.
+func readDockerfile(context []byte, name string) ([]byte, error) {
+	var r io.Reader = bytes.NewReader(context)
+	switch {
+	case bytes.HasPrefix(context, []byte{0x1f, 0x8b}):
+		gz, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		defer gz.Close()
+		r = gz
+	case bytes.HasPrefix(context, []byte("BZh")):
+		r = bzip2.NewReader(r)
+	}
+	name = path.Clean(name)
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil, fmt.Errorf("%s not found in the build context", name)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if path.Clean(hdr.Name) == name {
+			return ioutil.ReadAll(tr)
+		}
+	}
+}
+
+// baseImages returns the images the FROM instructions of dockerfile build
+// upon, skipping scratch and earlier build stages. ARGs declared before the
+// first FROM are expanded, overridden by buildArgs.
+func baseImages(dockerfile []byte, buildArgs map[string]string) ([]string, error) {
+	args := make(map[string]string)
+	stages := make(map[string]bool)
+	var images []string
+	seenFrom := false
+	for _, line := range dockerfileInstructions(dockerfile) {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		switch strings.ToUpper(fields[0]) {
+		case "ARG":
+			if seenFrom || len(fields) < 2 {
+				continue
+			}
+			kv := strings.SplitN(fields[1], "=", 2)
+			if v, ok := buildArgs[kv[0]]; ok {
+				args[kv[0]] = v
+			} else if len(kv) == 2 {
+				args[kv[0]] = strings.Trim(kv[1], `"'`)
+			}
+		case "FROM":
+			seenFrom = true
+			fields = fields[1:]
+			for len(fields) > 0 && strings.HasPrefix(fields[0], "--") {
+				fields = fields[1:]
+			}
+			if len(fields) == 0 {
+				return nil, fmt.Errorf("invalid instruction %q", line)
+			}
+			var unset []string
+			image := argRegExp.ReplaceAllStringFunc(fields[0], func(s string) string {
+				m := argRegExp.FindStringSubmatch(s)
+				name := m[2] + m[3]
+				v, ok := args[name]
+				if !ok {
+					unset = append(unset, name)
+				}
+				return v
+			})
+			if len(unset) > 0 {
+				return nil, fmt.Errorf("FROM %s uses unset build arguments %s", fields[0], strings.Join(unset, ", "))
+			}
+			if image != "scratch" && !stages[strings.ToLower(image)] {
+				images = append(images, image)
+			}
+			if len(fields) >= 3 && strings.EqualFold(fields[1], "AS") {
+				stages[strings.ToLower(fields[2])] = true
+			}
+		}
+	}
+	return images, nil
+}
+
+// dockerfileInstructions splits dockerfile into instructions, joining
+// continuation lines and dropping comments.
+func dockerfileInstructions(dockerfile []byte) []string {
+	var instructions []string
+	var cur string
+	scanner := bufio.NewScanner(bytes.NewReader(dockerfile))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		if strings.HasSuffix(line, `\`) {
+			cur += strings.TrimSuffix(line, `\`) + " "
+			continue
+		}
+		instructions = append(instructions, cur+line)
+		cur = ""
+	}
+	if cur != "" {
+		instructions = append(instructions, cur)
+	}
+	return instructions
+}
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"github.com/Sirupsen/logrus"
+	"github.com/containers/image/types"
+	"github.com/docker/docker/reference"
+)
+
+// compareCandidate evaluates img against the candidate policy and logs it
+// when the outcome differs from allowed, the one of the active policy.
+func compareCandidate(candidate *policyContexts, ref reference.Named, img types.Image, allowed bool) {
+	candidateAllowed, err := candidate.isRunningImageAllowed(img)
+	if candidateAllowed == allowed {
+		return
+	}
+	fields := logrus.Fields{
+		"audit":     "policy-divergence",
+		"reference": ref.String(),
+		"active":    outcome(allowed),
+		"candidate": outcome(candidateAllowed),
+	}
+	if err != nil {
+		fields["reason"] = err.Error()
+	}
+	logrus.WithFields(fields).Warnf("candidate policy would %s %s", outcome(candidateAllowed), ref)
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/containers/image/signature"
+	"github.com/ghodss/yaml"
+)
+
+const (
+	sigstoreCheckTimeout = 5 * time.Second
+
+	severityError   = "error"
+	severityWarning = "warning"
+
+	// Exit codes of check-config.
+	checkExitOK       = 0
+	checkExitError    = 1
+	checkExitWarnings = 2
+)
+
+// configProblem is a problem found by check-config.
+type configProblem struct {
+	Severity string `json:"severity"`
+	// Check is what was being checked: config, policy, keys or sigstore.
+	Check   string `json:"check"`
+	Message string `json:"message"`
+}
+
+// sigstoreConf is the part of a registries.d file naming signature storage.
+type sigstoreConf struct {
+	DefaultDocker *struct {
+		SigStore string `json:"sigstore"`
+	} `json:"default-docker"`
+	Docker map[string]struct {
+		SigStore string `json:"sigstore"`
+	} `json:"docker"`
+}
+
+// checkConfig validates the configuration, the policy, the keys they
+// reference and the reachability of the signature storage configured in
+// registriesDir.
+func checkConfig(registriesDir string) []configProblem {
+	var problems []configProblem
+	add := func(severity, check, format string, args ...interface{}) {
+		problems = append(problems, configProblem{Severity: severity, Check: check, Message: fmt.Sprintf(format, args...)})
+	}
+	cfg, err := loadConfig(*flConfig)
+	if err != nil {
+		add(severityError, "config", "%v", err)
+		return problems
+	}
+	if *flManaged {
+		policyPath, policyDir := policyPaths(cfg)
+		for _, path := range []string{*flConfig, policyPath, policyDir} {
+			if !underManagedMount(path) {
+				add(severityError, "mounts", "%s isn't under a mount of the managed plugin", path)
+			}
+		}
+	}
+	snap, err := loadSnapshot()
+	if err != nil {
+		add(severityError, "policy", "%v", err)
+		return problems
+	}
+	defer snap.keyrings.remove()
+	keyrings := map[string][]byte{}
+	for _, p := range []*signature.Policy{snap.policy, snap.candidate} {
+		if p == nil {
+			continue
+		}
+		for scope, reqs := range policyRequirements(p) {
+			if err := collectKeyrings(reqs, scope, keyrings); err != nil {
+				add(severityError, "keys", "%s: %v", scope, managedPathError(err))
+			}
+		}
+	}
+	for _, t := range cfg.SignatureThresholds {
+		for _, path := range t.Keys {
+			data, err := ioutil.ReadFile(path)
+			if err != nil {
+				add(severityError, "keys", "signature-thresholds: %v", managedPathError(err))
+				continue
+			}
+			keyrings[path] = data
+		}
+	}
+	names := make([]string, 0, len(keyrings))
+	for name := range keyrings {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		home := snap.keyrings.home(keyrings[name])
+		if home.err != nil {
+			add(severityError, "keys", "%s: %v", name, home.err)
+		} else if len(home.trusted) == 0 {
+			add(severityError, "keys", "%s: no keys", name)
+		}
+	}
+	stores, err := sigstores(registriesDir)
+	if err != nil {
+		add(severityError, "sigstore", "%v", err)
+	}
+	for _, s := range stores {
+		if err := checkSigstore(s); err != nil {
+			add(severityWarning, "sigstore", "%s unreachable: %v", s, err)
+		}
+	}
+	return problems
+}
+
+// policyRequirements returns the requirements of every scope of p.
+func policyRequirements(p *signature.Policy) map[string]signature.PolicyRequirements {
+	reqs := map[string]signature.PolicyRequirements{"default": p.Default}
+	for transport, scopes := range p.Transports {
+		for scope, r := range scopes {
+			reqs[transport+":"+scope] = r
+		}
+	}
+	return reqs
+}
+
+// collectKeyrings adds the keyrings of the signedBy requirements of reqs to
+// keyrings, by path or by scope for inline ones.
+func collectKeyrings(reqs signature.PolicyRequirements, scope string, keyrings map[string][]byte) error {
+	for _, req := range reqs {
+		b, err := json.Marshal(req)
+		if err != nil {
+			return err
+		}
+		var sb struct {
+			Type    string `json:"type"`
+			KeyPath string `json:"keyPath"`
+			KeyData []byte `json:"keyData"`
+		}
+		if err := json.Unmarshal(b, &sb); err != nil {
+			return err
+		}
+		if sb.Type != "signedBy" {
+			continue
+		}
+		if sb.KeyPath == "" {
+			keyrings[scope+" (inline)"] = sb.KeyData
+			continue
+		}
+		data, err := ioutil.ReadFile(sb.KeyPath)
+		if err != nil {
+			return err
+		}
+		keyrings[sb.KeyPath] = data
+	}
+	return nil
+}
+
+// sigstores returns the signature storage URLs configured in dir.
+func sigstores(dir string) ([]string, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*.yaml"))
+	if err != nil {
+		return nil, err
+	}
+	seen := map[string]bool{}
+	var urls []string
+	for _, f := range files {
+		data, err := ioutil.ReadFile(f)
+		if err != nil {
+			return nil, err
+		}
+		var c sigstoreConf
+		if err := yaml.Unmarshal(data, &c); err != nil {
+			return nil, fmt.Errorf("%s: %v", f, err)
+		}
+		if c.DefaultDocker != nil && c.DefaultDocker.SigStore != "" {
+			seen[c.DefaultDocker.SigStore] = true
+		}
+		for _, ns := range c.Docker {
+			if ns.SigStore != "" {
+				seen[ns.SigStore] = true
+			}
+		}
+	}
+	for u := range seen {
+		urls = append(urls, u)
+	}
+	sort.Strings(urls)
+	return urls, nil
+}
+
+// checkSigstore checks that the signature storage at rawurl can be reached.
+// Any HTTP answer will do, as the top level needn't be listable.
+func checkSigstore(rawurl string) error {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return err
+	}
+	switch u.Scheme {
+	case "file":
+		_, err := os.Stat(u.Path)
+		return err
+	case "http", "https":
+		client := &http.Client{Timeout: sigstoreCheckTimeout}
+		resp, err := client.Head(rawurl)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		return nil
+	}
+	return fmt.Errorf("unsupported scheme %q", u.Scheme)
+}
+
+// checkExitCode is the exit code of check-config for problems.
+func checkExitCode(problems []configProblem) int {
+	code := checkExitOK
+	for _, p := range problems {
+		if p.Severity == severityError {
+			return checkExitError
+		}
+		code = checkExitWarnings
+	}
+	return code
+}
+
+// runCheckConfig checks the configuration and exits 0 if it's fine, 1 if
+// it has errors, 2 if it only has warnings.
+func runCheckConfig(args []string) error {
+	fs := flag.NewFlagSet("check-config", flag.ContinueOnError)
+	registriesDir := fs.String("registries-d", defaultRegistriesDirPath, "Directory of the signature storage configuration")
+	asJSON := fs.Bool("json", false, "Print the problems as JSON")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	problems := checkConfig(*registriesDir)
+	if *asJSON {
+		if problems == nil {
+			problems = []configProblem{}
+		}
+		if err := json.NewEncoder(os.Stdout).Encode(problems); err != nil {
+			return err
+		}
+	} else {
+		for _, p := range problems {
+			fmt.Printf("%s: %s: %s\n", p.Severity, p.Check, p.Message)
+		}
+		if len(problems) == 0 {
+			fmt.Println("ok")
+		}
+	}
+	os.Exit(checkExitCode(problems))
+	return nil
+}
+
+// selfTest runs the checks of check-config at startup, logging warnings and
+// failing on errors.
+func selfTest() error {
+	var errs []string
+	for _, p := range checkConfig(defaultRegistriesDirPath) {
+		if p.Severity == severityError {
+			errs = append(errs, p.Check+": "+p.Message)
+			continue
+		}
+		logrus.Warnf("self-test: %s: %s", p.Check, p.Message)
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("self-test failed: %s", strings.Join(errs, "; "))
+	}
+	return nil
+}
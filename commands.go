@@ -0,0 +1,40 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// commands maps subcommand names to their implementation. Each command gets
+// the arguments following its name and parses its own flags.
+var commands = map[string]func(args []string) error{
+	"install":       runInstall,
+	"uninstall":     runUninstall,
+	"policy":        runPolicy,
+	"audit":         runAudit,
+	"timeline":      runTimeline,
+	"cri-proxy":     runCRIProxy,
+	"proxy":         runProxy,
+	"verify":        runVerify,
+	"explain":       runExplain,
+	"break-glass":   runBreakGlass,
+	"approve-tag":   runApproveTag,
+	"check-config":  runCheckConfig,
+	"plugin-config": runPluginConfig,
+	"stats":         runStats,
+	"bench":         runBench,
+}
+
+func runCommand(name string, args []string) error {
+	cmd, ok := commands[name]
+	if !ok {
+		names := make([]string, 0, len(commands))
+		for n := range commands {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		return fmt.Errorf("unknown command %q, available commands: %s", name, strings.Join(names, ", "))
+	}
+	return cmd(args)
+}
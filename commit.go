@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/docker/docker/reference"
+	"github.com/docker/go-plugins-helpers/authorization"
+	"github.com/projectatomic/container-trust-plugin/pkg/trust"
+	"golang.org/x/net/context"
+)
+
+// Modes for docker commit.
+const (
+	commitAllow     = "allow"
+	commitDeny      = "deny"
+	commitNamespace = "namespace"
+	commitAnnotate  = "annotate"
+)
+
+// Labels recording the provenance of committed images.
+const (
+	labelCommittedBy  = "io.projectatomic.trust.committed-by"
+	labelParentDigest = "io.projectatomic.trust.parent-digest"
+	labelCommittedAt  = "io.projectatomic.trust.committed-at"
+)
+
+// commitConf configures how images committed from containers are handled.
+type commitConf struct {
+	// Mode is allow (the default), deny, namespace or annotate.
+	Mode string `yaml:"mode"`
+	// Namespace is where images may be committed to in namespace mode.
+	Namespace string `yaml:"namespace"`
+}
+
+// inNamespace tells whether ref is the repository ns or one below it.
+func inNamespace(ns string, ref reference.Named) bool {
+	return isProtected([]string{ns}, ref)
+}
+
+// commit gates docker commit, which turns a container into an image no one
+// signed.
+func (p *trustPlugin) commit(snap *snapshot, req authorization.Request, m routeMatch, rec *auditRecord) authorization.Response {
+	cfg := snap.config.Commit
+	switch cfg.Mode {
+	case "", commitAllow, commitAnnotate:
+		return authorization.Response{Allow: true}
+	case commitDeny:
+		rec.intercepted = true
+		return newTrustError(codeUnverifiable, "committing containers to images isn't allowed").response()
+	case commitNamespace:
+		rec.intercepted = true
+		repo := m.query.Get("repo")
+		rec.Reference = repo
+		ref, err := trust.ParseNormalizedReference(repo)
+		if err != nil || !inNamespace(cfg.Namespace, ref) {
+			return newTrustError(codeUnverifiable, "containers can only be committed to %s", cfg.Namespace).response()
+		}
+		return authorization.Response{Allow: true}
+	}
+	return newTrustError(codeInternal, "invalid commit mode %q", cfg.Mode).response()
+}
+
+// annotateCommit labels the image a commit created with its provenance: the
+// digest of the image the container was running and the committing user.
+func (p *trustPlugin) annotateCommit(req authorization.Request) {
+	path, q, err := apiPath(req.RequestURI)
+	if err != nil || req.RequestMethod != "POST" || path != "/commit" || req.ResponseStatusCode/100 != 2 {
+		return
+	}
+	repo := q.Get("repo")
+	if repo == "" {
+		return
+	}
+	if tag := q.Get("tag"); tag != "" {
+		repo += ":" + tag
+	}
+	var res struct {
+		ID string `json:"Id"`
+	}
+	if err := json.Unmarshal(req.ResponseBody, &res); err != nil {
+		logrus.Errorf("unable to annotate commit of %s: %v", repo, err)
+		return
+	}
+	ctx := context.Background()
+	var parent string
+	if c, err := p.client.ContainerInspect(ctx, q.Get("container")); err == nil {
+		if img, _, err := p.client.ImageInspectWithRaw(ctx, c.Image, false); err == nil && len(img.RepoDigests) > 0 {
+			parent = img.RepoDigests[0]
+		}
+	}
+	// The daemon is waiting for this very response, label in the
+	// background.
+	go func() {
+		err := p.labelImage(ctx, res.ID, repo, map[string]string{
+			labelCommittedBy:  req.User,
+			labelParentDigest: parent,
+			labelCommittedAt:  time.Now().UTC().Format(time.RFC3339),
+		})
+		if err != nil {
+			logrus.Errorf("unable to annotate commit of %s: %v", repo, err)
+		}
+	}()
+}
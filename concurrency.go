@@ -0,0 +1,128 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	defaultMaxVerifications = 32
+	defaultMaxAutoPulls     = 4
+	defaultQueueTimeout     = 30 * time.Second
+)
+
+// concurrencyConf bounds the verifications and AutoPulls running at once,
+// so that a burst of pulls queues instead of opening as many registry
+// connections.
+type concurrencyConf struct {
+	// MaxVerifications is how many images are verified at once, 32 by
+	// default. Concurrent requests for the same image share one.
+	MaxVerifications int `yaml:"max-verifications"`
+	// MaxAutoPulls is how many images AutoPull pulls at once, 4 by default.
+	MaxAutoPulls int `yaml:"max-autopulls"`
+	// QueueTimeout is how long a request waits for its turn before it's
+	// denied with TRUST_BUSY, 30s by default.
+	QueueTimeout time.Duration `yaml:"queue-timeout"`
+}
+
+func (c concurrencyConf) validate() error {
+	if c.MaxVerifications < 0 || c.MaxAutoPulls < 0 {
+		return fmt.Errorf("concurrency: max-verifications and max-autopulls can't be negative")
+	}
+	if c.QueueTimeout < 0 {
+		return fmt.Errorf("concurrency: queue-timeout can't be negative")
+	}
+	return nil
+}
+
+func (c concurrencyConf) maxVerifications() int {
+	if c.MaxVerifications == 0 {
+		return defaultMaxVerifications
+	}
+	return c.MaxVerifications
+}
+
+func (c concurrencyConf) maxAutoPulls() int {
+	if c.MaxAutoPulls == 0 {
+		return defaultMaxAutoPulls
+	}
+	return c.MaxAutoPulls
+}
+
+func (c concurrencyConf) queueTimeout() time.Duration {
+	if c.QueueTimeout == 0 {
+		return defaultQueueTimeout
+	}
+	return c.QueueTimeout
+}
+
+// limiter is a semaphore handing its slots out in arrival order. The limit
+// is given on each call so that reloads change it for the next requests.
+type limiter struct {
+	name string
+
+	mu      sync.Mutex
+	active  int
+	waiters []chan struct{}
+}
+
+func newLimiter(name string) *limiter {
+	return &limiter{name: name}
+}
+
+// acquire takes a slot, waiting up to timeout for one to be released.
+func (l *limiter) acquire(limit int, timeout time.Duration) error {
+	l.mu.Lock()
+	if l.active < limit && len(l.waiters) == 0 {
+		l.active++
+		l.mu.Unlock()
+		return nil
+	}
+	ch := make(chan struct{})
+	l.waiters = append(l.waiters, ch)
+	l.mu.Unlock()
+
+	t := time.NewTimer(timeout)
+	defer t.Stop()
+	select {
+	case <-ch:
+		return nil
+	case <-t.C:
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for i, w := range l.waiters {
+		if w == ch {
+			l.waiters = append(l.waiters[:i], l.waiters[i+1:]...)
+			return newTrustError(codeBusy, "%d %s already in progress and none finished within %s, retry later", l.active, l.name, timeout)
+		}
+	}
+	// The slot was handed over while the timer fired.
+	return nil
+}
+
+// release frees a slot, handing it to the first waiter if the limit allows.
+func (l *limiter) release(limit int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.waiters) > 0 && l.active <= limit {
+		close(l.waiters[0])
+		l.waiters = l.waiters[1:]
+		return
+	}
+	l.active--
+	// The limit may have been raised by a reload.
+	for len(l.waiters) > 0 && l.active < limit {
+		l.active++
+		close(l.waiters[0])
+		l.waiters = l.waiters[1:]
+	}
+}
+
+// usage returns how many slots are taken and how many requests wait.
+func (l *limiter) usage() (active, queued int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.active, len(l.waiters)
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"regexp"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+	"gopkg.in/yaml.v2"
+)
+
+// loadConfig reads the plugin configuration at path, written in YAML or,
+// if it starts with a brace, JSON, and applies the overrides of the
+// environment and of --set. Errors name the file and, when known, the line.
+func loadConfig(path string) (conf, error) {
+	var config conf
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return config, err
+	}
+	if bytes.HasPrefix(bytes.TrimSpace(data), []byte("{")) {
+		if data, err = jsonToYAML(data); err != nil {
+			return config, fmt.Errorf("%s: %v", path, err)
+		}
+	}
+	if err := yaml.Unmarshal(data, &config); err != nil {
+		return config, fmt.Errorf("%s: %v", path, strings.Join(strings.Fields(err.Error()), " "))
+	}
+	var keys map[string]interface{}
+	if err := yaml.Unmarshal(data, &keys); err == nil {
+		known := configKeys()
+		for k := range keys {
+			if !known[k] {
+				logrus.Warnf("%s: unknown key %q ignored", path, k)
+			}
+		}
+	}
+	if err := applyOverrides(&config, os.Environ(), flSet); err != nil {
+		return config, err
+	}
+	if err := config.validate(); err != nil {
+		return config, fmt.Errorf("%s: %v", path, err)
+	}
+	return config, nil
+}
+
+// validate rejects configurations the plugin would only find out to be
+// wrong while handling requests.
+func (c conf) validate() error {
+	switch c.EnforcementMode {
+	case "", enforcementEnforce, enforcementAudit:
+	default:
+		return fmt.Errorf("enforcement-mode: invalid mode %q", c.EnforcementMode)
+	}
+	switch c.UnqualifiedNames {
+	case "", unqualifiedAllow, unqualifiedNudge, unqualifiedDeny:
+	default:
+		return fmt.Errorf("unqualified-names: invalid value %q", c.UnqualifiedNames)
+	}
+	switch c.Commit.Mode {
+	case "", commitAllow, commitDeny, commitAnnotate:
+	case commitNamespace:
+		if c.Commit.Namespace == "" {
+			return fmt.Errorf("commit: namespace mode requires a namespace")
+		}
+	default:
+		return fmt.Errorf("commit: invalid mode %q", c.Commit.Mode)
+	}
+	for r, o := range c.Registries.Overrides {
+		switch o.Mode {
+		case "", enforcementEnforce, enforcementAudit, registryQuarantine:
+		default:
+			return fmt.Errorf("registries: %s: invalid mode %q", r, o.Mode)
+		}
+		if (o.Cert == "") != (o.Key == "") {
+			return fmt.Errorf("registries: %s: cert and key go together", r)
+		}
+		if o.Proxy != proxyDirect {
+			if _, err := parseProxy(o.Proxy); err != nil {
+				return fmt.Errorf("registries: %s: %v", r, err)
+			}
+		}
+	}
+	for r, action := range c.Repositories {
+		switch action {
+		case repositoryAllowUnsigned, repositoryDeny, enforcementEnforce, enforcementAudit, registryQuarantine:
+		default:
+			return fmt.Errorf("repositories: %s: invalid action %q", r, action)
+		}
+		if _, err := path.Match(r, ""); err != nil {
+			return fmt.Errorf("repositories: %s: %v", r, err)
+		}
+	}
+	if err := c.Users.validate(); err != nil {
+		return err
+	}
+	switch c.TagImmutability.Mode {
+	case "", tagImmutabilityWarn, tagImmutabilityStrict:
+	default:
+		return fmt.Errorf("tag-immutability: invalid mode %q", c.TagImmutability.Mode)
+	}
+	for _, n := range c.Notifications {
+		if err := n.validate(); err != nil {
+			return err
+		}
+	}
+	if c.AuditLogRotation.MaxSize < 0 || c.AuditLogRotation.MaxBackups < 0 {
+		return fmt.Errorf("audit-log-rotation: max-size and max-backups must be positive")
+	}
+	if c.MaxImageAge < 0 {
+		return fmt.Errorf("max-image-age: must be positive")
+	}
+	if c.MaxSignatureAge < 0 {
+		return fmt.Errorf("max-signature-age: must be positive")
+	}
+	if c.DaemonInfoTTL < 0 {
+		return fmt.Errorf("daemon-info-ttl: must be positive")
+	}
+	for _, r := range c.RequiredLabels {
+		if err := r.validate(); err != nil {
+			return err
+		}
+	}
+	for _, t := range c.SignatureThresholds {
+		if err := t.validate(); err != nil {
+			return err
+		}
+	}
+	for _, r := range c.Quotas {
+		if err := r.validate(); err != nil {
+			return err
+		}
+	}
+	for _, w := range c.Freezes {
+		if err := w.validate(); err != nil {
+			return err
+		}
+	}
+	if c.History != nil {
+		if err := c.History.validate(); err != nil {
+			return err
+		}
+	}
+	if c.CircuitBreaker != nil {
+		if err := c.CircuitBreaker.validate(); err != nil {
+			return err
+		}
+	}
+	if c.Proxy != nil {
+		if err := c.Proxy.validate(); err != nil {
+			return err
+		}
+	}
+	if err := c.RegistryConnections.validate(); err != nil {
+		return err
+	}
+	if err := c.Retries.validate(); err != nil {
+		return err
+	}
+	if err := c.Timeouts.validate(); err != nil {
+		return err
+	}
+	if err := c.Concurrency.validate(); err != nil {
+		return err
+	}
+	if err := c.ManifestLists.validate(); err != nil {
+		return err
+	}
+	if c.VerificationCache != nil {
+		if err := c.VerificationCache.validate(); err != nil {
+			return err
+		}
+	}
+	if c.Tracing != nil {
+		if err := c.Tracing.validate(); err != nil {
+			return err
+		}
+	}
+	if c.Admin != nil {
+		if err := c.Admin.validate(); err != nil {
+			return err
+		}
+	}
+	if c.AllTags != nil && c.AllTags.Require != "" {
+		if _, err := regexp.Compile(c.AllTags.Require); err != nil {
+			return fmt.Errorf("all-tags: %v", err)
+		}
+	}
+	return nil
+}
+
+// jsonToYAML converts a JSON configuration so that it's decoded like the
+// YAML ones.
+func jsonToYAML(data []byte) ([]byte, error) {
+	var v interface{}
+	if err := json.Unmarshal(data, &v); err != nil {
+		switch e := err.(type) {
+		case *json.SyntaxError:
+			return nil, fmt.Errorf("line %d: %v", lineOf(data, e.Offset), err)
+		case *json.UnmarshalTypeError:
+			return nil, fmt.Errorf("line %d: %v", lineOf(data, e.Offset), err)
+		}
+		return nil, err
+	}
+	return yaml.Marshal(v)
+}
+
+// lineOf returns the line of data offset is on.
+func lineOf(data []byte, offset int64) int {
+	if offset > int64(len(data)) {
+		offset = int64(len(data))
+	}
+	return bytes.Count(data[:offset], []byte("\n")) + 1
+}
+
+// configKeys returns the top level keys of the configuration.
+func configKeys() map[string]bool {
+	keys := make(map[string]bool)
+	t := reflect.TypeOf(conf{})
+	for i := 0; i < t.NumField(); i++ {
+		if tag := strings.Split(t.Field(i).Tag.Get("yaml"), ",")[0]; tag != "" {
+			keys[tag] = true
+		}
+	}
+	return keys
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/containers/image/types"
+	"github.com/docker/docker/reference"
+	dockerclient "github.com/docker/engine-api/client"
+	"github.com/docker/go-plugins-helpers/authorization"
+	"github.com/projectatomic/container-trust-plugin/pkg/trust"
+	"golang.org/x/net/context"
+)
+
+// containerCreate checks the image a container is about to be created from.
+// Images the daemon doesn't have are let through: the daemon fails the
+// request or the client pulls them first, and pulls are verified.
+func (p *trustPlugin) containerCreate(snap *snapshot, req authorization.Request, m routeMatch, rec *auditRecord) authorization.Response {
+	rec.intercepted = true
+	var body struct {
+		Image string
+	}
+	if err := decodeJSONBody(req, &body); err != nil {
+		return errResponse(codeInvalidRequest, err)
+	}
+	if body.Image == "" {
+		return newTrustError(codeInvalidRequest, "no image in container config").response()
+	}
+	ctx, cancel := snap.config.Timeouts.daemonContext(rec.ctx)
+	defer cancel()
+	img, _, err := p.client.ImageInspectWithRaw(ctx, body.Image, false)
+	if err != nil {
+		if dockerclient.IsErrImageNotFound(err) {
+			return authorization.Response{Allow: true}
+		}
+		return errResponse(codeDaemonUnreachable, timedOut(ctx, "inspecting "+body.Image, err))
+	}
+	candidates := repoDigests(img.RepoDigests, body.Image)
+	if len(candidates) == 0 {
+		candidates = p.baseDigests(ctx, body.Image, img.Parent, img.RootFS.Layers)
+	}
+	if len(candidates) == 0 {
+		return newTrustError(codeUnverifiable, "%s wasn't pulled from a registry, its signatures can't be verified", body.Image).response()
+	}
+	var terr *trustError
+	for _, ref := range candidates {
+		rec.Reference = ref.String()
+		dgst, err := p.verifyImage(rec.ctx, snap, ref, rec.span)
+		if err != nil && snap.config.failOpen(ref, err) {
+			rec.log().WithFields(logrus.Fields{
+				"audit":     "fail-open",
+				"reference": ref.String(),
+				"user":      req.User,
+			}).Warnf("registry unreachable, allowing the image unverified: %v", err)
+			dgst, err = ref.Digest().String(), nil
+		}
+		if err == nil {
+			err = p.checkFreeze(snap, ref, dgst)
+		}
+		if err == nil {
+			rec.Digest = dgst
+			return authorization.Response{Allow: true}
+		}
+		rec.log().Debugf("container create: %s not allowed: %v", ref, err)
+		if terr == nil {
+			terr = err
+		}
+	}
+	return terr.response()
+}
+
+// baseDigests returns the repository digests of the image name, made of
+// layers, was built from without adding any, such as the verified image of
+// the tags AutoPull labels: its parent, else the image its tag is pinned to.
+// The labels of name aren't trusted, anyone can build an image with them.
+func (p *trustPlugin) baseDigests(ctx context.Context, name, parent string, layers []string) []reference.Canonical {
+	var bases []string
+	if parent != "" {
+		bases = append(bases, parent)
+	}
+	if ref, err := trust.ParseNormalizedReference(name); err == nil && p.pins != nil {
+		if pin, ok := p.pins.get(reference.WithDefaultTag(ref)); ok {
+			bases = append(bases, ref.FullName()+"@"+pin.Digest)
+		}
+	}
+	for _, b := range bases {
+		base, _, err := p.client.ImageInspectWithRaw(ctx, b, false)
+		if err != nil || !sameLayers(layers, base.RootFS.Layers) {
+			continue
+		}
+		if refs := repoDigests(base.RepoDigests, name); len(refs) > 0 {
+			return refs
+		}
+	}
+	return nil
+}
+
+// sameLayers tells whether two images are made of the same layers.
+func sameLayers(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// repoDigests parses the repository digests of a local image, those of the
+// repository name was given as first.
+func repoDigests(digests []string, name string) []reference.Canonical {
+	var fullName string
+	if named, err := trust.ParseNormalizedReference(name); err == nil {
+		fullName = named.FullName()
+	}
+	var refs []reference.Canonical
+	for _, rd := range digests {
+		named, err := trust.ParseNormalizedReference(rd)
+		if err != nil {
+			continue
+		}
+		c, ok := named.(reference.Canonical)
+		if !ok {
+			continue
+		}
+		if c.FullName() == fullName {
+			refs = append([]reference.Canonical{c}, refs...)
+		} else {
+			refs = append(refs, c)
+		}
+	}
+	return refs
+}
+
+// verifyImage runs ref through the policy, the guards, the required labels
+// and the maximum image age and returns the digest of its manifest. If ref
+// is canonical the manifest must match it.
+func (p *trustPlugin) verifyImage(ctx context.Context, snap *snapshot, ref reference.Named, sp *span) (string, *trustError) {
+	return p.verifyImageFor(ctx, snap, ref, trust.HostPlatform(), sp)
+}
+
+// verifyImageFor is verifyImage for the manifest of plat.
+func (p *trustPlugin) verifyImageFor(ctx context.Context, snap *snapshot, ref reference.Named, plat trust.Platform, sp *span) (string, *trustError) {
+	if terr := checkRegistry(snap.config, ref); terr != nil {
+		return "", terr
+	}
+	res, terr, err := p.verifyShared(ctx, snap, ref, plat, sp)
+	if err != nil {
+		return "", verificationError(err)
+	}
+	if terr != nil {
+		return "", terr
+	}
+	logrus.Debugf("%s verified as %s (%s)", ref, res.Digest, res.MIMEType)
+	return res.Digest, nil
+}
+
+// checkVerified enforces the guards, the required labels and the maximum
+// image age on the image of ref the policy allowed.
+func checkVerified(snap *snapshot, ref reference.Named, res *trust.Result) *trustError {
+	if terr := applyGuards(snap, res); terr != nil {
+		return terr
+	}
+	if terr := checkLabels(snap.config.RequiredLabels, ref, res.Image); terr != nil {
+		return terr
+	}
+	return checkImageAge(snap.config, ref, res.Image)
+}
+
+// verifier returns a verifier for snap, fetching images through the
+// prefetch cache, honoring the approved digests and the keys recorded on
+// first use, with the registry credentials ctx carries. Digests allowed
+// recently aren't evaluated again. The registry
+// accesses are retried and bounded as configured in snap and by ctx, and
+// traced with the policy evaluation under sp.
+func (p *trustPlugin) verifier(ctx context.Context, snap *snapshot, plat trust.Platform, sp *span) trust.Verifier {
+	settings := prefetchSettings(snap.config.Prefetch)
+	return &trust.PolicyVerifier{
+		Policy:   snap.policy,
+		Platform: plat,
+		FetchImage: func(ref types.ImageReference) (types.Image, error) {
+			img, err := p.prefetch.image(ref, p.systemContext(ctx, snap.config, ref.DockerReference().Hostname()), settings)
+			if err != nil {
+				return nil, err
+			}
+			return p.bounded(ctx, snap, img, sp), nil
+		},
+		Evaluate: func(ref reference.Named, img types.Image) (bool, error) {
+			es := sp.child("policy.evaluate")
+			es.set("image.reference", ref.String())
+			key := p.verdicts.key(snap, ref, img)
+			if p.verdicts.allowed(key) {
+				es.set("trust.allowed", true)
+				es.set("trust.cached", true)
+				es.finish(nil)
+				return true, nil
+			}
+			allowed, err := evaluate(snap, ref, img)
+			if allowed && p.tofu != nil && snap.config.TOFU != nil {
+				if terr := p.tofu.check(snap.keyrings, snap.policy, ref, img); terr != nil {
+					allowed, err = false, terr
+				}
+			}
+			if allowed && err == nil {
+				p.verdicts.add(snap.config.VerificationCache, key)
+			}
+			es.set("trust.allowed", allowed)
+			es.finish(err)
+			return allowed, err
+		},
+		CheckDigest: snap.digests.check,
+	}
+}
+
+// containerStart verifies the image of a container again before starting
+// it: the image must still be the one its tag was pinned to when verified,
+// and must still satisfy the policy, e.g. its signing key wasn't revoked.
+// During a change freeze it must be pinned as well.
+func (p *trustPlugin) containerStart(snap *snapshot, req authorization.Request, m routeMatch, rec *auditRecord) authorization.Response {
+	if !snap.config.VerifyOnStart && !freezeActive(snap.config.Freezes, time.Now()) {
+		return authorization.Response{Allow: true}
+	}
+	rec.intercepted = true
+	ctx, cancel := snap.config.Timeouts.daemonContext(rec.ctx)
+	defer cancel()
+	c, err := p.client.ContainerInspect(ctx, m.vars[0])
+	if err != nil {
+		if dockerclient.IsErrContainerNotFound(err) {
+			return authorization.Response{Allow: true}
+		}
+		return errResponse(codeDaemonUnreachable, timedOut(ctx, "inspecting container "+m.vars[0], err))
+	}
+	img, _, err := p.client.ImageInspectWithRaw(ctx, c.Image, false)
+	if err != nil {
+		return errResponse(codeDaemonUnreachable, timedOut(ctx, "inspecting "+c.Image, err))
+	}
+	name := c.Config.Image
+	candidates := repoDigests(img.RepoDigests, name)
+	if len(candidates) == 0 {
+		candidates = p.baseDigests(ctx, name, img.Parent, img.RootFS.Layers)
+	}
+	if ref, err := trust.ParseImageReference(name); err == nil && snap.config.VerifyOnStart {
+		if pinned, ok := p.pins.get(ref); ok {
+			replaced := true
+			for _, cand := range candidates {
+				if cand.FullName() == ref.FullName() && cand.Digest().String() == pinned.Digest {
+					replaced = false
+				}
+			}
+			if replaced {
+				return newTrustError(codeDigestMismatch, "%s was verified as %s but the container runs a different image", ref, pinned.Digest).response()
+			}
+		}
+	}
+	if len(candidates) == 0 {
+		return newTrustError(codeUnverifiable, "%s wasn't pulled from a registry, its signatures can't be verified", name).response()
+	}
+	rec.Reference = candidates[0].String()
+	dgst := candidates[0].Digest().String()
+	if snap.config.VerifyOnStart {
+		var terr *trustError
+		if dgst, terr = p.verifyImage(rec.ctx, snap, candidates[0], rec.span); terr != nil {
+			return terr.response()
+		}
+	}
+	rec.Digest = dgst
+	if terr := p.checkFreeze(snap, candidates[0], dgst); terr != nil {
+		return terr.response()
+	}
+	return authorization.Response{Allow: true}
+}
+
+// checkFreeze denies ref, verified as dgst, during a change freeze unless
+// dgst is in the pinning database.
+func (p *trustPlugin) checkFreeze(snap *snapshot, ref reference.Named, dgst string) *trustError {
+	w, ok := activeFreeze(snap.config.Freezes, ref, time.Now())
+	if !ok || p.pins.hasDigest(ref, dgst) {
+		return nil
+	}
+	return newTrustError(codeChangeFreeze, "only pinned images may be started during the change freeze (%s), %s isn't", w, ref)
+}
@@ -0,0 +1,349 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/containers/image/types"
+	"github.com/projectatomic/container-trust-plugin/pkg/trust"
+	"golang.org/x/net/context"
+	"golang.org/x/net/http2"
+)
+
+const (
+	defaultCRIListen = "/run/container-trust-plugin/cri.sock"
+	// grpcPermissionDenied is the gRPC PERMISSION_DENIED status code.
+	grpcPermissionDenied = "7"
+)
+
+// criProxy sits between kubelet and the image service of a CRI runtime and
+// verifies the images PullImage requests are for, through the verifier of
+// the plugin. Everything else is forwarded untouched.
+type criProxy struct {
+	p         *trustPlugin
+	runtime   string
+	transport *http2.Transport
+}
+
+func newCRIProxy(p *trustPlugin, runtime string) *criProxy {
+	return &criProxy{
+		p:       p,
+		runtime: runtime,
+		transport: &http2.Transport{
+			// The runtime speaks HTTP/2 in clear text over a unix socket.
+			DialTLS: func(network, addr string, cfg *tls.Config) (net.Conn, error) {
+				return net.Dial("unix", runtime)
+			},
+		},
+	}
+}
+
+func (c *criProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if strings.HasSuffix(r.URL.Path, ".ImageService/PullImage") {
+		if body, err = c.verifyPull(body); err != nil {
+			logrus.Infof("cri: denying pull: %v", err)
+			grpcError(w, grpcPermissionDenied, err.Error())
+			return
+		}
+	}
+	out, err := http.NewRequest(r.Method, "https://cri"+r.URL.RequestURI(), bytes.NewReader(body))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	out.Header = r.Header
+	res, err := c.transport.RoundTrip(out)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer res.Body.Close()
+	resBody, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	for k, vv := range res.Header {
+		w.Header()[k] = vv
+	}
+	for k := range res.Trailer {
+		w.Header().Add("Trailer", k)
+	}
+	w.WriteHeader(res.StatusCode)
+	w.Write(resBody)
+	for k, vv := range res.Trailer {
+		w.Header()[k] = vv
+	}
+}
+
+// verifyPull verifies the image of a PullImageRequest, fetched with the
+// credentials it carries, and returns the request rewritten to pull the
+// verified digest, so that the runtime can't pull anything else.
+func (c *criProxy) verifyPull(body []byte) ([]byte, error) {
+	image, err := pullImageRequestImage(body)
+	if err != nil {
+		return nil, err
+	}
+	ref, err := trust.ParseImageReference(image)
+	if err != nil {
+		return nil, err
+	}
+	auth, err := pullImageRequestAuth(body)
+	if err != nil {
+		return nil, err
+	}
+	snap := c.p.snapshots.load()
+	ctx, cancel := snap.config.Timeouts.decisionContext()
+	defer cancel()
+	if auth != nil {
+		ctx = context.WithValue(ctx, registryAuthKey{}, auth)
+	}
+	dgst, terr := c.p.verifyImage(ctx, snap, ref, nil)
+	if terr != nil {
+		if snap.config.failOpen(ref, terr) {
+			logrus.WithField("audit", "fail-open").Warnf("cri: registry unreachable, allowing %s unverified: %v", ref, terr)
+			return body, nil
+		}
+		return nil, terr
+	}
+	logrus.Infof("cri: %s verified as %s", ref, dgst)
+	return setPullImageRequestImage(body, ref.Name()+"@"+dgst)
+}
+
+// grpcError answers a gRPC call with status code and message.
+func grpcError(w http.ResponseWriter, code, msg string) {
+	w.Header().Set("Content-Type", "application/grpc")
+	w.Header().Add("Trailer", "Grpc-Status")
+	w.Header().Add("Trailer", "Grpc-Message")
+	w.WriteHeader(http.StatusOK)
+	w.Header().Set("Grpc-Status", code)
+	w.Header().Set("Grpc-Message", msg)
+}
+
+// pullImageRequestImage extracts image.image from a gRPC framed
+// PullImageRequest, whose ImageSpec is field 1 and holds the image as its
+// field 1.
+func pullImageRequestImage(frame []byte) (string, error) {
+	msg, err := grpcMessage(frame)
+	if err != nil {
+		return "", err
+	}
+	spec, err := protoField(msg, 1)
+	if err != nil {
+		return "", err
+	}
+	image, err := protoField(spec, 1)
+	if err != nil {
+		return "", err
+	}
+	if len(image) == 0 {
+		return "", errors.New("no image in PullImageRequest")
+	}
+	return string(image), nil
+}
+
+// pullImageRequestAuth returns the registry credentials of a gRPC framed
+// PullImageRequest, its AuthConfig field 2, nil if there are none. Like with
+// X-Registry-Auth, only username and password, or auth, are used.
+func pullImageRequestAuth(frame []byte) (*registryAuth, error) {
+	msg, err := grpcMessage(frame)
+	if err != nil {
+		return nil, err
+	}
+	ac, err := protoField(msg, 2)
+	if err != nil || ac == nil {
+		return nil, err
+	}
+	var fields [4][]byte
+	for i := range fields {
+		if fields[i], err = protoField(ac, uint64(i+1)); err != nil {
+			return nil, err
+		}
+	}
+	user, password := string(fields[0]), string(fields[1])
+	if user == "" && len(fields[2]) > 0 {
+		decoded, err := base64.StdEncoding.DecodeString(string(fields[2]))
+		if err != nil {
+			return nil, err
+		}
+		parts := strings.SplitN(string(decoded), ":", 2)
+		if len(parts) == 2 {
+			user, password = parts[0], parts[1]
+		}
+	}
+	if user == "" {
+		return nil, nil
+	}
+	return &registryAuth{
+		host:   registryHost(string(fields[3])),
+		config: &types.DockerAuthConfig{Username: user, Password: password},
+	}, nil
+}
+
+// setPullImageRequestImage returns the gRPC framed PullImageRequest with
+// image.image set to image.
+func setPullImageRequestImage(frame []byte, image string) ([]byte, error) {
+	msg, err := grpcMessage(frame)
+	if err != nil {
+		return nil, err
+	}
+	spec, err := protoField(msg, 1)
+	if err != nil {
+		return nil, err
+	}
+	if spec, err = protoSetField(spec, 1, []byte(image)); err != nil {
+		return nil, err
+	}
+	if msg, err = protoSetField(msg, 1, spec); err != nil {
+		return nil, err
+	}
+	out := make([]byte, 5, 5+len(msg))
+	binary.BigEndian.PutUint32(out[1:5], uint32(len(msg)))
+	return append(out, msg...), nil
+}
+
+// grpcMessage returns the message of an uncompressed gRPC frame.
+func grpcMessage(frame []byte) ([]byte, error) {
+	if len(frame) < 5 {
+		return nil, errors.New("short gRPC message")
+	}
+	if frame[0] != 0 {
+		return nil, errors.New("compressed gRPC messages aren't supported")
+	}
+	n := binary.BigEndian.Uint32(frame[1:5])
+	if uint32(len(frame)-5) < n {
+		return nil, errors.New("truncated gRPC message")
+	}
+	return frame[5 : 5+n], nil
+}
+
+// protoField returns the last occurrence of the length delimited field num
+// of a protobuf message.
+func protoField(msg []byte, num uint64) ([]byte, error) {
+	var found []byte
+	err := protoWalk(msg, func(key uint64, raw, value []byte) {
+		if key == num<<3|2 {
+			found = value
+		}
+	})
+	return found, err
+}
+
+// protoSetField returns msg with the length delimited field num set to
+// value, replacing all its occurrences.
+func protoSetField(msg []byte, num uint64, value []byte) ([]byte, error) {
+	out := make([]byte, 0, len(msg)+len(value)+2*binary.MaxVarintLen64)
+	err := protoWalk(msg, func(key uint64, raw, _ []byte) {
+		if key != num<<3|2 {
+			out = append(out, raw...)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	var buf [binary.MaxVarintLen64]byte
+	out = append(out, buf[:binary.PutUvarint(buf[:], num<<3|2)]...)
+	out = append(out, buf[:binary.PutUvarint(buf[:], uint64(len(value)))]...)
+	return append(out, value...), nil
+}
+
+// protoWalk calls fn with the key, the encoding and, for length delimited
+// fields, the value of every field of a protobuf message.
+func protoWalk(msg []byte, fn func(key uint64, raw, value []byte)) error {
+	for len(msg) > 0 {
+		key, n := binary.Uvarint(msg)
+		if n <= 0 {
+			return errors.New("invalid protobuf message")
+		}
+		var size int
+		var value []byte
+		switch key & 7 {
+		case 0:
+			_, m := binary.Uvarint(msg[n:])
+			if m <= 0 {
+				return errors.New("invalid protobuf varint")
+			}
+			size = n + m
+		case 1:
+			size = n + 8
+		case 2:
+			l, m := binary.Uvarint(msg[n:])
+			if m <= 0 || uint64(len(msg)-n-m) < l {
+				return errors.New("invalid protobuf message")
+			}
+			size = n + m + int(l)
+			value = msg[n+m : size]
+		case 5:
+			size = n + 4
+		default:
+			return fmt.Errorf("unsupported protobuf wire type %d", key&7)
+		}
+		if len(msg) < size {
+			return errors.New("invalid protobuf message")
+		}
+		fn(key, msg[:size], value)
+		msg = msg[size:]
+	}
+	return nil
+}
+
+// runCRIProxy serves the CRI image service proxy.
+func runCRIProxy(args []string) error {
+	fs := flag.NewFlagSet("cri-proxy", flag.ContinueOnError)
+	listen := fs.String("listen", defaultCRIListen, "Socket kubelet's --image-service-endpoint points to")
+	runtime := fs.String("runtime", "", "Socket of the CRI runtime, e.g. /run/containerd/containerd.sock")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *runtime == "" {
+		return errors.New("--runtime is required")
+	}
+	snap, err := loadSnapshot()
+	if err != nil {
+		return err
+	}
+	setupRegistryConnections(snap.config.RegistryConnections)
+	p := newOfflinePlugin()
+	if t := snap.config.TOFU; t != nil {
+		if p.tofu, err = newTOFUStore(t.store()); err != nil {
+			return err
+		}
+	}
+	p.snapshots.store(snap)
+	setupProxy(func() conf { return p.snapshots.load().config })
+	go p.watchReload()
+	if err := os.Remove(*listen); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	l, err := net.Listen("unix", *listen)
+	if err != nil {
+		return err
+	}
+	defer l.Close()
+	proxy := newCRIProxy(p, *runtime)
+	srv := &http2.Server{}
+	logrus.Infof("cri: proxying %s to %s", *listen, *runtime)
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go srv.ServeConn(conn, &http2.ServeConnOpts{Handler: proxy})
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"testing"
+)
+
+// protoBytes encodes the length delimited field num holding value.
+func protoBytes(num uint64, value []byte) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	out := append([]byte(nil), buf[:binary.PutUvarint(buf[:], num<<3|2)]...)
+	out = append(out, buf[:binary.PutUvarint(buf[:], uint64(len(value)))]...)
+	return append(out, value...)
+}
+
+func grpcFrame(msg []byte) []byte {
+	frame := make([]byte, 5, 5+len(msg))
+	binary.BigEndian.PutUint32(frame[1:5], uint32(len(msg)))
+	return append(frame, msg...)
+}
+
+func TestPullImageRequest(t *testing.T) {
+	spec := append(protoBytes(1, []byte("example.com/team/app:1")), protoBytes(2, []byte("annotations"))...)
+	auth := append(protoBytes(3, []byte(base64.StdEncoding.EncodeToString([]byte("alice:secret")))), protoBytes(4, []byte("https://example.com"))...)
+	// A sandbox config, field 3, follows along with a varint field 4.
+	msg := append(append(protoBytes(1, spec), protoBytes(2, auth)...), protoBytes(3, []byte("sandbox"))...)
+	msg = append(msg, 4<<3, 150, 1)
+	frame := grpcFrame(msg)
+
+	image, err := pullImageRequestImage(frame)
+	if err != nil || image != "example.com/team/app:1" {
+		t.Fatalf("image = %q (%v), want example.com/team/app:1", image, err)
+	}
+	a, err := pullImageRequestAuth(frame)
+	if err != nil || a == nil {
+		t.Fatalf("auth = %v (%v), want credentials", a, err)
+	}
+	if a.host != "example.com" || a.config.Username != "alice" || a.config.Password != "secret" {
+		t.Errorf("auth = %s %+v, want alice:secret for example.com", a.host, *a.config)
+	}
+
+	rewritten, err := setPullImageRequestImage(frame, "example.com/team/app@"+testImageDigest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if image, err = pullImageRequestImage(rewritten); err != nil || image != "example.com/team/app@"+testImageDigest {
+		t.Errorf("rewritten image = %q (%v)", image, err)
+	}
+	m, _ := grpcMessage(rewritten)
+	if sandbox, err := protoField(m, 3); err != nil || string(sandbox) != "sandbox" {
+		t.Errorf("rewritten sandbox config = %q (%v)", sandbox, err)
+	}
+	s, _ := protoField(m, 1)
+	if annotations, err := protoField(s, 2); err != nil || string(annotations) != "annotations" {
+		t.Errorf("rewritten image annotations = %q (%v)", annotations, err)
+	}
+	if a, err := pullImageRequestAuth(grpcFrame(protoBytes(1, spec))); err != nil || a != nil {
+		t.Errorf("auth of a request without any = %v (%v)", a, err)
+	}
+}
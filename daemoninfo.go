@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/docker/engine-api/types"
+	"github.com/docker/engine-api/types/filters"
+	"golang.org/x/net/context"
+)
+
+const (
+	// defaultDaemonInfoTTL is how long the registries and mirrors of the
+	// daemon are cached.
+	defaultDaemonInfoTTL = 5 * time.Minute
+	// eventsRetryInterval is how long to wait before watching the events of
+	// the daemon again once the stream broke.
+	eventsRetryInterval = 5 * time.Second
+)
+
+// daemonInfoCache caches the docker info the registries and mirrors of the
+// daemon are read from, which would otherwise be asked for on every pull.
+type daemonInfoCache struct {
+	mu      sync.Mutex
+	info    *types.Info
+	fetched time.Time
+}
+
+func newDaemonInfoCache() *daemonInfoCache {
+	return &daemonInfoCache{}
+}
+
+func (c *daemonInfoCache) get(ttl time.Duration) (*types.Info, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.info == nil || time.Since(c.fetched) >= ttl {
+		return nil, false
+	}
+	return c.info, true
+}
+
+func (c *daemonInfoCache) set(info *types.Info) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.info, c.fetched = info, time.Now()
+}
+
+// purge forgets the cached info, so that the next pull asks the daemon.
+func (c *daemonInfoCache) purge() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.info = nil
+}
+
+// dockerInfo returns the info of the daemon, cached for daemon-info-ttl.
+// Concurrent misses share a single call.
+func (p *trustPlugin) dockerInfo(ctx context.Context, cfg conf) (*types.Info, error) {
+	ttl := cfg.DaemonInfoTTL
+	if ttl == 0 {
+		ttl = defaultDaemonInfoTTL
+	}
+	if info, ok := p.info.get(ttl); ok {
+		return info, nil
+	}
+	v, err, _ := p.flights.do("docker info", func() (interface{}, error) {
+		ctx, cancel := cfg.Timeouts.daemonContext(ctx)
+		defer cancel()
+		info, err := p.client.Info(ctx)
+		if err != nil {
+			return nil, timedOut(ctx, "docker info", err)
+		}
+		p.info.set(&info)
+		return &info, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return v.(*types.Info), nil
+}
+
+// watchDaemonEvents purges the cached docker info whenever the daemon
+// reloads its configuration, and whenever the events stream breaks since the
+// daemon may have been restarted. It never returns.
+func (p *trustPlugin) watchDaemonEvents() {
+	f := filters.NewArgs()
+	f.Add("type", "daemon")
+	for {
+		rc, err := p.client.Events(context.Background(), types.EventsOptions{Filters: f})
+		if err == nil {
+			dec := json.NewDecoder(rc)
+			for {
+				var ev daemonEvent
+				if err = dec.Decode(&ev); err != nil {
+					break
+				}
+				if ev.Action == "reload" {
+					logrus.Debug("daemon configuration reloaded, purging the cached docker info")
+					p.info.purge()
+				}
+			}
+			rc.Close()
+		}
+		logrus.Debugf("watching the daemon events: %v", err)
+		p.info.purge()
+		time.Sleep(eventsRetryInterval)
+	}
+}
+
+// handleDaemonInfo flushes the cached docker info on DELETE.
+func (a *adminAPI) handleDaemonInfo(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, "DELETE") {
+		return
+	}
+	a.p.info.purge()
+	logrus.Info("admin: flushed the cached docker info")
+	w.WriteHeader(http.StatusNoContent)
+}
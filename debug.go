@@ -0,0 +1,110 @@
+package main
+
+import (
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	"sync/atomic"
+	"time"
+)
+
+// started is when the plugin started.
+var started = time.Now()
+
+// debugStatus is the runtime state served on /debug/status.
+type debugStatus struct {
+	Version   string        `json:"version"`
+	Uptime    string        `json:"uptime"`
+	GoVersion string        `json:"go_version"`
+	Runtime   runtimeStatus `json:"runtime"`
+	// InFlight is how many decisions are being taken, Background how
+	// many of them go on after the client was told to retry.
+	InFlight   int64 `json:"in_flight"`
+	Background int   `json:"background"`
+	// Verifications is how many verifications and AutoPulls are in
+	// progress, each shared by all the requests for the same image.
+	Verifications int `json:"verifications"`
+	// Queued is how many verifications and AutoPulls wait for their turn
+	// under the concurrency limits.
+	Queued int `json:"queued"`
+	// OpenBreakers are the registries not contacted by the circuit
+	// breaker, and since when.
+	OpenBreakers map[string]time.Time `json:"open_breakers"`
+	// Caches are the sizes of the caches and stores of the plugin.
+	Caches map[string]int `json:"caches"`
+	// ConfigFingerprint identifies the configuration and policy in effect.
+	ConfigFingerprint string `json:"config_fingerprint"`
+	Enforcing         bool   `json:"enforcing"`
+}
+
+type runtimeStatus struct {
+	Goroutines int    `json:"goroutines"`
+	HeapAlloc  uint64 `json:"heap_alloc"`
+	HeapInuse  uint64 `json:"heap_inuse"`
+	Sys        uint64 `json:"sys"`
+	NumGC      uint32 `json:"num_gc"`
+	// PauseTotal is the total GC pause time.
+	PauseTotal string `json:"gc_pause_total"`
+}
+
+// registerDebug adds the pprof handlers and the status page to mux.
+func (a *adminAPI) registerDebug(mux *http.ServeMux) {
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.HandleFunc("/debug/status", a.handleStatus)
+}
+
+func (a *adminAPI) handleStatus(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, "GET") {
+		return
+	}
+	writeAdminJSON(w, a.p.status())
+}
+
+// status returns the runtime state of the plugin.
+func (p *trustPlugin) status() debugStatus {
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	snap := p.snapshots.load()
+	s := debugStatus{
+		Version:   version,
+		Uptime:    time.Since(started).String(),
+		GoVersion: runtime.Version(),
+		Runtime: runtimeStatus{
+			Goroutines: runtime.NumGoroutine(),
+			HeapAlloc:  m.HeapAlloc,
+			HeapInuse:  m.HeapInuse,
+			Sys:        m.Sys,
+			NumGC:      m.NumGC,
+			PauseTotal: time.Duration(m.PauseTotalNs).String(),
+		},
+		InFlight:          atomic.LoadInt64(&p.inflight),
+		Background:        p.pending.len(),
+		Verifications:     p.flights.len(),
+		OpenBreakers:      p.breakers.states(),
+		ConfigFingerprint: snap.fingerprint,
+		Enforcing:         p.toggle.enabled(snap.config),
+		Caches: map[string]int{
+			"prefetch":   p.prefetch.len(),
+			"pins":       p.pins.len(),
+			"quarantine": p.quarantine.len(),
+			"verdicts":   p.verdicts.len(),
+		},
+	}
+	_, vq := p.verifications.usage()
+	_, aq := p.autopulls.usage()
+	s.Queued = vq + aq
+	if p.tofu != nil {
+		s.Caches["tofu"] = p.tofu.len()
+	}
+	if p.recent != nil {
+		s.Caches["recent_decisions"] = p.recent.len()
+	}
+	if p.history != nil {
+		s.Caches["history"] = p.history.len()
+	}
+	return s
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// digestsConf lists image digests allowed or blocked whatever their
+// signatures.
+type digestsConf struct {
+	// Allow lists digests allowed even if the policy rejects them.
+	Allow []string `yaml:"allow"`
+	// Deny lists digests never allowed, even if signed.
+	Deny []string `yaml:"deny"`
+	// AllowFile and DenyFile are files listing more digests, one per
+	// line, # starting comments.
+	AllowFile string `yaml:"allow-file"`
+	DenyFile  string `yaml:"deny-file"`
+}
+
+// digestLists are the digests of digestsConf, files included.
+type digestLists struct {
+	allow map[string]bool
+	deny  map[string]bool
+}
+
+// errDigestBlocked rejects images whose digest is blocked.
+type errDigestBlocked string
+
+func (e errDigestBlocked) Error() string {
+	return fmt.Sprintf("digest %s is blocked", string(e))
+}
+
+func loadDigestLists(cfg digestsConf) (*digestLists, error) {
+	l := &digestLists{allow: make(map[string]bool), deny: make(map[string]bool)}
+	for _, d := range cfg.Allow {
+		l.allow[d] = true
+	}
+	for _, d := range cfg.Deny {
+		l.deny[d] = true
+	}
+	if err := readDigestFile(cfg.AllowFile, l.allow); err != nil {
+		return nil, err
+	}
+	if err := readDigestFile(cfg.DenyFile, l.deny); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func readDigestFile(path string, digests map[string]bool) error {
+	if path == "" {
+		return nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		if line = strings.TrimSpace(line); line != "" {
+			digests[line] = true
+		}
+	}
+	return scanner.Err()
+}
+
+// check implements trust.PolicyVerifier.CheckDigest. Blocked digests win
+// over allowed ones.
+func (l *digestLists) check(digest string) (bool, error) {
+	if l == nil {
+		return false, nil
+	}
+	if l.deny[digest] {
+		return false, errDigestBlocked(digest)
+	}
+	return l.allow[digest], nil
+}
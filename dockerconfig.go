@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	imgtypes "github.com/containers/image/types"
+	"golang.org/x/net/context"
+)
+
+const (
+	// credentialsTTL is how long the credentials of a registry are cached,
+	// so that credential helpers don't run for every verification.
+	credentialsTTL = time.Minute
+	// dockerHubServer is the server docker logins to Docker Hub are
+	// recorded for.
+	dockerHubServer = "https://index.docker.io/v1/"
+)
+
+// dockerConfigFile is the subset of a docker config.json holding registry
+// credentials.
+type dockerConfigFile struct {
+	Auths       map[string]dockerConfigAuth `json:"auths"`
+	CredsStore  string                      `json:"credsStore"`
+	CredHelpers map[string]string           `json:"credHelpers"`
+}
+
+type dockerConfigAuth struct {
+	Auth     string `json:"auth"`
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+// credentialHelperOutput is what "docker-credential-<helper> get" prints.
+type credentialHelperOutput struct {
+	ServerURL string
+	Username  string
+	Secret    string
+}
+
+// cachedCredentials are the credentials of a registry, nil if it has none.
+type cachedCredentials struct {
+	config  *imgtypes.DockerAuthConfig
+	fetched time.Time
+}
+
+// credentialStore reads registry credentials from the docker config.json
+// set as docker-config, for the requests which carry none, e.g. pulls the
+// daemon starts itself.
+type credentialStore struct {
+	mu    sync.Mutex
+	cache map[string]cachedCredentials
+}
+
+func newCredentialStore() *credentialStore {
+	return &credentialStore{cache: make(map[string]cachedCredentials)}
+}
+
+// lookup returns the credentials for host in the docker config at path,
+// looked up like the docker CLI does: with the credential helper of host in
+// credHelpers, else with credsStore, else from auths. It returns nil if
+// there are none.
+func (s *credentialStore) lookup(ctx context.Context, path, host string) *imgtypes.DockerAuthConfig {
+	key := path + " " + host
+	s.mu.Lock()
+	c, ok := s.cache[key]
+	s.mu.Unlock()
+	if ok && time.Since(c.fetched) < credentialsTTL {
+		return c.config
+	}
+	config, err := readCredentials(ctx, path, host)
+	if err != nil {
+		logrus.Warnf("docker-config: reading the credentials of %s: %v", host, err)
+		return nil
+	}
+	s.mu.Lock()
+	s.cache[key] = cachedCredentials{config: config, fetched: time.Now()}
+	s.mu.Unlock()
+	return config
+}
+
+// purge forgets the cached credentials, e.g. after a reload.
+func (s *credentialStore) purge() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.cache = make(map[string]cachedCredentials)
+}
+
+func readCredentials(ctx context.Context, path, host string) (*imgtypes.DockerAuthConfig, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var cf dockerConfigFile
+	if err := json.Unmarshal(data, &cf); err != nil {
+		return nil, err
+	}
+	server := host
+	if host == "docker.io" {
+		server = dockerHubServer
+	}
+	for h, helper := range cf.CredHelpers {
+		if registryHost(h) == host {
+			return helperCredentials(ctx, helper, server)
+		}
+	}
+	if cf.CredsStore != "" {
+		return helperCredentials(ctx, cf.CredsStore, server)
+	}
+	for h, a := range cf.Auths {
+		if registryHost(h) != host {
+			continue
+		}
+		if a.Username != "" {
+			return &imgtypes.DockerAuthConfig{Username: a.Username, Password: a.Password}, nil
+		}
+		decoded, err := base64.StdEncoding.DecodeString(a.Auth)
+		if err != nil {
+			return nil, err
+		}
+		parts := strings.SplitN(string(decoded), ":", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid auth for %s", h)
+		}
+		return &imgtypes.DockerAuthConfig{Username: parts[0], Password: parts[1]}, nil
+	}
+	return nil, nil
+}
+
+// helperCredentials runs "docker-credential-<helper> get" for server.
+func helperCredentials(ctx context.Context, helper, server string) (*imgtypes.DockerAuthConfig, error) {
+	name := "docker-credential-" + helper
+	cmd := exec.CommandContext(ctx, name, "get")
+	cmd.Stdin = strings.NewReader(server)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	stdout, err := cmd.Output()
+	if err != nil {
+		msg := strings.TrimSpace(string(stdout) + stderr.String())
+		// Helpers report missing credentials this way.
+		if strings.Contains(msg, "credentials not found") {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("%s: %v: %s", name, err, msg)
+	}
+	var out credentialHelperOutput
+	if err := json.Unmarshal(stdout, &out); err != nil {
+		return nil, fmt.Errorf("%s: %v", name, err)
+	}
+	// Identity tokens are stored with this username, the registry client
+	// can't use them.
+	if out.Username == "<token>" {
+		return nil, nil
+	}
+	return &imgtypes.DockerAuthConfig{Username: out.Username, Password: out.Secret}, nil
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"sync/atomic"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/docker/go-plugins-helpers/authorization"
+	"github.com/projectatomic/container-trust-plugin/pkg/trust"
+)
+
+// Enforcement modes. Anything but audit enforces the decisions.
+const (
+	enforcementEnforce = "enforce"
+	enforcementAudit   = "audit"
+)
+
+// enforcementMode returns the enforcement mode for the request rec is
+// about, which the registry of its image may override.
+func enforcementMode(cfg conf, rec *auditRecord) string {
+	if rec.Reference != "" {
+		if ref, err := trust.ParseNormalizedReference(rec.Reference); err == nil {
+			switch mode := cfg.override(ref).Mode; mode {
+			case enforcementEnforce, enforcementAudit:
+				return mode
+			}
+		}
+	}
+	return cfg.EnforcementMode
+}
+
+// auditOnly lets through the request denied by res, recording and logging
+// the denial it would have got, when mode is audit.
+func auditOnly(mode string, rec *auditRecord, res authorization.Response) (authorization.Response, bool) {
+	if res.Allow || mode != enforcementAudit {
+		return res, false
+	}
+	msg := res.Err
+	if msg == "" {
+		msg = res.Msg
+	}
+	if code, _ := splitCode(msg); code == codeAutoPulled {
+		// The image was pulled, this isn't a denial.
+		return res, false
+	}
+	rec.Mode = enforcementAudit
+	logrus.WithFields(logrus.Fields{
+		"audit":     "would-deny",
+		"user":      rec.User,
+		"method":    rec.Method,
+		"uri":       rec.URI,
+		"reference": rec.Reference,
+	}).Warnf("audit mode, allowing request which would be denied: %s", msg)
+	return authorization.Response{Allow: true}, true
+}
+
+// Runtime overrides of the enabled setting of the configuration.
+const (
+	toggleConfig int32 = iota
+	toggleEnabled
+	toggleDisabled
+)
+
+// enforcementToggle turns enforcement on or off at runtime, regardless of
+// the configuration, until the plugin restarts.
+type enforcementToggle struct {
+	v int32
+}
+
+func (t *enforcementToggle) set(v int32) {
+	atomic.StoreInt32(&t.v, v)
+}
+
+func (t *enforcementToggle) get() int32 {
+	return atomic.LoadInt32(&t.v)
+}
+
+// enabled tells whether requests are to be checked with cfg in effect.
+func (t *enforcementToggle) enabled(cfg conf) bool {
+	switch atomic.LoadInt32(&t.v) {
+	case toggleEnabled:
+		return true
+	case toggleDisabled:
+		return false
+	}
+	return cfg.Enabled == nil || *cfg.Enabled
+}
+
+// disabled allows req without checking it, logging it if the configuration
+// asks for it and req would have been checked.
+func disabled(cfg conf, req authorization.Request) authorization.Response {
+	if cfg.LogDisabled {
+		if i, _, _ := intercept(req); i != nil {
+			logrus.WithFields(logrus.Fields{
+				"audit":  "disabled",
+				"user":   req.User,
+				"method": req.RequestMethod,
+				"uri":    req.RequestURI,
+			}).Info("enforcement disabled, allowing request unchecked")
+		}
+	}
+	return authorization.Response{Allow: true}
+}
@@ -0,0 +1,28 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// watchToggle disables enforcement on SIGUSR1 and enables it on SIGUSR2. It
+// never returns.
+func (p *trustPlugin) watchToggle() {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGUSR1, syscall.SIGUSR2)
+	for sig := range sigs {
+		if sig == syscall.SIGUSR1 {
+			p.toggle.set(toggleDisabled)
+			logrus.Warn("enforcement disabled at runtime, every request is allowed")
+		} else {
+			p.toggle.set(toggleEnabled)
+			logrus.Info("enforcement enabled at runtime")
+		}
+	}
+}
@@ -0,0 +1,9 @@
+package main
+
+import "github.com/Sirupsen/logrus"
+
+// watchToggle does nothing, there are no SIGUSR1 and SIGUSR2 to toggle
+// enforcement with on Windows.
+func (p *trustPlugin) watchToggle() {
+	logrus.Debug("enforcement can't be toggled at runtime on Windows")
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/containers/image/signature"
+	"github.com/docker/go-plugins-helpers/authorization"
+	"github.com/projectatomic/container-trust-plugin/pkg/trust"
+)
+
+// Denial codes are stable, machine-readable identifiers returned alongside
+// the human readable message. Tooling should branch on these, never on the
+// message text which may change or be localized.
+const (
+	codeInvalidRequest      = "TRUST_INVALID_REQUEST"
+	codeInvalidReference    = "TRUST_INVALID_REFERENCE"
+	codeAllTags             = "TRUST_ALL_TAGS_UNSUPPORTED"
+	codeUnqualified         = "TRUST_UNQUALIFIED_REFERENCE"
+	codeDaemonUnreachable   = "TRUST_DAEMON_UNREACHABLE"
+	codeRegistryError       = "TRUST_REGISTRY_ERROR"
+	codePolicyError         = "TRUST_POLICY_ERROR"
+	codeNoSignature         = "TRUST_NO_SIGNATURE"
+	codeKeyUntrusted        = "TRUST_KEY_UNTRUSTED"
+	codeSignatureInvalid    = "TRUST_SIGNATURE_INVALID"
+	codeIdentityMismatch    = "TRUST_IDENTITY_MISMATCH"
+	codeRejected            = "TRUST_REJECTED"
+	codeDenied              = "TRUST_DENIED"
+	codeDigestMismatch      = "TRUST_DIGEST_MISMATCH"
+	codePullByTag           = "TRUST_PULL_BY_TAG"
+	codeGuardViolation      = "TRUST_GUARD_VIOLATION"
+	codeQuotaExceeded       = "TRUST_QUOTA_EXCEEDED"
+	codeVerificationPending = "TRUST_VERIFICATION_PENDING"
+	codeUnverifiable        = "TRUST_UNVERIFIABLE_IMAGE"
+	codePinnedImage         = "TRUST_PINNED_IMAGE"
+	codeQuarantined         = "TRUST_QUARANTINED"
+	codeRegistryNotAllowed  = "TRUST_REGISTRY_NOT_ALLOWED"
+	codeRepositoryDenied    = "TRUST_REPOSITORY_DENIED"
+	codeDigestBlocked       = "TRUST_DIGEST_BLOCKED"
+	codeChangeFreeze        = "TRUST_CHANGE_FREEZE"
+	codeSignatureStale      = "TRUST_SIGNATURE_STALE"
+	codeSignatureThreshold  = "TRUST_SIGNATURE_THRESHOLD"
+	codeKeyChanged          = "TRUST_KEY_CHANGED"
+	codeLabelMissing        = "TRUST_LABEL_MISSING"
+	codeImageTooOld         = "TRUST_IMAGE_TOO_OLD"
+	codeTagMoved            = "TRUST_TAG_MOVED"
+	codeWebhookDenied       = "TRUST_WEBHOOK_DENIED"
+	codeWebhookError        = "TRUST_WEBHOOK_ERROR"
+	codeAutoPull            = "TRUST_AUTOPULL_FAILED"
+	codeAutoPulled          = "TRUST_AUTOPULLED"
+	codeBusy                = "TRUST_BUSY"
+	codeTimeout             = "TRUST_TIMEOUT"
+	codeInternal            = "TRUST_INTERNAL"
+)
+
+// trustError is a denial reason made of a stable code and a human message.
+type trustError struct {
+	Code string
+	Msg  string
+	// unreachable is set when the registry couldn't be reached, for
+	// fail-open.
+	unreachable bool
+}
+
+// registryUnreachable tells whether e denies because the registry, or its
+// signature server, couldn't be reached.
+func (e *trustError) registryUnreachable() bool {
+	return e.unreachable || e.Code == codeTimeout
+}
+
+func (e *trustError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Code, e.Msg)
+}
+
+func newTrustError(code, format string, args ...interface{}) *trustError {
+	return &trustError{Code: code, Msg: fmt.Sprintf(format, args...)}
+}
+
+// wrapError attaches code to err unless err already carries one.
+func wrapError(code string, err error) *trustError {
+	if te, ok := err.(*trustError); ok {
+		return te
+	}
+	return &trustError{Code: code, Msg: err.Error()}
+}
+
+func (e *trustError) response() authorization.Response {
+	return authorization.Response{Err: e.Error()}
+}
+
+// errResponse builds the authorization response for err, qualifying it with
+// code when err isn't already a trustError.
+func errResponse(code string, err error) authorization.Response {
+	return wrapError(code, err).response()
+}
+
+// verificationError maps an error of a trust.Verifier to a denial.
+func verificationError(err error) *trustError {
+	switch e := err.(type) {
+	case *trustError:
+		return e
+	case *trust.RejectionError:
+		if e.Err == nil {
+			return &trustError{Code: codeDenied, Msg: e.Error()}
+		}
+		return &trustError{Code: policyErrorCode(e.Err), Msg: e.Error(), unreachable: transient(e.Err)}
+	case *trust.DigestMismatchError:
+		return &trustError{Code: codeDigestMismatch, Msg: e.Error()}
+	}
+	return &trustError{Code: codeRegistryError, Msg: err.Error(), unreachable: transient(err)}
+}
+
+// policyErrorCode maps a policy evaluation failure coming from
+// containers/image to one of our denial codes.
+func policyErrorCode(err error) string {
+	switch err.(type) {
+	case errDigestBlocked:
+		return codeDigestBlocked
+	case errSignatureStale:
+		return codeSignatureStale
+	case errThresholdNotMet:
+		return codeSignatureThreshold
+	case errKeyChanged:
+		return codeKeyChanged
+	case signature.InvalidSignatureError:
+		if strings.Contains(err.Error(), "does not match expected fingerprint") {
+			return codeKeyUntrusted
+		}
+		return codeSignatureInvalid
+	case signature.PolicyRequirementError:
+	default:
+		return codePolicyError
+	}
+	msg := err.Error()
+	switch {
+	case strings.Contains(msg, "no signature exists"):
+		return codeNoSignature
+	case strings.Contains(msg, "No public keys imported"),
+		strings.Contains(msg, "Signature by key"):
+		return codeKeyUntrusted
+	case strings.Contains(msg, "Signature for identity"):
+		return codeIdentityMismatch
+	case strings.Contains(msg, "Signature for digest"):
+		return codeSignatureInvalid
+	case strings.Contains(msg, "rejected by policy"):
+		return codeRejected
+	}
+	return codeDenied
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/containers/image/docker"
+	"github.com/containers/image/signature"
+	"github.com/containers/image/types"
+	"github.com/docker/docker/reference"
+	"github.com/projectatomic/container-trust-plugin/pkg/trust"
+)
+
+// explanation describes how the policy evaluates an image.
+type explanation struct {
+	Reference string `json:"reference"`
+	// Scope is the policy scope which matched, transport:scope or default.
+	Scope        string                   `json:"scope"`
+	Requirements []requirementExplanation `json:"requirements"`
+	Decision     verifyResult             `json:"decision"`
+}
+
+// requirementExplanation is the outcome of a single policy requirement.
+type requirementExplanation struct {
+	Requirement map[string]interface{} `json:"requirement"`
+	Satisfied   bool                   `json:"satisfied"`
+	Reason      string                 `json:"reason,omitempty"`
+}
+
+// policyScope returns the scope of policy which applies to ref, following
+// the lookup order of containers/image, and its requirements.
+func policyScope(policy *signature.Policy, ref types.ImageReference) (string, signature.PolicyRequirements) {
+	transport := ref.Transport().Name()
+	if scopes, ok := policy.Transports[transport]; ok {
+		if reqs, ok := scopes[ref.PolicyConfigurationIdentity()]; ok {
+			return transport + ":" + ref.PolicyConfigurationIdentity(), reqs
+		}
+		for _, ns := range ref.PolicyConfigurationNamespaces() {
+			if reqs, ok := scopes[ns]; ok {
+				return transport + ":" + ns, reqs
+			}
+		}
+		if reqs, ok := scopes[""]; ok {
+			return transport + ":", reqs
+		}
+	}
+	return "default", policy.Default
+}
+
+// describeRequirement returns req as it's written in policy.json, leaving
+// inline key data out.
+func describeRequirement(req signature.PolicyRequirement) map[string]interface{} {
+	var m map[string]interface{}
+	b, err := json.Marshal(req)
+	if err != nil || json.Unmarshal(b, &m) != nil {
+		return map[string]interface{}{"type": fmt.Sprintf("%T", req)}
+	}
+	if _, ok := m["keyData"]; ok {
+		m["keyData"] = "(inline)"
+	}
+	return m
+}
+
+// explain walks the evaluation of image against the policy of snap, for
+// the manifest of plat the decision is taken on. The image is fetched like
+// the plugin does, and its requirements are evaluated even if its digest is
+// allowed or denied ahead of the policy.
+func explain(snap *snapshot, image string, plat trust.Platform) (*explanation, error) {
+	ref, err := trust.ParseImageReference(image)
+	if err != nil {
+		return nil, err
+	}
+	e := &explanation{Reference: ref.String()}
+	p := newOfflinePlugin()
+	p.snapshots.store(snap)
+	setupProxy(func() conf { return snap.config })
+	ctx, cancel := snap.config.Timeouts.decisionContext()
+	defer cancel()
+	v := p.verifier(ctx, snap, plat, nil).(*trust.PolicyVerifier)
+	v.CheckDigest = nil
+	evaluated := false
+	v.Evaluate = func(ref reference.Named, img types.Image) (bool, error) {
+		evaluated = true
+		imgRef, err := docker.NewReference(ref)
+		if err != nil {
+			return false, err
+		}
+		var reqs signature.PolicyRequirements
+		e.Scope, reqs = policyScope(snap.policy, imgRef)
+		allowed := true
+		for _, req := range reqs {
+			re := requirementExplanation{Requirement: describeRequirement(req)}
+			pc, err := signature.NewPolicyContext(&signature.Policy{Default: signature.PolicyRequirements{req}})
+			if err != nil {
+				return false, err
+			}
+			re.Satisfied, err = pc.IsRunningImageAllowed(img)
+			pc.Destroy()
+			if err != nil {
+				re.Reason = err.Error()
+			}
+			allowed = allowed && re.Satisfied
+			e.Requirements = append(e.Requirements, re)
+		}
+		return allowed, nil
+	}
+	// Rejections are what is being explained.
+	if _, err := v.Verify(ref); err != nil && !evaluated {
+		return nil, err
+	}
+	e.Decision = verifyReference(snap, image, plat)
+	return e, nil
+}
+
+// runExplain prints how the policy evaluates an image: the scope which
+// matched, the outcome of each of its requirements and the decision.
+func runExplain(args []string) error {
+	fs := flag.NewFlagSet("explain", flag.ContinueOnError)
+	asJSON := fs.Bool("json", false, "Print the explanation as JSON")
+	platform := fs.String("platform", "", "Platform to explain the manifest of, os/arch[/variant], defaults to this host")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return errors.New("usage: explain [--json] [--platform os/arch] IMAGE")
+	}
+	plat := trust.HostPlatform()
+	if *platform != "" {
+		var err error
+		if plat, err = trust.ParsePlatform(*platform); err != nil {
+			return err
+		}
+	}
+	snap, err := loadSnapshot()
+	if err != nil {
+		return err
+	}
+	defer snap.keyrings.remove()
+	e, err := explain(snap, fs.Arg(0), plat)
+	if err != nil {
+		return err
+	}
+	if *asJSON {
+		return json.NewEncoder(os.Stdout).Encode(e)
+	}
+	fmt.Printf("reference: %s\n", e.Reference)
+	fmt.Printf("scope: %s\n", e.Scope)
+	for i, re := range e.Requirements {
+		b, _ := json.Marshal(re.Requirement)
+		fmt.Printf("requirement %d: %s: %s", i+1, b, outcome(re.Satisfied))
+		if re.Reason != "" {
+			fmt.Printf(" (%s)", re.Reason)
+		}
+		fmt.Println()
+	}
+	if e.Decision.Allowed {
+		fmt.Printf("decision: allow %s\n", e.Decision.Digest)
+	} else {
+		fmt.Printf("decision: deny %s: %s\n", e.Decision.Code, e.Decision.Message)
+	}
+	return nil
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"sync"
+
+	"github.com/docker/go-plugins-helpers/authorization"
+)
+
+// Matcher is an organization-specific endpoint check. Integrators register
+// matchers from their own files, typically in an init function, instead of
+// patching AuthZReq:
+//
+//	func init() {
+//		RegisterMatcher("internal-extensions", myMatcher{})
+//	}
+//
+// Matchers are consulted in registration order before the built-in checks,
+// the first one matching a request decides it.
+type Matcher interface {
+	// Match tells whether the matcher handles req.
+	Match(req authorization.Request) bool
+	// Decide returns the decision for a request Match returned true for.
+	Decide(req authorization.Request) authorization.Response
+}
+
+// DecisionHook is called with every decision taken on a request, built-in
+// or by a Matcher, and returns the response actually sent to the daemon.
+// Hooks are chained in registration order.
+type DecisionHook func(req authorization.Request, res authorization.Response) authorization.Response
+
+type namedMatcher struct {
+	name string
+	Matcher
+}
+
+var extensions struct {
+	sync.RWMutex
+	matchers []namedMatcher
+	hooks    []DecisionHook
+}
+
+// RegisterMatcher adds m to the matchers consulted for every request.
+func RegisterMatcher(name string, m Matcher) {
+	extensions.Lock()
+	defer extensions.Unlock()
+	extensions.matchers = append(extensions.matchers, namedMatcher{name: name, Matcher: m})
+}
+
+// RegisterDecisionHook adds h to the hooks run on every decision.
+func RegisterDecisionHook(h DecisionHook) {
+	extensions.Lock()
+	defer extensions.Unlock()
+	extensions.hooks = append(extensions.hooks, h)
+}
+
+// matchExtension returns the first registered matcher handling req.
+func matchExtension(req authorization.Request) (namedMatcher, bool) {
+	extensions.RLock()
+	defer extensions.RUnlock()
+	for _, m := range extensions.matchers {
+		if m.Match(req) {
+			return m, true
+		}
+	}
+	return namedMatcher{}, false
+}
+
+func runDecisionHooks(req authorization.Request, res authorization.Response) authorization.Response {
+	extensions.RLock()
+	defer extensions.RUnlock()
+	for _, h := range extensions.hooks {
+		res = h(req, res)
+	}
+	return res
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"sync"
+
+	"github.com/docker/docker/reference"
+	"github.com/projectatomic/container-trust-plugin/pkg/trust"
+	"golang.org/x/net/context"
+)
+
+// flight is a call in progress, or done, whose result is shared by the
+// callers which asked for it meanwhile.
+type flight struct {
+	done chan struct{}
+	val  interface{}
+	err  error
+}
+
+// flightGroup deduplicates concurrent calls with the same key: while one is
+// in progress, the others wait for its result instead of running their own.
+type flightGroup struct {
+	mu      sync.Mutex
+	flights map[string]*flight
+}
+
+func newFlightGroup() *flightGroup {
+	return &flightGroup{flights: make(map[string]*flight)}
+}
+
+// do runs fn unless a call for key is in progress, and returns its result
+// or the one of the call in progress. shared tells whether it was the
+// result of another call.
+func (g *flightGroup) do(key string, fn func() (interface{}, error)) (val interface{}, err error, shared bool) {
+	g.mu.Lock()
+	if f, ok := g.flights[key]; ok {
+		g.mu.Unlock()
+		<-f.done
+		return f.val, f.err, true
+	}
+	f := &flight{done: make(chan struct{})}
+	g.flights[key] = f
+	g.mu.Unlock()
+
+	defer func() {
+		g.mu.Lock()
+		delete(g.flights, key)
+		g.mu.Unlock()
+		close(f.done)
+	}()
+	f.val, f.err = fn()
+	return f.val, f.err, false
+}
+
+// len returns how many calls are in progress.
+func (g *flightGroup) len() int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return len(g.flights)
+}
+
+// sharedVerification is the outcome of a verification shared by concurrent
+// requests: the policy verification result and the guards, labels and age
+// checks run on it.
+type sharedVerification struct {
+	res  *trust.Result
+	terr *trustError
+}
+
+// verifyShared verifies ref for plat like verifier, checkVerified and
+// verifyPlatforms do, sharing the manifest and signature fetches and the
+// policy evaluation with the concurrent requests for the same reference and
+// snapshot. Only the first request is traced under sp, and its ctx bounds the
+// fetches.
+func (p *trustPlugin) verifyShared(ctx context.Context, snap *snapshot, ref reference.Named, plat trust.Platform, sp *span) (*trust.Result, *trustError, error) {
+	// Requests with other credentials may not be able to fetch the image.
+	key := "verify " + snap.fingerprint + " " + plat.String() + " " + ref.String() + " " + registryAuthID(ctx)
+	v, err, shared := p.flights.do(key, func() (interface{}, error) {
+		limit := snap.config.Concurrency.maxVerifications()
+		if err := p.verifications.acquire(limit, snap.config.Concurrency.queueTimeout()); err != nil {
+			return nil, err
+		}
+		defer p.verifications.release(limit)
+		res, err := p.verifier(ctx, snap, plat, sp).Verify(ref)
+		if err != nil {
+			return nil, err
+		}
+		terr := checkVerified(snap, ref, res)
+		if terr == nil {
+			terr = p.verifyPlatforms(ctx, snap, ref, plat, res, sp)
+		}
+		return sharedVerification{res: res, terr: terr}, nil
+	})
+	sp.set("trust.shared", shared)
+	if err != nil {
+		return nil, nil, err
+	}
+	sv := v.(sharedVerification)
+	return sv.res, sv.terr, nil
+}
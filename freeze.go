@@ -0,0 +1,203 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/reference"
+	"github.com/projectatomic/container-trust-plugin/pkg/trust"
+)
+
+// freezeWindow is a change freeze: while it's active no image may be pulled
+// and only images whose digest is in the pinning database may be started,
+// except for the images of ExceptRegistries.
+type freezeWindow struct {
+	Name string `yaml:"name"`
+	// Schedule is when the window starts, in crontab syntax (minute hour
+	// day-of-month month day-of-week, local time), Duration how long it
+	// lasts.
+	Schedule string        `yaml:"schedule"`
+	Duration time.Duration `yaml:"duration"`
+	// From and Until define a one-off window instead, e.g. during an
+	// incident.
+	From  time.Time `yaml:"from"`
+	Until time.Time `yaml:"until"`
+	// ExceptRegistries are the registries the freeze doesn't apply to.
+	ExceptRegistries []string `yaml:"except-registries"`
+}
+
+func (w freezeWindow) String() string {
+	if w.Name != "" {
+		return w.Name
+	}
+	if w.Schedule != "" {
+		return fmt.Sprintf("%q for %s", w.Schedule, w.Duration)
+	}
+	return fmt.Sprintf("%s to %s", w.From.Format(time.RFC3339), w.Until.Format(time.RFC3339))
+}
+
+func (w freezeWindow) validate() error {
+	if w.Schedule == "" {
+		if w.From.IsZero() || !w.Until.After(w.From) {
+			return fmt.Errorf("freezes: %s: either a schedule and a duration or from and until are required", w)
+		}
+		return nil
+	}
+	if w.Duration <= 0 {
+		return fmt.Errorf("freezes: %s: duration must be positive", w)
+	}
+	if _, err := parseCron(w.Schedule); err != nil {
+		return fmt.Errorf("freezes: %s: %v", w, err)
+	}
+	return nil
+}
+
+// active tells whether the window is in effect at now.
+func (w freezeWindow) active(now time.Time) bool {
+	if w.Schedule == "" {
+		return !now.Before(w.From) && now.Before(w.Until)
+	}
+	s, err := parseCron(w.Schedule)
+	if err != nil {
+		return false
+	}
+	// Look for a start within Duration before now.
+	t := now.Truncate(time.Minute)
+	for start := now.Add(-w.Duration); t.After(start); t = t.Add(-time.Minute) {
+		if s.matches(t) {
+			return true
+		}
+	}
+	return false
+}
+
+func (w freezeWindow) excepts(ref reference.Named) bool {
+	host := ref.Hostname()
+	for _, r := range w.ExceptRegistries {
+		if trust.NormalizeHostname(r) == host {
+			return true
+		}
+	}
+	return false
+}
+
+// freezeActive tells whether any of windows is in effect at now.
+func freezeActive(windows []freezeWindow, now time.Time) bool {
+	for _, w := range windows {
+		if w.active(now) {
+			return true
+		}
+	}
+	return false
+}
+
+// activeFreeze returns the freeze window applying to ref at now, if any.
+func activeFreeze(windows []freezeWindow, ref reference.Named, now time.Time) (freezeWindow, bool) {
+	for _, w := range windows {
+		if w.active(now) && !w.excepts(ref) {
+			return w, true
+		}
+	}
+	return freezeWindow{}, false
+}
+
+// cronSchedule is a parsed crontab schedule, one set of allowed values per
+// field.
+type cronSchedule struct {
+	minute, hour, dom, month, dow map[int]bool
+	// domAny and dowAny tell whether the day fields are *, as days match
+	// either of them otherwise.
+	domAny, dowAny bool
+}
+
+var cronFields = []struct {
+	name     string
+	min, max int
+}{
+	{"minute", 0, 59},
+	{"hour", 0, 23},
+	{"day of month", 1, 31},
+	{"month", 1, 12},
+	{"day of week", 0, 7},
+}
+
+func parseCron(spec string) (*cronSchedule, error) {
+	fields := strings.Fields(spec)
+	if len(fields) != len(cronFields) {
+		return nil, fmt.Errorf("schedule %q must have %d fields", spec, len(cronFields))
+	}
+	sets := make([]map[int]bool, len(fields))
+	for i, f := range fields {
+		set, err := parseCronField(f, cronFields[i].min, cronFields[i].max)
+		if err != nil {
+			return nil, fmt.Errorf("schedule %q: %s: %v", spec, cronFields[i].name, err)
+		}
+		sets[i] = set
+	}
+	// Sunday is both 0 and 7.
+	if sets[4][7] {
+		sets[4][0] = true
+	}
+	return &cronSchedule{
+		minute: sets[0], hour: sets[1], dom: sets[2], month: sets[3], dow: sets[4],
+		domAny: fields[2] == "*", dowAny: fields[4] == "*",
+	}, nil
+}
+
+// parseCronField parses a comma separated list of *, values and ranges,
+// each with an optional /step.
+func parseCronField(field string, min, max int) (map[int]bool, error) {
+	set := make(map[int]bool)
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			n, err := strconv.Atoi(part[i+1:])
+			if err != nil || n <= 0 {
+				return nil, fmt.Errorf("invalid step in %q", part)
+			}
+			step = n
+			part = part[:i]
+		}
+		lo, hi := min, max
+		if part != "*" {
+			bounds := strings.SplitN(part, "-", 2)
+			var err error
+			if lo, err = strconv.Atoi(bounds[0]); err != nil {
+				return nil, fmt.Errorf("invalid value %q", part)
+			}
+			hi = lo
+			if len(bounds) == 2 {
+				if hi, err = strconv.Atoi(bounds[1]); err != nil {
+					return nil, fmt.Errorf("invalid value %q", part)
+				}
+			} else if step > 1 {
+				hi = max
+			}
+		}
+		if lo < min || hi > max || lo > hi {
+			return nil, fmt.Errorf("%q out of range %d-%d", part, min, max)
+		}
+		for v := lo; v <= hi; v += step {
+			set[v] = true
+		}
+	}
+	return set, nil
+}
+
+func (s *cronSchedule) matches(t time.Time) bool {
+	if !s.minute[t.Minute()] || !s.hour[t.Hour()] || !s.month[int(t.Month())] {
+		return false
+	}
+	dom, dow := s.dom[t.Day()], s.dow[int(t.Weekday())]
+	switch {
+	case s.domAny && s.dowAny:
+		return true
+	case s.domAny:
+		return dow
+	case s.dowAny:
+		return dom
+	}
+	return dom || dow
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+
+	"github.com/containers/image/manifest"
+	"github.com/containers/image/signature"
+	"github.com/containers/image/types"
+	"github.com/projectatomic/container-trust-plugin/pkg/trust"
+)
+
+// foreignLayerMediaType is the media type of layers which aren't stored in
+// the registry but fetched from an arbitrary URL.
+const foreignLayerMediaType = "application/vnd.docker.image.rootfs.foreign.diff.tar.gzip"
+
+// guardsConf are the guard rails applied to images allowed only because
+// their scope is insecureAcceptAnything, so that "accept anything" doesn't
+// literally mean anything.
+type guardsConf struct {
+	// MaxSize is the maximum total size, in bytes, of the image layers.
+	MaxSize int64 `yaml:"max-size"`
+	// Platforms lists the allowed "os/architecture" pairs.
+	Platforms []string `yaml:"platforms"`
+	// AllowForeignLayers allows layers fetched from outside the registry.
+	AllowForeignLayers bool `yaml:"allow-foreign-layers"`
+}
+
+var acceptAnythingType = reflect.TypeOf(signature.NewPRInsecureAcceptAnything())
+
+// requirementsFor returns the policy requirements applying to imgRef,
+// following the same scope lookup as containers/image.
+func requirementsFor(policy *signature.Policy, imgRef types.ImageReference) signature.PolicyRequirements {
+	if scopes, ok := policy.Transports[imgRef.Transport().Name()]; ok {
+		if req, ok := scopes[imgRef.PolicyConfigurationIdentity()]; ok {
+			return req
+		}
+		for _, ns := range imgRef.PolicyConfigurationNamespaces() {
+			if req, ok := scopes[ns]; ok {
+				return req
+			}
+		}
+		if req, ok := scopes[""]; ok {
+			return req
+		}
+	}
+	return policy.Default
+}
+
+// acceptsAnything tells whether imgRef is allowed by policy without any
+// signature being required.
+func acceptsAnything(policy *signature.Policy, imgRef types.ImageReference) bool {
+	reqs := requirementsFor(policy, imgRef)
+	if len(reqs) == 0 {
+		return false
+	}
+	for _, r := range reqs {
+		if reflect.TypeOf(r) != acceptAnythingType {
+			return false
+		}
+	}
+	return true
+}
+
+type schema2Manifest struct {
+	Layers []struct {
+		MediaType string `json:"mediaType"`
+		Size      int64  `json:"size"`
+	} `json:"layers"`
+}
+
+// checkGuards enforces g on img.
+func checkGuards(g guardsConf, img types.Image) error {
+	m, mimeType, err := img.Manifest()
+	if err != nil {
+		return err
+	}
+	if mimeType == manifest.DockerV2Schema2MediaType {
+		var s2 schema2Manifest
+		if err := json.Unmarshal(m, &s2); err != nil {
+			return err
+		}
+		var size int64
+		for _, l := range s2.Layers {
+			if l.MediaType == foreignLayerMediaType && !g.AllowForeignLayers {
+				return newTrustError(codeGuardViolation, "image has foreign layers")
+			}
+			size += l.Size
+		}
+		if g.MaxSize > 0 && size > g.MaxSize {
+			return newTrustError(codeGuardViolation, "image size %d exceeds the maximum of %d bytes", size, g.MaxSize)
+		}
+	} else if g.MaxSize > 0 {
+		// Schema 1 manifests don't record layer sizes.
+		return newTrustError(codeGuardViolation, "image size can't be determined from a %s manifest", mimeType)
+	}
+	if len(g.Platforms) > 0 {
+		info, err := img.Inspect()
+		if err != nil {
+			return err
+		}
+		p := info.Os + "/" + info.Architecture
+		for _, allowed := range g.Platforms {
+			if p == allowed {
+				return nil
+			}
+		}
+		return newTrustError(codeGuardViolation, "platform %s isn't allowed", p)
+	}
+	return nil
+}
+
+// applyGuards enforces the accept-anything guards on the verified image of
+// res if its policy scope accepts anything.
+func applyGuards(snap *snapshot, res *trust.Result) *trustError {
+	g := snap.config.AcceptAnythingGuards
+	if g == nil || !acceptsAnything(snap.policy, res.ImageRef) {
+		return nil
+	}
+	if err := checkGuards(*g, res.Image); err != nil {
+		return wrapError(codeRegistryError, err)
+	}
+	return nil
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"golang.org/x/net/context"
+)
+
+const (
+	// healthTimeout bounds each health and readiness check.
+	healthTimeout = 2 * time.Second
+
+	checkOK = "ok"
+)
+
+// healthStatus is the answer of /healthz and /readyz, with the outcome of
+// each check.
+type healthStatus struct {
+	Status string            `json:"status"`
+	Checks map[string]string `json:"checks"`
+}
+
+// health checks that the plugin serves and answers requests.
+func (p *trustPlugin) health() healthStatus {
+	checks := map[string]string{"serving": checkOK, "answering": checkOK}
+	if atomic.LoadInt32(&p.serving) == 0 {
+		checks["serving"] = "the plugin sockets aren't served yet"
+	}
+	if !p.answers(healthTimeout) {
+		checks["answering"] = fmt.Sprintf("no answer within %s", healthTimeout)
+	}
+	return newHealthStatus(checks)
+}
+
+// readiness checks that the plugin is healthy, that the configuration, the
+// policy and the keys it references load, and that the daemon can be
+// reached.
+func (p *trustPlugin) readiness() healthStatus {
+	checks := p.health().Checks
+	checks["policy"], checks["keys"] = checkOK, checkOK
+	if snap, err := loadSnapshot(); err != nil {
+		checks["policy"] = err.Error()
+		checks["keys"] = "policy not loaded"
+	} else {
+		for scope, reqs := range policyRequirements(snap.policy) {
+			if err := collectKeyrings(reqs, scope, map[string][]byte{}); err != nil {
+				checks["keys"] = fmt.Sprintf("%s: %v", scope, err)
+				break
+			}
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), healthTimeout)
+	defer cancel()
+	checks["docker"] = checkOK
+	if _, err := p.client.ServerVersion(ctx); err != nil {
+		checks["docker"] = err.Error()
+	}
+	return newHealthStatus(checks)
+}
+
+func newHealthStatus(checks map[string]string) healthStatus {
+	s := healthStatus{Status: checkOK, Checks: checks}
+	for _, c := range checks {
+		if c != checkOK {
+			s.Status = "fail"
+		}
+	}
+	return s
+}
+
+// handleHealth serves /healthz and /readyz, answering 503 when a check
+// fails.
+func (p *trustPlugin) handleHealth(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, "GET", "HEAD") {
+		return
+	}
+	var s healthStatus
+	if r.URL.Path == "/readyz" {
+		s = p.readiness()
+	} else {
+		s = p.health()
+	}
+	if s.Status != checkOK {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	writeAdminJSON(w, s)
+}
+
+// healthHandler serves only the health endpoints, to unauthenticated
+// clients.
+func (p *trustPlugin) healthHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", p.handleHealth)
+	mux.HandleFunc("/readyz", p.handleHealth)
+	return mux
+}
+
+// serveHealth serves the health endpoints on the TCP address addr.
+func serveHealth(p *trustPlugin, addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("health: %v", err)
+	}
+	logrus.Infof("health: serving on %s", l.Addr())
+	go func() {
+		if err := http.Serve(l, p.healthHandler()); err != nil {
+			logrus.Errorf("health: %v", err)
+		}
+	}()
+	return nil
+}
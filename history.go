@@ -0,0 +1,329 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/projectatomic/container-trust-plugin/pkg/trust"
+)
+
+const (
+	defaultHistoryMaxAge     = 30 * 24 * time.Hour
+	defaultHistoryMaxRecords = 50000
+)
+
+var defaultHistoryPath = filepath.Join(stateDir, "history.jsonl")
+
+// historyConf keeps the recent decisions on disk, for the history queries
+// of the admin API.
+type historyConf struct {
+	// Path is the file the decisions are appended to.
+	Path string `yaml:"path"`
+	// MaxAge and MaxRecords bound the decisions kept, 720h and 50000 by
+	// default.
+	MaxAge     time.Duration `yaml:"max-age"`
+	MaxRecords int           `yaml:"max-records"`
+}
+
+func (c historyConf) validate() error {
+	if c.MaxAge < 0 || c.MaxRecords < 0 {
+		return fmt.Errorf("history: max-age and max-records must be positive")
+	}
+	return nil
+}
+
+// historyEntry is a decision taken on host.
+type historyEntry struct {
+	Host string `json:"host"`
+	auditRecord
+}
+
+// historyStore is an audit sink keeping the decisions within the retention
+// limits in memory and in an append-only JSON lines file, compacted once
+// it holds a tenth more than it should.
+type historyStore struct {
+	path       string
+	maxAge     time.Duration
+	maxRecords int
+	host       string
+
+	mu      sync.Mutex
+	f       *os.File
+	entries []historyEntry
+	// stale counts the entries of the file beyond the retention limits.
+	stale int
+}
+
+func newHistoryStore(c historyConf) (*historyStore, error) {
+	s := &historyStore{path: c.Path, maxAge: c.MaxAge, maxRecords: c.MaxRecords}
+	if s.path == "" {
+		s.path = defaultHistoryPath
+	}
+	if s.maxAge == 0 {
+		s.maxAge = defaultHistoryMaxAge
+	}
+	if s.maxRecords == 0 {
+		s.maxRecords = defaultHistoryMaxRecords
+	}
+	s.host, _ = os.Hostname()
+	if err := s.load(); err != nil {
+		return nil, fmt.Errorf("history: %v", err)
+	}
+	if err := s.compact(); err != nil {
+		return nil, fmt.Errorf("history: %v", err)
+	}
+	return s, nil
+}
+
+// load reads the entries of the file, skipping the lines it can't parse,
+// e.g. one truncated by a crash.
+func (s *historyStore) load() error {
+	f, err := os.Open(s.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	sc.Buffer(make([]byte, 64*1024), 1024*1024)
+	for sc.Scan() {
+		var e historyEntry
+		if err := json.Unmarshal(sc.Bytes(), &e); err != nil {
+			logrus.Warnf("history: skipping unreadable entry of %s: %v", s.path, err)
+			continue
+		}
+		s.entries = append(s.entries, e)
+	}
+	return sc.Err()
+}
+
+func (s *historyStore) send(rec *auditRecord) error {
+	data, err := json.Marshal(historyEntry{Host: s.host, auditRecord: *rec})
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, err := s.f.Write(append(data, '\n')); err != nil {
+		return err
+	}
+	s.entries = append(s.entries, historyEntry{Host: s.host, auditRecord: *rec})
+	s.expire()
+	if s.stale > s.maxRecords/10 {
+		return s.compact()
+	}
+	return nil
+}
+
+// expire drops the entries beyond the retention limits from memory. Must
+// be called with s.mu held.
+func (s *historyStore) expire() {
+	cutoff := time.Now().Add(-s.maxAge)
+	drop := 0
+	for drop < len(s.entries) && (len(s.entries)-drop > s.maxRecords || s.entries[drop].Time.Before(cutoff)) {
+		drop++
+	}
+	if drop > 0 {
+		s.entries = s.entries[drop:]
+		s.stale += drop
+	}
+}
+
+// compact rewrites the file with the entries within the retention limits
+// and reopens it. Must be called with s.mu held, or before s is shared.
+func (s *historyStore) compact() error {
+	s.expire()
+	if err := os.MkdirAll(filepath.Dir(s.path), 0700); err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+	for _, e := range s.entries {
+		if err := enc.Encode(e); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, s.path); err != nil {
+		return err
+	}
+	if s.f != nil {
+		s.f.Close()
+	}
+	if s.f, err = os.OpenFile(s.path, os.O_WRONLY|os.O_APPEND, 0600); err != nil {
+		return err
+	}
+	s.stale = 0
+	return nil
+}
+
+// historyQuery selects decisions. Empty fields match everything.
+type historyQuery struct {
+	// ID is the correlation ID of the request.
+	ID         string
+	Registry   string
+	Repository string
+	Digest     string
+	User       string
+	Host       string
+	// Action is pull or create.
+	Action  string
+	Allowed *bool
+	Since   time.Time
+	Limit   int
+}
+
+// parseHistoryQuery parses the parameters of a history request: id,
+// registry, repository, digest, user, host, action, allowed (true or
+// false), since (a duration, e.g. 24h, or an RFC 3339 time) and limit.
+func parseHistoryQuery(v url.Values) (historyQuery, error) {
+	q := historyQuery{
+		ID:         v.Get("id"),
+		Registry:   v.Get("registry"),
+		Repository: v.Get("repository"),
+		Digest:     v.Get("digest"),
+		User:       v.Get("user"),
+		Host:       v.Get("host"),
+		Action:     v.Get("action"),
+	}
+	if q.Registry != "" {
+		q.Registry = trust.NormalizeHostname(q.Registry)
+	}
+	switch q.Action {
+	case "", "pull", "create":
+	default:
+		return q, fmt.Errorf("invalid action %q, pull or create", q.Action)
+	}
+	if s := v.Get("allowed"); s != "" {
+		allowed, err := strconv.ParseBool(s)
+		if err != nil {
+			return q, fmt.Errorf("invalid allowed %q", s)
+		}
+		q.Allowed = &allowed
+	}
+	if s := v.Get("since"); s != "" {
+		if d, err := time.ParseDuration(s); err == nil {
+			q.Since = time.Now().Add(-d)
+		} else if q.Since, err = time.Parse(time.RFC3339, s); err != nil {
+			return q, fmt.Errorf("invalid since %q, a duration or an RFC 3339 time", s)
+		}
+	}
+	if s := v.Get("limit"); s != "" {
+		var err error
+		if q.Limit, err = strconv.Atoi(s); err != nil || q.Limit < 0 {
+			return q, fmt.Errorf("invalid limit %q", s)
+		}
+	}
+	return q, nil
+}
+
+func (q historyQuery) matches(e *historyEntry) bool {
+	if q.ID != "" && e.ID != q.ID {
+		return false
+	}
+	if q.Digest != "" && e.Digest != q.Digest {
+		return false
+	}
+	if q.User != "" && e.User != q.User {
+		return false
+	}
+	if q.Host != "" && e.Host != q.Host {
+		return false
+	}
+	if q.Allowed != nil && e.Allowed != *q.Allowed {
+		return false
+	}
+	if !q.Since.IsZero() && e.Time.Before(q.Since) {
+		return false
+	}
+	if q.Action != "" && recordAction(&e.auditRecord) != q.Action {
+		return false
+	}
+	if q.Registry != "" || q.Repository != "" {
+		ref, err := trust.ParseImageReference(e.Reference)
+		if err != nil {
+			return false
+		}
+		if q.Registry != "" && ref.Hostname() != q.Registry {
+			return false
+		}
+		if q.Repository != "" && ref.FullName() != q.Repository && ref.RemoteName() != q.Repository {
+			return false
+		}
+	}
+	return true
+}
+
+// query returns the entries matching q, the newest first.
+func (s *historyStore) query(q historyQuery) []historyEntry {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entries := []historyEntry{}
+	for i := len(s.entries) - 1; i >= 0; i-- {
+		if !q.matches(&s.entries[i]) {
+			continue
+		}
+		entries = append(entries, s.entries[i])
+		if q.Limit > 0 && len(entries) == q.Limit {
+			break
+		}
+	}
+	return entries
+}
+
+// historyHost is a host of the entries of a query.
+type historyHost struct {
+	Host     string    `json:"host"`
+	Count    int       `json:"count"`
+	LastSeen time.Time `json:"last_seen"`
+}
+
+// hosts returns the hosts of the entries matching q, by name.
+func (s *historyStore) hosts(q historyQuery) []historyHost {
+	q.Limit = 0
+	byHost := map[string]*historyHost{}
+	for _, e := range s.query(q) {
+		h, ok := byHost[e.Host]
+		if !ok {
+			h = &historyHost{Host: e.Host, LastSeen: e.Time}
+			byHost[e.Host] = h
+		}
+		h.Count++
+	}
+	hosts := []historyHost{}
+	for _, h := range byHost {
+		hosts = append(hosts, *h)
+	}
+	sort.Slice(hosts, func(i, j int) bool { return hosts[i].Host < hosts[j].Host })
+	return hosts
+}
+
+// len returns how many decisions the history holds.
+func (s *historyStore) len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.entries)
+}
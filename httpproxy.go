@@ -0,0 +1,161 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// proxyDirect is the proxy of a registry override connecting to the
+// registry directly.
+const proxyDirect = "direct"
+
+// proxyConf sets the HTTP(S) proxies of the outbound connections of the
+// plugin, replacing the HTTP_PROXY, HTTPS_PROXY and NO_PROXY environment
+// variables.
+type proxyConf struct {
+	// HTTPProxy and HTTPSProxy are the proxies of the http:// and https://
+	// requests, none if empty.
+	HTTPProxy  string `yaml:"http-proxy"`
+	HTTPSProxy string `yaml:"https-proxy"`
+	// NoProxy lists the hosts connected to directly, comma separated like
+	// NO_PROXY: "example.com" matches it and its subdomains,
+	// ".example.com" only its subdomains, and "10.0.0.0/8" the IPs in the
+	// network. "*" disables the proxies.
+	NoProxy string `yaml:"no-proxy"`
+}
+
+func (c *proxyConf) validate() error {
+	for _, p := range []string{c.HTTPProxy, c.HTTPSProxy} {
+		if _, err := parseProxy(p); err != nil {
+			return fmt.Errorf("proxy: %v", err)
+		}
+	}
+	return nil
+}
+
+// parseProxy parses the proxy address s, http:// if it has no scheme, nil
+// if s is empty.
+func parseProxy(s string) (*url.URL, error) {
+	if s == "" {
+		return nil, nil
+	}
+	if !strings.Contains(s, "://") {
+		s = "http://" + s
+	}
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxy address %q: %v", s, err)
+	}
+	switch u.Scheme {
+	case "http", "https", "socks5":
+	default:
+		return nil, fmt.Errorf("invalid proxy address %q: unsupported scheme %s", s, u.Scheme)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("invalid proxy address %q: no host", s)
+	}
+	return u, nil
+}
+
+// setupProxy makes http.DefaultTransport, and the transports following it,
+// pick the proxy of each request from the configuration config returns, so
+// that it's changed on reload.
+func setupProxy(config func() conf) {
+	tr, ok := http.DefaultTransport.(*http.Transport)
+	if !ok {
+		return
+	}
+	tr.Proxy = func(req *http.Request) (*url.URL, error) {
+		return proxyFor(config(), req)
+	}
+}
+
+// defaultTransportProxy is the proxy of http.DefaultTransport, for the
+// transports of the plugin which can't be cloned from it.
+func defaultTransportProxy(req *http.Request) (*url.URL, error) {
+	if tr, ok := http.DefaultTransport.(*http.Transport); ok && tr.Proxy != nil {
+		return tr.Proxy(req)
+	}
+	return nil, nil
+}
+
+// proxyFor returns the proxy req goes through with cfg: the proxy of the
+// registry override of its host, else the one of the registry it's made
+// for, else the one of the proxy settings, else the one of the environment.
+// Requests to loopback addresses are never proxied.
+func proxyFor(cfg conf, req *http.Request) (*url.URL, error) {
+	host := req.URL.Hostname()
+	if host == "localhost" {
+		return nil, nil
+	}
+	if ip := net.ParseIP(host); ip != nil && ip.IsLoopback() {
+		return nil, nil
+	}
+	p := cfg.Registries.overrideFor(registryHost(req.URL.Host)).Proxy
+	if registry, ok := req.Context().Value(registryKey{}).(string); ok && p == "" {
+		p = cfg.Registries.overrideFor(registryHost(registry)).Proxy
+	}
+	if p != "" {
+		if p == proxyDirect {
+			return nil, nil
+		}
+		return parseProxy(p)
+	}
+	c := cfg.Proxy
+	if c == nil {
+		return http.ProxyFromEnvironment(req)
+	}
+	if noProxy(c.NoProxy, req.URL) {
+		return nil, nil
+	}
+	if req.URL.Scheme == "https" {
+		return parseProxy(c.HTTPSProxy)
+	}
+	return parseProxy(c.HTTPProxy)
+}
+
+// noProxy tells whether u matches the no-proxy list.
+func noProxy(list string, u *url.URL) bool {
+	host, port := strings.TrimSuffix(strings.ToLower(u.Hostname()), "."), u.Port()
+	ip := net.ParseIP(host)
+	for _, e := range strings.Split(list, ",") {
+		e = strings.ToLower(strings.TrimSpace(e))
+		if e == "" {
+			continue
+		}
+		if e == "*" {
+			return true
+		}
+		if _, network, err := net.ParseCIDR(e); err == nil {
+			if ip != nil && network.Contains(ip) {
+				return true
+			}
+			continue
+		}
+		if h, p, err := net.SplitHostPort(e); err == nil {
+			if p != port {
+				continue
+			}
+			e = h
+		}
+		if eip := net.ParseIP(e); eip != nil {
+			if ip != nil && eip.Equal(ip) {
+				return true
+			}
+			continue
+		}
+		if strings.HasPrefix(e, ".") {
+			if strings.HasSuffix(host, e) {
+				return true
+			}
+			continue
+		}
+		if host == e || strings.HasSuffix(host, "."+e) {
+			return true
+		}
+	}
+	return false
+}
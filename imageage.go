@@ -0,0 +1,37 @@
+package main
+
+import (
+	"time"
+
+	"github.com/containers/image/types"
+	"github.com/docker/docker/reference"
+)
+
+// maxImageAge returns the maximum age of the images of ref, 0 if they may
+// be of any age.
+func (c conf) maxImageAge(ref reference.Named) time.Duration {
+	if o := c.override(ref); o.MaxImageAge != nil {
+		return *o.MaxImageAge
+	}
+	return c.MaxImageAge
+}
+
+// checkImageAge denies img, pulled as ref, if it was created longer ago
+// than the maximum image age of ref.
+func checkImageAge(cfg conf, ref reference.Named, img types.Image) *trustError {
+	maxAge := cfg.maxImageAge(ref)
+	if maxAge <= 0 {
+		return nil
+	}
+	info, err := img.Inspect()
+	if err != nil {
+		return wrapError(codeRegistryError, err)
+	}
+	if info.Created.IsZero() {
+		return newTrustError(codeImageTooOld, "%s has no creation time, images must be newer than %s", ref, maxAge)
+	}
+	if age := time.Since(info.Created); age > maxAge {
+		return newTrustError(codeImageTooOld, "%s was created %s, images must be newer than %s", ref, info.Created.UTC().Format(time.RFC3339), maxAge)
+	}
+	return nil
+}
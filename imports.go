@@ -0,0 +1,51 @@
+package main
+
+import (
+	"net/url"
+
+	"github.com/docker/go-plugins-helpers/authorization"
+	"github.com/projectatomic/container-trust-plugin/pkg/trust"
+)
+
+// importExemptConf lists who may import images and from where.
+type importExemptConf struct {
+	// Users allowed to import from anywhere.
+	Users []string `yaml:"users"`
+	// Sources are the hosts anyone may import from.
+	Sources []string `yaml:"sources"`
+}
+
+// load gates docker load: tarballs carry no signatures, so loaded images
+// can't be verified.
+func (p *trustPlugin) load(snap *snapshot, req authorization.Request, m routeMatch, rec *auditRecord) authorization.Response {
+	rec.intercepted = true
+	if !snap.config.AllowLoad {
+		return newTrustError(codeUnverifiable, "loading images from tarballs is disabled, their signatures can't be verified").response()
+	}
+	return authorization.Response{Allow: true}
+}
+
+// importImage gates docker import, which creates an image from a plain
+// filesystem tarball: only exempt users, or imports from exempt hosts, are
+// allowed.
+func (p *trustPlugin) importImage(snap *snapshot, req authorization.Request, m routeMatch, rec *auditRecord) authorization.Response {
+	rec.intercepted = true
+	src := m.query.Get("fromSrc")
+	rec.Reference = src
+	exempt := snap.config.ImportExempt
+	for _, user := range exempt.Users {
+		if user == req.User {
+			return authorization.Response{Allow: true}
+		}
+	}
+	if src != "-" {
+		if su, err := url.Parse(src); err == nil {
+			for _, host := range exempt.Sources {
+				if trust.NormalizeHostname(su.Host) == trust.NormalizeHostname(host) {
+					return authorization.Response{Allow: true}
+				}
+			}
+		}
+	}
+	return newTrustError(codeUnverifiable, "importing images from %s isn't allowed, their signatures can't be verified", src).response()
+}
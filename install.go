@@ -0,0 +1,115 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+)
+
+const pluginName = "container-trust-plugin"
+
+// dockerDropIn orders the docker daemon after the plugin so that the daemon
+// never starts serving requests while the plugin isn't there to answer them.
+const dockerDropIn = `# Generated by ` + pluginName + ` install, do not edit.
+[Unit]
+Wants=%[1]s.socket %[1]s.service
+After=%[1]s.socket %[1]s.service
+`
+
+type installPaths struct {
+	specDir   string
+	dropInDir string
+}
+
+func (i installPaths) spec() string {
+	return filepath.Join(i.specDir, pluginName+".spec")
+}
+
+func (i installPaths) dropIn() string {
+	return filepath.Join(i.dropInDir, pluginName+".conf")
+}
+
+func parseInstallFlags(name string, args []string) (installPaths, error) {
+	var paths installPaths
+	if *flManaged {
+		return paths, fmt.Errorf("%s: the managed plugin is installed with docker plugin install", name)
+	}
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.StringVar(&paths.specDir, "spec-dir", defaultPluginSpecDir, "Directory where docker looks for plugin spec files")
+	fs.StringVar(&paths.dropInDir, "systemd-dir", defaultDockerDropInDir, "Drop-in directory of the docker systemd unit")
+	if err := fs.Parse(args); err != nil {
+		return paths, err
+	}
+	return paths, nil
+}
+
+// runInstall writes the plugin spec file pointing docker to the plugin
+// socket and, unless on Windows, a systemd drop-in ordering docker after
+// the plugin.
+func runInstall(args []string) error {
+	paths, err := parseInstallFlags("install", args)
+	if err != nil {
+		return err
+	}
+	cfg, err := loadConfig(*flConfig)
+	if err != nil {
+		logrus.Warnf("using the default plugin socket: %v", err)
+	}
+	var socket string
+	for _, s := range pluginSockets(cfg) {
+		if !strings.HasPrefix(s, "tcp://") {
+			socket = s
+			break
+		}
+	}
+	if socket == "" {
+		return errors.New("install sets up local daemons, the plugin doesn't serve on any local socket")
+	}
+	if !strings.HasPrefix(socket, "npipe://") && !strings.HasPrefix(socket, "unix://") {
+		socket = "unix://" + socket
+	}
+	if err := writeFile(paths.spec(), socket+"\n"); err != nil {
+		return err
+	}
+	if paths.dropInDir == "" {
+		logrus.Infof("installed %s, restart docker to apply", paths.spec())
+		return nil
+	}
+	if err := writeFile(paths.dropIn(), fmt.Sprintf(dockerDropIn, pluginName)); err != nil {
+		return err
+	}
+	logrus.Infof("installed %s and %s, run 'systemctl daemon-reload' to apply", paths.spec(), paths.dropIn())
+	return nil
+}
+
+// runUninstall removes whatever runInstall created.
+func runUninstall(args []string) error {
+	paths, err := parseInstallFlags("uninstall", args)
+	if err != nil {
+		return err
+	}
+	files := []string{paths.spec()}
+	if paths.dropInDir != "" {
+		files = append(files, paths.dropIn())
+	}
+	for _, f := range files {
+		if err := os.Remove(f); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	logrus.Infof("removed %s, restart docker or run 'systemctl daemon-reload' to apply", strings.Join(files, " and "))
+	return nil
+}
+
+func writeFile(path, content string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, []byte(content), 0644)
+}
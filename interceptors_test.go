@@ -0,0 +1,349 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/docker/go-plugins-helpers/authorization"
+	"github.com/projectatomic/container-trust-plugin/pkg/trust"
+)
+
+// newTestDaemon serves a docker daemon which has no images and no
+// containers, and sets it as the daemon of p.
+func newTestDaemon(t *testing.T, p *trustPlugin) {
+	newTestDaemonWith(t, p, nil)
+}
+
+// newTestDaemonWith serves a docker daemon answering the API paths of
+// objects, without their version prefix, with their JSON, and sets it as the
+// daemon of p. Anything else isn't found.
+func newTestDaemonWith(t *testing.T, p *trustPlugin, objects map[string]string) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		path, _, err := apiPath(r.URL.RequestURI())
+		if data, ok := objects[path]; ok && err == nil {
+			w.Write([]byte(data))
+			return
+		}
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(`{"message":"not found"}`))
+	}))
+	t.Cleanup(srv.Close)
+	client, err := newDockerClient("tcp://"+strings.TrimPrefix(srv.URL, "http://"), "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.client = client
+}
+
+// interceptorNamed returns the first interceptor of the pipeline named name.
+func interceptorNamed(t *testing.T, name string) interceptor {
+	for _, i := range interceptors {
+		if i.Name() == name {
+			return i
+		}
+	}
+	t.Fatalf("no %s interceptor", name)
+	return nil
+}
+
+func TestRouteMatch(t *testing.T) {
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		match  bool
+	}{
+		{"pull", "POST", "/images/create", true},
+		{"pull", "GET", "/images/create", false},
+		{"pull", "POST", "/images/create/x", false},
+		// Routes match paths stripped of their version prefix already.
+		{"pull", "POST", "/v1.24/images/create", false},
+		{"load", "POST", "/images/load", true},
+		{"tag", "POST", "/images/example.com/app/tag", true},
+		{"tag", "POST", "/images/tag", false},
+		{"push", "POST", "/images/app/push", true},
+		{"rmi", "DELETE", "/images/example.com/app:1", true},
+		{"rmi", "POST", "/images/app", false},
+		{"create", "POST", "/containers/create", true},
+		{"start", "POST", "/containers/web/start", true},
+		{"start", "POST", "/containers/a/b/start", false},
+		{"exec", "POST", "/containers/web/exec", true},
+		{"exec", "POST", "/containers/web/attach", true},
+		{"exec", "GET", "/containers/web/attach", false},
+		{"attach", "GET", "/containers/web/attach/ws", true},
+		{"build", "POST", "/build", true},
+		{"build", "POST", "/build/prune", false},
+		{"commit", "POST", "/commit", true},
+		{"service", "POST", "/services/create", true},
+		{"plugin", "POST", "/plugins/pull", true},
+		{"plugin", "POST", "/plugins/vieux/sshfs/enable", false},
+	}
+	for _, tt := range tests {
+		i := interceptorNamed(t, tt.name)
+		query := url.Values{"q": {"v"}}
+		m, ok := i.Match(authorization.Request{RequestMethod: tt.method}, tt.path, query)
+		if ok != tt.match {
+			t.Errorf("%s interceptor match of %s %s = %t, want %t", tt.name, tt.method, tt.path, ok, tt.match)
+			continue
+		}
+		if ok && m.query.Get("q") != "v" {
+			t.Errorf("%s interceptor match of %s %s lost the query", tt.name, tt.method, tt.path)
+		}
+	}
+}
+
+func TestInterceptorHandle(t *testing.T) {
+	tests := []struct {
+		desc  string
+		cfg   conf
+		req   authorization.Request
+		allow bool
+		code  string
+	}{
+		{
+			desc: "pull of an invalid reference",
+			req:  authorization.Request{RequestMethod: "POST", RequestURI: "/images/create?fromImage=Busybox"},
+			code: codeInvalidReference,
+		},
+		{
+			desc: "pull of all tags",
+			req:  authorization.Request{RequestMethod: "POST", RequestURI: "/images/create?fromImage=example.com/app"},
+			code: codeAllTags,
+		},
+		{
+			desc: "pull from a denied registry",
+			cfg:  conf{Registries: registriesConf{Deny: []string{"example.com"}}},
+			req:  authorization.Request{RequestMethod: "POST", RequestURI: "/images/create?fromImage=example.com/app&tag=1"},
+			code: codeRegistryNotAllowed,
+		},
+		{
+			desc: "pull from a registry not allowed",
+			cfg:  conf{Registries: registriesConf{Allow: []string{"registry.example.com"}}},
+			req:  authorization.Request{RequestMethod: "POST", RequestURI: "/images/create?fromImage=example.com/app:1"},
+			code: codeRegistryNotAllowed,
+		},
+		{
+			desc: "import",
+			req:  authorization.Request{RequestMethod: "POST", RequestURI: "/images/create?fromSrc=-&repo=imported"},
+			code: codeUnverifiable,
+		},
+		{
+			desc:  "import by an exempt user",
+			cfg:   conf{ImportExempt: importExemptConf{Users: []string{"builder"}}},
+			req:   authorization.Request{User: "builder", RequestMethod: "POST", RequestURI: "/images/create?fromSrc=-"},
+			allow: true,
+		},
+		{
+			desc:  "import from an exempt source",
+			cfg:   conf{ImportExempt: importExemptConf{Sources: []string{"Files.Example.com"}}},
+			req:   authorization.Request{RequestMethod: "POST", RequestURI: "/images/create?fromSrc=https://files.example.com/rootfs.tar"},
+			allow: true,
+		},
+		{
+			desc: "load",
+			req:  authorization.Request{RequestMethod: "POST", RequestURI: "/images/load"},
+			code: codeUnverifiable,
+		},
+		{
+			desc:  "load allowed",
+			cfg:   conf{AllowLoad: true},
+			req:   authorization.Request{RequestMethod: "POST", RequestURI: "/images/load"},
+			allow: true,
+		},
+		{
+			desc:  "tag outside the protected namespaces",
+			req:   authorization.Request{RequestMethod: "POST", RequestURI: "/images/app/tag?repo=example.com/app"},
+			allow: true,
+		},
+		{
+			desc:  "push to a registry without signed pushes",
+			req:   authorization.Request{RequestMethod: "POST", RequestURI: "/images/example.com/app/push?tag=1"},
+			allow: true,
+		},
+		{
+			desc:  "removal of an image missing from the daemon",
+			cfg:   conf{ProtectPinnedImages: true},
+			req:   authorization.Request{RequestMethod: "DELETE", RequestURI: "/images/example.com/app:1"},
+			allow: true,
+		},
+		{
+			desc: "create without an image",
+			req:  authorization.Request{RequestMethod: "POST", RequestURI: "/containers/create", RequestBody: []byte(`{}`)},
+			code: codeInvalidRequest,
+		},
+		{
+			desc: "create with a malformed body",
+			req:  authorization.Request{RequestMethod: "POST", RequestURI: "/containers/create", RequestBody: []byte(`{`)},
+			code: codeInvalidRequest,
+		},
+		{
+			desc:  "create from an image missing from the daemon",
+			req:   authorization.Request{RequestMethod: "POST", RequestURI: "/containers/create", RequestBody: []byte(`{"Image":"example.com/app:1"}`)},
+			allow: true,
+		},
+		{
+			desc:  "start without verify-on-start",
+			req:   authorization.Request{RequestMethod: "POST", RequestURI: "/containers/web/start"},
+			allow: true,
+		},
+		{
+			desc:  "start of a container missing from the daemon",
+			cfg:   conf{VerifyOnStart: true},
+			req:   authorization.Request{RequestMethod: "POST", RequestURI: "/containers/web/start"},
+			allow: true,
+		},
+		{
+			desc:  "exec without quarantine",
+			req:   authorization.Request{RequestMethod: "POST", RequestURI: "/containers/web/exec"},
+			allow: true,
+		},
+		{
+			desc:  "exec into a container missing from the daemon",
+			cfg:   conf{Quarantine: &quarantineConf{DenyExec: true}},
+			req:   authorization.Request{RequestMethod: "GET", RequestURI: "/containers/web/attach/ws"},
+			allow: true,
+		},
+		{
+			desc: "build with BuildKit",
+			req:  authorization.Request{RequestMethod: "POST", RequestURI: "/build?version=2"},
+			code: codeUnverifiable,
+		},
+		{
+			desc: "build without its context",
+			req:  authorization.Request{RequestMethod: "POST", RequestURI: "/build?t=app"},
+			code: codeUnverifiable,
+		},
+		{
+			desc:  "unchecked build",
+			cfg:   conf{AllowUncheckedBuilds: true},
+			req:   authorization.Request{RequestMethod: "POST", RequestURI: "/build?t=app"},
+			allow: true,
+		},
+		{
+			desc:  "commit",
+			req:   authorization.Request{RequestMethod: "POST", RequestURI: "/commit?container=web&repo=example.com/app"},
+			allow: true,
+		},
+		{
+			desc: "commit denied",
+			cfg:  conf{Commit: commitConf{Mode: commitDeny}},
+			req:  authorization.Request{RequestMethod: "POST", RequestURI: "/commit?container=web&repo=example.com/app"},
+			code: codeUnverifiable,
+		},
+		{
+			desc:  "commit in the namespace",
+			cfg:   conf{Commit: commitConf{Mode: commitNamespace, Namespace: "example.com/scratch"}},
+			req:   authorization.Request{RequestMethod: "POST", RequestURI: "/commit?container=web&repo=example.com/scratch/app"},
+			allow: true,
+		},
+		{
+			desc: "commit outside the namespace",
+			cfg:  conf{Commit: commitConf{Mode: commitNamespace, Namespace: "example.com/scratch"}},
+			req:  authorization.Request{RequestMethod: "POST", RequestURI: "/commit?container=web&repo=example.com/app"},
+			code: codeUnverifiable,
+		},
+		{
+			desc: "service without an image",
+			req:  authorization.Request{RequestMethod: "POST", RequestURI: "/services/create", RequestBody: []byte(`{"TaskTemplate":{"ContainerSpec":{}}}`)},
+			code: codeInvalidRequest,
+		},
+		{
+			desc: "service update with an invalid image",
+			req:  authorization.Request{RequestMethod: "POST", RequestURI: "/services/web/update?version=3", RequestBody: []byte(`{"TaskTemplate":{"ContainerSpec":{"Image":"Example.com/App"}}}`)},
+			code: codeInvalidReference,
+		},
+		{
+			desc:  "plugin without signatures required",
+			req:   authorization.Request{RequestMethod: "POST", RequestURI: "/plugins/pull?remote=vieux/sshfs"},
+			allow: true,
+		},
+		{
+			desc: "plugin without a remote",
+			cfg:  conf{RequirePluginSignatures: true},
+			req:  authorization.Request{RequestMethod: "POST", RequestURI: "/plugins/pull"},
+			code: codeInvalidRequest,
+		},
+		{
+			desc: "plugin upgrade to an invalid remote",
+			cfg:  conf{RequirePluginSignatures: true},
+			req:  authorization.Request{RequestMethod: "POST", RequestURI: "/plugins/vieux/sshfs/upgrade?remote=Vieux/sshfs"},
+			code: codeInvalidReference,
+		},
+		{
+			desc:  "plugin creation without signatures required",
+			req:   authorization.Request{RequestMethod: "POST", RequestURI: "/plugins/create?name=sshfs"},
+			allow: true,
+		},
+		{
+			desc: "plugin creation",
+			cfg:  conf{RequirePluginSignatures: true},
+			req:  authorization.Request{RequestMethod: "POST", RequestURI: "/plugins/create?name=sshfs"},
+			code: codeUnverifiable,
+		},
+		{
+			desc:  "plugin creation with load allowed",
+			cfg:   conf{RequirePluginSignatures: true, AllowLoad: true},
+			req:   authorization.Request{RequestMethod: "POST", RequestURI: "/plugins/create?name=sshfs"},
+			allow: true,
+		},
+	}
+	for _, tt := range tests {
+		p := newTestPlugin(tt.cfg)
+		newTestDaemon(t, p)
+		for _, version := range apiVersions {
+			req := tt.req
+			req.RequestURI = version + req.RequestURI
+			i, m, err := intercept(req)
+			if err != nil || i == nil {
+				t.Fatalf("%s: %s %s not intercepted (%v)", tt.desc, req.RequestMethod, req.RequestURI, err)
+			}
+			res := i.Handle(p, p.snapshots.load(), req, m, newAuditRecord(req))
+			if res.Allow != tt.allow {
+				t.Errorf("%s: %s %s allowed %t, want %t (%s)", tt.desc, req.RequestMethod, req.RequestURI, res.Allow, tt.allow, res.Err)
+				continue
+			}
+			if tt.code != "" && !strings.HasPrefix(res.Err, tt.code+": ") {
+				t.Errorf("%s: %s %s denied with %q, want code %s", tt.desc, req.RequestMethod, req.RequestURI, res.Err, tt.code)
+			}
+		}
+	}
+}
+
+func TestContainerStartBuiltImage(t *testing.T) {
+	// web runs an image built from a pulled one without adding layers,
+	// which has no repository digests of its own.
+	objects := map[string]string{
+		"/containers/web/json":      `{"Id": "c1", "Image": "sha256:built", "Config": {"Image": "example.com/app:built"}}`,
+		"/images/sha256:built/json": `{"Id": "sha256:built", "Parent": "sha256:base", "RootFS": {"Type": "layers", "Layers": ["sha256:l1"]}}`,
+		"/images/sha256:base/json":  `{"Id": "sha256:base", "RepoDigests": ["example.com/app@` + testImageDigest + `"], "RootFS": {"Type": "layers", "Layers": ["sha256:l1"]}}`,
+	}
+	now := time.Now()
+	cfg := conf{Freezes: []freezeWindow{{Name: "release", From: now.Add(-time.Hour), Until: now.Add(time.Hour)}}}
+	req := authorization.Request{RequestMethod: "POST", RequestURI: "/v1.40/containers/web/start"}
+	i, m, err := intercept(req)
+	if err != nil || i == nil {
+		t.Fatalf("start not intercepted (%v)", err)
+	}
+
+	p := newTestPlugin(cfg)
+	newTestDaemonWith(t, p, objects)
+	res := i.Handle(p, p.snapshots.load(), req, m, newAuditRecord(req))
+	if res.Allow || !strings.HasPrefix(res.Err, codeChangeFreeze+": ") {
+		t.Errorf("unpinned base image during a freeze: allowed %t (%s), want %s", res.Allow, res.Err, codeChangeFreeze)
+	}
+
+	ref, err := trust.ParseImageReference("example.com/app:1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.pins.set(ref, testImageDigest)
+	res = i.Handle(p, p.snapshots.load(), req, m, newAuditRecord(req))
+	if !res.Allow {
+		t.Errorf("pinned base image during a freeze denied: %s", res.Err)
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/docker/go-plugins-helpers/authorization"
+)
+
+// clientTimeoutMargin is how long before the daemon gives up on the plugin
+// we answer, leaving time for the response to get there.
+const clientTimeoutMargin = 2 * time.Second
+
+// pendingDecision is a decision still being taken after its request was
+// answered because it took too long.
+type pendingDecision struct {
+	done chan struct{}
+	res  authorization.Response
+}
+
+// pendingDecisions are keyed by pendingKey, so that the retry of a request
+// joins the decision still being taken for the first attempt. Decisions are
+// forgotten as soon as they're taken, the retries coming later are decided
+// again from the caches.
+type pendingDecisions struct {
+	mu      sync.Mutex
+	pending map[string]*pendingDecision
+}
+
+// len returns how many decisions are still being taken in the background.
+func (p *pendingDecisions) len() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.pending)
+}
+
+func newPendingDecisions() *pendingDecisions {
+	return &pendingDecisions{pending: make(map[string]*pendingDecision)}
+}
+
+// forget drops d unless it has already been replaced.
+func (p *pendingDecisions) forget(key string, d *pendingDecision) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.pending[key] == d {
+		delete(p.pending, key)
+	}
+}
+
+// decideWithin answers req before the daemon's plugin timeout expires. If
+// the decision isn't taken by then, it goes on in the background and the
+// client is told to retry: nothing is allowed before its decision is taken.
+func (p *trustPlugin) decideWithin(req authorization.Request, timeout time.Duration) authorization.Response {
+	key := pendingKey(req, p.snapshots.load().fingerprint)
+	p.pending.mu.Lock()
+	d, ok := p.pending.pending[key]
+	if !ok {
+		d = &pendingDecision{done: make(chan struct{})}
+		p.pending.pending[key] = d
+		go func() {
+			d.res = p.decide(req)
+			close(d.done)
+			p.pending.forget(key, d)
+		}()
+	}
+	p.pending.mu.Unlock()
+
+	wait := timeout - clientTimeoutMargin
+	if wait <= 0 {
+		wait = timeout
+	}
+	select {
+	case <-d.done:
+		return d.res
+	case <-time.After(wait):
+	}
+
+	logrus.Infof("%s %s is taking long, asking the client to retry", req.RequestMethod, req.RequestURI)
+	return newTrustError(codeVerificationPending, "verification is still in progress, retry the same command in a moment").response()
+}
+
+// pendingKey identifies req for pendingDecisions: the decision taken for a
+// request only stands for the same request of the same user, with the same
+// body and registry credentials, under the same snapshot.
+func pendingKey(req authorization.Request, fingerprint string) string {
+	h := sha256.New()
+	for _, s := range []string{fingerprint, req.User, req.UserAuthNMethod, req.RequestMethod, req.RequestURI, requestHeader(req, "X-Registry-Auth")} {
+		h.Write([]byte(s))
+		h.Write([]byte{0})
+	}
+	h.Write(req.RequestBody)
+	return hex.EncodeToString(h.Sum(nil))
+}
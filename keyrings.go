@@ -0,0 +1,109 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"runtime"
+	"sync"
+
+	"github.com/containers/image/signature"
+)
+
+// keyringHome is a GPG home holding the keys of a single keyring.
+type keyringHome struct {
+	once sync.Once
+	dir  string
+	// trusted are the fingerprints of the keys of the keyring.
+	trusted []string
+	err     error
+}
+
+// importKeyring returns a new GPG home holding the keys of keyring, which
+// the caller removes.
+func importKeyring(keyring []byte) (*keyringHome, error) {
+	h := &keyringHome{}
+	h.importKeys(keyring)
+	return h, h.err
+}
+
+func (h *keyringHome) importKeys(keyring []byte) {
+	if h.dir, h.err = ioutil.TempDir("", "container-trust-plugin-"); h.err != nil {
+		return
+	}
+	mech, err := signature.NewGPGSigningMechanismInDirectory(h.dir)
+	if err != nil {
+		h.err = err
+		return
+	}
+	h.trusted, h.err = mech.ImportKeysFromBytes(keyring)
+}
+
+// remove removes the GPG home.
+func (h *keyringHome) remove() {
+	if h.dir != "" {
+		os.RemoveAll(h.dir)
+	}
+}
+
+// verify verifies signed with the keys of the keyring only and returns the
+// signed contents and the fingerprint of the key which signed them. Each
+// verification has a GPG context of its own, so that they run concurrently.
+func (h *keyringHome) verify(signed []byte) ([]byte, string, error) {
+	if h.err != nil {
+		return nil, "", h.err
+	}
+	mech, err := signature.NewGPGSigningMechanismInDirectory(h.dir)
+	if err != nil {
+		return nil, "", err
+	}
+	contents, keyIdentity, err := mech.Verify(signed)
+	if err != nil {
+		return nil, "", err
+	}
+	for _, t := range h.trusted {
+		if t == keyIdentity {
+			return contents, keyIdentity, nil
+		}
+	}
+	return nil, "", fmt.Errorf("signed by untrusted key %s", keyIdentity)
+}
+
+// keyrings are the GPG homes of the keyrings a snapshot verifies signatures
+// with, by contents, each imported once on first use and removed along
+// with the snapshot.
+type keyrings struct {
+	mu    sync.Mutex
+	homes map[[sha256.Size]byte]*keyringHome
+}
+
+func newKeyrings() *keyrings {
+	k := &keyrings{homes: make(map[[sha256.Size]byte]*keyringHome)}
+	runtime.SetFinalizer(k, (*keyrings).remove)
+	return k
+}
+
+// home returns the GPG home of keyring.
+func (k *keyrings) home(keyring []byte) *keyringHome {
+	sum := sha256.Sum256(keyring)
+	k.mu.Lock()
+	h, ok := k.homes[sum]
+	if !ok {
+		h = &keyringHome{}
+		k.homes[sum] = h
+	}
+	k.mu.Unlock()
+	h.once.Do(func() { h.importKeys(keyring) })
+	return h
+}
+
+// remove removes the GPG homes.
+func (k *keyrings) remove() {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	for sum, h := range k.homes {
+		h.remove()
+		delete(k.homes, sum)
+	}
+}
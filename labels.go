@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+
+	"github.com/containers/image/types"
+	"github.com/docker/docker/reference"
+)
+
+// labelRule requires the images of Repositories, all of them if empty, to
+// carry Labels, mapping label names to regular expressions their values
+// must match, "" for any value.
+type labelRule struct {
+	Repositories []string          `yaml:"repositories"`
+	Labels       map[string]string `yaml:"labels"`
+}
+
+func (r labelRule) validate() error {
+	for name, expr := range r.Labels {
+		if _, err := regexp.Compile(expr); err != nil {
+			return fmt.Errorf("required-labels: %s: %v", name, err)
+		}
+	}
+	return nil
+}
+
+func (r labelRule) applies(ref reference.Named) bool {
+	if len(r.Repositories) == 0 {
+		return true
+	}
+	for _, pattern := range r.Repositories {
+		if matchRepository(pattern, ref.FullName()) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkLabels denies img, pulled as ref, unless its configuration has the
+// labels of every rule applying to ref.
+func checkLabels(rules []labelRule, ref reference.Named, img types.Image) *trustError {
+	var labels map[string]string
+	for _, r := range rules {
+		if !r.applies(ref) {
+			continue
+		}
+		if labels == nil {
+			info, err := img.Inspect()
+			if err != nil {
+				return wrapError(codeRegistryError, err)
+			}
+			labels = info.Labels
+			if labels == nil {
+				labels = map[string]string{}
+			}
+		}
+		names := make([]string, 0, len(r.Labels))
+		for name := range r.Labels {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			value, ok := labels[name]
+			if !ok {
+				return newTrustError(codeLabelMissing, "%s has no label %s", ref, name)
+			}
+			if ok, _ := regexp.MatchString(r.Labels[name], value); !ok {
+				return newTrustError(codeLabelMissing, "label %s=%q of %s doesn't match %q", name, value, ref, r.Labels[name])
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/docker/go-plugins-helpers/authorization"
+)
+
+// pluginSockets returns the sockets the plugin serves on: the one docker
+// expects of a managed plugin, else the --socket flags, else the sockets of
+// cfg, else the default one.
+func pluginSockets(cfg conf) []string {
+	if *flManaged {
+		if len(flSockets) > 0 || len(cfg.Sockets) > 0 {
+			logrus.Warnf("managed plugin, serving on %s only", managedSocket())
+		}
+		return []string{managedSocket()}
+	}
+	if len(flSockets) > 0 {
+		return flSockets
+	}
+	if len(cfg.Sockets) > 0 {
+		return cfg.Sockets
+	}
+	return []string{defaultPluginSocket}
+}
+
+// listenTLSConf is the TLS configuration of the TCP sockets of the plugin,
+// which require client certificates signed by ClientCA.
+type listenTLSConf struct {
+	Cert     string `yaml:"cert"`
+	Key      string `yaml:"key"`
+	ClientCA string `yaml:"client-ca"`
+}
+
+func (c listenTLSConf) config() (*tls.Config, error) {
+	if c.Cert == "" || c.Key == "" || c.ClientCA == "" {
+		return nil, errors.New("listen-tls: cert, key and client-ca are required to serve on TCP")
+	}
+	cert, err := tls.LoadX509KeyPair(c.Cert, c.Key)
+	if err != nil {
+		return nil, fmt.Errorf("listen-tls: %v", err)
+	}
+	pem, err := ioutil.ReadFile(c.ClientCA)
+	if err != nil {
+		return nil, fmt.Errorf("listen-tls: %v", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("listen-tls: no certificate in %s", c.ClientCA)
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientCAs:    pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
+
+// pluginListeners returns the listeners of the sockets passed by systemd
+// socket activation if any, listeners on the sockets of cfg otherwise:
+// local sockets, or TCP ones, tcp://host:port, with mutual TLS.
+func pluginListeners(cfg conf) ([]net.Listener, error) {
+	listeners, err := activatedListeners()
+	if err != nil {
+		return nil, err
+	}
+	if len(listeners) > 0 {
+		logrus.Infof("serving on %d sockets passed by systemd", len(listeners))
+		return listeners, nil
+	}
+	for _, addr := range pluginSockets(cfg) {
+		if strings.HasPrefix(addr, "tcp://") {
+			tlsc, err := cfg.ListenTLS.config()
+			if err != nil {
+				return nil, err
+			}
+			l, err := net.Listen("tcp", strings.TrimPrefix(addr, "tcp://"))
+			if err != nil {
+				return nil, err
+			}
+			listeners = append(listeners, tls.NewListener(l, tlsc))
+			continue
+		}
+		l, err := localListener(addr)
+		if err != nil {
+			return nil, err
+		}
+		listeners = append(listeners, l)
+	}
+	return listeners, nil
+}
+
+// servePlugin serves h on every listener and returns as soon as one of them
+// fails.
+func servePlugin(h *authorization.Handler, listeners []net.Listener) error {
+	errs := make(chan error, len(listeners))
+	for _, l := range listeners {
+		logrus.Infof("serving on %s", l.Addr())
+		go func(l net.Listener) {
+			errs <- h.Serve(l)
+		}(l)
+	}
+	return <-errs
+}
@@ -0,0 +1,52 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/coreos/go-systemd/activation"
+	"github.com/docker/go-connections/sockets"
+)
+
+// activatedListeners returns the listeners of the sockets passed by systemd
+// socket activation.
+func activatedListeners() ([]net.Listener, error) {
+	activated, err := activation.Listeners(true)
+	if err != nil {
+		return nil, err
+	}
+	var listeners []net.Listener
+	for _, l := range activated {
+		if l != nil {
+			listeners = append(listeners, l)
+		}
+	}
+	return listeners, nil
+}
+
+// localListener listens on the unix socket at addr, a path or unix://path.
+func localListener(addr string) (net.Listener, error) {
+	if strings.HasPrefix(addr, "npipe://") {
+		return nil, fmt.Errorf("%s: named pipes are only supported on Windows", addr)
+	}
+	path := strings.TrimPrefix(addr, "unix://")
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	return sockets.NewUnixSocket(path, "root")
+}
+
+// proxySocket listens on the unix socket of the API proxy at path, which the
+// docker group may connect to, like the daemon socket.
+func proxySocket(path string) (net.Listener, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	return sockets.NewUnixSocket(path, "docker")
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/Microsoft/go-winio"
+)
+
+// pipeSDDL grants access to the plugin pipe to the daemon, which runs as
+// SYSTEM, and to administrators only.
+const pipeSDDL = "D:P(A;;GA;;;SY)(A;;GA;;;BA)"
+
+// activatedListeners returns no listener, there's no socket activation on
+// Windows.
+func activatedListeners() ([]net.Listener, error) {
+	return nil, nil
+}
+
+// localListener listens on the named pipe at addr, npipe://path.
+func localListener(addr string) (net.Listener, error) {
+	if !strings.HasPrefix(addr, "npipe://") {
+		return nil, fmt.Errorf("%s: only named pipes, npipe://path, and tcp:// sockets are supported on Windows", addr)
+	}
+	return winio.ListenPipe(strings.TrimPrefix(addr, "npipe://"), &winio.PipeConfig{SecurityDescriptor: pipeSDDL})
+}
+
+// proxySocket fails, the API proxy only serves on tcp:// on Windows.
+func proxySocket(path string) (net.Listener, error) {
+	return nil, fmt.Errorf("unix://%s: unix sockets aren't supported on Windows", path)
+}
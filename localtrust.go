@@ -0,0 +1,34 @@
+package main
+
+import (
+	"github.com/Sirupsen/logrus"
+	"github.com/docker/docker/reference"
+	"golang.org/x/net/context"
+)
+
+// localTrust decides whether ref may be allowed while its registry can't be
+// reached: that's the case only if the pinning database maps ref to a digest
+// which the daemon confirms it already has locally.
+func (p *trustPlugin) localTrust(ctx context.Context, c timeoutsConf, ref reference.Named) (string, bool) {
+	pinned, ok := p.pins.get(ref)
+	if !ok {
+		return "", false
+	}
+	ctx, cancel := c.daemonContext(ctx)
+	defer cancel()
+	img, _, err := p.client.ImageInspectWithRaw(ctx, ref.FullName()+"@"+pinned.Digest, false)
+	if err != nil {
+		logrus.Debugf("local-trust: %s pinned to %s but not found locally: %v", pinKey(ref), pinned.Digest, err)
+		return "", false
+	}
+	for _, rd := range img.RepoDigests {
+		named, err := reference.ParseNamed(rd)
+		if err != nil {
+			continue
+		}
+		if c, ok := named.(reference.Canonical); ok && c.FullName() == ref.FullName() && c.Digest().String() == pinned.Digest {
+			return pinned.Digest, true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// setupLogging configures logrus from --log-level, --log-format and
+// --log-file.
+func setupLogging(level, format, file string) error {
+	lvl, err := logrus.ParseLevel(level)
+	if err != nil {
+		return fmt.Errorf("--log-level: %v", err)
+	}
+	logrus.SetLevel(lvl)
+	switch format {
+	case "text":
+		logrus.SetFormatter(&logrus.TextFormatter{})
+	case "json":
+		logrus.SetFormatter(&logrus.JSONFormatter{})
+	default:
+		return fmt.Errorf("--log-format: %q isn't text or json", format)
+	}
+	if file != "" {
+		f, err := os.OpenFile(file, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+		if err != nil {
+			return fmt.Errorf("--log-file: %v", err)
+		}
+		logrus.SetOutput(f)
+	}
+	return nil
+}
@@ -2,24 +2,63 @@ package main
 
 import (
 	"flag"
+	"sync/atomic"
 
 	"github.com/Sirupsen/logrus"
+	dockerclient "github.com/docker/engine-api/client"
 	"github.com/docker/go-plugins-helpers/authorization"
 )
 
 const (
-	defaultDockerHost = "unix:///var/run/docker.sock"
-	pluginSocket      = "/run/docker/plugins/container-trust-plugin.sock"
+	// defaultDockerHost is the unix socket of the daemon, its named pipe on
+	// Windows.
+	defaultDockerHost = dockerclient.DefaultDockerHost
 )
 
 var (
-	flDockerHost = flag.String("host", defaultDockerHost, "Specifies the host where to contact the docker daemon")
-	flCertPath   = flag.String("cert-path", "", "Certificates path to connect to Docker (cert.pem, key.pem)")
-	flTLSVerify  = flag.Bool("tls-verify", false, "Whether to verify certificates or not")
+	flDockerHost = flag.String("host", envDefault("host", defaultDockerHost), "Specifies the host where to contact the docker daemon")
+	flCertPath   = flag.String("cert-path", envDefault("cert-path", ""), "Certificates path to connect to Docker (cert.pem, key.pem)")
+	flTLSVerify  = flag.Bool("tls-verify", envDefaultBool("tls-verify", false), "Whether to verify certificates or not")
+	flConfig     = flag.String("config", envDefault("config", pluginConfPath), "Path of the plugin configuration, YAML or JSON")
+	flPolicy     = flag.String("policy", "", "Path of the signature policy, overriding the configuration")
+	flMode       = flag.String("mode", envDefault("mode", modePlugin), "Run as an authorization plugin (plugin) or as an OCI prestart/precreate hook (oci-hook)")
+	flManaged    = flag.Bool("managed", envDefaultBool("managed", false), "Run as a docker managed plugin, serving on the socket docker expects")
+	flLogLevel   = flag.String("log-level", envDefault("log-level", "info"), "Log level: debug, info, warning, error, fatal or panic")
+	flLogFormat  = flag.String("log-format", envDefault("log-format", "text"), "Log format: text or json")
+	flLogFile    = flag.String("log-file", envDefault("log-file", ""), "File to append the logs to instead of stderr")
+	flSet        setFlags
+	flSockets    listFlags
 )
 
+func init() {
+	flag.Var(&flSet, "set", "Override a configuration key, e.g. --set enforcement-mode=audit (repeatable)")
+	flag.Var(&flSockets, "socket", "Socket to serve the plugin on, a unix socket path, npipe://path on Windows, or tcp://host:port, overriding the configuration (repeatable)")
+	flag.Var(&flSockets, "listen", "Alias of --socket")
+}
+
 func main() {
 	flag.Parse()
+	if err := setupLogging(*flLogLevel, *flLogFormat, *flLogFile); err != nil {
+		logrus.Fatal(err)
+	}
+
+	if handled, err := runMode(*flMode); handled {
+		if err != nil {
+			logrus.Fatal(err)
+		}
+		return
+	}
+
+	if flag.NArg() > 0 {
+		if err := runCommand(flag.Arg(0), flag.Args()[1:]); err != nil {
+			logrus.Fatal(err)
+		}
+		return
+	}
+
+	if err := selfTest(); err != nil {
+		logrus.Fatal(err)
+	}
 
 	trustPlugin, err := newPlugin(*flDockerHost, *flCertPath, *flTLSVerify)
 	if err != nil {
@@ -28,7 +67,21 @@ func main() {
 
 	h := authorization.NewHandler(trustPlugin)
 
-	if err := h.ServeUnix("root", pluginSocket); err != nil {
+	cfg := trustPlugin.snapshots.load().config
+	listeners, err := pluginListeners(cfg)
+	if err != nil {
+		logrus.Fatal(err)
+	}
+	if cfg.Admin != nil {
+		if err := serveAdmin(trustPlugin, *cfg.Admin); err != nil {
+			logrus.Fatal(err)
+		}
+	}
+	// The policy is loaded and the sockets are listening.
+	sdNotify("READY=1")
+	go trustPlugin.watchdog()
+	atomic.StoreInt32(&trustPlugin.serving, 1)
+	if err := servePlugin(h, listeners); err != nil {
 		logrus.Fatal(err)
 	}
 }
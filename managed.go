@@ -0,0 +1,141 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	// managedSocketName is the socket of the managed plugin, which docker
+	// expects in managedSocketDir of the plugin root filesystem.
+	managedSocketName = pluginName + ".sock"
+	managedSocketDir  = "/run/docker/plugins"
+	// managedEntrypoint is where the binary is in the plugin root
+	// filesystem.
+	managedEntrypoint = "/usr/libexec/docker/" + pluginName
+)
+
+// pluginManifest is the config.json of a docker managed plugin.
+type pluginManifest struct {
+	Description   string          `json:"description"`
+	Documentation string          `json:"documentation"`
+	Entrypoint    []string        `json:"entrypoint"`
+	Interface     pluginInterface `json:"interface"`
+	Network       pluginNetwork   `json:"network"`
+	Mounts        []pluginMount   `json:"mounts"`
+	Env           []pluginEnv     `json:"env"`
+}
+
+type pluginInterface struct {
+	Types  []string `json:"types"`
+	Socket string   `json:"socket"`
+}
+
+type pluginNetwork struct {
+	Type string `json:"type"`
+}
+
+type pluginMount struct {
+	Name        string   `json:"name"`
+	Description string   `json:"description"`
+	Settable    []string `json:"settable"`
+	Source      string   `json:"source"`
+	Destination string   `json:"destination"`
+	Type        string   `json:"type"`
+	Options     []string `json:"options"`
+}
+
+type pluginEnv struct {
+	Name        string   `json:"name"`
+	Description string   `json:"description"`
+	Settable    []string `json:"settable"`
+	Value       string   `json:"value"`
+}
+
+// managedMounts are the host paths the managed plugin sees, at the same
+// place as on the host so that the configuration and the policy needn't
+// change. Their sources can be changed with docker plugin set.
+var managedMounts = []pluginMount{
+	{Name: "containers", Description: "Signature policy and registries.d", Source: "/etc/containers", Options: []string{"ro"}},
+	{Name: "pki", Description: "Keys the policy references", Source: "/etc/pki", Options: []string{"ro"}},
+	{Name: "config", Description: "Directory of container-trust-plugin.yaml", Source: "/etc/docker", Options: []string{"ro"}},
+	{Name: "state", Description: "Pins, quarantine and other stores", Source: stateDir},
+	{Name: "docker", Description: "Socket of the docker daemon", Source: "/var/run/docker.sock"},
+}
+
+// managedManifest returns the config.json of the managed plugin.
+func managedManifest() pluginManifest {
+	m := pluginManifest{
+		Description:   "Authorization plugin enforcing image signature policies",
+		Documentation: "https://github.com/projectatomic/container-trust-plugin",
+		Entrypoint:    []string{managedEntrypoint, "--managed"},
+		Interface:     pluginInterface{Types: []string{"docker.authz/1.0"}, Socket: managedSocketName},
+		// Registries, signature storage and webhooks are reached from the
+		// host network.
+		Network: pluginNetwork{Type: "host"},
+		Env: []pluginEnv{
+			{Name: envName("config"), Description: "Path of the plugin configuration", Settable: []string{"value"}, Value: pluginConfPath},
+		},
+	}
+	for _, mnt := range managedMounts {
+		mnt.Settable = []string{"source"}
+		mnt.Destination = mnt.Source
+		mnt.Type = "bind"
+		mnt.Options = append([]string{"rbind"}, mnt.Options...)
+		m.Mounts = append(m.Mounts, mnt)
+	}
+	return m
+}
+
+// managedSocket is the socket the managed plugin serves on.
+func managedSocket() string {
+	return filepath.Join(managedSocketDir, managedSocketName)
+}
+
+// underManagedMount tells whether path is visible to the managed plugin.
+func underManagedMount(path string) bool {
+	path = filepath.Clean(path)
+	for _, mnt := range managedMounts {
+		if path == mnt.Source || strings.HasPrefix(path, mnt.Source+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// managedPathError explains err, failing to open a file, if the file isn't
+// under a mount of the managed plugin.
+func managedPathError(err error) error {
+	pe, ok := err.(*os.PathError)
+	if !*flManaged || !ok || !os.IsNotExist(err) || underManagedMount(pe.Path) {
+		return err
+	}
+	return fmt.Errorf("%s isn't under a mount of the managed plugin", pe.Path)
+}
+
+// runPluginConfig prints the config.json of the managed plugin, to be
+// shipped alongside its root filesystem.
+func runPluginConfig(args []string) error {
+	fs := flag.NewFlagSet("plugin-config", flag.ContinueOnError)
+	output := fs.String("output", "", "File to write config.json to, stdout by default")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(managedManifest(), "", "  ")
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+	if *output == "" {
+		_, err := os.Stdout.Write(data)
+		return err
+	}
+	if err := writeFile(*output, string(data)); err != nil {
+		return fmt.Errorf("plugin-config: %v", err)
+	}
+	return nil
+}
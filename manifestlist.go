@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"sync"
+
+	"github.com/docker/distribution/digest"
+	"github.com/docker/docker/reference"
+	"github.com/projectatomic/container-trust-plugin/pkg/trust"
+	"golang.org/x/net/context"
+)
+
+// defaultPlatformConcurrency is how many platform manifests of a manifest
+// list are verified at once.
+const defaultPlatformConcurrency = 4
+
+// manifestListsConf configures the verification of manifest lists.
+type manifestListsConf struct {
+	// AllPlatforms requires the manifests of every platform of a manifest
+	// list to verify, not only the one pulled.
+	AllPlatforms bool `yaml:"all-platforms"`
+	// Concurrency is how many of them are verified at once, 4 by default.
+	Concurrency int `yaml:"concurrency"`
+}
+
+func (c manifestListsConf) validate() error {
+	if c.Concurrency < 0 {
+		return fmt.Errorf("manifest-lists: concurrency can't be negative")
+	}
+	return nil
+}
+
+// requestedPlatform returns the platform asked for by the platform parameter
+// of a pull (API 1.32+), "os[/arch[/variant]]", or the host platform.
+func requestedPlatform(q url.Values) (trust.Platform, error) {
+	s := q.Get("platform")
+	if s == "" {
+		return trust.HostPlatform(), nil
+	}
+	return trust.ParsePlatform(s)
+}
+
+// verifyPlatforms verifies the manifests of the other platforms of the
+// manifest list of ref verified as res for plat, with manifest-lists
+// all-platforms. They're fetched and verified concurrently, and the first
+// platform listed which fails is reported.
+func (p *trustPlugin) verifyPlatforms(ctx context.Context, snap *snapshot, ref reference.Named, plat trust.Platform, res *trust.Result, sp *span) *trustError {
+	cfg := snap.config.ManifestLists
+	if !cfg.AllPlatforms || !trust.IsManifestList(res.MIMEType) {
+		return nil
+	}
+	entries, err := trust.PlatformManifests(res.Manifest)
+	if err != nil {
+		return wrapError(codeRegistryError, err)
+	}
+	verified, _ := trust.PlatformDigest(res.Manifest, plat)
+	name, err := reference.WithName(ref.Name())
+	if err != nil {
+		return wrapError(codeInvalidReference, err)
+	}
+	concurrency := cfg.Concurrency
+	if concurrency == 0 {
+		concurrency = defaultPlatformConcurrency
+	}
+	sem := make(chan struct{}, concurrency)
+	errs := make([]*trustError, len(entries))
+	var wg sync.WaitGroup
+	for i, e := range entries {
+		// Build attestations are listed as unknown/unknown.
+		if e.Digest == verified || e.Platform.OS == "unknown" {
+			continue
+		}
+		wg.Add(1)
+		go func(i int, e trust.PlatformManifest) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			errs[i] = p.verifyPlatform(ctx, snap, name, e, sp)
+		}(i, e)
+	}
+	wg.Wait()
+	for _, terr := range errs {
+		if terr != nil {
+			return terr
+		}
+	}
+	return nil
+}
+
+// verifyPlatform verifies the manifest e of the manifest list of name like
+// verifyShared, outside of the concurrency limits since the verification of
+// the list holds a slot already.
+func (p *trustPlugin) verifyPlatform(ctx context.Context, snap *snapshot, name reference.Named, e trust.PlatformManifest, sp *span) *trustError {
+	canonical, err := reference.WithDigest(name, digest.Digest(e.Digest))
+	if err != nil {
+		return wrapError(codeInvalidReference, err)
+	}
+	res, err := p.verifier(ctx, snap, e.Platform, sp).Verify(canonical)
+	if err != nil {
+		terr := verificationError(err)
+		return newTrustError(terr.Code, "platform %s: %s", e.Platform, terr.Msg)
+	}
+	if terr := checkVerified(snap, canonical, res); terr != nil {
+		return newTrustError(terr.Code, "platform %s: %s", e.Platform, terr.Msg)
+	}
+	return nil
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"net/url"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/containers/image/docker"
+	"github.com/containers/image/manifest"
+	"github.com/docker/docker/reference"
+	"github.com/projectatomic/container-trust-plugin/pkg/trust"
+	"golang.org/x/net/context"
+)
+
+// registryMirrors returns the hosts of the registry mirrors the daemon pulls
+// Docker Hub images from.
+func (p *trustPlugin) registryMirrors(ctx context.Context, cfg conf) ([]string, error) {
+	i, err := p.dockerInfo(ctx, cfg)
+	if err != nil {
+		return nil, err
+	}
+	if i.RegistryConfig == nil {
+		return nil, nil
+	}
+	var hosts []string
+	for _, m := range i.RegistryConfig.Mirrors {
+		u, err := url.Parse(m)
+		if err != nil || u.Host == "" {
+			logrus.Debugf("ignoring invalid registry mirror %q", m)
+			continue
+		}
+		hosts = append(hosts, trust.NormalizeHostname(u.Host))
+	}
+	return hosts, nil
+}
+
+// checkMirrors makes sure the mirrors the daemon is going to pull ref from
+// serve the manifest whose digest was verified against the signatures of
+// the canonical repository. Unreachable mirrors are skipped since the daemon
+// falls back to the canonical registry then. The mirrors are accessed like
+// registries, traced under sp.
+func (p *trustPlugin) checkMirrors(ctx context.Context, snap *snapshot, ref reference.Named, verified string, sp *span) *trustError {
+	if ref.Hostname() != "docker.io" {
+		return nil
+	}
+	cfg := snap.config
+	mirrors, err := p.registryMirrors(ctx, cfg)
+	if err != nil {
+		return wrapError(codeDaemonUnreachable, err)
+	}
+	for _, host := range mirrors {
+		mirrored, err := trust.SubstituteReferenceName(ref, host+"/"+ref.RemoteName())
+		if err != nil {
+			return wrapError(codeInternal, err)
+		}
+		var dgst string
+		err = within(ctx, cfg.Timeouts.registry(), "fetching the manifest of "+mirrored.String(), func() (err error) {
+			dgst, err = p.manifestDigest(ctx, snap, mirrored, sp)
+			return err
+		})
+		if err != nil {
+			logrus.Debugf("mirror %s unavailable for %s: %v", host, ref, err)
+			continue
+		}
+		if dgst != verified {
+			return newTrustError(codeDigestMismatch, "mirror %s serves %s for %s, the verified digest is %s", host, dgst, ref, verified)
+		}
+	}
+	return nil
+}
+
+// manifestDigest fetches the manifest of ref and returns its digest.
+func (p *trustPlugin) manifestDigest(ctx context.Context, snap *snapshot, ref reference.Named, sp *span) (string, error) {
+	imgRef, err := docker.NewReference(ref)
+	if err != nil {
+		return "", err
+	}
+	img, err := imgRef.NewImage(p.systemContext(ctx, snap.config, ref.Hostname()))
+	if err != nil {
+		return "", err
+	}
+	img = p.bounded(ctx, snap, img, sp)
+	defer img.Close()
+	m, _, err := img.Manifest()
+	if err != nil {
+		return "", err
+	}
+	return manifest.Digest(m)
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	defaultNotifyTimeout = 5 * time.Second
+	defaultNotifyRetries = 3
+	notifyBackoff        = time.Second
+
+	// notifySignatureHeader carries the HMAC-SHA256 of the event body,
+	// sha256=<hex>.
+	notifySignatureHeader = "X-Container-Trust-Signature"
+	// notifyDeliveryHeader identifies an event across retries.
+	notifyDeliveryHeader = "X-Container-Trust-Delivery"
+)
+
+// notificationConf is a webhook notified of the denied pulls and container
+// creations.
+type notificationConf struct {
+	URL string `yaml:"url"`
+	// SecretFile holds the key the events are signed with, if any.
+	SecretFile string `yaml:"secret-file"`
+	// Timeout is how long to wait for each attempt, 5s by default.
+	Timeout time.Duration `yaml:"timeout"`
+	// Retries is how many times failed deliveries are retried, with an
+	// exponential backoff, 3 by default.
+	Retries *int `yaml:"retries"`
+}
+
+func (c notificationConf) validate() error {
+	if !strings.HasPrefix(c.URL, "https://") && !strings.HasPrefix(c.URL, "http://") {
+		return fmt.Errorf("notifications: invalid url %q", c.URL)
+	}
+	if c.Retries != nil && *c.Retries < 0 {
+		return errors.New("notifications: retries must be positive")
+	}
+	return nil
+}
+
+// denialEvent is the event posted on denials. Text makes it readable by
+// Slack incoming webhooks as is.
+type denialEvent struct {
+	Event       string    `json:"event"`
+	ID          string    `json:"id"`
+	Time        time.Time `json:"time"`
+	Host        string    `json:"host"`
+	Action      string    `json:"action"`
+	User        string    `json:"user,omitempty"`
+	Image       string    `json:"image"`
+	Digest      string    `json:"digest,omitempty"`
+	Code        string    `json:"code,omitempty"`
+	Message     string    `json:"message"`
+	PolicyScope string    `json:"policy_scope,omitempty"`
+	Text        string    `json:"text"`
+}
+
+// notifier is an audit sink posting the enforced denials of pulls and
+// container creations to a webhook.
+type notifier struct {
+	conf    notificationConf
+	secret  []byte
+	retries int
+	host    string
+	client  *http.Client
+}
+
+func newNotifier(c notificationConf) (*notifier, error) {
+	n := &notifier{conf: c, retries: defaultNotifyRetries}
+	if c.SecretFile != "" {
+		data, err := ioutil.ReadFile(c.SecretFile)
+		if err != nil {
+			return nil, fmt.Errorf("notifications: %v", err)
+		}
+		n.secret = bytes.TrimSpace(data)
+	}
+	if c.Retries != nil {
+		n.retries = *c.Retries
+	}
+	timeout := c.Timeout
+	if timeout <= 0 {
+		timeout = defaultNotifyTimeout
+	}
+	n.client = &http.Client{Timeout: timeout}
+	n.host, _ = os.Hostname()
+	return n, nil
+}
+
+// deniedAction returns pull or create if rec is the enforced denial of one,
+// "" otherwise. AutoPulls only turn the request down once the plugin pulled
+// the image itself, they aren't denials.
+func deniedAction(rec *auditRecord) string {
+	if rec.Allowed || rec.Mode != "" || rec.Phase != phaseRequest || rec.Code == codeAutoPulled {
+		return ""
+	}
+	return recordAction(rec)
+}
+
+// recordAction returns pull or create if rec is a decision on one, ""
+// otherwise.
+func recordAction(rec *auditRecord) string {
+	path, query, err := apiPath(rec.URI)
+	if err != nil {
+		return ""
+	}
+	switch {
+	case path == "/images/create" && query.Get("fromImage") != "":
+		return "pull"
+	case path == "/containers/create":
+		return "create"
+	}
+	return ""
+}
+
+func (n *notifier) send(rec *auditRecord) error {
+	action := deniedAction(rec)
+	if action == "" {
+		return nil
+	}
+	ev := denialEvent{
+		Event:       "denied",
+		ID:          rec.ID,
+		Time:        rec.Time,
+		Host:        n.host,
+		Action:      action,
+		User:        rec.User,
+		Image:       rec.Reference,
+		Digest:      rec.Digest,
+		Code:        rec.Code,
+		Message:     rec.Message,
+		PolicyScope: rec.PolicyScope,
+	}
+	ev.Text = fmt.Sprintf("%s denied on %s: %s: %s (correlation ID %s)", action, n.host, rec.Reference, rec.Message, rec.ID)
+	body, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	delivery := make([]byte, 16)
+	if _, err := rand.Read(delivery); err != nil {
+		return err
+	}
+	backoff := notifyBackoff
+	for attempt := 0; ; attempt++ {
+		retry, err := n.post(body, hex.EncodeToString(delivery))
+		if err == nil {
+			return nil
+		}
+		if !retry || attempt >= n.retries {
+			return fmt.Errorf("notifying %s: %v", n.conf.URL, err)
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// post posts body once and tells whether a failure is worth retrying.
+func (n *notifier) post(body []byte, delivery string) (bool, error) {
+	req, err := http.NewRequest("POST", n.conf.URL, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(notifyDeliveryHeader, delivery)
+	if n.secret != nil {
+		mac := hmac.New(sha256.New, n.secret)
+		mac.Write(body)
+		req.Header.Set(notifySignatureHeader, "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 == 2 {
+		return false, nil
+	}
+	// Client errors won't go away by retrying, except rate limiting.
+	retry := resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests
+	return retry, fmt.Errorf("answered %s", resp.Status)
+}
@@ -0,0 +1,22 @@
+package main
+
+import "testing"
+
+func TestDeniedAction(t *testing.T) {
+	tests := []struct {
+		rec    auditRecord
+		action string
+	}{
+		{auditRecord{Phase: phaseRequest, URI: "/v1.40/images/create?fromImage=app&tag=1", Code: codeNoSignature}, "pull"},
+		{auditRecord{Phase: phaseRequest, URI: "/containers/create", Code: codeDenied}, "create"},
+		{auditRecord{Phase: phaseRequest, URI: "/v1.24/images/create?fromImage=app&tag=1", Code: codeAutoPulled}, ""},
+		{auditRecord{Phase: phaseRequest, URI: "/images/create?fromImage=app&tag=1", Allowed: true}, ""},
+		{auditRecord{Phase: phaseRequest, URI: "/images/create?fromImage=app&tag=1", Mode: enforcementAudit}, ""},
+		{auditRecord{Phase: phaseRequest, URI: "/images/load", Code: codeUnverifiable}, ""},
+	}
+	for _, tt := range tests {
+		if action := deniedAction(&tt.rec); action != tt.action {
+			t.Errorf("deniedAction(%s %s) = %q, want %q", tt.rec.URI, tt.rec.Code, action, tt.action)
+		}
+	}
+}
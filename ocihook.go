@@ -0,0 +1,248 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/docker/distribution/digest"
+	"github.com/docker/docker/reference"
+	"github.com/projectatomic/container-trust-plugin/pkg/trust"
+)
+
+const (
+	modePlugin  = "plugin"
+	modeOCIHook = "oci-hook"
+)
+
+// defaultContainerStorage is where Podman and CRI-O keep their images and
+// containers.
+const defaultContainerStorage = "/var/lib/containers/storage"
+
+// imageNameAnnotation is where CRI-O records the image of a container. It
+// can be set by users of Podman, so it's only ever checked against the
+// container storage.
+const imageNameAnnotation = "io.kubernetes.cri-o.ImageName"
+
+// ociState is the state of a container passed to prestart hooks.
+type ociState struct {
+	ID          string            `json:"id"`
+	Bundle      string            `json:"bundle"`
+	Annotations map[string]string `json:"annotations"`
+}
+
+// ociConfig is the part of the runtime configuration of a container hooks
+// care about.
+type ociConfig struct {
+	Root struct {
+		Path string `json:"path"`
+	} `json:"root"`
+	Annotations map[string]string `json:"annotations"`
+}
+
+// storageContainer and storageImage are the parts of the records of
+// containers/storage the hook cares about.
+type storageContainer struct {
+	ID    string `json:"id"`
+	Image string `json:"image"`
+	Layer string `json:"layer"`
+}
+
+type storageImage struct {
+	ID      string   `json:"id"`
+	Names   []string `json:"names"`
+	Digest  string   `json:"digest"`
+	Digests []string `json:"digests"`
+}
+
+// runOCIHook verifies the image of the container described on stdin and
+// fails if it doesn't satisfy the policy. As a prestart hook it gets the
+// container state, as a precreate hook the runtime configuration, which it
+// writes back unchanged to stdout. The image is the one the engine recorded
+// in the container storage, annotations can be set by users.
+func runOCIHook(stdin io.Reader, stdout io.Writer) error {
+	input, err := ioutil.ReadAll(stdin)
+	if err != nil {
+		return err
+	}
+	var state ociState
+	if err := json.Unmarshal(input, &state); err != nil {
+		return fmt.Errorf("invalid hook input: %v", err)
+	}
+	precreate := state.Bundle == ""
+	var c ociConfig
+	if precreate {
+		if err := json.Unmarshal(input, &c); err != nil {
+			return fmt.Errorf("invalid hook input: %v", err)
+		}
+	} else {
+		config, err := ioutil.ReadFile(filepath.Join(state.Bundle, "config.json"))
+		if err != nil {
+			return err
+		}
+		if err := json.Unmarshal(config, &c); err != nil {
+			return fmt.Errorf("invalid config.json of container %s: %v", state.ID, err)
+		}
+	}
+	snap, err := loadSnapshot()
+	if err != nil {
+		return err
+	}
+	defer snap.keyrings.remove()
+	root := snap.config.ContainerStorage
+	if root == "" {
+		root = defaultContainerStorage
+	}
+	ref, img, err := storageImageReference(root, state.ID, c.Root.Path)
+	if err != nil {
+		return err
+	}
+	for _, a := range []map[string]string{c.Annotations, state.Annotations} {
+		if err := checkImageAnnotation(a[imageNameAnnotation], img); err != nil {
+			return err
+		}
+	}
+	p := newOfflinePlugin()
+	p.snapshots.store(snap)
+	setupProxy(func() conf { return snap.config })
+	ctx, cancel := snap.config.Timeouts.decisionContext()
+	defer cancel()
+	dgst, terr := p.verifyImage(ctx, snap, ref, nil)
+	if terr != nil {
+		return terr
+	}
+	logrus.Infof("oci-hook: %s verified as %s", ref, dgst)
+	if precreate {
+		_, err = stdout.Write(input)
+		return err
+	}
+	return nil
+}
+
+// storageImageReference returns the image of a container as recorded in the
+// container storage at root, by the digest it was pulled by. The container
+// is looked up by id or, before it's created, by the layer its root
+// filesystem is mounted from.
+func storageImageReference(root, id, rootfs string) (reference.Named, *storageImage, error) {
+	stores, err := filepath.Glob(filepath.Join(root, "*-containers", "containers.json"))
+	if err != nil {
+		return nil, nil, err
+	}
+	mounted := make(map[string]bool)
+	for _, e := range strings.Split(filepath.Clean(rootfs), string(filepath.Separator)) {
+		mounted[e] = true
+	}
+	for _, store := range stores {
+		var containers []storageContainer
+		if err := readJSONFile(store, &containers); err != nil {
+			return nil, nil, err
+		}
+		for _, c := range containers {
+			match := c.ID == id
+			if id == "" {
+				match = c.Layer != "" && mounted[c.Layer]
+			}
+			if !match {
+				continue
+			}
+			images := strings.TrimSuffix(filepath.Dir(store), "-containers") + "-images"
+			img, err := storedImage(filepath.Join(images, "images.json"), c.Image)
+			if err != nil {
+				return nil, nil, err
+			}
+			ref, err := img.reference()
+			if err != nil {
+				return nil, nil, fmt.Errorf("container %s: %v", c.ID, err)
+			}
+			return ref, img, nil
+		}
+	}
+	return nil, nil, fmt.Errorf("unable to find the container in %s", root)
+}
+
+func storedImage(path, id string) (*storageImage, error) {
+	var images []storageImage
+	if err := readJSONFile(path, &images); err != nil {
+		return nil, err
+	}
+	for i := range images {
+		if images[i].ID == id {
+			return &images[i], nil
+		}
+	}
+	return nil, fmt.Errorf("unable to find image %s in %s", id, path)
+}
+
+func readJSONFile(path string, v interface{}) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	return nil
+}
+
+// reference returns the repository of img pinned to the digest it was
+// pulled by.
+func (img *storageImage) reference() (reference.Named, error) {
+	d := img.Digest
+	if d == "" && len(img.Digests) > 0 {
+		d = img.Digests[0]
+	}
+	if d == "" {
+		return nil, fmt.Errorf("image %s wasn't pulled from a registry, its signatures can't be verified", img.ID)
+	}
+	dgst, err := digest.ParseDigest(d)
+	if err != nil {
+		return nil, err
+	}
+	for _, n := range img.Names {
+		ref, err := trust.ParseImageReference(n)
+		if err != nil {
+			continue
+		}
+		name, err := reference.WithName(ref.Name())
+		if err != nil {
+			return nil, err
+		}
+		return reference.WithDigest(name, dgst)
+	}
+	return nil, fmt.Errorf("image %s has no repository name", img.ID)
+}
+
+// checkImageAnnotation refuses a container whose image annotation names
+// another repository than the image it runs.
+func checkImageAnnotation(name string, img *storageImage) error {
+	if name == "" {
+		return nil
+	}
+	claimed, err := trust.ParseImageReference(name)
+	if err != nil {
+		return fmt.Errorf("invalid %s annotation: %v", imageNameAnnotation, err)
+	}
+	for _, n := range img.Names {
+		if ref, err := trust.ParseImageReference(n); err == nil && ref.FullName() == claimed.FullName() {
+			return nil
+		}
+	}
+	return fmt.Errorf("%s annotation %s doesn't name the image of the container", imageNameAnnotation, name)
+}
+
+// runMode runs the plugin in the given mode, returning false if mode is
+// the regular authorization plugin.
+func runMode(mode string) (bool, error) {
+	switch mode {
+	case modePlugin:
+		return false, nil
+	case modeOCIHook:
+		return true, runOCIHook(os.Stdin, os.Stdout)
+	}
+	return true, fmt.Errorf("unknown mode %q", mode)
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const testImageDigest = "sha256:ea7d3b8b84fe21d2ae2c7c53a43c43e0b8b0a0fdab6e2e1ec1fdfd7f3b7a18a1"
+
+func newTestContainerStorage(t *testing.T) string {
+	root := t.TempDir()
+	files := map[string]string{
+		"overlay-containers/containers.json": `[
+			{"id": "c1", "image": "i1", "layer": "l1"},
+			{"id": "c2", "image": "i2", "layer": "l2"}
+		]`,
+		"overlay-images/images.json": `[
+			{"id": "i1", "names": ["example.com/team/app:1"], "digest": "` + testImageDigest + `"},
+			{"id": "i2", "names": ["localhost/built:latest"]}
+		]`,
+	}
+	for name, data := range files {
+		path := filepath.Join(root, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return root
+}
+
+func TestStorageImageReference(t *testing.T) {
+	root := newTestContainerStorage(t)
+	want := "example.com/team/app@" + testImageDigest
+	ref, img, err := storageImageReference(root, "c1", "rootfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ref.String() != want {
+		t.Errorf("image of c1 = %s, want %s", ref, want)
+	}
+	// Before the container is created, it's found by its mounted layer.
+	if ref, _, err = storageImageReference(root, "", filepath.Join(root, "overlay", "l1", "merged")); err != nil || ref.String() != want {
+		t.Errorf("image mounted from l1 = %v (%v), want %s", ref, err, want)
+	}
+	if _, _, err := storageImageReference(root, "c2", "rootfs"); err == nil {
+		t.Error("image without a registry digest resolved")
+	}
+	if _, _, err := storageImageReference(root, "c3", "rootfs"); err == nil {
+		t.Error("unknown container resolved")
+	}
+
+	if err := checkImageAnnotation("example.com/team/app:2", img); err != nil {
+		t.Errorf("annotation naming the repository of the image refused: %v", err)
+	}
+	if err := checkImageAnnotation("example.com/team/signed", img); err == nil {
+		t.Error("annotation naming another image accepted")
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+	"gopkg.in/yaml.v2"
+)
+
+// envPrefix prefixes the environment variables overriding the flags and the
+// configuration.
+const envPrefix = "CONTAINER_TRUST_PLUGIN_"
+
+// setFlags are the --set key=value configuration overrides.
+type setFlags []string
+
+func (s *setFlags) String() string {
+	return strings.Join(*s, ",")
+}
+
+func (s *setFlags) Set(v string) error {
+	if !strings.Contains(v, "=") {
+		return fmt.Errorf("%q isn't key=value", v)
+	}
+	*s = append(*s, v)
+	return nil
+}
+
+// listFlags are the values of a repeatable flag.
+type listFlags []string
+
+func (l *listFlags) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *listFlags) Set(v string) error {
+	*l = append(*l, v)
+	return nil
+}
+
+// envDefault returns the value of the environment variable overriding flag
+// name, def if it isn't set.
+func envDefault(name, def string) string {
+	if v, ok := os.LookupEnv(envName(name)); ok {
+		return v
+	}
+	return def
+}
+
+func envDefaultBool(name string, def bool) bool {
+	switch strings.ToLower(envDefault(name, "")) {
+	case "1", "true", "yes":
+		return true
+	case "0", "false", "no":
+		return false
+	}
+	return def
+}
+
+// envName is the environment variable of the configuration key at path,
+// e.g. CONTAINER_TRUST_PLUGIN_PREFETCH__TTL for prefetch.ttl.
+func envName(path string) string {
+	r := strings.NewReplacer("-", "_", ".", "__")
+	return envPrefix + strings.ToUpper(r.Replace(path))
+}
+
+// configPaths returns the dotted paths of the keys of t, nested structures
+// included.
+func configPaths(t reflect.Type, prefix string) []string {
+	var paths []string
+	for i := 0; i < t.NumField(); i++ {
+		tag := strings.Split(t.Field(i).Tag.Get("yaml"), ",")[0]
+		if tag == "" || tag == "-" {
+			continue
+		}
+		path := prefix + tag
+		paths = append(paths, path)
+		ft := t.Field(i).Type
+		if ft.Kind() == reflect.Ptr {
+			ft = ft.Elem()
+		}
+		if ft.Kind() == reflect.Struct && ft.PkgPath() == t.PkgPath() {
+			paths = append(paths, configPaths(ft, path+".")...)
+		}
+	}
+	return paths
+}
+
+// applyOverrides applies the configuration overrides of the environment
+// and then of --set to config, flags taking precedence.
+func applyOverrides(config *conf, environ []string, sets []string) error {
+	byEnv := make(map[string]string)
+	for _, p := range configPaths(reflect.TypeOf(conf{}), "") {
+		byEnv[envName(p)] = p
+	}
+	for _, kv := range environ {
+		i := strings.Index(kv, "=")
+		if i < 0 || !strings.HasPrefix(kv[:i], envPrefix) {
+			continue
+		}
+		path, ok := byEnv[kv[:i]]
+		if !ok {
+			if !globalFlagEnv(kv[:i]) {
+				logrus.Warnf("unknown configuration variable %s ignored", kv[:i])
+			}
+			continue
+		}
+		if err := setConfig(config, path, kv[i+1:]); err != nil {
+			return fmt.Errorf("%s: %v", kv[:i], err)
+		}
+	}
+	for _, kv := range sets {
+		i := strings.Index(kv, "=")
+		path := kv[:i]
+		if !configKeys()[strings.Split(path, ".")[0]] {
+			return fmt.Errorf("--set %s: unknown key", path)
+		}
+		if err := setConfig(config, path, kv[i+1:]); err != nil {
+			return fmt.Errorf("--set %s: %v", path, err)
+		}
+	}
+	return nil
+}
+
+// globalFlagEnv tells whether name is the environment variable of a global
+// flag.
+func globalFlagEnv(name string) bool {
+	for _, f := range []string{"host", "cert-path", "tls-verify", "config", "mode", "managed", "log-level", "log-format", "log-file"} {
+		if envName(f) == name {
+			return true
+		}
+	}
+	return false
+}
+
+// setConfig sets the key at the dotted path of config to value, a YAML
+// scalar, list or map.
+func setConfig(config *conf, path, value string) error {
+	var v interface{}
+	if err := yaml.Unmarshal([]byte(value), &v); err != nil {
+		return err
+	}
+	keys := strings.Split(path, ".")
+	for i := len(keys) - 1; i >= 0; i-- {
+		v = map[string]interface{}{keys[i]: v}
+	}
+	data, err := yaml.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return yaml.Unmarshal(data, config)
+}
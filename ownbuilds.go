@@ -0,0 +1,62 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"net/url"
+	"sync"
+)
+
+// labelBuildNonce labels the builds the plugin runs itself with a random
+// value only it knows, which is what tells them from user builds: their tag
+// and other labels can all be guessed.
+const labelBuildNonce = "io.projectatomic.trust.build-nonce"
+
+// ownBuilds tracks the builds the plugin itself is running, by nonce.
+type ownBuilds struct {
+	mu sync.Mutex
+	// builds are the tags of the builds by nonce.
+	builds map[string]string
+}
+
+func newOwnBuilds() *ownBuilds {
+	return &ownBuilds{builds: make(map[string]string)}
+}
+
+// add registers a build of tag, returning the nonce to label it with and a
+// function unregistering it.
+func (b *ownBuilds) add(tag string) (string, func()) {
+	var n [16]byte
+	rand.Read(n[:])
+	nonce := hex.EncodeToString(n[:])
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.builds[nonce] = tag
+	return nonce, func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		delete(b.builds, nonce)
+	}
+}
+
+// owns tells whether the build request with query q is one of ours. A nonce
+// is accepted once, so that a build can't be slipped in with it while ours
+// is running.
+func (b *ownBuilds) owns(q url.Values) bool {
+	var labels map[string]string
+	if err := json.Unmarshal([]byte(q.Get("labels")), &labels); err != nil {
+		return false
+	}
+	nonce := labels[labelBuildNonce]
+	if nonce == "" {
+		return false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if tag, ok := b.builds[nonce]; !ok || tag != q.Get("t") {
+		return false
+	}
+	delete(b.builds, nonce)
+	return true
+}
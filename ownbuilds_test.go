@@ -0,0 +1,37 @@
+package main
+
+import (
+	"encoding/json"
+	"net/url"
+	"testing"
+)
+
+func buildQuery(tag string, labels map[string]string) url.Values {
+	data, _ := json.Marshal(labels)
+	return url.Values{"t": {tag}, "labels": {string(data)}}
+}
+
+func TestOwnBuilds(t *testing.T) {
+	b := newOwnBuilds()
+	labels := map[string]string{labelVerifiedBy: "container-trust-plugin@host", labelDigest: "sha256:abc"}
+	nonce, done := b.add("example.com/app:1")
+	defer done()
+
+	if b.owns(buildQuery("example.com/app:1", labels)) {
+		t.Error("build without the nonce owned")
+	}
+	labels[labelBuildNonce] = "0123456789abcdef0123456789abcdef"
+	if b.owns(buildQuery("example.com/app:1", labels)) {
+		t.Error("build with another nonce owned")
+	}
+	labels[labelBuildNonce] = nonce
+	if b.owns(buildQuery("example.com/app:2", labels)) {
+		t.Error("build of another tag owned")
+	}
+	if !b.owns(buildQuery("example.com/app:1", labels)) {
+		t.Error("build with the nonce not owned")
+	}
+	if b.owns(buildQuery("example.com/app:1", labels)) {
+		t.Error("nonce accepted twice")
+	}
+}
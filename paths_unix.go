@@ -0,0 +1,18 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+const (
+	pluginConfPath           = "/etc/docker/container-trust-plugin.yaml"
+	defaultPolicyPath        = "/etc/containers/policy.json"
+	defaultPolicyDir         = "/etc/containers/policy.d"
+	defaultRegistriesDirPath = "/etc/containers/registries.d"
+	defaultCertsDir          = "/etc/docker/certs.d"
+	defaultPluginSpecDir     = "/etc/docker/plugins"
+	defaultDockerDropInDir   = "/etc/systemd/system/docker.service.d"
+	defaultPluginSocket      = "/run/docker/plugins/container-trust-plugin.sock"
+	defaultAdminSocket       = "/run/container-trust-plugin/admin.sock"
+	// stateDir holds the stores of the plugin.
+	stateDir = "/var/lib/container-trust-plugin"
+)
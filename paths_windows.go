@@ -0,0 +1,18 @@
+package main
+
+// The Windows daemon reads its configuration and plugin spec files from
+// %ProgramData%\docker.
+const (
+	pluginConfPath           = `C:\ProgramData\docker\config\container-trust-plugin.yaml`
+	defaultPolicyPath        = `C:\ProgramData\containers\policy.json`
+	defaultPolicyDir         = `C:\ProgramData\containers\policy.d`
+	defaultRegistriesDirPath = `C:\ProgramData\containers\registries.d`
+	defaultCertsDir          = `C:\ProgramData\docker\certs.d`
+	defaultPluginSpecDir     = `C:\ProgramData\docker\plugins`
+	// There is no systemd to order the daemon after the plugin.
+	defaultDockerDropInDir = ""
+	defaultPluginSocket    = `npipe:////./pipe/container-trust-plugin`
+	defaultAdminSocket     = `npipe:////./pipe/container-trust-plugin-admin`
+	// stateDir holds the stores of the plugin.
+	stateDir = `C:\ProgramData\container-trust-plugin`
+)
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/docker/docker/reference"
+)
+
+var defaultPinStorePath = filepath.Join(stateDir, "pins.json")
+
+// pinFlushDelay is how long the pins set by verified pulls wait before the
+// database is written, so that a burst of pulls rewrites it once.
+const pinFlushDelay = time.Second
+
+// pin records the digest a tag resolved to when it was last verified, and
+// since when it has been resolving to it.
+type pin struct {
+	Digest   string    `json:"digest"`
+	Pinned   time.Time `json:"pinned"`
+	Verified time.Time `json:"verified"`
+}
+
+// pinStore is the pinning database, mapping verified tags to the digest they
+// resolved to. It's persisted as a JSON file so pins survive restarts. No
+// key-value store is vendored, so rather than writing each pin the whole
+// file is rewritten, at most once per pinFlushDelay: pins set less than
+// pinFlushDelay before a crash are lost, and pinned again on their next
+// verified pull. Without a path, it's only kept in memory.
+type pinStore struct {
+	path string
+
+	mu   sync.Mutex
+	pins map[string]pin
+	// flushing is set while a write of the pins set lately is scheduled.
+	flushing bool
+	// saveMu serializes the writes of the file, in the order their
+	// contents were taken.
+	saveMu sync.Mutex
+}
+
+func newPinStore(path string) (*pinStore, error) {
+	s := &pinStore{path: path, pins: make(map[string]pin)}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return s, nil
+		}
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &s.pins); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// pinKey returns the key ref is pinned under, or "" if ref isn't tagged.
+func pinKey(ref reference.Named) string {
+	tagged, ok := ref.(reference.NamedTagged)
+	if !ok {
+		return ""
+	}
+	return ref.FullName() + ":" + tagged.Tag()
+}
+
+func (s *pinStore) get(ref reference.Named) (pin, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	p, ok := s.pins[pinKey(ref)]
+	return p, ok
+}
+
+// hasDigest tells whether any tag of ref's repository is pinned to digest.
+func (s *pinStore) hasDigest(ref reference.Named, digest string) bool {
+	prefix := ref.FullName() + ":"
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for k, p := range s.pins {
+		if p.Digest == digest && strings.HasPrefix(k, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// all returns a copy of the pins, by tag.
+func (s *pinStore) all() map[string]pin {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	pins := make(map[string]pin, len(s.pins))
+	for k, p := range s.pins {
+		pins[k] = p
+	}
+	return pins
+}
+
+// len returns how many tags are pinned.
+func (s *pinStore) len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.pins)
+}
+
+// set pins ref to digest and schedules the write of the database.
+func (s *pinStore) set(ref reference.Named, digest string) {
+	key := pinKey(ref)
+	if key == "" {
+		return
+	}
+	now := time.Now().UTC()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	p := pin{Digest: digest, Pinned: now, Verified: now}
+	if old, ok := s.pins[key]; ok && old.Digest == digest && !old.Pinned.IsZero() {
+		p.Pinned = old.Pinned
+	}
+	s.pins[key] = p
+	if !s.flushing {
+		s.flushing = true
+		time.AfterFunc(pinFlushDelay, s.flush)
+	}
+}
+
+// flush writes the pins set since the last write.
+func (s *pinStore) flush() {
+	if err := s.save(); err != nil {
+		logrus.Errorf("unable to save the pins to %s: %v", s.path, err)
+	}
+}
+
+// pinFilter selects pins. Empty fields match everything.
+type pinFilter struct {
+	// Reference is a tag, e.g. quay.io/team-a/app:1.2.
+	Reference string
+	// Repository matches the tags of a repository, e.g. quay.io/team-a/app.
+	Repository string
+	// OlderThan matches the pins last verified before it.
+	OlderThan time.Time
+}
+
+func (f pinFilter) matches(key string, p pin) bool {
+	if f.Reference != "" && key != f.Reference {
+		return false
+	}
+	if f.Repository != "" && !strings.HasPrefix(key, f.Repository+":") {
+		return false
+	}
+	return f.OlderThan.IsZero() || p.Verified.Before(f.OlderThan)
+}
+
+// parsePinFilter parses the parameters of a pins request: reference (a
+// tag), repository and older-than (a duration, e.g. 720h, or an RFC 3339
+// time).
+func parsePinFilter(v url.Values) (pinFilter, error) {
+	var f pinFilter
+	if s := v.Get("reference"); s != "" {
+		ref, err := reference.ParseNamed(s)
+		if err != nil {
+			return f, fmt.Errorf("invalid reference %q: %v", s, err)
+		}
+		if f.Reference = pinKey(ref); f.Reference == "" {
+			return f, fmt.Errorf("invalid reference %q: not a tag", s)
+		}
+	}
+	if s := v.Get("repository"); s != "" {
+		ref, err := reference.ParseNamed(s)
+		if err != nil {
+			return f, fmt.Errorf("invalid repository %q: %v", s, err)
+		}
+		f.Repository = ref.FullName()
+	}
+	if s := v.Get("older-than"); s != "" {
+		if d, err := time.ParseDuration(s); err == nil {
+			f.OlderThan = time.Now().Add(-d)
+		} else if f.OlderThan, err = time.Parse(time.RFC3339, s); err != nil {
+			return f, fmt.Errorf("invalid older-than %q, a duration or an RFC 3339 time", s)
+		}
+	}
+	return f, nil
+}
+
+func (f pinFilter) empty() bool {
+	return f == pinFilter{}
+}
+
+// list returns the pins matching f, by tag.
+func (s *pinStore) list(f pinFilter) map[string]pin {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	pins := make(map[string]pin)
+	for k, p := range s.pins {
+		if f.matches(k, p) {
+			pins[k] = p
+		}
+	}
+	return pins
+}
+
+// prune removes the pins matching f and returns how many were removed.
+func (s *pinStore) prune(f pinFilter) (int, error) {
+	s.mu.Lock()
+	n := 0
+	for k, p := range s.pins {
+		if f.matches(k, p) {
+			delete(s.pins, k)
+			n++
+		}
+	}
+	s.mu.Unlock()
+	if n == 0 {
+		return 0, nil
+	}
+	return n, s.save()
+}
+
+// save writes the database to a temporary file and renames it over the old
+// one so a crash never leaves a truncated database behind.
+func (s *pinStore) save() error {
+	s.saveMu.Lock()
+	defer s.saveMu.Unlock()
+	s.mu.Lock()
+	s.flushing = false
+	data, err := json.Marshal(s.pins)
+	s.mu.Unlock()
+	if err != nil || s.path == "" {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(s.path), 0700); err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
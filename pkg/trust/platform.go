@@ -0,0 +1,156 @@
+package trust
+
+import (
+	"encoding/json"
+	"fmt"
+	"runtime"
+	"strconv"
+	"strings"
+
+	"github.com/containers/image/manifest"
+)
+
+// manifestList is the subset of a Docker manifest list we need to pick the
+// manifest matching a platform.
+type manifestList struct {
+	Manifests []manifestDescriptor `json:"manifests"`
+}
+
+type manifestDescriptor struct {
+	MediaType string   `json:"mediaType"`
+	Digest    string   `json:"digest"`
+	Platform  Platform `json:"platform"`
+}
+
+// Platform is what the manifests of a manifest list are selected by.
+type Platform struct {
+	Architecture string `json:"architecture"`
+	OS           string `json:"os"`
+	Variant      string `json:"variant,omitempty"`
+	// OSVersion is the Windows build images must have been built for,
+	// major.minor.build[.revision].
+	OSVersion string `json:"os.version,omitempty"`
+}
+
+func (p Platform) String() string {
+	s := p.OS + "/" + p.Architecture
+	if p.Variant != "" {
+		s += "/" + p.Variant
+	}
+	if p.OSVersion != "" {
+		s += " (" + p.OSVersion + ")"
+	}
+	return s
+}
+
+// IsManifestList tells whether mimeType is the one of manifest lists.
+func IsManifestList(mimeType string) bool {
+	return mimeType == manifest.DockerV2ListMediaType
+}
+
+// HostPlatform is the platform images are run on, which is the one the
+// caller itself runs on.
+func HostPlatform() Platform {
+	return Platform{OS: runtime.GOOS, Architecture: runtime.GOARCH, OSVersion: hostOSVersion()}
+}
+
+// ParsePlatform parses "os[/arch[/variant]]", the architecture defaulting
+// to the host's. The OS version is the host's for its own OS.
+func ParsePlatform(s string) (Platform, error) {
+	parts := strings.Split(s, "/")
+	if len(parts) > 3 || parts[0] == "" {
+		return Platform{}, fmt.Errorf("invalid platform %q", s)
+	}
+	p := Platform{OS: parts[0], Architecture: runtime.GOARCH}
+	if p.OS == runtime.GOOS {
+		p.OSVersion = hostOSVersion()
+	}
+	if len(parts) > 1 {
+		p.Architecture = parts[1]
+	}
+	if len(parts) > 2 {
+		p.Variant = parts[2]
+	}
+	return p, nil
+}
+
+// PlatformDigest returns the digest of the manifest for p listed in the
+// manifest list m. The child manifest carries signatures of its own, which
+// are only meaningful once it's been checked to have this digest.
+//
+// Like the Windows daemon, manifests with an OS version are only picked
+// for the same build as p, the latest revision first, so that the manifest
+// verified is the one the daemon pulls.
+func PlatformDigest(m []byte, p Platform) (string, error) {
+	var list manifestList
+	if err := json.Unmarshal(m, &list); err != nil {
+		return "", err
+	}
+	var match *manifestDescriptor
+	for i, d := range list.Manifests {
+		if d.Platform.OS != p.OS || d.Platform.Architecture != p.Architecture {
+			continue
+		}
+		if p.Variant != "" && d.Platform.Variant != p.Variant {
+			continue
+		}
+		if d.Platform.OSVersion == "" || p.OSVersion == "" {
+			if match == nil {
+				match = &list.Manifests[i]
+			}
+			continue
+		}
+		if osBuild(d.Platform.OSVersion) != osBuild(p.OSVersion) {
+			continue
+		}
+		if match == nil || osRevision(match.Platform.OSVersion) < osRevision(d.Platform.OSVersion) {
+			match = &list.Manifests[i]
+		}
+	}
+	if match == nil {
+		return "", fmt.Errorf("no manifest for platform %s in manifest list", p)
+	}
+	return match.Digest, nil
+}
+
+// PlatformManifest is an entry of a manifest list.
+type PlatformManifest struct {
+	Platform Platform
+	Digest   string
+}
+
+// PlatformManifests returns the entries of the manifest list m.
+func PlatformManifests(m []byte) ([]PlatformManifest, error) {
+	var list manifestList
+	if err := json.Unmarshal(m, &list); err != nil {
+		return nil, err
+	}
+	entries := make([]PlatformManifest, 0, len(list.Manifests))
+	for _, d := range list.Manifests {
+		entries = append(entries, PlatformManifest{Platform: d.Platform, Digest: d.Digest})
+	}
+	return entries, nil
+}
+
+// osBuild returns the major.minor.build part of the Windows version v.
+func osBuild(v string) string {
+	parts := strings.SplitN(v, ".", 4)
+	if len(parts) > 3 {
+		parts = parts[:3]
+	}
+	return strings.Join(parts, ".")
+}
+
+// osRevision returns the revision of the Windows version v, -1 if it has
+// none.
+func osRevision(v string) int {
+	parts := strings.SplitN(v, ".", 4)
+	if len(parts) < 4 {
+		return -1
+	}
+	r, err := strconv.Atoi(parts[3])
+	if err != nil {
+		return -1
+	}
+	return r
+}
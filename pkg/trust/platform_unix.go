@@ -0,0 +1,10 @@
+//go:build !windows
+// +build !windows
+
+package trust
+
+// hostOSVersion is only known on Windows, where images are built for a
+// given OS version.
+func hostOSVersion() string {
+	return ""
+}
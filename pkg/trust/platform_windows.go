@@ -0,0 +1,34 @@
+package trust
+
+import (
+	"fmt"
+	"syscall"
+	"unsafe"
+)
+
+var procRtlGetVersion = syscall.NewLazyDLL("ntdll.dll").NewProc("RtlGetVersion")
+
+// osVersionInfo is RTL_OSVERSIONINFOW.
+type osVersionInfo struct {
+	size        uint32
+	major       uint32
+	minor       uint32
+	build       uint32
+	platformID  uint32
+	servicePack [128]uint16
+}
+
+// hostOSVersion returns the major.minor.build version of the host, empty
+// if it can't be determined. RtlGetVersion is used as GetVersion lies to
+// programs without a compatibility manifest.
+func hostOSVersion() string {
+	info := osVersionInfo{}
+	info.size = uint32(unsafe.Sizeof(info))
+	if err := procRtlGetVersion.Find(); err != nil {
+		return ""
+	}
+	if status, _, _ := procRtlGetVersion.Call(uintptr(unsafe.Pointer(&info))); status != 0 {
+		return ""
+	}
+	return fmt.Sprintf("%d.%d.%d", info.major, info.minor, info.build)
+}
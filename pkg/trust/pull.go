@@ -0,0 +1,62 @@
+package trust
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/docker/docker/reference"
+	dockerclient "github.com/docker/engine-api/client"
+	"github.com/docker/engine-api/types"
+	"golang.org/x/net/context"
+)
+
+// PullDigest makes the docker daemon pull the verified digest of ref and
+// returns the digest it pulled. When digest is a manifest list only the
+// manifest for plat is pulled, so the layers of every other architecture
+// aren't downloaded. registryAuth is the X-Registry-Auth header to pull
+// with, if any.
+func PullDigest(ctx context.Context, client *dockerclient.Client, ref reference.Named, digest string, m []byte, mimeType string, plat Platform, registryAuth string) (string, error) {
+	if IsManifestList(mimeType) {
+		child, err := PlatformDigest(m, plat)
+		if err != nil {
+			return "", err
+		}
+		digest = child
+	}
+	canonical := ref.FullName() + "@" + digest
+	rc, err := client.ImagePull(ctx, canonical, types.ImagePullOptions{RegistryAuth: registryAuth})
+	if err != nil {
+		return "", err
+	}
+	defer rc.Close()
+	if err := DrainJSONStream(rc); err != nil {
+		return "", fmt.Errorf("pulling %s: %v", canonical, err)
+	}
+	return digest, nil
+}
+
+// StreamMessage is the subset of the daemon progress messages we care about.
+type StreamMessage struct {
+	Status string `json:"status"`
+	Error  string `json:"error"`
+}
+
+// DrainJSONStream consumes a daemon progress stream, which is how pulls and
+// builds report their outcome, and returns the first error reported in it.
+func DrainJSONStream(r io.Reader) error {
+	dec := json.NewDecoder(r)
+	for {
+		var m StreamMessage
+		if err := dec.Decode(&m); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		if m.Error != "" {
+			return errors.New(m.Error)
+		}
+	}
+}
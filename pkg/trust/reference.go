@@ -0,0 +1,188 @@
+// Package trust is the verification core of the container trust plugin:
+// reference normalization and qualification, policy evaluation, digest
+// comparison and pulls of verified digests. It lets other tools, such as CI
+// gates or admission webhooks, take the same decisions as the plugin.
+package trust
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/containers/image/signature"
+	distreference "github.com/docker/distribution/reference"
+	"github.com/docker/docker/reference"
+)
+
+// defaultRegistryPort is stripped from hostnames: registries are always
+// contacted over https first, so "host:443" and "host" are the same registry.
+const defaultRegistryPort = "443"
+
+// NormalizeHostname returns the canonical form of a registry hostname, so
+// that "Registry.Corp:443" and "registry.corp" never evaluate differently:
+// lowercased and the default port stripped. References can't hold
+// internationalized hostnames, only their punycode form.
+func NormalizeHostname(host string) string {
+	name, port := host, ""
+	if i := strings.LastIndex(host, ":"); i >= 0 && !strings.Contains(host[i:], "]") {
+		name, port = host[:i], host[i+1:]
+	}
+	name = strings.TrimSuffix(strings.ToLower(name), ".")
+	if port == "" || port == defaultRegistryPort {
+		return name
+	}
+	return name + ":" + port
+}
+
+// NormalizeReference returns ref with its hostname normalized.
+func NormalizeReference(ref reference.Named) (reference.Named, error) {
+	host, remote := SplitHostAndRemote(ref.Name())
+	if host == "" {
+		return ref, nil
+	}
+	normalized := NormalizeHostname(host)
+	if normalized == host {
+		return ref, nil
+	}
+	return SubstituteReferenceName(ref, normalized+"/"+remote)
+}
+
+// NormalizeScope normalizes the hostname part of a policy scope.
+func NormalizeScope(scope string) string {
+	host, rest := scope, ""
+	if i := strings.Index(scope, "/"); i >= 0 {
+		host, rest = scope[:i], scope[i:]
+	}
+	if host == "" {
+		return scope
+	}
+	return NormalizeHostname(host) + rest
+}
+
+// NormalizePolicyScopes rewrites the docker transport scopes of policy with
+// normalized hostnames, failing if two scopes end up being the same.
+func NormalizePolicyScopes(policy *signature.Policy) error {
+	scopes, ok := policy.Transports["docker"]
+	if !ok {
+		return nil
+	}
+	normalized := make(signature.PolicyTransportScopes, len(scopes))
+	for scope, reqs := range scopes {
+		n := NormalizeScope(scope)
+		if _, dup := normalized[n]; dup {
+			return fmt.Errorf("policy scopes for %q collide once normalized to %q", scope, n)
+		}
+		normalized[n] = reqs
+	}
+	policy.Transports["docker"] = normalized
+	return nil
+}
+
+// SplitHostAndRemote splits name in its hostname, if any, and the rest.
+func SplitHostAndRemote(name string) (string, string) {
+	i := strings.Index(name, "/")
+	if i < 0 {
+		return "", name
+	}
+	if host := name[:i]; IsValidHostname(host) {
+		return host, name[i+1:]
+	}
+	return "", name
+}
+
+// ParseNormalizedReference parses s and normalizes its hostname.
+func ParseNormalizedReference(s string) (reference.Named, error) {
+	ref, err := reference.ParseNamed(s)
+	if err != nil {
+		return nil, err
+	}
+	return NormalizeReference(ref)
+}
+
+// ParseImageReference parses the image a container, service or build refers
+// to, defaulting the tag and dropping it when a digest is given as well.
+func ParseImageReference(s string) (reference.Named, error) {
+	ref, err := ParseNormalizedReference(s)
+	if err != nil {
+		return nil, err
+	}
+	if c, ok := ref.(reference.Canonical); ok {
+		name, err := reference.WithName(c.Name())
+		if err != nil {
+			return nil, err
+		}
+		return reference.WithDigest(name, c.Digest())
+	}
+	if reference.IsNameOnly(ref) {
+		ref = reference.WithDefaultTag(ref)
+	}
+	return ref, nil
+}
+
+// IsReferenceFullyQualified determines whether the given reposName has prepended
+// name of index.
+func IsReferenceFullyQualified(reposName reference.Named) bool {
+	indexName, _, _ := SplitReposName(reposName)
+	return indexName != ""
+}
+
+// SplitReposName breaks a reposName into an index name and remote name
+func SplitReposName(reposName reference.Named) (indexName string, remoteName reference.Named, err error) {
+	var remoteNameStr string
+	indexName, remoteNameStr = distreference.SplitHostname(reposName)
+	if !IsValidHostname(indexName) {
+		// This is a Docker Index repos (ex: samalba/hipache or ubuntu)
+		// 'docker.io'
+		indexName = ""
+		remoteName = reposName
+	} else {
+		remoteName, err = reference.WithName(remoteNameStr)
+	}
+	return
+}
+
+// IsValidHostname tells whether hostname, the first component of a
+// repository name, is a registry hostname.
+func IsValidHostname(hostname string) bool {
+	return hostname != "" && !strings.Contains(hostname, "/") &&
+		(strings.Contains(hostname, ".") ||
+			strings.Contains(hostname, ":") || hostname == "localhost")
+}
+
+// QualifyUnqualifiedReference prepends indexName to ref unless it's already
+// fully qualified.
+func QualifyUnqualifiedReference(ref reference.Named, indexName string) (reference.Named, error) {
+	if !IsValidHostname(indexName) {
+		return nil, fmt.Errorf("Invalid hostname %q", indexName)
+	}
+	orig, remoteName, err := SplitReposName(ref)
+	if err != nil {
+		return nil, err
+	}
+	if orig == "" {
+		return SubstituteReferenceName(ref, indexName+"/"+remoteName.Name())
+	}
+	return ref, nil
+}
+
+// SubstituteReferenceName creates a new image reference from given ref with
+// its *name* part substituted for reposName.
+func SubstituteReferenceName(ref reference.Named, reposName string) (newRef reference.Named, err error) {
+	reposNameRef, err := reference.WithName(reposName)
+	if err != nil {
+		return nil, err
+	}
+	if tagged, isTagged := ref.(distreference.Tagged); isTagged {
+		newRef, err = reference.WithTag(reposNameRef, tagged.Tag())
+		if err != nil {
+			return nil, err
+		}
+	} else if digested, isDigested := ref.(distreference.Digested); isDigested {
+		newRef, err = reference.WithDigest(reposNameRef, digested.Digest())
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		newRef = reposNameRef
+	}
+	return
+}
@@ -0,0 +1,204 @@
+package trust
+
+import (
+	"fmt"
+
+	"github.com/containers/image/docker"
+	"github.com/containers/image/manifest"
+	"github.com/containers/image/signature"
+	"github.com/containers/image/types"
+	"github.com/docker/distribution/digest"
+	"github.com/docker/docker/reference"
+)
+
+// Verifier decides whether an image may be used.
+type Verifier interface {
+	// Verify verifies ref, failing with a *RejectionError or a
+	// *DigestMismatchError if it may not be used and with any other
+	// error if it couldn't be verified at all.
+	Verify(ref reference.Named) (*Result, error)
+}
+
+// Result describes a verified image.
+type Result struct {
+	// Digest is the digest of the manifest of the image, of the manifest
+	// list if it's a multi-platform image.
+	Digest   string
+	Manifest []byte
+	MIMEType string
+	// Image is the verified image, the one for the requested platform for
+	// multi-platform images.
+	Image types.Image
+	// ImageRef is the reference of Image.
+	ImageRef types.ImageReference
+}
+
+// RejectionError is returned when the policy rejects an image.
+type RejectionError struct {
+	Reference string
+	// Digest is the digest of the manifest of the rejected image.
+	Digest string
+	// Err is the reason given by the policy, if any.
+	Err error
+}
+
+func (e *RejectionError) Error() string {
+	if e.Err == nil {
+		return fmt.Sprintf("%s isn't allowed", e.Reference)
+	}
+	return fmt.Sprintf("%s isn't allowed: %v", e.Reference, e.Err)
+}
+
+// DigestMismatchError is returned when the manifest of an image verified by
+// digest has another digest.
+type DigestMismatchError struct {
+	Provided, Computed string
+}
+
+func (e *DigestMismatchError) Error() string {
+	return fmt.Sprintf("digests mismatch, provided %s, computed %s", e.Provided, e.Computed)
+}
+
+// IsPolicyRejection tells whether err is the outcome of evaluating the policy,
+// as opposed to a failure to get at the image or its signatures.
+func IsPolicyRejection(err error) bool {
+	switch err.(type) {
+	case signature.InvalidSignatureError, signature.PolicyRequirementError:
+		return true
+	}
+	return false
+}
+
+// PolicyVerifier verifies images against a signature policy.
+type PolicyVerifier struct {
+	Policy *signature.Policy
+	// Platform selects the manifest verified for manifest lists, the
+	// host's if zero.
+	Platform Platform
+	// FetchImage gets the image ref refers to, straight from its registry
+	// if nil.
+	FetchImage func(ref types.ImageReference) (types.Image, error)
+	// Evaluate evaluates the policy for img, using Policy if nil.
+	Evaluate func(ref reference.Named, img types.Image) (bool, error)
+	// CheckDigest, if set, decides on digests ahead of the policy: it's
+	// called with the digest of the manifest, and of the manifest for the
+	// platform for manifest lists. A non nil error rejects the image, true
+	// allows it without evaluating the policy.
+	CheckDigest func(digest string) (bool, error)
+}
+
+// NewPolicyVerifier returns a verifier for policy.
+func NewPolicyVerifier(policy *signature.Policy) *PolicyVerifier {
+	return &PolicyVerifier{Policy: policy}
+}
+
+// Verify implements Verifier. For manifest lists, the manifest for the
+// platform is verified, once checked to have the digest the list names,
+// while requested digests are compared at the list level.
+func (v *PolicyVerifier) Verify(ref reference.Named) (*Result, error) {
+	imgRef, img, err := v.fetch(ref)
+	if err != nil {
+		return nil, err
+	}
+	m, mimeType, err := img.Manifest()
+	if err != nil {
+		return nil, err
+	}
+	dgst, err := manifest.Digest(m)
+	if err != nil {
+		return nil, err
+	}
+	if c, ok := ref.(reference.Canonical); ok && c.Digest().String() != dgst {
+		return nil, &DigestMismatchError{Provided: c.Digest().String(), Computed: dgst}
+	}
+	digests := []string{dgst}
+	verifiedRef := ref
+	if IsManifestList(mimeType) {
+		plat := v.Platform
+		if plat == (Platform{}) {
+			plat = HostPlatform()
+		}
+		child, err := PlatformDigest(m, plat)
+		if err != nil {
+			return nil, err
+		}
+		name, err := reference.WithName(ref.Name())
+		if err != nil {
+			return nil, err
+		}
+		if verifiedRef, err = reference.WithDigest(name, digest.Digest(child)); err != nil {
+			return nil, err
+		}
+		if imgRef, img, err = v.fetch(verifiedRef); err != nil {
+			return nil, err
+		}
+		// The registry could answer with any other manifest of the
+		// repository, whose signatures would then be checked instead.
+		cm, _, err := img.Manifest()
+		if err != nil {
+			return nil, err
+		}
+		cdgst, err := manifest.Digest(cm)
+		if err != nil {
+			return nil, err
+		}
+		if cdgst != child {
+			return nil, &DigestMismatchError{Provided: child, Computed: cdgst}
+		}
+		digests = append(digests, child)
+	}
+	result := &Result{Digest: dgst, Manifest: m, MIMEType: mimeType, Image: img, ImageRef: imgRef}
+	if v.CheckDigest != nil {
+		listed := false
+		for _, d := range digests {
+			allowed, err := v.CheckDigest(d)
+			if err != nil {
+				return nil, &RejectionError{Reference: imgRef.DockerReference().String(), Digest: dgst, Err: err}
+			}
+			listed = listed || allowed
+		}
+		if listed {
+			return result, nil
+		}
+	}
+	allowed, err := v.evaluate(verifiedRef, img)
+	if !allowed {
+		if err != nil && !IsPolicyRejection(err) {
+			return nil, err
+		}
+		return nil, &RejectionError{Reference: imgRef.DockerReference().String(), Digest: dgst, Err: err}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func (v *PolicyVerifier) fetch(ref reference.Named) (types.ImageReference, types.Image, error) {
+	imgRef, err := docker.NewReference(ref)
+	if err != nil {
+		return nil, nil, err
+	}
+	var img types.Image
+	if v.FetchImage != nil {
+		img, err = v.FetchImage(imgRef)
+	} else {
+		img, err = imgRef.NewImage(nil)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	return imgRef, img, nil
+}
+
+func (v *PolicyVerifier) evaluate(ref reference.Named, img types.Image) (bool, error) {
+	if v.Evaluate != nil {
+		return v.Evaluate(ref, img)
+	}
+	pc, err := signature.NewPolicyContext(v.Policy)
+	if err != nil {
+		return false, err
+	}
+	defer pc.Destroy()
+	return pc.IsRunningImageAllowed(img)
+}
@@ -3,46 +3,313 @@ package main
 import (
 	"crypto/tls"
 	"fmt"
-	"io/ioutil"
 	"net/http"
-	"net/url"
 	"path/filepath"
-	"regexp"
-	"strings"
+	"sync/atomic"
+	"time"
 
 	"golang.org/x/net/context"
 
-	"github.com/containers/image/docker"
-	"github.com/containers/image/manifest"
-	"github.com/containers/image/signature"
+	"github.com/Sirupsen/logrus"
 	"github.com/docker/distribution/digest"
-	distreference "github.com/docker/distribution/reference"
 	dockerapi "github.com/docker/docker/api"
 	"github.com/docker/docker/reference"
 	dockerclient "github.com/docker/engine-api/client"
 	"github.com/docker/go-connections/sockets"
 	"github.com/docker/go-plugins-helpers/authorization"
-	"gopkg.in/yaml.v2"
+	"github.com/projectatomic/container-trust-plugin/pkg/trust"
 )
 
 type conf struct {
-	Enabled bool `yaml:"enabled"`
+	// Enabled turns enforcement off when false. It can be overridden at
+	// runtime with SIGUSR1 (off) and SIGUSR2 (on).
+	Enabled *bool `yaml:"enabled"`
+	// LogDisabled logs the requests let through unchecked while
+	// enforcement is off.
+	LogDisabled bool `yaml:"log-disabled"`
+	// EnforcementMode is enforce (the default) or audit, in which denials
+	// are only logged and recorded and requests are let through.
+	EnforcementMode string `yaml:"enforcement-mode"`
+	// LocalTrust allows pulls of pinned tags already present locally when
+	// the registry can't be reached.
+	LocalTrust bool `yaml:"local-trust"`
+	// PinStore is the path of the pinning database.
+	PinStore string `yaml:"pin-store"`
+	// CertsDir holds the CAs and client certificates of registries in a
+	// directory per registry, like the daemon, /etc/docker/certs.d by
+	// default.
+	CertsDir string `yaml:"certs-dir"`
+	// DockerConfig is the path of a docker config.json the registry
+	// credentials are read from for the requests which carry none.
+	DockerConfig string `yaml:"docker-config"`
+	// RecordRequests is the path of a file the requests are appended to,
+	// without their credentials, for "container-trust-plugin bench".
+	RecordRequests string `yaml:"record-requests"`
+	// AuditLog is the path of the file decisions are appended to.
+	AuditLog string `yaml:"audit-log"`
+	// AuditLogRotation rotates AuditLog by size.
+	AuditLogRotation auditRotationConf `yaml:"audit-log-rotation"`
+	// AuditStderr writes decisions to stderr too.
+	AuditStderr bool `yaml:"audit-stderr"`
+	// AuditSinks publish decisions to event buses.
+	AuditSinks []auditSinkConf `yaml:"audit-sinks"`
+	// Notifications are the webhooks notified of denied pulls and
+	// container creations.
+	Notifications []notificationConf `yaml:"notifications"`
+	// TeamsManifest is the path of a manifest mapping image namespaces to
+	// the keys of the team owning them.
+	TeamsManifest string `yaml:"teams-manifest"`
+	// Prefetch keeps the registry data of frequently pulled images warm.
+	Prefetch prefetchConf `yaml:"prefetch"`
+	// AutoPull makes the plugin pull verified tags by digest and tag them
+	// itself instead of asking the user to do so.
+	AutoPull bool `yaml:"autopull"`
+	// AutoPullLabels records the verification decision as labels on the
+	// images tagged by AutoPull.
+	AutoPullLabels bool `yaml:"autopull-labels"`
+	// ShadowVerify records the digests and errors the daemon reports back
+	// for pulls in the audit log, for later reconciliation.
+	ShadowVerify bool `yaml:"shadow-verify"`
+	// AcceptAnythingGuards are enforced on images whose policy scope is
+	// insecureAcceptAnything.
+	AcceptAnythingGuards *guardsConf `yaml:"accept-anything-guards"`
+	// UnqualifiedNames is how pulls of unqualified names are handled:
+	// allow (the default), nudge or deny.
+	UnqualifiedNames string `yaml:"unqualified-names"`
+	// Quotas limit pulls per user and/or policy scope.
+	Quotas []quotaRule `yaml:"quotas"`
+	// ApprovedDigests is a signed list of approved digests per repository.
+	ApprovedDigests *approvedDigestsConf `yaml:"approved-digests"`
+	// ClientTimeout is how long the daemon waits for the plugin. Requests
+	// taking longer are answered before it expires while the verification
+	// goes on in the background.
+	ClientTimeout time.Duration `yaml:"client-timeout"`
+	// AllowUncheckedBuilds allows builds whose context the daemon didn't
+	// forward, so that their base images can't be verified.
+	AllowUncheckedBuilds bool `yaml:"allow-unchecked-builds"`
+	// AllowLoad allows docker load of image tarballs.
+	AllowLoad bool `yaml:"allow-load"`
+	// ImportExempt lists the users and sources docker import is allowed
+	// for. Everything else is denied.
+	ImportExempt importExemptConf `yaml:"import-exempt"`
+	// ServicesRequireDigest denies swarm services whose image isn't pinned
+	// by digest.
+	ServicesRequireDigest bool `yaml:"services-require-digest"`
+	// RequirePluginSignatures runs the images of docker plugins through
+	// the policy too.
+	RequirePluginSignatures bool `yaml:"require-plugin-signatures"`
+	// ProtectedNamespaces are the repositories and namespaces images can
+	// be tagged into only if they were verified from there.
+	ProtectedNamespaces []string `yaml:"protected-namespaces"`
+	// SignedPushRegistries are the registries only signed images may be
+	// pushed to.
+	SignedPushRegistries []string `yaml:"signed-push-registries"`
+	// AllTags allows pulls of all the tags of a repository once they've
+	// all been verified.
+	AllTags *allTagsConf `yaml:"all-tags"`
+	// VerifyOnStart verifies the image of containers again when they're
+	// started.
+	VerifyOnStart bool `yaml:"verify-on-start"`
+	// ProtectPinnedImages refuses removal of images whose digest is in the
+	// pinning database.
+	ProtectPinnedImages bool `yaml:"protect-pinned-images"`
+	// Commit configures how docker commit is handled.
+	Commit commitConf `yaml:"commit"`
+	// Quarantine admits images failing verification in some scopes, and
+	// keeps track of them.
+	Quarantine *quarantineConf `yaml:"quarantine"`
+	// Registries restricts the registries images may come from.
+	Registries registriesConf `yaml:"registries"`
+	// Sockets are the sockets the plugin serves on, e.g. one per docker
+	// daemon, /run/docker/plugins/container-trust-plugin.sock by default:
+	// unix socket paths, or tcp://host:port served with ListenTLS.
+	Sockets []string `yaml:"sockets"`
+	// ListenTLS is the mutual TLS configuration of the TCP sockets.
+	ListenTLS listenTLSConf `yaml:"listen-tls"`
+	// Policy is the path of the signature policy, /etc/containers/policy.json
+	// by default.
+	Policy string `yaml:"policy"`
+	// PolicyDir is a directory of policy fragments merged into the
+	// policy, /etc/containers/policy.d by default.
+	PolicyDir string `yaml:"policy-dir"`
+	// Repositories maps repository patterns to the action applying to
+	// their images: allow-unsigned, deny, enforce, audit or quarantine.
+	Repositories map[string]string `yaml:"repositories"`
+	// Users maps the users the daemon authenticated to policy profiles.
+	Users usersConf `yaml:"users"`
+	// BreakGlass configures the grants lifting the denials of an image for
+	// a limited time.
+	BreakGlass breakGlassConf `yaml:"break-glass"`
+	// Digests lists image digests allowed or blocked whatever their
+	// signatures.
+	Digests digestsConf `yaml:"digests"`
+	// MaxSignatureAge rejects images whose newest signature is older,
+	// even if valid.
+	MaxSignatureAge time.Duration `yaml:"max-signature-age"`
+	// SignatureThresholds require images to be signed by several keys.
+	SignatureThresholds []signatureThreshold `yaml:"signature-thresholds"`
+	// TagImmutability handles pulls of tags which moved since they were
+	// pinned.
+	TagImmutability tagImmutabilityConf `yaml:"tag-immutability"`
+	// MaxImageAge denies images created longer ago, so that they're
+	// rebuilt on current base images.
+	MaxImageAge time.Duration `yaml:"max-image-age"`
+	// RequiredLabels are the labels images must carry.
+	RequiredLabels []labelRule `yaml:"required-labels"`
+	// TOFU records the keys which signed the first verified image of a
+	// repository and requires them for later ones.
+	TOFU *tofuConf `yaml:"tofu"`
+	// Webhook is an external decision point whose answer on every image
+	// decided on is enforced.
+	Webhook *webhookConf `yaml:"webhook"`
+	// Freezes are the change freeze windows, during which no image may be
+	// pulled and only pinned images may be started.
+	Freezes []freezeWindow `yaml:"freezes"`
+	// CandidatePolicy is a policy file evaluated alongside the active
+	// policy, whose divergent decisions are logged but not enforced.
+	CandidatePolicy string `yaml:"candidate-policy"`
+	// Admin enables the admin API.
+	Admin *adminConf `yaml:"admin"`
+	// History keeps the decisions on disk for the history queries of the
+	// admin API.
+	History *historyConf `yaml:"history"`
+	// Tracing exports spans of the verification of requests over OTLP.
+	Tracing *tracingConf `yaml:"tracing"`
+	// Retries retry the registry accesses failing for a transient reason.
+	Retries retriesConf `yaml:"retries"`
+	// CircuitBreaker stops contacting the registries which keep failing
+	// for a while.
+	CircuitBreaker *breakerConf `yaml:"circuit-breaker"`
+	// DaemonInfoTTL is how long the registries and mirrors of the daemon
+	// are cached, 5m by default.
+	DaemonInfoTTL time.Duration `yaml:"daemon-info-ttl"`
+	// Proxy sets the HTTP(S) proxies of the outbound connections instead
+	// of the environment.
+	Proxy *proxyConf `yaml:"proxy"`
+	// RegistryConnections tunes the connection pool of the registry
+	// clients.
+	RegistryConnections registryConnectionsConf `yaml:"registry-connections"`
+	// Timeouts bound the registry and daemon accesses of decisions.
+	Timeouts timeoutsConf `yaml:"timeouts"`
+	// Concurrency bounds the verifications and AutoPulls running at once.
+	Concurrency concurrencyConf `yaml:"concurrency"`
+	// VerificationCache caches the images the policy allowed by digest.
+	VerificationCache *verdictCacheConf `yaml:"verification-cache"`
+	// ManifestLists configures the verification of multi-platform images.
+	ManifestLists manifestListsConf `yaml:"manifest-lists"`
+	// ContainerStorage is where Podman and CRI-O keep their containers, for
+	// the OCI hook, /var/lib/containers/storage by default.
+	ContainerStorage string `yaml:"container-storage"`
 }
 
-const (
-	pluginConfPath = "/etc/docker/container-trust-plugin.yaml"
-)
+// newOfflinePlugin returns a plugin taking decisions in process, without a
+// daemon: its pins and quarantined digests are kept in memory, and its
+// decisions aren't recorded. The caller stores the snapshot.
+func newOfflinePlugin() *trustPlugin {
+	return &trustPlugin{
+		pins:              &pinStore{pins: make(map[string]pin)},
+		quarantine:        &quarantineStore{digests: make(map[string]quarantined)},
+		prefetch:          newPrefetcher(),
+		quotas:            newQuotaTracker(),
+		pending:           newPendingDecisions(),
+		info:              newDaemonInfoCache(),
+		builds:            newOwnBuilds(),
+		stats:             newStatsSink(),
+		verdicts:          newVerdictCache(),
+		flights:           newFlightGroup(),
+		verifications:     newLimiter("verifications"),
+		autopulls:         newLimiter("autopulls"),
+		retries:           newRetryBudget(),
+		breakers:          newRegistryBreakers(),
+		dockerCredentials: newCredentialStore(),
+		transports:        newRegistryTransports(),
+	}
+}
 
 func newPlugin(dockerHost, certPath string, tlsVerify bool) (*trustPlugin, error) {
-	confFile, err := ioutil.ReadFile(pluginConfPath)
+	snap, err := loadSnapshot()
+	if err != nil {
+		return nil, err
+	}
+	client, err := newDockerClient(dockerHost, certPath, tlsVerify)
+	if err != nil {
+		return nil, err
+	}
+	setupRegistryConnections(snap.config.RegistryConnections)
+	pinStorePath := snap.config.PinStore
+	if pinStorePath == "" {
+		pinStorePath = defaultPinStorePath
+	}
+	pins, err := newPinStore(pinStorePath)
 	if err != nil {
 		return nil, err
 	}
-	var config conf
-	if err := yaml.Unmarshal(confFile, &config); err != nil {
+	audit, err := newAuditLog(snap.config)
+	if err != nil {
+		return nil, err
+	}
+	quarantinePath := defaultQuarantineStorePath
+	if q := snap.config.Quarantine; q != nil && q.Store != "" {
+		quarantinePath = q.Store
+	}
+	quarantine, err := newQuarantineStore(quarantinePath)
+	if err != nil {
 		return nil, err
 	}
-	c := &http.Client{}
+	var tofu *tofuStore
+	if t := snap.config.TOFU; t != nil {
+		if tofu, err = newTOFUStore(t.store()); err != nil {
+			return nil, err
+		}
+	}
+	var recent *recentDecisions
+	if a := snap.config.Admin; a != nil {
+		recent = newRecentDecisions(a.RecentDecisions)
+		audit = audit.add(recent)
+	}
+	var history *historyStore
+	if h := snap.config.History; h != nil {
+		if history, err = newHistoryStore(*h); err != nil {
+			return nil, err
+		}
+		audit = audit.add(history)
+	}
+	stats := newStatsSink()
+	audit = audit.add(stats)
+	var tr *tracer
+	if t := snap.config.Tracing; t != nil {
+		tr = newTracer(*t)
+	}
+	var recorder *requestRecorder
+	if path := snap.config.RecordRequests; path != "" {
+		if recorder, err = newRequestRecorder(path); err != nil {
+			return nil, err
+		}
+	}
+	p := newOfflinePlugin()
+	p.client, p.pins, p.audit, p.quarantine, p.tofu = client, pins, audit, quarantine, tofu
+	p.recent, p.history, p.tracer, p.stats, p.recorder = recent, history, tr, stats, recorder
+	p.snapshots.store(snap)
+	setupProxy(func() conf { return p.snapshots.load().config })
+	go p.prefetch.run(p)
+	go p.watchReload()
+	go p.watchToggle()
+	go p.watchDaemonEvents()
+	return p, nil
+}
+
+// newDockerClient returns a client for the docker daemon at dockerHost.
+func newDockerClient(dockerHost, certPath string, tlsVerify bool) (*dockerclient.Client, error) {
+	tr, err := dockerTransport(dockerHost, certPath, tlsVerify)
+	if err != nil {
+		return nil, err
+	}
+	return dockerclient.NewClient(dockerHost, dockerapi.DefaultVersion, &http.Client{Transport: tr}, nil)
+}
+
+// dockerTransport returns the transport to reach the docker daemon at
+// dockerHost with.
+func dockerTransport(dockerHost, certPath string, tlsVerify bool) (*http.Transport, error) {
 	if certPath != "" {
 		tlsc := &tls.Config{}
 
@@ -53,174 +320,397 @@ func newPlugin(dockerHost, certPath string, tlsVerify bool) (*trustPlugin, error
 
 		tlsc.Certificates = append(tlsc.Certificates, cert)
 		tlsc.InsecureSkipVerify = !tlsVerify
-		transport := &http.Transport{
+		return &http.Transport{
 			TLSClientConfig: tlsc,
-		}
-		c.Transport = transport
-	} else {
-		proto, addr, _, err := dockerclient.ParseHost(dockerHost)
-		if err != nil {
-			return nil, err
-		}
-		tr := new(http.Transport)
-		sockets.ConfigureTransport(tr, proto, addr)
-		c.Transport = tr
+		}, nil
 	}
-
-	client, err := dockerclient.NewClient(dockerHost, dockerapi.DefaultVersion, c, nil)
+	proto, addr, _, err := dockerclient.ParseHost(dockerHost)
 	if err != nil {
 		return nil, err
 	}
-	return &trustPlugin{client: client, config: config}, nil
+	tr := new(http.Transport)
+	sockets.ConfigureTransport(tr, proto, addr)
+	return tr, nil
 }
 
-var (
-	pullRegExp = regexp.MustCompile(`/images/create(\?fromImage=([^&]*)(&tag=(.*)?)?)?`)
-)
-
 type trustPlugin struct {
-	config conf
-	client *dockerclient.Client
+	// inflight counts the decisions being taken. It comes first for the
+	// 64-bit alignment atomic operations need.
+	inflight int64
+	// serving is set once the plugin sockets are served.
+	serving    int32
+	snapshots  snapshotHolder
+	client     *dockerclient.Client
+	pins       *pinStore
+	audit      *auditLog
+	prefetch   *prefetcher
+	quotas     *quotaTracker
+	pending    *pendingDecisions
+	builds     *ownBuilds
+	quarantine *quarantineStore
+	tofu       *tofuStore
+	toggle     enforcementToggle
+	recent     *recentDecisions
+	history    *historyStore
+	tracer     *tracer
+	stats      *statsSink
+	verdicts   *verdictCache
+	flights    *flightGroup
+	// verifications and autopulls bound the verifications and AutoPulls
+	// running at once.
+	verifications *limiter
+	autopulls     *limiter
+	// retries is the budget of the retries of registry accesses.
+	retries  *retryBudget
+	breakers *registryBreakers
+	// info caches the docker info of the daemon.
+	info *daemonInfoCache
+	// dockerCredentials caches the credentials read from docker-config.
+	dockerCredentials *credentialStore
+	// transports are the transports of the registries with TLS settings
+	// of their own.
+	transports *registryTransports
+	// recorder records the requests, with record-requests.
+	recorder *requestRecorder
 }
 
 func (p *trustPlugin) AuthZReq(req authorization.Request) authorization.Response {
-	decodedURL, err := url.QueryUnescape(req.RequestURI)
-	if err != nil {
-		return authorization.Response{Err: err.Error()}
+	if p.recorder != nil {
+		p.recorder.record(req)
+	}
+	cfg := p.snapshots.load().config
+	if !p.toggle.enabled(cfg) {
+		return disabled(cfg, req)
+	}
+	if timeout := cfg.ClientTimeout; timeout > 0 {
+		return p.decideWithin(req, timeout)
+	}
+	return p.decide(req)
+}
+
+// decide takes the decision for req, records it and returns it.
+func (p *trustPlugin) decide(req authorization.Request) authorization.Response {
+	atomic.AddInt64(&p.inflight, 1)
+	defer atomic.AddInt64(&p.inflight, -1)
+	rec := newAuditRecord(req)
+	var cancel context.CancelFunc
+	rec.ctx, cancel = p.snapshots.load().config.Timeouts.decisionContext()
+	defer cancel()
+	rec.ctx = withRegistryAuth(rec.ctx, req)
+	rec.span = p.tracer.startRequest(req)
+	rec.span.set("trust.id", rec.ID)
+	var res authorization.Response
+	if m, ok := matchExtension(req); ok {
+		rec.log().Debugf("request %s %s decided by matcher %s", req.RequestMethod, req.RequestURI, m.name)
+		rec.intercepted = true
+		rec.endpoint = "matcher:" + m.name
+		res = m.Decide(req)
+	} else {
+		res = p.authZReq(req, rec)
+	}
+	res = runDecisionHooks(req, res)
+	snap := p.snapshots.load()
+	if snap.webhook != nil && rec.intercepted && rec.Reference != "" {
+		ws := rec.span.client("webhook")
+		res = snap.webhook.decide(req, rec, res)
+		ws.set("trust.allowed", res.Allow)
+		ws.finish(nil)
 	}
-	if req.RequestMethod == "POST" && pullRegExp.MatchString(decodedURL) {
-		res := pullRegExp.FindStringSubmatch(decodedURL)
-		if len(res) < 5 {
-			return authorization.Response{Err: "unable to find repository name and reference"}
+	cfg := snap.config
+	if name, _, ok := cfg.Users.profile(req.User); ok {
+		rec.Profile = name
+	}
+	if rec.intercepted && rec.Reference != "" {
+		rec.PolicyScope = policyScopeOf(snap.policy, rec.Reference)
+	}
+	allowed, audited := auditOnly(enforcementMode(cfg, rec), rec, res)
+	overridden := audited
+	if !overridden {
+		allowed, overridden = userExemption(cfg.Users, req, rec, res)
+	}
+	if !overridden {
+		allowed, _ = breakGlass(cfg.BreakGlass, rec, res)
+	}
+	p.audit.record(rec, res)
+	if rec.Reference != "" {
+		rec.span.set("image.reference", rec.Reference)
+	}
+	if rec.Digest != "" {
+		rec.span.set("image.digest", rec.Digest)
+	}
+	rec.span.finishResponse(res)
+	res = allowed
+	if audited {
+		// The warning of the denial doesn't apply anymore.
+		rec.Warning = ""
+	}
+	if rec.Warning != "" {
+		rec.log().Warn(rec.Warning)
+		if res.Err != "" {
+			res.Err += " (" + rec.Warning + ")"
+		} else if res.Msg != "" {
+			res.Msg += " (" + rec.Warning + ")"
+		} else {
+			res.Msg = rec.Warning
 		}
-		ref, err := reference.ParseNamed(res[2])
-		if err != nil {
-			return authorization.Response{Err: err.Error()}
+	}
+	if !res.Allow && rec.intercepted {
+		// Lets users reporting a denial point at its audit record.
+		if res.Err != "" {
+			res.Err += " (correlation ID " + rec.ID + ")"
+		} else {
+			res.Msg += " (correlation ID " + rec.ID + ")"
 		}
+	}
+	return res
+}
 
-		var isByDigest bool
-		if res[4] != "" {
-			// The "tag" could actually be a digest.
-			var dgst digest.Digest
-			dgst, err = digest.ParseDigest(res[4])
-			if err == nil {
-				ref, err = reference.WithDigest(ref, dgst)
-				isByDigest = true
-			} else {
-				ref, err = reference.WithTag(ref, res[4])
-			}
-			if err != nil {
-				return authorization.Response{Err: err.Error()}
-			}
+func (p *trustPlugin) authZReq(req authorization.Request, rec *auditRecord) authorization.Response {
+	// Everything below is evaluated against this single snapshot even if a
+	// newer one gets published while we're still working on the request.
+	snap := p.snapshots.load()
+	i, m, err := intercept(req)
+	if err != nil {
+		return errResponse(codeInvalidRequest, err)
+	}
+	if i == nil {
+		return authorization.Response{Allow: true}
+	}
+	rec.log().Debugf("request %s %s handled by the %s interceptor", req.RequestMethod, req.RequestURI, i.Name())
+	rec.endpoint = i.Name()
+	return i.Handle(p, snap, req, m, rec)
+}
+
+// pull verifies the image pulled by req.
+func (p *trustPlugin) pull(snap *snapshot, req authorization.Request, m routeMatch, rec *auditRecord) authorization.Response {
+	rec.intercepted = true
+	name, tagOrDigest, err := pullReference(m.query)
+	if err != nil {
+		return errResponse(codeInvalidReference, err)
+	}
+	ref, err := reference.WithName(name)
+	if err != nil {
+		return errResponse(codeInvalidReference, err)
+	}
+	if ref, err = trust.NormalizeReference(ref); err != nil {
+		return errResponse(codeInvalidReference, err)
+	}
+
+	var isByDigest, allTags bool
+	if tagOrDigest != "" {
+		// The "tag" could actually be a digest.
+		var dgst digest.Digest
+		dgst, err = digest.ParseDigest(tagOrDigest)
+		if err == nil {
+			ref, err = reference.WithDigest(ref, dgst)
+			isByDigest = true
 		} else {
-			return authorization.Response{Err: "unable to verify all tags for the given image"}
+			ref, err = reference.WithTag(ref, tagOrDigest)
 		}
-		if reference.IsNameOnly(ref) {
-			ref = reference.WithDefaultTag(ref)
+		if err != nil {
+			return errResponse(codeInvalidReference, err)
 		}
+	} else if snap.config.AllTags != nil {
+		allTags = true
+	} else {
+		return newTrustError(codeAllTags, "unable to verify all tags for the given image").response()
+	}
+	if _, profile, ok := snap.config.Users.profile(req.User); ok && profile.RequireDigest && !isByDigest {
+		rec.Reference = ref.String()
+		return newTrustError(codePullByTag, "user %s may only pull by digest", req.User).response()
+	}
+	if reference.IsNameOnly(ref) && !allTags {
+		ref = reference.WithDefaultTag(ref)
+	}
+	unqualified := !trust.IsReferenceFullyQualified(ref)
+	rec.log().Debugf("pull of %s %q parsed as %s (fully qualified: %t)", name, tagOrDigest, ref, !unqualified)
+
+	registries, err := p.getAdditionalDockerRegistries(rec.ctx, snap.config)
+	if err != nil {
+		return errResponse(codeDaemonUnreachable, err)
+	}
+	rec.log().Debugf("registries of the daemon: %v", registries)
+
+	// Pull with an unqualified image and projectatomic/docker
+	//
+	// this is the case where the plugin is talking to a projectatomic/docker
+	// and we can't have the signature check because we can only control the
+	// first registry in "registries" and we can't say anything about the others
+	// which will be tried inside the daemon.
+	//
+	// if this chekc is false we assume the first registry is docker.io
+	// and the signature check  can be done below.
+	if unqualified && len(registries) > 1 {
+		return newTrustError(codeUnqualified, "can't check signatures, please pull with a fully qualified image name").response()
+	}
+
+	var defaultRegistry string
+	if len(registries) != 0 {
+		defaultRegistry = registries[0]
+	}
 
-		registries, err := p.getAdditionalDockerRegistries()
+	// If we're talking to a projectatomic/docker and one has --block-registry=public
+	// and --add-registry=redhat.io, we'll qualify the reference with that
+	// registry configured as the first.
+	//
+	// docker pull rhel/rhel7 # --add-registry=redhat.io --block-registry=public
+	// ref == redhat.io/rhel/rhel7
+	if !trust.IsReferenceFullyQualified(ref) && defaultRegistry != "" && defaultRegistry != "docker.io" {
+		defaultRegistry = trust.NormalizeHostname(defaultRegistry)
+		ref, err = trust.QualifyUnqualifiedReference(ref, defaultRegistry)
 		if err != nil {
-			return authorization.Response{Err: err.Error()}
+			return errResponse(codeInvalidReference, err)
 		}
+		rec.log().Debugf("qualified with the first registry of the daemon as %s", ref)
+	}
 
-		// Pull with an unqualified image and projectatomic/docker
-		//
-		// this is the case where the plugin is talking to a projectatomic/docker
-		// and we can't have the signature check because we can only control the
-		// first registry in "registries" and we can't say anything about the others
-		// which will be tried inside the daemon.
-		//
-		// if this chekc is false we assume the first registry is docker.io
-		// and the signature check  can be done below.
-		if !isReferenceFullyQualified(ref) && len(registries) > 1 {
-			return authorization.Response{Err: "can't check signatures, please pull with a fully qualified image name"}
-		}
+	// otherwise, ref is fine to be used now in case we're talking to
+	// a docker/docker engine.
 
-		var defaultRegistry string
-		if len(registries) != 0 {
-			defaultRegistry = registries[0]
+	if unqualified {
+		rec.Warning, err = checkUnqualified(snap.config.UnqualifiedNames, ref)
+		if err != nil {
+			return errResponse(codeUnqualified, err)
 		}
+	}
 
-		// If we're talking to a projectatomic/docker and one has --block-registry=public
-		// and --add-registry=redhat.io, we'll qualify the reference with that
-		// registry configured as the first.
-		//
-		// docker pull rhel/rhel7 # --add-registry=redhat.io --block-registry=public
-		// ref == redhat.io/rhel/rhel7
-		if !isReferenceFullyQualified(ref) && defaultRegistry != "" && defaultRegistry != "docker.io" {
-			ref, err = qualifyUnqualifiedReference(ref, defaultRegistry)
-			if err != nil {
-				return authorization.Response{Err: err.Error()}
-			}
-		}
+	if terr := checkRegistry(snap.config, ref); terr != nil {
+		rec.Reference = ref.String()
+		return terr.response()
+	}
+	if w, ok := activeFreeze(snap.config.Freezes, ref, time.Now()); ok {
+		rec.Reference = ref.String()
+		return newTrustError(codeChangeFreeze, "pulls are frozen (%s)", w).response()
+	}
 
-		// otherwise, ref is fine to be used now in case we're talking to
-		// a docker/docker engine.
+	if allTags {
+		return p.pullAllTags(snap, ref, rec)
+	}
 
-		imgRef, err := docker.NewReference(ref)
-		if err != nil {
-			return authorization.Response{Err: err.Error()}
+	// registryFailure denies the request because the registry couldn't
+	// be reached, unless the local-trust fallback or fail-open applies.
+	registryFailure := func(terr *trustError) authorization.Response {
+		if snap.config.LocalTrust {
+			if dgst, ok := p.localTrust(rec.ctx, snap.config.Timeouts, ref); ok {
+				rec.Digest = dgst
+				rec.log().WithFields(logrus.Fields{
+					"audit":     "local-trust",
+					"reference": ref.String(),
+					"digest":    dgst,
+					"user":      req.User,
+				}).Warnf("registry unreachable, allowing locally present pinned image: %v", terr)
+				return authorization.Response{Allow: true}
+			}
 		}
-		img, err := imgRef.NewImage(nil)
-		if err != nil {
-			return authorization.Response{Err: err.Error()}
+		if snap.config.failOpen(ref, terr) {
+			rec.log().WithFields(logrus.Fields{
+				"audit":     "fail-open",
+				"reference": ref.String(),
+				"user":      req.User,
+			}).Warnf("registry unreachable, allowing the image unverified: %v", terr)
+			return authorization.Response{Allow: true}
 		}
-		defaultPolicy, err := signature.DefaultPolicy(nil)
-		if err != nil {
-			return authorization.Response{Err: err.Error()}
+		return terr.response()
+	}
+
+	rec.Reference = ref.String()
+
+	if err := p.quotas.chargePull(snap.config.Quotas, req.User, ref); err != nil {
+		return errResponse(codeQuotaExceeded, err)
+	}
+
+	plat, err := requestedPlatform(m.query)
+	if err != nil {
+		return errResponse(codeInvalidRequest, err)
+	}
+	res, checkErr, err := p.verifyShared(rec.ctx, snap, ref, plat, rec.span)
+	if err != nil {
+		terr := verificationError(err)
+		if terr.Code == codeRegistryError || terr.Code == codeTimeout || terr.registryUnreachable() {
+			return registryFailure(terr)
 		}
-		pc, err := signature.NewPolicyContext(defaultPolicy)
-		if err != nil {
-			return authorization.Response{Err: err.Error()}
+		rej, rejected := err.(*trust.RejectionError)
+		if rejected {
+			rec.Digest = rej.Digest
 		}
-		allowed, err := pc.IsRunningImageAllowed(img)
-		if !allowed {
-			if err != nil {
-				return authorization.Response{Err: fmt.Sprintf("%s isn't allowed: %v", imgRef.DockerReference(), err)}
+		// Quarantine mode may admit rejected images anyway.
+		if rejected && inQuarantineScope(snap.config, ref) {
+			if err := p.quarantine.add(ref, rej.Digest); err != nil {
+				return errResponse(codeInternal, err)
 			}
-			return authorization.Response{Err: fmt.Sprintf("%s isn't allowed", imgRef.DockerReference())}
-		}
-		if err != nil {
-			return authorization.Response{Err: err.Error()}
+			rec.Warning = "admitted in quarantine: " + terr.Error()
+			return authorization.Response{Allow: true}
 		}
-		d, _, err := img.Manifest()
-		if err != nil {
-			return authorization.Response{Err: err.Error()}
-		}
-		digest, err := manifest.Digest(d)
-		if err != nil {
-			return authorization.Response{Err: err.Error()}
+		return terr.response()
+	}
+	if checkErr != nil {
+		return checkErr.response()
+	}
+	digest := res.Digest
+	rec.Digest = digest
+	rec.log().WithFields(logrus.Fields{
+		"reference": ref.String(),
+		"registry":  ref.Hostname(),
+		"digest":    digest,
+		"mime_type": res.MIMEType,
+	}).Debug("verified")
+	if isByDigest {
+		// The verifier compared the digests, and the daemon checks content
+		// pulled by digest itself.
+		rec.log().Debugf("requested digest %s matches the manifest", tagOrDigest)
+		return authorization.Response{Allow: true}
+	}
+	if terr := p.checkMirrors(rec.ctx, snap, ref, digest, rec.span); terr != nil {
+		return terr.response()
+	}
+	if terr := p.checkTagMove(snap.config.TagImmutability, ref, digest, rec); terr != nil {
+		return terr.response()
+	}
+	p.pins.set(ref, digest)
+	if snap.config.autoPull(ref) {
+		if err := p.quotas.chargeAutoPull(snap.config.Quotas, req.User, ref, imageSize(res.Image)); err != nil {
+			return errResponse(codeQuotaExceeded, err)
 		}
-		if allowed {
-			if isByDigest {
-				if res[4] == digest {
-					goto allow
-				} else {
-					return authorization.Response{Err: fmt.Sprintf("digests mismatch, provided %s, computed %s", res[4], digest)}
-				}
-			} else {
-				return authorization.Response{Err: fmt.Sprintf("image is allowed but can't pull by tag. Pull the image with 'docker pull %s@%s' and tag it with 'docker tag %s@%s %s:%s'", res[2], digest, res[2], digest, res[2], res[4])}
+		as := rec.span.client("autopull")
+		// Concurrent pulls of the tag share a single AutoPull.
+		_, err, shared := p.flights.do(fmt.Sprintf("autopull %s@%s %s %t", ref, digest, plat, snap.config.AutoPullLabels), func() (interface{}, error) {
+			limit := snap.config.Concurrency.maxAutoPulls()
+			if err := p.autopulls.acquire(limit, snap.config.Concurrency.queueTimeout()); err != nil {
+				return nil, err
+			}
+			defer p.autopulls.release(limit)
+			ctx, cancel := context.WithTimeout(rec.ctx, snap.config.Timeouts.autoPull())
+			defer cancel()
+			if err := p.autoPull(ctx, ref.(reference.NamedTagged), digest, res.Manifest, res.MIMEType, plat, p.pullAuth(ctx, snap.config, ref.Hostname()), snap.config.AutoPullLabels); err != nil {
+				return nil, timedOut(ctx, "pulling "+ref.String(), err)
 			}
+			return nil, nil
+		})
+		as.set("trust.shared", shared)
+		as.finish(err)
+		if err != nil {
+			return errResponse(codeAutoPull, err)
 		}
-		goto noallow
+		return authorization.Response{Msg: newTrustError(codeAutoPulled, "%s verified, pulled %s@%s and tagged it as %s", ref, ref.FullName(), digest, ref).Error()}
 	}
-allow:
-	return authorization.Response{Allow: true}
-
-noallow:
-	return authorization.Response{Msg: "image isn't allowed"}
+	return newTrustError(codePullByTag, "image is allowed but can't pull by tag. Pull the image with 'docker pull %s@%s' and tag it with 'docker tag %s@%s %s:%s'", name, digest, name, digest, name, tagOrDigest).response()
 }
 
 func (p *trustPlugin) AuthZRes(req authorization.Request) authorization.Response {
+	snap := p.snapshots.load()
+	if snap.config.ShadowVerify {
+		p.shadowPullResponse(req)
+	}
+	if snap.config.Commit.Mode == commitAnnotate {
+		p.annotateCommit(req)
+	}
 	return authorization.Response{Allow: true}
 }
 
-func (p *trustPlugin) getAdditionalDockerRegistries() ([]string, error) {
-	ctx := context.Background()
+func (p *trustPlugin) getAdditionalDockerRegistries(ctx context.Context, cfg conf) ([]string, error) {
 	// XXX: official engine-api client doesn't have Registries in Info() response
 	// hacked into vendor/github.com/docker/engine-api/types/types.go
-	i, err := p.client.Info(ctx)
+	i, err := p.dockerInfo(ctx, cfg)
 	if err != nil {
 		return nil, err
 	}
@@ -230,68 +720,3 @@ func (p *trustPlugin) getAdditionalDockerRegistries() ([]string, error) {
 	}
 	return regs, nil
 }
-
-// isReferenceFullyQualified determines whether the given reposName has prepended
-// name of index.
-func isReferenceFullyQualified(reposName reference.Named) bool {
-	indexName, _, _ := splitReposName(reposName)
-	return indexName != ""
-}
-
-// splitReposName breaks a reposName into an index name and remote name
-func splitReposName(reposName reference.Named) (indexName string, remoteName reference.Named, err error) {
-	var remoteNameStr string
-	indexName, remoteNameStr = distreference.SplitHostname(reposName)
-	if !isValidHostname(indexName) {
-		// This is a Docker Index repos (ex: samalba/hipache or ubuntu)
-		// 'docker.io'
-		indexName = ""
-		remoteName = reposName
-	} else {
-		remoteName, err = reference.WithName(remoteNameStr)
-	}
-	return
-}
-
-func isValidHostname(hostname string) bool {
-	return hostname != "" && !strings.Contains(hostname, "/") &&
-		(strings.Contains(hostname, ".") ||
-			strings.Contains(hostname, ":") || hostname == "localhost")
-}
-
-func qualifyUnqualifiedReference(ref reference.Named, indexName string) (reference.Named, error) {
-	if !isValidHostname(indexName) {
-		return nil, fmt.Errorf("Invalid hostname %q", indexName)
-	}
-	orig, remoteName, err := splitReposName(ref)
-	if err != nil {
-		return nil, err
-	}
-	if orig == "" {
-		return substituteReferenceName(ref, indexName+"/"+remoteName.Name())
-	}
-	return ref, nil
-}
-
-// substituteReferenceName creates a new image reference from given ref with
-// its *name* part substituted for reposName.
-func substituteReferenceName(ref reference.Named, reposName string) (newRef reference.Named, err error) {
-	reposNameRef, err := reference.WithName(reposName)
-	if err != nil {
-		return nil, err
-	}
-	if tagged, isTagged := ref.(distreference.Tagged); isTagged {
-		newRef, err = reference.WithTag(reposNameRef, tagged.Tag())
-		if err != nil {
-			return nil, err
-		}
-	} else if digested, isDigested := ref.(distreference.Digested); isDigested {
-		newRef, err = reference.WithDigest(reposNameRef, digested.Digest())
-		if err != nil {
-			return nil, err
-		}
-	} else {
-		newRef = reposNameRef
-	}
-	return
-}
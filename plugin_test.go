@@ -0,0 +1,48 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/containers/image/signature"
+	"github.com/docker/engine-api/types"
+	"github.com/docker/go-plugins-helpers/authorization"
+)
+
+// newTestPlugin returns a plugin deciding with cfg and a policy rejecting
+// everything, which never reaches a daemon: the docker info is cached
+// already, with no additional registries.
+func newTestPlugin(cfg conf) *trustPlugin {
+	p := newOfflinePlugin()
+	p.audit = p.audit.add(p.stats)
+	p.info.set(&types.Info{})
+	p.snapshots.store(&snapshot{
+		config:   cfg,
+		policy:   &signature.Policy{Default: signature.PolicyRequirements{signature.NewPRReject()}},
+		keyrings: newKeyrings(),
+	})
+	return p
+}
+
+func BenchmarkAuthZReq(b *testing.B) {
+	p := newTestPlugin(conf{Registries: registriesConf{Deny: []string{"denied.example.com"}}})
+	benchmarks := []struct {
+		name  string
+		req   authorization.Request
+		allow bool
+	}{
+		{"not intercepted", authorization.Request{RequestMethod: "GET", RequestURI: "/v1.24/containers/json"}, true},
+		{"not intercepted unversioned", authorization.Request{RequestMethod: "GET", RequestURI: "/containers/json"}, true},
+		{"invalid reference", authorization.Request{RequestMethod: "POST", RequestURI: "/v1.40/images/create?fromImage=Busybox"}, false},
+		{"denied registry", authorization.Request{RequestMethod: "POST", RequestURI: "/v1.40/images/create?fromImage=denied.example.com/app&tag=latest"}, false},
+	}
+	for _, bm := range benchmarks {
+		b.Run(bm.name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if res := p.AuthZReq(bm.req); res.Allow != bm.allow {
+					b.Fatalf("%s %s: allowed %t, want %t (%s%s)", bm.req.RequestMethod, bm.req.RequestURI, res.Allow, bm.allow, res.Msg, res.Err)
+				}
+			}
+		})
+	}
+}
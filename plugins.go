@@ -0,0 +1,47 @@
+package main
+
+import (
+	"github.com/docker/go-plugins-helpers/authorization"
+	"github.com/projectatomic/container-trust-plugin/pkg/trust"
+)
+
+// pluginPull checks the image of docker plugins being installed or
+// upgraded, named by remote. Plugins are verified only with
+// RequirePluginSignatures.
+func (p *trustPlugin) pluginPull(snap *snapshot, req authorization.Request, m routeMatch, rec *auditRecord) authorization.Response {
+	if !snap.config.RequirePluginSignatures {
+		return authorization.Response{Allow: true}
+	}
+	rec.intercepted = true
+	remote := m.query.Get("remote")
+	if remote == "" {
+		return newTrustError(codeInvalidRequest, "unable to find plugin reference").response()
+	}
+	ref, err := trust.ParseImageReference(remote)
+	if err != nil {
+		return errResponse(codeInvalidReference, err)
+	}
+	rec.Reference = ref.String()
+	dgst, terr := p.verifyImage(rec.ctx, snap, ref, rec.span)
+	if terr != nil {
+		terr.Msg = "plugin " + terr.Msg
+		return terr.response()
+	}
+	rec.Digest = dgst
+	return authorization.Response{Allow: true}
+}
+
+// pluginCreate gates plugins created from tarballs, which carry no
+// signatures: with RequirePluginSignatures, they're allowed only along with
+// docker load.
+func (p *trustPlugin) pluginCreate(snap *snapshot, req authorization.Request, m routeMatch, rec *auditRecord) authorization.Response {
+	if !snap.config.RequirePluginSignatures {
+		return authorization.Response{Allow: true}
+	}
+	rec.intercepted = true
+	rec.Reference = m.query.Get("name")
+	if !snap.config.AllowLoad {
+		return newTrustError(codeUnverifiable, "creating plugins from tarballs is disabled, their signatures can't be verified").response()
+	}
+	return authorization.Response{Allow: true}
+}
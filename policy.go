@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+
+	"github.com/containers/image/signature"
+	"github.com/projectatomic/container-trust-plugin/pkg/trust"
+)
+
+// policyPaths returns the policy file and the drop-in directory of cfg,
+// the --policy flag taking precedence over the configuration.
+func policyPaths(cfg conf) (string, string) {
+	path := cfg.Policy
+	if *flPolicy != "" {
+		path = *flPolicy
+	}
+	if path == "" {
+		path = defaultPolicyPath
+	}
+	dir := cfg.PolicyDir
+	if dir == "" {
+		dir = defaultPolicyDir
+	}
+	return path, dir
+}
+
+// policyFragments returns the fragments in dir, sorted by name, which is
+// the order they're merged in.
+func policyFragments(dir string) ([]string, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// policyFile is the part of a policy file fragments are merged into.
+type policyFile struct {
+	Default    json.RawMessage                       `json:"default,omitempty"`
+	Transports map[string]map[string]json.RawMessage `json:"transports,omitempty"`
+}
+
+// loadPolicy reads the policy at path and merges in the fragments of dir.
+// Fragments only add transport scopes: setting the default requirements or
+// a scope defined elsewhere is an error, so that no fragment can loosen
+// another one.
+func loadPolicy(path, dir string) (*signature.Policy, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	fragments, err := policyFragments(dir)
+	if err != nil {
+		return nil, err
+	}
+	if len(fragments) == 0 {
+		return signature.NewPolicyFromBytes(data)
+	}
+	var merged policyFile
+	if err := json.Unmarshal(data, &merged); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	if merged.Transports == nil {
+		merged.Transports = make(map[string]map[string]json.RawMessage)
+	}
+	definedIn := make(map[string]string)
+	for transport, scopes := range merged.Transports {
+		for scope := range scopes {
+			definedIn[scopeKey(transport, scope)] = path
+		}
+	}
+	for _, f := range fragments {
+		data, err := ioutil.ReadFile(f)
+		if err != nil {
+			return nil, err
+		}
+		var fragment policyFile
+		if err := json.Unmarshal(data, &fragment); err != nil {
+			return nil, fmt.Errorf("%s: %v", f, err)
+		}
+		if len(fragment.Default) != 0 {
+			return nil, fmt.Errorf("%s: fragments can't set the default requirements", f)
+		}
+		for transport, scopes := range fragment.Transports {
+			if merged.Transports[transport] == nil {
+				merged.Transports[transport] = make(map[string]json.RawMessage)
+			}
+			for scope, reqs := range scopes {
+				key := scopeKey(transport, scope)
+				if other, ok := definedIn[key]; ok {
+					return nil, fmt.Errorf("%s: scope %q is already defined in %s", f, key, other)
+				}
+				definedIn[key] = f
+				merged.Transports[transport][scope] = reqs
+			}
+		}
+	}
+	data, err = json.Marshal(merged)
+	if err != nil {
+		return nil, err
+	}
+	policy, err := signature.NewPolicyFromBytes(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s merged with %s: %v", path, dir, err)
+	}
+	return policy, nil
+}
+
+// scopeKey identifies scope of transport, normalized for docker.
+func scopeKey(transport, scope string) string {
+	if transport == "docker" {
+		scope = trust.NormalizeScope(scope)
+	}
+	return transport + ":" + scope
+}
+
+// policyFiles returns the files the policy of cfg is read from.
+func policyFiles(cfg conf) []string {
+	path, dir := policyPaths(cfg)
+	files := []string{path, dir}
+	if fragments, err := policyFragments(dir); err == nil {
+		files = append(files, fragments...)
+	}
+	return files
+}
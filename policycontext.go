@@ -0,0 +1,45 @@
+package main
+
+import (
+	"runtime"
+
+	"github.com/containers/image/signature"
+	"github.com/containers/image/types"
+)
+
+// policyContexts reuses the policy contexts of a policy across requests
+// instead of setting one up for each evaluation. A context evaluates a
+// single image at a time, so each evaluation takes one of its own.
+type policyContexts struct {
+	policy *signature.Policy
+	free   chan *signature.PolicyContext
+}
+
+// newPolicyContexts returns the contexts of policy, which mustn't be modified
+// while they're in use.
+func newPolicyContexts(policy *signature.Policy) *policyContexts {
+	return &policyContexts{policy: policy, free: make(chan *signature.PolicyContext, runtime.GOMAXPROCS(0))}
+}
+
+// isRunningImageAllowed tells whether the policy allows img, like
+// signature.PolicyContext.IsRunningImageAllowed.
+func (c *policyContexts) isRunningImageAllowed(img types.Image) (bool, error) {
+	var pc *signature.PolicyContext
+	select {
+	case pc = <-c.free:
+	default:
+		var err error
+		if pc, err = signature.NewPolicyContext(c.policy); err != nil {
+			return false, err
+		}
+	}
+	allowed, err := pc.IsRunningImageAllowed(img)
+	select {
+	case c.free <- pc:
+	default:
+		// More evaluations than processors ran at once, keep only as
+		// many contexts.
+		pc.Destroy()
+	}
+	return allowed, err
+}
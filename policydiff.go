@@ -0,0 +1,142 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+
+	"github.com/containers/image/docker"
+	"github.com/containers/image/signature"
+	"github.com/containers/image/types"
+	"github.com/docker/docker/reference"
+)
+
+// runPolicy dispatches the "policy" subcommands.
+func runPolicy(args []string) error {
+	if len(args) == 0 {
+		return errors.New("usage: policy diff --old OLD --new NEW --traffic AUDIT_LOG")
+	}
+	switch args[0] {
+	case "diff":
+		return runPolicyDiff(args[1:])
+	}
+	return fmt.Errorf("unknown policy command %q", args[0])
+}
+
+// runPolicyDiff replays the references found in an audit log against two
+// policies and reports those whose outcome would change.
+func runPolicyDiff(args []string) error {
+	fs := flag.NewFlagSet("policy diff", flag.ContinueOnError)
+	oldPath := fs.String("old", "", "Currently deployed policy file")
+	newPath := fs.String("new", "", "Candidate policy file")
+	trafficPath := fs.String("traffic", "", "Audit log whose decisions are replayed")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *oldPath == "" || *newPath == "" || *trafficPath == "" {
+		return errors.New("--old, --new and --traffic are all required")
+	}
+	oldPolicy, err := signature.NewPolicyFromFile(*oldPath)
+	if err != nil {
+		return fmt.Errorf("%s: %v", *oldPath, err)
+	}
+	newPolicy, err := signature.NewPolicyFromFile(*newPath)
+	if err != nil {
+		return fmt.Errorf("%s: %v", *newPath, err)
+	}
+	refs, err := readTrafficReferences(*trafficPath)
+	if err != nil {
+		return err
+	}
+
+	changed, skipped, errored := 0, 0, 0
+	for _, r := range refs {
+		ref, err := reference.ParseNamed(r)
+		if err != nil {
+			skipped++
+			fmt.Printf("%s: skipped: %v\n", r, err)
+			continue
+		}
+		img, err := fetchReference(ref)
+		if err != nil {
+			errored++
+			fmt.Printf("%s: errored: %v\n", r, err)
+			continue
+		}
+		oldAllowed, oldErr := evaluateImage(oldPolicy, img)
+		newAllowed, newErr := evaluateImage(newPolicy, img)
+		img.Close()
+		if err := evaluationError(oldErr, newErr); err != nil {
+			errored++
+			fmt.Printf("%s: errored: %v\n", r, err)
+			continue
+		}
+		if oldAllowed == newAllowed {
+			continue
+		}
+		changed++
+		reason := newErr
+		if reason == nil {
+			reason = oldErr
+		}
+		fmt.Printf("%s: %s -> %s (%v)\n", r, outcome(oldAllowed), outcome(newAllowed), reason)
+	}
+	fmt.Printf("%d of %d replayed references would change outcome, %d skipped, %d errored\n", changed, len(refs), skipped, errored)
+	return nil
+}
+
+// readTrafficReferences returns the distinct references found in an audit
+// log, in the order they were first seen.
+func readTrafficReferences(path string) ([]string, error) {
+	records, err := readAuditRecords(path)
+	if err != nil {
+		return nil, err
+	}
+	var refs []string
+	seen := make(map[string]bool)
+	for _, rec := range records {
+		if rec.Reference == "" || seen[rec.Reference] {
+			continue
+		}
+		seen[rec.Reference] = true
+		refs = append(refs, rec.Reference)
+	}
+	return refs, nil
+}
+
+// fetchReference returns the image ref points to.
+func fetchReference(ref reference.Named) (types.Image, error) {
+	imgRef, err := docker.NewReference(ref)
+	if err != nil {
+		return nil, err
+	}
+	return imgRef.NewImage(nil)
+}
+
+// evaluateImage tells whether policy allows img.
+func evaluateImage(policy *signature.Policy, img types.Image) (bool, error) {
+	pc, err := signature.NewPolicyContext(policy)
+	if err != nil {
+		return false, err
+	}
+	defer pc.Destroy()
+	return pc.IsRunningImageAllowed(img)
+}
+
+// evaluationError returns the first of errs which isn't a policy rejection,
+// e.g. the signatures couldn't be fetched, so that the outcome is unknown.
+func evaluationError(errs ...error) error {
+	for _, err := range errs {
+		if _, ok := err.(signature.PolicyRequirementError); err != nil && !ok {
+			return err
+		}
+	}
+	return nil
+}
+
+func outcome(allowed bool) string {
+	if allowed {
+		return "allow"
+	}
+	return "deny"
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/containers/image/docker"
+	"github.com/containers/image/types"
+	"github.com/docker/docker/reference"
+	"golang.org/x/net/context"
+)
+
+const (
+	defaultPrefetchInterval = 5 * time.Minute
+	defaultPrefetchIdle     = 30 * time.Second
+	defaultPrefetchTTL      = 10 * time.Minute
+	// prefetchThrottle is the pause between two prefetches in the same round
+	// so that a round never turns into a burst of registry requests.
+	prefetchThrottle = time.Second
+)
+
+// prefetchConf configures the background prefetch of signatures and
+// manifests of the most frequently pulled references.
+type prefetchConf struct {
+	// Top is how many of the most pulled references are kept warm, 0
+	// disables prefetching.
+	Top      int           `yaml:"top"`
+	Interval time.Duration `yaml:"interval"`
+	// Idle is how long no request must have been seen before a round of
+	// prefetching starts.
+	Idle time.Duration `yaml:"idle"`
+	// TTL is how long prefetched data is served from the cache.
+	TTL time.Duration `yaml:"ttl"`
+}
+
+// registryEntry is the registry data policy evaluation needs for an image.
+type registryEntry struct {
+	manifest []byte
+	mimeType string
+	sigs     [][]byte
+	fetched  time.Time
+}
+
+// cachedImage serves the manifest and signatures from a registryEntry and
+// defers anything else to the underlying image.
+type cachedImage struct {
+	types.Image
+	entry *registryEntry
+}
+
+func (i *cachedImage) Manifest() ([]byte, string, error) {
+	return i.entry.manifest, i.entry.mimeType, nil
+}
+
+func (i *cachedImage) Signatures() ([][]byte, error) {
+	return i.entry.sigs, nil
+}
+
+// prefetcher tracks how often references are pulled and keeps the registry
+// data of the most popular ones warm, refreshing it in the background while
+// the plugin is idle.
+type prefetcher struct {
+	mu          sync.Mutex
+	hits        map[string]int
+	refs        map[string]reference.Named
+	entries     map[string]*registryEntry
+	lastRequest time.Time
+	// cacheHits and cacheMisses count the images served from the cache and
+	// the others.
+	cacheHits, cacheMisses uint64
+}
+
+func newPrefetcher() *prefetcher {
+	return &prefetcher{
+		hits:    make(map[string]int),
+		refs:    make(map[string]reference.Named),
+		entries: make(map[string]*registryEntry),
+	}
+}
+
+// image returns the image for imgRef, fetched with sys, served from the cache
+// if there's a fresh entry for it fetched with the same credentials. It also
+// records the request for popularity tracking, unless prefetching is
+// disabled.
+func (f *prefetcher) image(imgRef types.ImageReference, sys *types.SystemContext, cfg prefetchConf) (types.Image, error) {
+	img, err := imgRef.NewImage(sys)
+	if err != nil {
+		return nil, err
+	}
+	ref := imgRef.DockerReference()
+	key := prefetchKey(ref, sys)
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.lastRequest = time.Now()
+	if cfg.Top > 0 {
+		f.hits[key]++
+		f.refs[key] = ref
+	}
+	if e, ok := f.entries[key]; ok && time.Since(e.fetched) < cfg.TTL {
+		f.cacheHits++
+		return &cachedImage{Image: img, entry: e}, nil
+	}
+	f.cacheMisses++
+	return img, nil
+}
+
+// run refreshes the most popular references whenever the plugin has been
+// idle for a while. It never returns.
+func (f *prefetcher) run(p *trustPlugin) {
+	for {
+		snap := p.snapshots.load()
+		cfg := prefetchSettings(snap.config.Prefetch)
+		time.Sleep(cfg.Interval)
+		f.mu.Lock()
+		idle := time.Since(f.lastRequest) >= cfg.Idle
+		f.mu.Unlock()
+		if idle && cfg.Top > 0 {
+			for _, ref := range f.popular(cfg.Top) {
+				if err := f.refresh(ref, p.systemContext(context.Background(), snap.config, ref.Hostname())); err != nil {
+					logrus.Debugf("prefetch of %s failed: %v", ref, err)
+				}
+				time.Sleep(prefetchThrottle)
+			}
+		}
+		// Decay even when not prefetching, so that the counters of a
+		// busy plugin, or those left by a disabled top, don't pile up.
+		f.decay(cfg.TTL)
+	}
+}
+
+// popular returns the n most requested references.
+func (f *prefetcher) popular(n int) []reference.Named {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	keys := make([]string, 0, len(f.hits))
+	for k := range f.hits {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool { return f.hits[keys[i]] > f.hits[keys[j]] })
+	if len(keys) > n {
+		keys = keys[:n]
+	}
+	refs := make([]reference.Named, 0, len(keys))
+	for _, k := range keys {
+		refs = append(refs, f.refs[k])
+	}
+	return refs
+}
+
+func (f *prefetcher) refresh(ref reference.Named, sys *types.SystemContext) error {
+	imgRef, err := docker.NewReference(ref)
+	if err != nil {
+		return err
+	}
+	img, err := imgRef.NewImage(sys)
+	if err != nil {
+		return err
+	}
+	defer img.Close()
+	m, mt, err := img.Manifest()
+	if err != nil {
+		return err
+	}
+	sigs, err := img.Signatures()
+	if err != nil {
+		return err
+	}
+	f.mu.Lock()
+	f.entries[prefetchKey(ref, sys)] = &registryEntry{manifest: m, mimeType: mt, sigs: sigs, fetched: time.Now()}
+	f.mu.Unlock()
+	return nil
+}
+
+// prefetchKey keys the data of ref fetched with the credentials of sys, so
+// that requests never get data fetched with credentials other than theirs.
+func prefetchKey(ref reference.Named, sys *types.SystemContext) string {
+	if sys == nil || sys.DockerAuthConfig == nil {
+		return ref.String()
+	}
+	return ref.String() + " " + credentialsID(sys.DockerAuthConfig)
+}
+
+// decay halves popularity counters so references which stopped being pulled
+// eventually drop out, and forgets expired entries.
+func (f *prefetcher) decay(ttl time.Duration) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for k, n := range f.hits {
+		if n /= 2; n == 0 {
+			delete(f.hits, k)
+			delete(f.refs, k)
+			continue
+		}
+		f.hits[k] = n
+	}
+	for k, e := range f.entries {
+		if time.Since(e.fetched) >= ttl {
+			delete(f.entries, k)
+		}
+	}
+}
+
+// prefetchSettings fills in defaults for unset values.
+func prefetchSettings(c prefetchConf) prefetchConf {
+	if c.Interval <= 0 {
+		c.Interval = defaultPrefetchInterval
+	}
+	if c.Idle <= 0 {
+		c.Idle = defaultPrefetchIdle
+	}
+	if c.TTL <= 0 {
+		c.TTL = defaultPrefetchTTL
+	}
+	return c
+}
+
+// cacheStats returns how many images were served from the cache and how
+// many weren't.
+func (f *prefetcher) cacheStats() (hits, misses uint64) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.cacheHits, f.cacheMisses
+}
+
+// len returns how many images the cache holds.
+func (f *prefetcher) len() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.entries)
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"flag"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/Sirupsen/logrus"
+	dockerclient "github.com/docker/engine-api/client"
+	"github.com/docker/go-plugins-helpers/authorization"
+)
+
+const defaultProxyListen = "unix:///run/container-trust-plugin/docker.sock"
+
+// apiProxy enforces the plugin decisions in front of daemons which can't
+// load authorization plugins: requests are handed to the plugin exactly as
+// the daemon would, and only the allowed ones are forwarded.
+type apiProxy struct {
+	plugin *trustPlugin
+	proxy  *httputil.ReverseProxy
+}
+
+func newAPIProxy(p *trustPlugin, dockerHost, certPath string, tlsVerify bool) (*apiProxy, error) {
+	tr, err := dockerTransport(dockerHost, certPath, tlsVerify)
+	if err != nil {
+		return nil, err
+	}
+	proto, addr, _, err := dockerclient.ParseHost(dockerHost)
+	if err != nil {
+		return nil, err
+	}
+	target := &url.URL{Scheme: "http", Host: addr}
+	if certPath != "" {
+		target.Scheme = "https"
+	}
+	if proto == "unix" || proto == "npipe" {
+		// The host of socket URLs only makes it to the Host header.
+		target.Host = "docker"
+	}
+	a := &apiProxy{plugin: p}
+	a.proxy = httputil.NewSingleHostReverseProxy(target)
+	a.proxy.Transport = tr
+	// Pull and build progress, logs and events are streamed.
+	a.proxy.FlushInterval = -1
+	a.proxy.ModifyResponse = a.response
+	return a, nil
+}
+
+func (a *apiProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	req, err := authZRequest(r)
+	if err != nil {
+		writeProxyError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	res := a.plugin.AuthZReq(req)
+	if !res.Allow {
+		msg := res.Err
+		if msg == "" {
+			msg = res.Msg
+		}
+		writeProxyError(w, http.StatusForbidden, "authorization denied by plugin "+pluginName+": "+msg)
+		return
+	}
+	a.proxy.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), authZRequestKey{}, req)))
+}
+
+// authZRequestKey is the context key of the authorization request of a
+// request being proxied.
+type authZRequestKey struct{}
+
+// response hands the response of the daemon to the plugin once it has been
+// streamed to the client. Since the plugin never denies responses, they
+// don't have to be held back until it's done.
+func (a *apiProxy) response(res *http.Response) error {
+	if res.StatusCode == http.StatusSwitchingProtocols {
+		return nil
+	}
+	req, ok := res.Request.Context().Value(authZRequestKey{}).(authorization.Request)
+	if !ok {
+		return nil
+	}
+	req.ResponseStatusCode = res.StatusCode
+	req.ResponseHeaders = flattenHeader(res.Header)
+	capture := isJSON(res.Header.Get("Content-Type"))
+	res.Body = &responseTee{ReadCloser: res.Body, capture: capture, done: func(body []byte) {
+		req.ResponseBody = body
+		a.plugin.AuthZRes(req)
+	}}
+	return nil
+}
+
+// authZRequest builds the authorization request the daemon would send for
+// r. Like the daemon, only JSON bodies up to maxRequestBody are included,
+// the body of r is left intact.
+func authZRequest(r *http.Request) (authorization.Request, error) {
+	req := authorization.Request{
+		RequestMethod:  r.Method,
+		RequestURI:     r.URL.RequestURI(),
+		RequestHeaders: flattenHeader(r.Header),
+	}
+	if r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
+		req.User = r.TLS.PeerCertificates[0].Subject.CommonName
+		req.UserAuthNMethod = "TLS"
+	}
+	if r.Body == nil || !isJSON(r.Header.Get("Content-Type")) {
+		return req, nil
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, maxRequestBody+1))
+	if err != nil {
+		return req, err
+	}
+	r.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(body), r.Body), r.Body}
+	if len(body) <= maxRequestBody {
+		req.RequestBody = body
+	}
+	return req, nil
+}
+
+// flattenHeader converts h to the form plugins get headers in, leaving the
+// Authorization header out as the daemon does. Unlike the daemon, it keeps
+// X-Registry-Auth so that the registry credentials of the client are used to
+// verify the images of private registries.
+func flattenHeader(h http.Header) map[string]string {
+	m := make(map[string]string, len(h))
+	for k, v := range h {
+		if strings.EqualFold(k, "Authorization") {
+			continue
+		}
+		m[k] = strings.Join(v, ",")
+	}
+	return m
+}
+
+func isJSON(contentType string) bool {
+	mt, _, err := mime.ParseMediaType(contentType)
+	return err == nil && mt == "application/json"
+}
+
+func writeProxyError(w http.ResponseWriter, code int, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(struct {
+		Message string `json:"message"`
+	}{msg})
+}
+
+// responseTee keeps up to maxRequestBody bytes of a response body, when
+// capture is set, and calls done with them once the body is closed.
+type responseTee struct {
+	io.ReadCloser
+	capture bool
+	buf     bytes.Buffer
+	over    bool
+	once    sync.Once
+	done    func(body []byte)
+}
+
+func (t *responseTee) Read(p []byte) (int, error) {
+	n, err := t.ReadCloser.Read(p)
+	if t.capture && !t.over {
+		if t.buf.Len()+n > maxRequestBody {
+			t.over = true
+			t.buf.Reset()
+		} else {
+			t.buf.Write(p[:n])
+		}
+	}
+	return n, err
+}
+
+func (t *responseTee) Close() error {
+	err := t.ReadCloser.Close()
+	t.once.Do(func() {
+		var body []byte
+		if t.capture && !t.over {
+			body = t.buf.Bytes()
+		}
+		go t.done(body)
+	})
+	return err
+}
+
+// proxyListener listens on addr, either unix:///path or tcp://host:port. The
+// docker API gives root on the host, TCP listeners require client
+// certificates with tlsc.
+func proxyListener(addr string, tlsc listenTLSConf) (net.Listener, error) {
+	u, err := url.Parse(addr)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "unix":
+		return proxySocket(u.Path)
+	case "tcp":
+		c, err := tlsc.config()
+		if err != nil {
+			return nil, err
+		}
+		l, err := net.Listen("tcp", u.Host)
+		if err != nil {
+			return nil, err
+		}
+		return tls.NewListener(l, c), nil
+	}
+	return nil, errors.New("--listen must be a unix:// or tcp:// address")
+}
+
+// runProxy serves the docker API on --listen, enforcing the plugin
+// decisions and forwarding allowed requests to the daemon at --host.
+func runProxy(args []string) error {
+	fs := flag.NewFlagSet("proxy", flag.ContinueOnError)
+	listen := fs.String("listen", defaultProxyListen, "Address docker clients connect to, unix:///path or tcp://host:port with the mutual TLS of listen-tls")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	p, err := newPlugin(*flDockerHost, *flCertPath, *flTLSVerify)
+	if err != nil {
+		return err
+	}
+	proxy, err := newAPIProxy(p, *flDockerHost, *flCertPath, *flTLSVerify)
+	if err != nil {
+		return err
+	}
+	l, err := proxyListener(*listen, p.snapshots.load().config.ListenTLS)
+	if err != nil {
+		return err
+	}
+	defer l.Close()
+	logrus.Infof("proxy: serving %s for %s", *listen, *flDockerHost)
+	return http.Serve(l, proxy)
+}
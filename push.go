@@ -0,0 +1,79 @@
+package main
+
+import (
+	"github.com/containers/image/docker"
+	"github.com/docker/docker/reference"
+	dockerclient "github.com/docker/engine-api/client"
+	"github.com/docker/go-plugins-helpers/authorization"
+	"github.com/projectatomic/container-trust-plugin/pkg/trust"
+)
+
+// push denies pushes to the registries in SignedPushRegistries unless the
+// image being pushed is already signed there and its signatures satisfy the
+// policy. Images never pushed before have no digest in the registry yet, so
+// they have to be signed as part of pushing them by other means.
+func (p *trustPlugin) push(snap *snapshot, req authorization.Request, m routeMatch, rec *auditRecord) authorization.Response {
+	name := m.vars[0]
+	ref, err := trust.ParseNormalizedReference(name)
+	if err != nil {
+		return errResponse(codeInvalidReference, err)
+	}
+	if !signedPushRegistry(snap.config.SignedPushRegistries, ref) {
+		return authorization.Response{Allow: true}
+	}
+	rec.intercepted = true
+	if tag := m.query.Get("tag"); tag != "" {
+		if ref, err = reference.WithTag(ref, tag); err != nil {
+			return errResponse(codeInvalidReference, err)
+		}
+	}
+	rec.Reference = ref.String()
+	ctx, cancel := snap.config.Timeouts.daemonContext(rec.ctx)
+	defer cancel()
+	img, _, err := p.client.ImageInspectWithRaw(ctx, ref.String(), false)
+	if err != nil {
+		if dockerclient.IsErrImageNotFound(err) {
+			return authorization.Response{Allow: true}
+		}
+		return errResponse(codeDaemonUnreachable, timedOut(ctx, "inspecting "+ref.String(), err))
+	}
+	for _, c := range repoDigests(img.RepoDigests, ref.String()) {
+		if c.FullName() != ref.FullName() {
+			break
+		}
+		imgRef, err := docker.NewReference(c)
+		if err != nil {
+			return errResponse(codeInvalidReference, err)
+		}
+		remote, err := p.prefetch.image(imgRef, p.systemContext(rec.ctx, snap.config, c.Hostname()), prefetchSettings(snap.config.Prefetch))
+		if err != nil {
+			return errResponse(codeRegistryError, err)
+		}
+		remote = p.bounded(rec.ctx, snap, remote, rec.span)
+		sigs, err := remote.Signatures()
+		if err != nil {
+			return errResponse(codeRegistryError, err)
+		}
+		if len(sigs) == 0 {
+			break
+		}
+		dgst, terr := p.verifyImage(rec.ctx, snap, c, rec.span)
+		if terr != nil {
+			return terr.response()
+		}
+		rec.Digest = dgst
+		return authorization.Response{Allow: true}
+	}
+	return newTrustError(codeNoSignature, "%s must be signed before being pushed to %s", ref, ref.Hostname()).response()
+}
+
+// signedPushRegistry tells whether pushes to the registry of ref must be
+// signed.
+func signedPushRegistry(registries []string, ref reference.Named) bool {
+	for _, r := range registries {
+		if trust.NormalizeHostname(r) == ref.Hostname() {
+			return true
+		}
+	}
+	return false
+}
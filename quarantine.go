@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/reference"
+	dockerclient "github.com/docker/engine-api/client"
+	"github.com/docker/go-plugins-helpers/authorization"
+)
+
+var defaultQuarantineStorePath = filepath.Join(stateDir, "quarantine.json")
+
+// quarantineConf configures quarantine mode: images in Scopes failing
+// verification are admitted anyway, and remembered as quarantined.
+type quarantineConf struct {
+	// Scopes are the repositories and namespaces quarantine mode applies
+	// to.
+	Scopes []string `yaml:"scopes"`
+	// DenyExec denies exec and attach into containers running quarantined
+	// images.
+	DenyExec bool `yaml:"deny-exec"`
+	// Store is the path of the quarantined digests database.
+	Store string `yaml:"store"`
+}
+
+// quarantined records an image admitted in quarantine mode.
+type quarantined struct {
+	Reference string    `json:"reference"`
+	Admitted  time.Time `json:"admitted"`
+}
+
+// quarantineStore maps the digests of quarantined images to how they were
+// admitted. Like the pinning database, it's persisted as a JSON file, unless
+// it has no path.
+type quarantineStore struct {
+	path string
+
+	mu      sync.Mutex
+	digests map[string]quarantined
+}
+
+func newQuarantineStore(path string) (*quarantineStore, error) {
+	s := &quarantineStore{path: path, digests: make(map[string]quarantined)}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return s, nil
+		}
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &s.digests); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *quarantineStore) add(ref reference.Named, digest string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.digests[digest] = quarantined{Reference: ref.String(), Admitted: time.Now().UTC()}
+	if s.path == "" {
+		return nil
+	}
+	data, err := json.Marshal(s.digests)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(s.path), 0700); err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
+
+func (s *quarantineStore) has(digest string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.digests[digest]
+	return ok
+}
+
+// inQuarantineScope tells whether quarantine mode applies to ref, because
+// of its scope or of its registry.
+func inQuarantineScope(cfg conf, ref reference.Named) bool {
+	if cfg.override(ref).Mode == registryQuarantine {
+		return true
+	}
+	return cfg.Quarantine != nil && isProtected(cfg.Quarantine.Scopes, ref)
+}
+
+// containerExec denies exec and attach into containers running images
+// admitted in quarantine mode.
+func (p *trustPlugin) containerExec(snap *snapshot, req authorization.Request, m routeMatch, rec *auditRecord) authorization.Response {
+	if cfg := snap.config.Quarantine; cfg == nil || !cfg.DenyExec {
+		return authorization.Response{Allow: true}
+	}
+	rec.intercepted = true
+	ctx, cancel := snap.config.Timeouts.daemonContext(rec.ctx)
+	defer cancel()
+	c, err := p.client.ContainerInspect(ctx, m.vars[0])
+	if err != nil {
+		if dockerclient.IsErrContainerNotFound(err) {
+			return authorization.Response{Allow: true}
+		}
+		return errResponse(codeDaemonUnreachable, timedOut(ctx, "inspecting container "+m.vars[0], err))
+	}
+	img, _, err := p.client.ImageInspectWithRaw(ctx, c.Image, false)
+	if err != nil {
+		return errResponse(codeDaemonUnreachable, timedOut(ctx, "inspecting "+c.Image, err))
+	}
+	for _, rd := range repoDigests(img.RepoDigests, c.Config.Image) {
+		if p.quarantine.has(rd.Digest().String()) {
+			rec.Reference = rd.String()
+			rec.Digest = rd.Digest().String()
+			return newTrustError(codeQuarantined, "container %s runs quarantined image %s", m.vars[0], rd).response()
+		}
+	}
+	return authorization.Response{Allow: true}
+}
+
+// len returns how many digests are quarantined.
+func (s *quarantineStore) len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.digests)
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/containers/image/types"
+	"github.com/docker/docker/reference"
+	"github.com/projectatomic/container-trust-plugin/pkg/trust"
+)
+
+const quotaWindow = time.Hour
+
+// quotaRule limits pulls for users and/or a policy scope. Every rule
+// matching a request is charged, separately for each user unless Per is
+// "scope".
+type quotaRule struct {
+	// User the rule applies to, "" or "*" for every user.
+	User string `yaml:"user"`
+	// Scope is a registry, namespace or repository prefix the rule applies
+	// to, "" for every image.
+	Scope string `yaml:"scope"`
+	// Per is what the limits apply to: "user", the default, each user on
+	// their own, or "scope", all users together.
+	Per string `yaml:"per"`
+	// PullsPerHour limits the number of pull requests, 0 means unlimited.
+	PullsPerHour int64 `yaml:"pulls-per-hour"`
+	// AutoPullBytesPerHour limits the bytes downloaded by AutoPull, 0 means
+	// unlimited.
+	AutoPullBytesPerHour int64 `yaml:"autopull-bytes-per-hour"`
+}
+
+func (r quotaRule) validate() error {
+	switch r.Per {
+	case "", "user", "scope":
+		return nil
+	}
+	return fmt.Errorf("quotas: %q: per must be user or scope, not %q", r.Scope, r.Per)
+}
+
+func (r quotaRule) matches(user string, ref reference.Named) bool {
+	if r.User != "" && r.User != "*" && r.User != user {
+		return false
+	}
+	if r.Scope == "" {
+		return true
+	}
+	scope := trust.NormalizeScope(r.Scope)
+	name := ref.FullName()
+	return name == scope || strings.HasPrefix(name, scope+"/")
+}
+
+// quotaDenials counts requests denied because of a quota, per scope.
+var quotaDenials = expvar.NewMap("quota_denials")
+
+type usage struct {
+	at     time.Time
+	amount int64
+}
+
+// quotaTracker keeps a sliding window of usage per rule and user.
+type quotaTracker struct {
+	mu     sync.Mutex
+	usages map[string][]usage
+}
+
+func newQuotaTracker() *quotaTracker {
+	return &quotaTracker{usages: make(map[string][]usage)}
+}
+
+// used returns the usage recorded for key in the last window, forgetting
+// older entries. Must be called with q.mu held.
+func (q *quotaTracker) used(key string, now time.Time) int64 {
+	entries := q.usages[key]
+	i := 0
+	for i < len(entries) && now.Sub(entries[i].at) >= quotaWindow {
+		i++
+	}
+	entries = entries[i:]
+	if len(entries) == 0 {
+		delete(q.usages, key)
+	} else {
+		q.usages[key] = entries
+	}
+	var total int64
+	for _, e := range entries {
+		total += e.amount
+	}
+	return total
+}
+
+// charge records amount against every matching rule, unless that would
+// exceed one of their limits in which case nothing is charged and a
+// quota error is returned. limit selects which limit of a rule applies. A
+// negative amount is unknown, and exceeds any limit.
+func (q *quotaTracker) charge(rules []quotaRule, user string, ref reference.Named, kind string, amount int64, limit func(quotaRule) int64) error {
+	now := time.Now()
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	var keys []string
+	for i, r := range rules {
+		max := limit(r)
+		if max <= 0 || !r.matches(user, ref) {
+			continue
+		}
+		key := kind + "/" + strconv.Itoa(i) + "/" + user
+		if r.Per == "scope" {
+			key = kind + "/" + strconv.Itoa(i)
+		}
+		if amount < 0 || q.used(key, now)+amount > max {
+			quotaDenials.Add(r.Scope, 1)
+			if amount < 0 {
+				return newTrustError(codeQuotaExceeded, "%s quota of %d per hour on %q can't be enforced, the image size is unknown", kind, max, r.Scope)
+			}
+			if r.Per == "scope" {
+				return newTrustError(codeQuotaExceeded, "%s quota of %d per hour exceeded on %q", kind, max, r.Scope)
+			}
+			return newTrustError(codeQuotaExceeded, "%s quota of %d per hour exceeded for user %q on %q", kind, max, user, r.Scope)
+		}
+		keys = append(keys, key)
+	}
+	for _, k := range keys {
+		q.usages[k] = append(q.usages[k], usage{at: now, amount: amount})
+	}
+	return nil
+}
+
+func (q *quotaTracker) chargePull(rules []quotaRule, user string, ref reference.Named) error {
+	return q.charge(rules, user, ref, "pulls", 1, func(r quotaRule) int64 { return r.PullsPerHour })
+}
+
+func (q *quotaTracker) chargeAutoPull(rules []quotaRule, user string, ref reference.Named, bytes int64) error {
+	return q.charge(rules, user, ref, "autopull bytes", bytes, func(r quotaRule) int64 { return r.AutoPullBytesPerHour })
+}
+
+// imageSize returns the total size of the layers of img, the image of the
+// platform being pulled, -1 if unknown, e.g. for schema1 manifests.
+func imageSize(img types.Image) int64 {
+	layers, err := img.LayerInfos()
+	if err != nil {
+		return -1
+	}
+	var size int64
+	for _, l := range layers {
+		if l.Size < 0 {
+			return -1
+		}
+		size += l.Size
+	}
+	return size
+}
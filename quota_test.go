@@ -0,0 +1,41 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/projectatomic/container-trust-plugin/pkg/trust"
+)
+
+func TestQuotaPer(t *testing.T) {
+	ref, err := trust.ParseImageReference("docker.io/library/busybox:latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rules := []quotaRule{
+		{User: "*", PullsPerHour: 2},
+		{Scope: "docker.io", Per: "scope", PullsPerHour: 3},
+	}
+	q := newQuotaTracker()
+	for _, user := range []string{"alice", "alice", "bob"} {
+		if err := q.chargePull(rules, user, ref); err != nil {
+			t.Fatalf("pull by %s: %v", user, err)
+		}
+	}
+	if err := q.chargePull(rules, "carol", ref); err == nil {
+		t.Error("pull beyond the quota of the scope allowed")
+	}
+	if err := q.chargePull(rules[:1], "alice", ref); err == nil {
+		t.Error("pull beyond the quota of the user allowed")
+	}
+
+	bytes := []quotaRule{{AutoPullBytesPerHour: 100}}
+	if err := q.chargeAutoPull(bytes, "alice", ref, 60); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.chargeAutoPull(bytes, "alice", ref, 60); err == nil {
+		t.Error("AutoPull beyond the bytes quota allowed")
+	}
+	if err := q.chargeAutoPull(bytes, "bob", ref, -1); err == nil {
+		t.Error("AutoPull of an image of unknown size allowed")
+	}
+}
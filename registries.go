@@ -0,0 +1,111 @@
+package main
+
+import (
+	"time"
+
+	"github.com/docker/docker/reference"
+	"github.com/projectatomic/container-trust-plugin/pkg/trust"
+)
+
+// registriesConf restricts the registries images may come from, whatever
+// their signatures.
+type registriesConf struct {
+	// Allow, if not empty, lists the only registries allowed.
+	Allow []string `yaml:"allow"`
+	// Deny lists registries which are never allowed.
+	Deny []string `yaml:"deny"`
+	// Overrides change the behavior of the plugin for images of some
+	// registries.
+	Overrides map[string]registryOverride `yaml:"overrides"`
+}
+
+// registryOverride is the behavior of the plugin for the images of a
+// registry, where it differs from the global one.
+type registryOverride struct {
+	// Mode is enforce, audit or quarantine: denials are enforced, only
+	// logged, or images failing verification are admitted in quarantine.
+	Mode string `yaml:"mode"`
+	// AutoPull overrides the global autopull setting.
+	AutoPull *bool `yaml:"autopull"`
+	// AllowUnsigned accepts images without checking their signatures, for
+	// throwaway development registries.
+	AllowUnsigned bool `yaml:"allow-unsigned"`
+	// MaxImageAge overrides the global max-image-age, 0 lifts it.
+	MaxImageAge *time.Duration `yaml:"max-image-age"`
+	// CA is a bundle of CAs trusted for the registry on top of the system
+	// ones and those of certs-dir, and Cert and Key a client certificate to
+	// authenticate with.
+	CA   string `yaml:"ca"`
+	Cert string `yaml:"cert"`
+	Key  string `yaml:"key"`
+	// Insecure skips the verification of the certificate of the registry
+	// and lets it be contacted over plain HTTP.
+	Insecure bool `yaml:"insecure"`
+	// Proxy is the HTTP(S) proxy to reach the registry through, or direct
+	// to connect to it directly, whatever the proxy settings.
+	Proxy string `yaml:"proxy"`
+	// FailOpen allows the images of the registry unverified while it, or
+	// its signature server, can't be reached.
+	FailOpen bool `yaml:"fail-open"`
+
+	// deny is set by repository rules denying the images.
+	deny bool
+}
+
+// Quarantine mode of a registry override.
+const registryQuarantine = "quarantine"
+
+// override returns the override applying to the registry of ref, the zero
+// override if there's none.
+func (c registriesConf) override(ref reference.Named) registryOverride {
+	return c.overrideFor(ref.Hostname())
+}
+
+// overrideFor returns the override of the registry host.
+func (c registriesConf) overrideFor(host string) registryOverride {
+	host = trust.NormalizeHostname(host)
+	for r, o := range c.Overrides {
+		if trust.NormalizeHostname(r) == host {
+			return o
+		}
+	}
+	return registryOverride{}
+}
+
+// failOpen tells whether terr, denying ref, is lifted because the registry
+// of ref fails open and couldn't be reached.
+func (c conf) failOpen(ref reference.Named, terr *trustError) bool {
+	return c.override(ref).FailOpen && terr.registryUnreachable()
+}
+
+// autoPull tells whether the tags of ref are pulled by the plugin.
+func (c conf) autoPull(ref reference.Named) bool {
+	if o := c.override(ref); o.AutoPull != nil {
+		return *o.AutoPull
+	}
+	return c.AutoPull
+}
+
+// checkRegistry denies refs whose registry isn't allowed by cfg, or whose
+// repository is denied.
+func checkRegistry(config conf, ref reference.Named) *trustError {
+	if config.override(ref).deny {
+		return newTrustError(codeRepositoryDenied, "repository %s is denied", ref.FullName())
+	}
+	cfg := config.Registries
+	host := ref.Hostname()
+	for _, r := range cfg.Deny {
+		if trust.NormalizeHostname(r) == host {
+			return newTrustError(codeRegistryNotAllowed, "registry %s is denied", host)
+		}
+	}
+	if len(cfg.Allow) == 0 {
+		return nil
+	}
+	for _, r := range cfg.Allow {
+		if trust.NormalizeHostname(r) == host {
+			return nil
+		}
+	}
+	return newTrustError(codeRegistryNotAllowed, "registry %s isn't allowed", host)
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"net/url"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+	imgtypes "github.com/containers/image/types"
+	"github.com/docker/engine-api/types"
+	"github.com/docker/go-plugins-helpers/authorization"
+	"github.com/projectatomic/container-trust-plugin/pkg/trust"
+	"golang.org/x/net/context"
+)
+
+// registryAuth is the registry credentials a request carries in its
+// X-Registry-Auth header.
+type registryAuth struct {
+	// header is the header as sent, handed over to the daemon for
+	// AutoPull.
+	header string
+	// host is the registry the credentials are for, any when empty.
+	host   string
+	config *imgtypes.DockerAuthConfig
+}
+
+type registryAuthKey struct{}
+
+// withRegistryAuth returns ctx carrying the credentials of req, if any. The
+// daemon strips X-Registry-Auth before calling plugins, so only the requests
+// of the proxy carry them.
+func withRegistryAuth(ctx context.Context, req authorization.Request) context.Context {
+	header := requestHeader(req, "X-Registry-Auth")
+	if header == "" {
+		return ctx
+	}
+	auth, err := parseRegistryAuth(header)
+	if err != nil {
+		logrus.Debugf("ignoring the X-Registry-Auth header: %v", err)
+		return ctx
+	}
+	return context.WithValue(ctx, registryAuthKey{}, auth)
+}
+
+// parseRegistryAuth decodes an X-Registry-Auth header, base64url encoded
+// JSON credentials, like the daemon does.
+func parseRegistryAuth(header string) (*registryAuth, error) {
+	var ac types.AuthConfig
+	if err := json.NewDecoder(base64.NewDecoder(base64.URLEncoding, strings.NewReader(header))).Decode(&ac); err != nil {
+		return nil, err
+	}
+	auth := &registryAuth{header: header, host: registryHost(ac.ServerAddress)}
+	user, password := ac.Username, ac.Password
+	if user == "" && ac.Auth != "" {
+		decoded, err := base64.StdEncoding.DecodeString(ac.Auth)
+		if err != nil {
+			return nil, err
+		}
+		parts := strings.SplitN(string(decoded), ":", 2)
+		if len(parts) == 2 {
+			user, password = parts[0], parts[1]
+		}
+	}
+	// The registry client only speaks basic auth, identity tokens are
+	// only forwarded to the daemon.
+	if user != "" {
+		auth.config = &imgtypes.DockerAuthConfig{Username: user, Password: password}
+	}
+	return auth, nil
+}
+
+// registryHost returns the hostname of the registry at address, e.g.
+// https://index.docker.io/v1/, the hostname of references for Docker Hub.
+func registryHost(address string) string {
+	if address == "" {
+		return ""
+	}
+	if !strings.Contains(address, "://") {
+		address = "https://" + address
+	}
+	u, err := url.Parse(address)
+	if err != nil {
+		return trust.NormalizeHostname(address)
+	}
+	host := trust.NormalizeHostname(u.Host)
+	switch host {
+	case "index.docker.io", "registry-1.docker.io":
+		return "docker.io"
+	}
+	return host
+}
+
+// registryAuthFrom returns the credentials ctx carries, if any.
+func registryAuthFrom(ctx context.Context) *registryAuth {
+	auth, _ := ctx.Value(registryAuthKey{}).(*registryAuth)
+	return auth
+}
+
+// systemContext returns the system context to fetch images from host with:
+// with the credentials ctx carries for it, else those of the docker-config
+// of cfg, and the TLS settings of the registries and signature servers.
+func (p *trustPlugin) systemContext(ctx context.Context, cfg conf, host string) *imgtypes.SystemContext {
+	return &imgtypes.SystemContext{
+		DockerAuthConfig:            p.credentials(ctx, cfg, host),
+		DockerTransport:             p.transports.roundTripper(cfg, host),
+		DockerInsecureSkipTLSVerify: cfg.Registries.overrideFor(host).Insecure,
+	}
+}
+
+func (p *trustPlugin) credentials(ctx context.Context, cfg conf, host string) *imgtypes.DockerAuthConfig {
+	if auth := registryAuthFrom(ctx); auth != nil && auth.config != nil && (auth.host == "" || auth.host == trust.NormalizeHostname(host)) {
+		return auth.config
+	}
+	if cfg.DockerConfig != "" {
+		return p.dockerCredentials.lookup(ctx, cfg.DockerConfig, trust.NormalizeHostname(host))
+	}
+	return nil
+}
+
+// pullAuth returns the X-Registry-Auth header for the pulls the plugin makes
+// from host on behalf of the request: the one ctx carries, else one made of
+// the credentials of the docker-config of cfg.
+func (p *trustPlugin) pullAuth(ctx context.Context, cfg conf, host string) string {
+	if auth := registryAuthFrom(ctx); auth != nil {
+		return auth.header
+	}
+	if cfg.DockerConfig == "" {
+		return ""
+	}
+	config := p.dockerCredentials.lookup(ctx, cfg.DockerConfig, trust.NormalizeHostname(host))
+	if config == nil {
+		return ""
+	}
+	data, err := json.Marshal(types.AuthConfig{Username: config.Username, Password: config.Password, ServerAddress: host})
+	if err != nil {
+		return ""
+	}
+	return base64.URLEncoding.EncodeToString(data)
+}
+
+// registryAuthID identifies the credentials ctx carries, to tell apart the
+// verifications made with different credentials.
+func registryAuthID(ctx context.Context) string {
+	if auth := registryAuthFrom(ctx); auth != nil {
+		return credentialsID(auth.config)
+	}
+	return ""
+}
+
+// credentialsID identifies config in cache keys, username and password,
+// without holding the password in the clear.
+func credentialsID(config *imgtypes.DockerAuthConfig) string {
+	if config == nil {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(config.Username + "\x00" + config.Password))
+	return config.Username + ":" + hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+const (
+	defaultMaxIdleConns        = 100
+	defaultMaxIdleConnsPerHost = 16
+	defaultIdleConnTimeout     = 90 * time.Second
+	defaultTLSSessionCache     = 64
+)
+
+// registryConnectionsConf tunes the connection pool the registry and
+// signature server requests share.
+type registryConnectionsConf struct {
+	// MaxIdleConns is how many idle connections are kept open, 100 by
+	// default, and MaxIdleConnsPerHost how many per host, 16 by default.
+	MaxIdleConns        int `yaml:"max-idle-conns"`
+	MaxIdleConnsPerHost int `yaml:"max-idle-conns-per-host"`
+	// MaxConnsPerHost caps the connections to each host, unlimited by
+	// default. Further requests wait for one to be available.
+	MaxConnsPerHost int `yaml:"max-conns-per-host"`
+	// IdleConnTimeout is how long idle connections are kept open, 90s by
+	// default.
+	IdleConnTimeout time.Duration `yaml:"idle-conn-timeout"`
+	// TLSSessionCache is how many TLS sessions are kept to resume them
+	// without a full handshake, 64 by default.
+	TLSSessionCache int `yaml:"tls-session-cache"`
+}
+
+func (c registryConnectionsConf) validate() error {
+	if c.MaxIdleConns < 0 || c.MaxIdleConnsPerHost < 0 || c.MaxConnsPerHost < 0 || c.TLSSessionCache < 0 {
+		return fmt.Errorf("registry-connections: limits can't be negative")
+	}
+	if c.IdleConnTimeout < 0 {
+		return fmt.Errorf("registry-connections: idle-conn-timeout can't be negative")
+	}
+	return nil
+}
+
+// setupRegistryConnections tunes the transport of the registry clients. The
+// vendored containers/image has no way to be given a transport and uses
+// http.DefaultTransport, which is shared with the other clients of the
+// plugin without one of their own, so it's the one tuned.
+func setupRegistryConnections(c registryConnectionsConf) {
+	tr, ok := http.DefaultTransport.(*http.Transport)
+	if !ok {
+		return
+	}
+	tr.MaxIdleConns = defaultMaxIdleConns
+	if c.MaxIdleConns > 0 {
+		tr.MaxIdleConns = c.MaxIdleConns
+	}
+	tr.MaxIdleConnsPerHost = defaultMaxIdleConnsPerHost
+	if c.MaxIdleConnsPerHost > 0 {
+		tr.MaxIdleConnsPerHost = c.MaxIdleConnsPerHost
+	}
+	tr.MaxConnsPerHost = c.MaxConnsPerHost
+	tr.IdleConnTimeout = defaultIdleConnTimeout
+	if c.IdleConnTimeout > 0 {
+		tr.IdleConnTimeout = c.IdleConnTimeout
+	}
+	size := defaultTLSSessionCache
+	if c.TLSSessionCache > 0 {
+		size = c.TLSSessionCache
+	}
+	tr.TLSClientConfig = &tls.Config{ClientSessionCache: tls.NewLRUClientSessionCache(size)}
+}
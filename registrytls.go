@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+
+	"github.com/projectatomic/container-trust-plugin/pkg/trust"
+)
+
+// registryTransports are the transports of the registries and signature
+// servers with TLS settings of their own, from certs-dir or their registry
+// override, by hostname. The others use http.DefaultTransport.
+type registryTransports struct {
+	mu         sync.Mutex
+	transports map[string]*http.Transport
+}
+
+func newRegistryTransports() *registryTransports {
+	return &registryTransports{transports: make(map[string]*http.Transport)}
+}
+
+// purge forgets the transports, so that they're set up again from the
+// configuration and certs-dir.
+func (r *registryTransports) purge() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.transports = make(map[string]*http.Transport)
+}
+
+// transport returns the transport of host, nil for http.DefaultTransport.
+func (r *registryTransports) transport(cfg conf, host string) (*http.Transport, error) {
+	host = trust.NormalizeHostname(host)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if tr, ok := r.transports[host]; ok {
+		return tr, nil
+	}
+	tlsc, err := registryTLSConfig(cfg, host)
+	if err != nil {
+		return nil, err
+	}
+	var tr *http.Transport
+	if tlsc != nil {
+		// Tuned like the shared transport, see registry-connections.
+		tr = http.DefaultTransport.(*http.Transport).Clone()
+		tr.TLSClientConfig = tlsc
+	}
+	r.transports[host] = tr
+	return tr, nil
+}
+
+// roundTripper returns a transport for the clients of registry, sending each
+// request with the transport of its host. The requests to other hosts, its
+// token and signature servers, carry registry for proxyFor.
+func (r *registryTransports) roundTripper(cfg conf, registry string) http.RoundTripper {
+	return &registryRoundTripper{transports: r, cfg: cfg, registry: registry}
+}
+
+type registryRoundTripper struct {
+	transports *registryTransports
+	cfg        conf
+	registry   string
+}
+
+// registryKey is the key of the registry a request is made for in its
+// context.
+type registryKey struct{}
+
+func (t *registryRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	tr, err := t.transports.transport(t.cfg, req.URL.Host)
+	if err != nil {
+		return nil, err
+	}
+	if t.registry != "" && registryHost(req.URL.Host) != registryHost(t.registry) {
+		req = req.WithContext(context.WithValue(req.Context(), registryKey{}, t.registry))
+	}
+	if tr == nil {
+		return http.DefaultTransport.RoundTrip(req)
+	}
+	return tr.RoundTrip(req)
+}
+
+// registryTLSConfig returns the TLS configuration of host like the daemon
+// sets it up, nil if it has none of its own: the *.crt CAs and the
+// *.cert/*.key client certificates of its directory in certs-dir, then the
+// ca, cert and key of its registry override, and insecure skipping the
+// verification.
+func registryTLSConfig(cfg conf, host string) (*tls.Config, error) {
+	o := cfg.Registries.overrideFor(host)
+	dir := filepath.Join(cfg.certsDir(), certsDirName(host))
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if len(entries) == 0 && o.CA == "" && o.Cert == "" && !o.Insecure {
+		return nil, nil
+	}
+	tlsc := &tls.Config{InsecureSkipVerify: o.Insecure}
+	if tr, ok := http.DefaultTransport.(*http.Transport); ok && tr.TLSClientConfig != nil {
+		tlsc.ClientSessionCache = tr.TLSClientConfig.ClientSessionCache
+	}
+	var cas []string
+	for _, e := range entries {
+		name := filepath.Join(dir, e.Name())
+		switch filepath.Ext(name) {
+		case ".crt":
+			cas = append(cas, name)
+		case ".cert":
+			key := strings.TrimSuffix(name, ".cert") + ".key"
+			cert, err := tls.LoadX509KeyPair(name, key)
+			if err != nil {
+				return nil, err
+			}
+			tlsc.Certificates = append(tlsc.Certificates, cert)
+		case ".key":
+			if _, err := os.Stat(strings.TrimSuffix(name, ".key") + ".cert"); err != nil {
+				return nil, fmt.Errorf("missing client certificate %s.cert for key %s", strings.TrimSuffix(e.Name(), ".key"), name)
+			}
+		}
+	}
+	if o.CA != "" {
+		cas = append(cas, o.CA)
+	}
+	if len(cas) > 0 {
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		for _, ca := range cas {
+			data, err := ioutil.ReadFile(ca)
+			if err != nil {
+				return nil, err
+			}
+			if !pool.AppendCertsFromPEM(data) {
+				return nil, fmt.Errorf("no certificate in %s", ca)
+			}
+		}
+		tlsc.RootCAs = pool
+	}
+	if o.Cert != "" {
+		cert, err := tls.LoadX509KeyPair(o.Cert, o.Key)
+		if err != nil {
+			return nil, err
+		}
+		tlsc.Certificates = append(tlsc.Certificates, cert)
+	}
+	return tlsc, nil
+}
+
+// certsDirName is the name of the directory of host in certs-dir, which
+// can't hold colons on Windows.
+func certsDirName(host string) string {
+	if runtime.GOOS == "windows" {
+		return strings.Replace(host, ":", "", -1)
+	}
+	return host
+}
+
+func (c conf) certsDir() string {
+	if c.CertsDir != "" {
+		return c.CertsDir
+	}
+	return defaultCertsDir
+}
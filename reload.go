@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"reflect"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// reloadInterval is how often the files a snapshot was built from are
+// checked for changes.
+const reloadInterval = 2 * time.Second
+
+// watchedFiles returns the files snap was built from.
+func watchedFiles(snap *snapshot) []string {
+	files := append([]string{*flConfig}, policyFiles(snap.config)...)
+	if snap.config.CandidatePolicy != "" {
+		files = append(files, snap.config.CandidatePolicy)
+	}
+	if snap.config.TeamsManifest != "" {
+		files = append(files, snap.config.TeamsManifest)
+	}
+	if a := snap.config.ApprovedDigests; a != nil {
+		files = append(files, a.Path)
+	}
+	for _, f := range []string{snap.config.Digests.AllowFile, snap.config.Digests.DenyFile} {
+		if f != "" {
+			files = append(files, f)
+		}
+	}
+	return files
+}
+
+// fileVersions identifies the current content of files by modification
+// time and size, missing files included.
+func fileVersions(files []string) map[string]string {
+	v := make(map[string]string, len(files))
+	for _, f := range files {
+		if fi, err := os.Stat(f); err == nil {
+			v[f] = fmt.Sprintf("%d/%d", fi.ModTime().UnixNano(), fi.Size())
+		} else {
+			v[f] = ""
+		}
+	}
+	return v
+}
+
+func sameVersions(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k, v := range a {
+		if bv, ok := b[k]; !ok || bv != v {
+			return false
+		}
+	}
+	return true
+}
+
+// reload builds a new snapshot and publishes it. The current snapshot is
+// kept if the new one can't be built or is invalid.
+func (p *trustPlugin) reload() error {
+	snap, err := loadSnapshot()
+	if err != nil {
+		return err
+	}
+	old := p.snapshots.load()
+	if old.config.PinStore != snap.config.PinStore || old.config.AuditLog != snap.config.AuditLog ||
+		old.config.AuditLogRotation != snap.config.AuditLogRotation || old.config.AuditStderr != snap.config.AuditStderr ||
+		len(old.config.AuditSinks) != len(snap.config.AuditSinks) || !reflect.DeepEqual(old.config.Notifications, snap.config.Notifications) || (old.config.TOFU == nil) != (snap.config.TOFU == nil) ||
+		strings.Join(old.config.Sockets, ",") != strings.Join(snap.config.Sockets, ",") || !reflect.DeepEqual(old.config.Admin, snap.config.Admin) ||
+		!reflect.DeepEqual(old.config.History, snap.config.History) || !reflect.DeepEqual(old.config.Tracing, snap.config.Tracing) ||
+		old.config.RegistryConnections != snap.config.RegistryConnections || old.config.RecordRequests != snap.config.RecordRequests {
+		logrus.Warn("reload: pin-store, audit-log, audit-sinks, notifications, tofu, sockets, admin, history, tracing, registry-connections and record-requests changes take effect on restart")
+	}
+	p.snapshots.store(snap)
+	// The verdicts may not hold anymore, e.g. if a key was revoked.
+	p.verdicts.purge()
+	p.info.purge()
+	p.dockerCredentials.purge()
+	p.transports.purge()
+	return nil
+}
+
+// watchReload reloads the configuration and the policy on SIGHUP and
+// whenever the files they're read from change. It never returns.
+func (p *trustPlugin) watchReload() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	versions := fileVersions(watchedFiles(p.snapshots.load()))
+	ticker := time.NewTicker(reloadInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-hup:
+			logrus.Info("reload: SIGHUP received")
+		case <-ticker.C:
+			current := fileVersions(watchedFiles(p.snapshots.load()))
+			if sameVersions(current, versions) {
+				continue
+			}
+			versions = current
+			logrus.Info("reload: configuration or policy changed")
+		}
+		sdNotify("RELOADING=1")
+		err := p.reload()
+		sdNotify("READY=1")
+		if err != nil {
+			logrus.Errorf("reload: rejected, keeping the current configuration and policy: %v", err)
+			continue
+		}
+		// Files added by the new configuration are watched from now on.
+		versions = fileVersions(watchedFiles(p.snapshots.load()))
+		logrus.Info("reload: new configuration and policy in effect")
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/docker/docker/reference"
+	"github.com/projectatomic/container-trust-plugin/pkg/trust"
+)
+
+// Actions of repository rules. The modes of registry overrides, enforce,
+// audit and quarantine, are actions as well.
+const (
+	repositoryAllowUnsigned = "allow-unsigned"
+	repositoryDeny          = "deny"
+)
+
+// repositoryAction returns the action of the most specific repository rule
+// matching ref, if any. Patterns are globs on the fully qualified name of
+// the repository, a trailing /* matching the whole namespace.
+func repositoryAction(rules map[string]string, ref reference.Named) (string, bool) {
+	patterns := make([]string, 0, len(rules))
+	for p := range rules {
+		patterns = append(patterns, p)
+	}
+	// The longest pattern is the most specific one.
+	sort.Slice(patterns, func(i, j int) bool {
+		if len(patterns[i]) != len(patterns[j]) {
+			return len(patterns[i]) > len(patterns[j])
+		}
+		return patterns[i] < patterns[j]
+	})
+	name := ref.FullName()
+	for _, p := range patterns {
+		if matchRepository(trust.NormalizeScope(p), name) {
+			return rules[p], true
+		}
+	}
+	return "", false
+}
+
+func matchRepository(pattern, name string) bool {
+	if ns := strings.TrimSuffix(pattern, "/*"); ns != pattern && strings.HasPrefix(name, ns+"/") {
+		return true
+	}
+	ok, err := path.Match(pattern, name)
+	return err == nil && ok
+}
+
+// override returns the behavior of the plugin for the images of ref: the
+// one of its registry, refined by the repository rules.
+func (c conf) override(ref reference.Named) registryOverride {
+	o := c.Registries.override(ref)
+	action, ok := repositoryAction(c.Repositories, ref)
+	if !ok {
+		return o
+	}
+	switch action {
+	case repositoryAllowUnsigned:
+		o.AllowUnsigned = true
+	case repositoryDeny:
+		o.deny = true
+	case enforcementEnforce:
+		o.Mode = action
+		o.AllowUnsigned = false
+	case enforcementAudit, registryQuarantine:
+		o.Mode = action
+	}
+	return o
+}
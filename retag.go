@@ -0,0 +1,59 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/docker/docker/reference"
+	dockerclient "github.com/docker/engine-api/client"
+	"github.com/docker/go-plugins-helpers/authorization"
+	"github.com/projectatomic/container-trust-plugin/pkg/trust"
+)
+
+// isProtected tells whether ref falls under one of the protected namespaces.
+func isProtected(namespaces []string, ref reference.Named) bool {
+	name := ref.FullName()
+	for _, ns := range namespaces {
+		ns = strings.TrimSuffix(trust.NormalizeScope(ns), "/")
+		if name == ns || strings.HasPrefix(name, ns+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// tag denies giving an image a name in a protected namespace unless the
+// image was pulled from that very repository and still verifies there.
+func (p *trustPlugin) tag(snap *snapshot, req authorization.Request, m routeMatch, rec *auditRecord) authorization.Response {
+	target, err := trust.ParseNormalizedReference(m.query.Get("repo"))
+	if err != nil {
+		return errResponse(codeInvalidReference, err)
+	}
+	if !isProtected(snap.config.ProtectedNamespaces, target) {
+		return authorization.Response{Allow: true}
+	}
+	rec.intercepted = true
+	source := m.vars[0]
+	rec.Reference = target.String()
+	ctx, cancel := snap.config.Timeouts.daemonContext(rec.ctx)
+	defer cancel()
+	img, _, err := p.client.ImageInspectWithRaw(ctx, source, false)
+	if err != nil {
+		if dockerclient.IsErrImageNotFound(err) {
+			return authorization.Response{Allow: true}
+		}
+		return errResponse(codeDaemonUnreachable, timedOut(ctx, "inspecting "+source, err))
+	}
+	for _, ref := range repoDigests(img.RepoDigests, target.String()) {
+		if ref.FullName() != target.FullName() {
+			break
+		}
+		dgst, terr := p.verifyImage(rec.ctx, snap, ref, rec.span)
+		if terr != nil {
+			terr.Msg = "retag " + terr.Msg
+			return terr.response()
+		}
+		rec.Digest = dgst
+		return authorization.Response{Allow: true}
+	}
+	return newTrustError(codeUnverifiable, "%s wasn't pulled from %s, it can't be tagged into a protected namespace", source, target.FullName()).response()
+}
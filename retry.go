@@ -0,0 +1,200 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/containers/image/types"
+	"golang.org/x/net/context"
+)
+
+const (
+	defaultRetryAttempts  = 3
+	defaultInitialBackoff = 200 * time.Millisecond
+	defaultMaxBackoff     = 5 * time.Second
+	defaultRetryBudget    = 60
+)
+
+// retriesConf retries the manifest, configuration and signature fetches
+// failing for a transient reason, e.g. a 503 from the registry, within the
+// timeouts of their stage.
+type retriesConf struct {
+	// Attempts is how many times a fetch is tried, 3 by default, 1 to
+	// never retry.
+	Attempts int `yaml:"attempts"`
+	// InitialBackoff is the longest wait before the first retry, 200ms by
+	// default. It doubles for each retry up to MaxBackoff, 5s by default,
+	// and the actual wait is picked at random below it.
+	InitialBackoff time.Duration `yaml:"initial-backoff"`
+	MaxBackoff     time.Duration `yaml:"max-backoff"`
+	// Budget is how many retries are made per minute, for all the
+	// registries, 60 by default, so that retries don't pile up on a
+	// registry which is down.
+	Budget int `yaml:"budget"`
+}
+
+func (c retriesConf) validate() error {
+	if c.Attempts < 0 || c.Budget < 0 {
+		return fmt.Errorf("retries: attempts and budget can't be negative")
+	}
+	if c.InitialBackoff < 0 || c.MaxBackoff < 0 {
+		return fmt.Errorf("retries: initial-backoff and max-backoff can't be negative")
+	}
+	return nil
+}
+
+func retriesSettings(c retriesConf) retriesConf {
+	if c.Attempts == 0 {
+		c.Attempts = defaultRetryAttempts
+	}
+	if c.InitialBackoff == 0 {
+		c.InitialBackoff = defaultInitialBackoff
+	}
+	if c.MaxBackoff == 0 {
+		c.MaxBackoff = defaultMaxBackoff
+	}
+	if c.Budget == 0 {
+		c.Budget = defaultRetryBudget
+	}
+	return c
+}
+
+// retryBudget counts the retries made in the current minute.
+type retryBudget struct {
+	mu      sync.Mutex
+	window  time.Time
+	retries int
+}
+
+func newRetryBudget() *retryBudget {
+	return &retryBudget{}
+}
+
+// take tells whether a retry may be made under budget, counting it if so.
+func (b *retryBudget) take(budget int) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	if now.Sub(b.window) >= time.Minute {
+		b.window, b.retries = now, 0
+	}
+	if b.retries >= budget {
+		return false
+	}
+	b.retries++
+	return true
+}
+
+// transientStatus matches the errors of the registry client for statuses
+// worth retrying: 429 and 5xx.
+var transientStatus = regexp.MustCompile(`(?:status(?: code:)?|response code|fetching blob) (?:429|5\d\d)\b`)
+
+// transient tells whether err may go away if the request is made again.
+func transient(err error) bool {
+	if err == nil {
+		return false
+	}
+	if _, ok := err.(*trustError); ok {
+		return false
+	}
+	if err == io.ErrUnexpectedEOF {
+		return true
+	}
+	if ne, ok := err.(net.Error); ok && (ne.Timeout() || ne.Temporary()) {
+		return true
+	}
+	msg := err.Error()
+	for _, s := range []string{"connection reset", "connection refused", "broken pipe", "unexpected EOF", "i/o timeout", "TLS handshake timeout"} {
+		if strings.Contains(msg, s) {
+			return true
+		}
+	}
+	return transientStatus.MatchString(msg)
+}
+
+// retry runs fn until it succeeds, fails for a reason which isn't
+// transient, runs out of attempts or of budget, or ctx is done.
+func retry(ctx context.Context, c retriesConf, budget *retryBudget, stage string, fn func() error) error {
+	c = retriesSettings(c)
+	backoff := c.InitialBackoff
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil || attempt >= c.Attempts || !transient(err) {
+			return err
+		}
+		if !budget.take(c.Budget) {
+			logrus.Debugf("%s: not retrying, the retry budget is spent: %v", stage, err)
+			return err
+		}
+		wait := time.Duration(rand.Int63n(int64(backoff) + 1))
+		logrus.Debugf("%s: retrying in %s after attempt %d: %v", stage, wait, attempt, err)
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return err
+		}
+		if backoff *= 2; backoff > c.MaxBackoff {
+			backoff = c.MaxBackoff
+		}
+	}
+}
+
+// retryingImage retries the registry accesses of an image failing for a
+// transient reason.
+type retryingImage struct {
+	types.Image
+	ctx    context.Context
+	conf   retriesConf
+	budget *retryBudget
+}
+
+// withRetries wraps img so that fetching its manifest, its configuration and
+// its signatures is retried on transient errors while ctx isn't done.
+func withRetries(ctx context.Context, img types.Image, c retriesConf, budget *retryBudget) types.Image {
+	return &retryingImage{Image: img, ctx: ctx, conf: c, budget: budget}
+}
+
+func (i *retryingImage) Manifest() (m []byte, mimeType string, err error) {
+	err = retry(i.ctx, i.conf, i.budget, "fetching the manifest of "+i.Reference().DockerReference().String(), func() error {
+		m, mimeType, err = i.Image.Manifest()
+		return err
+	})
+	return m, mimeType, err
+}
+
+func (i *retryingImage) Inspect() (info *types.ImageInspectInfo, err error) {
+	err = retry(i.ctx, i.conf, i.budget, "fetching the configuration of "+i.Reference().DockerReference().String(), func() error {
+		info, err = i.Image.Inspect()
+		return err
+	})
+	return info, err
+}
+
+func (i *retryingImage) Signatures() (sigs [][]byte, err error) {
+	err = retry(i.ctx, i.conf, i.budget, "fetching the signatures of "+i.Reference().DockerReference().String(), func() error {
+		sigs, err = i.Image.Signatures()
+		return err
+	})
+	return sigs, err
+}
+
+// bounded wraps img so that its registry accesses are traced under sp,
+// retried, timed out and guarded by the circuit breaker of the registry as
+// configured in snap, and given up once ctx is done.
+func (p *trustPlugin) bounded(ctx context.Context, snap *snapshot, img types.Image, sp *span) types.Image {
+	_, cached := img.(*cachedImage)
+	img = withDeadlines(ctx, withRetries(ctx, traceImage(img, sp), snap.config.Retries, p.retries), snap.config.Timeouts)
+	// Images served from the prefetch cache don't tell how the registry is
+	// doing.
+	if c := snap.config.CircuitBreaker; c != nil && !cached {
+		img = withBreaker(img, p.breakers, c)
+	}
+	return img
+}
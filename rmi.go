@@ -0,0 +1,32 @@
+package main
+
+import (
+	dockerclient "github.com/docker/engine-api/client"
+	"github.com/docker/go-plugins-helpers/authorization"
+)
+
+// imageDelete refuses to remove images whose digest is in the pinning
+// database, that is the exact content workloads were verified against.
+func (p *trustPlugin) imageDelete(snap *snapshot, req authorization.Request, m routeMatch, rec *auditRecord) authorization.Response {
+	if !snap.config.ProtectPinnedImages {
+		return authorization.Response{Allow: true}
+	}
+	rec.intercepted = true
+	ctx, cancel := snap.config.Timeouts.daemonContext(rec.ctx)
+	defer cancel()
+	img, _, err := p.client.ImageInspectWithRaw(ctx, m.vars[0], false)
+	if err != nil {
+		if dockerclient.IsErrImageNotFound(err) {
+			return authorization.Response{Allow: true}
+		}
+		return errResponse(codeDaemonUnreachable, timedOut(ctx, "inspecting "+m.vars[0], err))
+	}
+	for _, c := range repoDigests(img.RepoDigests, m.vars[0]) {
+		if p.pins.hasDigest(c, c.Digest().String()) {
+			rec.Reference = c.String()
+			rec.Digest = c.Digest().String()
+			return newTrustError(codePinnedImage, "%s is pinned as verified and can't be removed", c).response()
+		}
+	}
+	return authorization.Response{Allow: true}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"errors"
+	"net/url"
+	"regexp"
+
+	"github.com/docker/docker/reference"
+	"github.com/docker/go-plugins-helpers/authorization"
+)
+
+// interceptor takes over the requests it matches, the pipeline of
+// interceptors is tried in order and the first match decides.
+type interceptor interface {
+	// Match tells whether the interceptor handles req, path being the
+	// request path stripped of its API version prefix.
+	Match(req authorization.Request, path string, query url.Values) (routeMatch, bool)
+	Handle(p *trustPlugin, snap *snapshot, req authorization.Request, m routeMatch, rec *auditRecord) authorization.Response
+	Name() string
+}
+
+// routeHandler decides a request matched by a route.
+type routeHandler func(p *trustPlugin, snap *snapshot, req authorization.Request, m routeMatch, rec *auditRecord) authorization.Response
+
+// route is an interceptor for an endpoint of the docker API. Patterns match
+// the path without its API version prefix.
+type route struct {
+	name    string
+	method  string
+	pattern *regexp.Regexp
+	handler routeHandler
+}
+
+// routeMatch carries what was extracted from the URI of a matched request.
+type routeMatch struct {
+	// vars are the submatches of the route pattern.
+	vars  []string
+	query url.Values
+}
+
+func newRoute(name, method, pattern string, handler routeHandler) *route {
+	return &route{name: name, method: method, pattern: regexp.MustCompile(pattern), handler: handler}
+}
+
+func (r *route) Match(req authorization.Request, path string, query url.Values) (routeMatch, bool) {
+	if r.method != req.RequestMethod {
+		return routeMatch{}, false
+	}
+	vars := r.pattern.FindStringSubmatch(path)
+	if vars == nil {
+		return routeMatch{}, false
+	}
+	return routeMatch{vars: vars[1:], query: query}, true
+}
+
+func (r *route) Handle(p *trustPlugin, snap *snapshot, req authorization.Request, m routeMatch, rec *auditRecord) authorization.Response {
+	return r.handler(p, snap, req, m, rec)
+}
+
+func (r *route) Name() string {
+	return r.name
+}
+
+var (
+	apiVersionRegExp = regexp.MustCompile(`^/v[0-9]+(\.[0-9]+)*/`)
+
+	interceptors = []interceptor{
+		newRoute("pull", "POST", `^/images/create$`, (*trustPlugin).imagesCreate),
+		newRoute("load", "POST", `^/images/load$`, (*trustPlugin).load),
+		newRoute("tag", "POST", `^/images/(.+)/tag$`, (*trustPlugin).tag),
+		newRoute("push", "POST", `^/images/(.+)/push$`, (*trustPlugin).push),
+		newRoute("rmi", "DELETE", `^/images/(.+)$`, (*trustPlugin).imageDelete),
+		newRoute("create", "POST", `^/containers/create$`, (*trustPlugin).containerCreate),
+		newRoute("start", "POST", `^/containers/([^/]+)/start$`, (*trustPlugin).containerStart),
+		newRoute("exec", "POST", `^/containers/([^/]+)/(exec|attach)$`, (*trustPlugin).containerExec),
+		newRoute("attach", "GET", `^/containers/([^/]+)/attach/ws$`, (*trustPlugin).containerExec),
+		newRoute("build", "POST", `^/build$`, (*trustPlugin).build),
+		newRoute("commit", "POST", `^/commit$`, (*trustPlugin).commit),
+		newRoute("service", "POST", `^/services/create$`, (*trustPlugin).service),
+		newRoute("service", "POST", `^/services/([^/]+)/update$`, (*trustPlugin).service),
+		newRoute("plugin", "POST", `^/plugins/pull$`, (*trustPlugin).pluginPull),
+		newRoute("plugin", "POST", `^/plugins/(.+)/upgrade$`, (*trustPlugin).pluginPull),
+		newRoute("plugin", "POST", `^/plugins/create$`, (*trustPlugin).pluginCreate),
+	}
+)
+
+// apiPath returns the path of uri without its API version prefix, so
+// "/v1.24/images/create" and "/images/create" are the same endpoint.
+func apiPath(uri string) (string, url.Values, error) {
+	u, err := url.ParseRequestURI(uri)
+	if err != nil {
+		return "", nil, err
+	}
+	return apiVersionRegExp.ReplaceAllString(u.Path, "/"), u.Query(), nil
+}
+
+// intercept returns the interceptor req is for, nil if it isn't intercepted.
+func intercept(req authorization.Request) (interceptor, routeMatch, error) {
+	path, query, err := apiPath(req.RequestURI)
+	if err != nil {
+		return nil, routeMatch{}, err
+	}
+	for _, i := range interceptors {
+		if m, ok := i.Match(req, path, query); ok {
+			return i, m, nil
+		}
+	}
+	return nil, routeMatch{}, nil
+}
+
+// imagesCreate is either a pull or, without fromImage, an import.
+func (p *trustPlugin) imagesCreate(snap *snapshot, req authorization.Request, m routeMatch, rec *auditRecord) authorization.Response {
+	if m.query.Get("fromImage") == "" && m.query.Get("fromSrc") != "" {
+		return p.importImage(snap, req, m, rec)
+	}
+	return p.pull(snap, req, m, rec)
+}
+
+// isPull tells whether req is an image pull, returning its query.
+func isPull(req authorization.Request) (url.Values, bool) {
+	path, q, err := apiPath(req.RequestURI)
+	if err != nil || req.RequestMethod != "POST" || path != "/images/create" || q.Get("fromImage") == "" {
+		return nil, false
+	}
+	return q, true
+}
+
+// pullReference returns the repository name and the tag or digest a pull
+// is for. fromImage may carry the tag or digest itself, which the tag
+// parameter overrides when set, like the daemon does.
+func pullReference(q url.Values) (string, string, error) {
+	fromImage, tagOrDigest := q.Get("fromImage"), q.Get("tag")
+	if fromImage == "" {
+		return "", "", errors.New("unable to find repository name and reference")
+	}
+	ref, err := reference.ParseNamed(fromImage)
+	if err != nil {
+		return "", "", err
+	}
+	name := ref.Name()
+	if tagOrDigest != "" {
+		return name, tagOrDigest, nil
+	}
+	if c, ok := ref.(reference.Canonical); ok {
+		tagOrDigest = c.Digest().String()
+	} else if t, ok := ref.(reference.NamedTagged); ok {
+		tagOrDigest = t.Tag()
+	}
+	return name, tagOrDigest, nil
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"net/url"
+	"testing"
+
+	"github.com/docker/go-plugins-helpers/authorization"
+)
+
+// apiVersions are the API version prefixes requests are tested with.
+var apiVersions = []string{"", "/v1.24", "/v1.40"}
+
+func TestAPIPath(t *testing.T) {
+	tests := []struct {
+		uri   string
+		path  string
+		query url.Values
+	}{
+		{"/images/create?fromImage=busybox&tag=latest", "/images/create", url.Values{"fromImage": {"busybox"}, "tag": {"latest"}}},
+		{"/v1.24/images/create?fromImage=busybox", "/images/create", url.Values{"fromImage": {"busybox"}}},
+		{"/v1.40/containers/create?name=web", "/containers/create", url.Values{"name": {"web"}}},
+		{"/v1/containers/abc/start", "/containers/abc/start", url.Values{}},
+		{"/v1.40/images/docker.io/library/busybox:latest", "/images/docker.io/library/busybox:latest", url.Values{}},
+		// Only a leading version prefix is stripped.
+		{"/images/v1.24/tag", "/images/v1.24/tag", url.Values{}},
+		{"/v1.24", "/v1.24", url.Values{}},
+		{"/version1.24/images/create", "/version1.24/images/create", url.Values{}},
+	}
+	for _, tt := range tests {
+		path, query, err := apiPath(tt.uri)
+		if err != nil {
+			t.Errorf("apiPath(%q): %v", tt.uri, err)
+			continue
+		}
+		if path != tt.path {
+			t.Errorf("apiPath(%q) path = %q, want %q", tt.uri, path, tt.path)
+		}
+		if query.Encode() != tt.query.Encode() {
+			t.Errorf("apiPath(%q) query = %v, want %v", tt.uri, query, tt.query)
+		}
+	}
+	for _, uri := range []string{"", "images/create", "://"} {
+		if _, _, err := apiPath(uri); err == nil {
+			t.Errorf("apiPath(%q) succeeded, want an error", uri)
+		}
+	}
+}
+
+func TestIntercept(t *testing.T) {
+	tests := []struct {
+		method string
+		path   string
+		// name is the interceptor the request is for, empty if it isn't
+		// intercepted.
+		name string
+		vars []string
+	}{
+		{"POST", "/images/create?fromImage=busybox", "pull", nil},
+		{"POST", "/images/create?fromSrc=-&repo=imported", "pull", nil},
+		{"POST", "/images/load?quiet=1", "load", nil},
+		{"POST", "/images/busybox/tag?repo=mine", "tag", []string{"busybox"}},
+		{"POST", "/images/example.com/team/app/push?tag=1", "push", []string{"example.com/team/app"}},
+		{"DELETE", "/images/busybox:latest", "rmi", []string{"busybox:latest"}},
+		{"POST", "/containers/create?name=web", "create", nil},
+		{"POST", "/containers/web/start", "start", []string{"web"}},
+		{"POST", "/containers/web/exec", "exec", []string{"web", "exec"}},
+		{"POST", "/containers/web/attach?stream=1", "exec", []string{"web", "attach"}},
+		{"GET", "/containers/web/attach/ws", "attach", []string{"web"}},
+		{"POST", "/build?t=app", "build", nil},
+		{"POST", "/commit?container=web", "commit", nil},
+		{"POST", "/services/create", "service", nil},
+		{"POST", "/services/web/update?version=3", "service", []string{"web"}},
+		{"POST", "/plugins/pull?remote=vieux/sshfs", "plugin", nil},
+		{"POST", "/plugins/vieux/sshfs/upgrade?remote=vieux/sshfs:next", "plugin", []string{"vieux/sshfs"}},
+		{"POST", "/plugins/create?name=sshfs", "plugin", nil},
+
+		{"GET", "/images/json", "", nil},
+		{"GET", "/images/busybox/json", "", nil},
+		{"GET", "/images/create", "", nil},
+		{"GET", "/containers/web/json", "", nil},
+		{"POST", "/containers/web/stop", "", nil},
+		{"POST", "/containers/web/exec/extra", "", nil},
+		{"GET", "/containers/web/attach", "", nil},
+		{"POST", "/plugins/enable", "", nil},
+		{"GET", "/_ping", "", nil},
+	}
+	for _, tt := range tests {
+		for _, version := range apiVersions {
+			req := authorization.Request{RequestMethod: tt.method, RequestURI: version + tt.path}
+			i, m, err := intercept(req)
+			if err != nil {
+				t.Errorf("%s %s: %v", req.RequestMethod, req.RequestURI, err)
+				continue
+			}
+			if tt.name == "" {
+				if i != nil {
+					t.Errorf("%s %s intercepted by %s", req.RequestMethod, req.RequestURI, i.Name())
+				}
+				continue
+			}
+			if i == nil {
+				t.Errorf("%s %s not intercepted, want %s", req.RequestMethod, req.RequestURI, tt.name)
+				continue
+			}
+			if i.Name() != tt.name {
+				t.Errorf("%s %s intercepted by %s, want %s", req.RequestMethod, req.RequestURI, i.Name(), tt.name)
+			}
+			if !equalStrings(m.vars, tt.vars) {
+				t.Errorf("%s %s vars = %q, want %q", req.RequestMethod, req.RequestURI, m.vars, tt.vars)
+			}
+		}
+	}
+	if _, _, err := intercept(authorization.Request{RequestMethod: "POST", RequestURI: "images/create"}); err == nil {
+		t.Error("intercept of a relative URI succeeded, want an error")
+	}
+}
+
+func TestPullReference(t *testing.T) {
+	const (
+		good = "sha256:ea7d3b8b84fe21d2ae2c7c53a43c43e0b8b0a0fdab6e2e1ec1fdfd7f3b7a18a1"
+		evil = "sha256:0d8d3b6a0bd8d1c4b3b6dfb1e52f8e10e1bd4a8e25c0c9b3b0f4cc8a6a5e7a00"
+	)
+	tests := []struct {
+		query       string
+		name        string
+		tagOrDigest string
+	}{
+		{"fromImage=busybox", "busybox", ""},
+		{"fromImage=busybox&tag=latest", "busybox", "latest"},
+		{"fromImage=busybox:1.25", "busybox", "1.25"},
+		{"fromImage=example.com:5000/team/app&tag=v2", "example.com:5000/team/app", "v2"},
+		{"fromImage=example.com/team/app@" + good, "example.com/team/app", good},
+		{"fromImage=busybox&tag=" + good, "busybox", good},
+		// The tag parameter wins over what fromImage carries, as with the
+		// daemon, whichever is checked must be what gets pulled.
+		{"fromImage=busybox:1.25&tag=latest", "busybox", "latest"},
+		{"fromImage=example.com/team/app@" + good + "&tag=" + evil, "example.com/team/app", evil},
+		{"fromImage=example.com/team/app:v1&tag=" + evil, "example.com/team/app", evil},
+	}
+	for _, tt := range tests {
+		for _, version := range apiVersions {
+			uri := version + "/images/create?" + tt.query
+			_, q, err := apiPath(uri)
+			if err != nil {
+				t.Fatalf("apiPath(%q): %v", uri, err)
+			}
+			name, tagOrDigest, err := pullReference(q)
+			if err != nil {
+				t.Errorf("pullReference(%q): %v", uri, err)
+				continue
+			}
+			if name != tt.name || tagOrDigest != tt.tagOrDigest {
+				t.Errorf("pullReference(%q) = %q, %q, want %q, %q", uri, name, tagOrDigest, tt.name, tt.tagOrDigest)
+			}
+		}
+	}
+	for _, query := range []string{"", "tag=latest", "fromSrc=-", "fromImage=Busybox", "fromImage=busybox:bad:tag"} {
+		q, err := url.ParseQuery(query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := pullReference(q); err == nil {
+			t.Errorf("pullReference(%q) succeeded, want an error", query)
+		}
+	}
+}
+
+func TestIsPull(t *testing.T) {
+	tests := []struct {
+		method string
+		path   string
+		pull   bool
+	}{
+		{"POST", "/images/create?fromImage=busybox", true},
+		{"POST", "/images/create?fromSrc=-", false},
+		{"GET", "/images/create?fromImage=busybox", false},
+		{"POST", "/images/load", false},
+	}
+	for _, tt := range tests {
+		for _, version := range apiVersions {
+			req := authorization.Request{RequestMethod: tt.method, RequestURI: version + tt.path}
+			if _, pull := isPull(req); pull != tt.pull {
+				t.Errorf("isPull(%s %s) = %t, want %t", req.RequestMethod, req.RequestURI, pull, tt.pull)
+			}
+		}
+	}
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
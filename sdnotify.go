@@ -0,0 +1,82 @@
+package main
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/docker/go-plugins-helpers/authorization"
+)
+
+// sdNotify sends state to the service manager, doing nothing when the
+// plugin isn't run by systemd with notification support.
+func sdNotify(state string) {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return
+	}
+	if socket[0] == '@' {
+		// Abstract socket.
+		socket = "\x00" + socket[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		logrus.Debugf("sd_notify: %v", err)
+		return
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte(state)); err != nil {
+		logrus.Debugf("sd_notify: %v", err)
+	}
+}
+
+// watchdogInterval returns how often systemd expects watchdog pings, 0 if it
+// doesn't.
+func watchdogInterval() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond
+}
+
+// watchdog pings systemd at half the watchdog interval for as long as the
+// plugin answers requests in time. It never returns when the watchdog is
+// enabled.
+func (p *trustPlugin) watchdog() {
+	interval := watchdogInterval()
+	if interval == 0 {
+		return
+	}
+	ticker := time.NewTicker(interval / 2)
+	defer ticker.Stop()
+	for range ticker.C {
+		if p.answers(interval / 4) {
+			sdNotify("WATCHDOG=1")
+		} else {
+			logrus.Error("watchdog: the plugin doesn't answer requests, not pinging")
+		}
+	}
+}
+
+// answers tells whether the plugin answers a request within timeout.
+func (p *trustPlugin) answers(timeout time.Duration) bool {
+	answered := make(chan struct{})
+	go func() {
+		// Requests the plugin doesn't intercept go through the whole
+		// decision path without being audited.
+		p.AuthZReq(authorization.Request{RequestMethod: "GET", RequestURI: "/_ping"})
+		close(answered)
+	}()
+	select {
+	case <-answered:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"github.com/docker/docker/reference"
+	"github.com/docker/go-plugins-helpers/authorization"
+	"github.com/projectatomic/container-trust-plugin/pkg/trust"
+)
+
+// service checks the image of swarm services being created or updated.
+// Plugins can't rewrite requests, so with ServicesRequireDigest tags are
+// denied along with the digest-pinned reference to deploy instead.
+func (p *trustPlugin) service(snap *snapshot, req authorization.Request, m routeMatch, rec *auditRecord) authorization.Response {
+	rec.intercepted = true
+	var spec struct {
+		TaskTemplate struct {
+			ContainerSpec struct {
+				Image string
+			}
+		}
+	}
+	if err := decodeJSONBody(req, &spec); err != nil {
+		return errResponse(codeInvalidRequest, err)
+	}
+	image := spec.TaskTemplate.ContainerSpec.Image
+	if image == "" {
+		return newTrustError(codeInvalidRequest, "no image in service spec").response()
+	}
+	ref, err := trust.ParseImageReference(image)
+	if err != nil {
+		return errResponse(codeInvalidReference, err)
+	}
+	rec.Reference = ref.String()
+	dgst, terr := p.verifyImage(rec.ctx, snap, ref, rec.span)
+	if terr != nil {
+		return terr.response()
+	}
+	rec.Digest = dgst
+	if _, ok := ref.(reference.Canonical); !ok && snap.config.ServicesRequireDigest {
+		return newTrustError(codePullByTag, "image is allowed but services must be pinned by digest, deploy %s@%s", ref.FullName(), dgst).response()
+	}
+	return authorization.Response{Allow: true}
+}
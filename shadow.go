@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/docker/go-plugins-helpers/authorization"
+	"github.com/projectatomic/container-trust-plugin/pkg/trust"
+)
+
+const (
+	phaseRequest  = "request"
+	phaseResponse = "response"
+)
+
+// shadowPullResponse parses the pull progress stream the daemon sent back
+// to the client and records which digest, or which error, the daemon
+// reported. It never affects the response.
+func (p *trustPlugin) shadowPullResponse(req authorization.Request) {
+	q, ok := isPull(req)
+	if !ok {
+		return
+	}
+	rec := newAuditRecord(req)
+	rec.Phase = phaseResponse
+	rec.intercepted = true
+	if name, tagOrDigest, err := pullReference(q); err == nil {
+		rec.Reference = name
+		if strings.Contains(tagOrDigest, ":") {
+			rec.Reference += "@" + tagOrDigest
+		} else if tagOrDigest != "" {
+			rec.Reference += ":" + tagOrDigest
+		}
+	}
+	rec.Digest, rec.Message = parsePullStream(req.ResponseBody)
+	p.audit.record(rec, authorization.Response{Allow: rec.Message == ""})
+}
+
+// parsePullStream returns the digest and the error reported in a pull
+// progress stream.
+func parsePullStream(body []byte) (digest, errMsg string) {
+	dec := json.NewDecoder(bytes.NewReader(body))
+	for {
+		var m trust.StreamMessage
+		if err := dec.Decode(&m); err != nil {
+			return
+		}
+		if m.Error != "" {
+			errMsg = m.Error
+		}
+		if strings.HasPrefix(m.Status, "Digest: ") {
+			digest = strings.TrimPrefix(m.Status, "Digest: ")
+		}
+	}
+}
+
+// runAuditReconcile compares the decisions taken when pulls were requested
+// with what the daemon reported in the responses, and prints divergences:
+// pulls the plugin denied which the daemon went on with, and pulls whose
+// pulled digest isn't the one the plugin verified. Meant to be run
+// periodically, e.g. from a nightly timer.
+func runAuditReconcile(args []string) error {
+	fs := flag.NewFlagSet("audit reconcile", flag.ContinueOnError)
+	logPath := fs.String("log", "", "Audit log to reconcile")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *logPath == "" {
+		return errors.New("--log is required")
+	}
+	f, err := os.Open(*logPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	// Responses are matched with the oldest pending request for the same
+	// user and URI.
+	pending := make(map[string][]auditRecord)
+	divergences := 0
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		var rec auditRecord
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			return fmt.Errorf("%s:%d: %v", *logPath, line, err)
+		}
+		key := rec.User + " " + rec.URI
+		switch rec.Phase {
+		case phaseResponse:
+			reqs := pending[key]
+			if len(reqs) == 0 {
+				fmt.Printf("%s %s: daemon response without a recorded request decision\n", rec.Time, rec.URI)
+				divergences++
+				continue
+			}
+			decision := reqs[0]
+			pending[key] = reqs[1:]
+			if msg := diverges(decision, rec); msg != "" {
+				fmt.Printf("%s %s: %s\n", rec.Time, rec.URI, msg)
+				divergences++
+			}
+		default:
+			pending[key] = append(pending[key], rec)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	fmt.Printf("%d divergences found\n", divergences)
+	return nil
+}
+
+// diverges describes how the daemon response diverges from the request
+// decision, or returns "" if it doesn't.
+func diverges(decision, response auditRecord) string {
+	pulled := response.Digest != "" && response.Message == ""
+	switch {
+	case !decision.Allowed && pulled:
+		return fmt.Sprintf("plugin denied (%s) but daemon pulled %s", decision.Code, response.Digest)
+	case decision.Allowed && pulled && decision.Digest != "" && decision.Digest != response.Digest:
+		return fmt.Sprintf("plugin verified %s but daemon pulled %s", decision.Digest, response.Digest)
+	}
+	return ""
+}
+
+// runAudit dispatches the "audit" subcommands.
+func runAudit(args []string) error {
+	if len(args) == 0 {
+		return errors.New("usage: audit reconcile --log AUDIT_LOG")
+	}
+	switch args[0] {
+	case "reconcile":
+		return runAuditReconcile(args[1:])
+	}
+	return fmt.Errorf("unknown audit command %q", args[0])
+}
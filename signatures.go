@@ -0,0 +1,144 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	"github.com/containers/image/manifest"
+	"github.com/containers/image/signature"
+	"github.com/containers/image/types"
+)
+
+// signedByKeys returns the keyrings of the signedBy requirements of reqs.
+func signedByKeys(reqs signature.PolicyRequirements) ([][]byte, error) {
+	var keyrings [][]byte
+	for _, req := range reqs {
+		b, err := json.Marshal(req)
+		if err != nil {
+			return nil, err
+		}
+		var sb struct {
+			Type    string `json:"type"`
+			KeyPath string `json:"keyPath"`
+			KeyData []byte `json:"keyData"`
+		}
+		if err := json.Unmarshal(b, &sb); err != nil {
+			return nil, err
+		}
+		if sb.Type != "signedBy" {
+			continue
+		}
+		keyring := sb.KeyData
+		if sb.KeyPath != "" {
+			if keyring, err = ioutil.ReadFile(sb.KeyPath); err != nil {
+				return nil, err
+			}
+		}
+		keyrings = append(keyrings, keyring)
+	}
+	return keyrings, nil
+}
+
+// signedPayload is the content of a signature verified with a keyring.
+type signedPayload struct {
+	Critical struct {
+		Image struct {
+			Digest string `json:"docker-manifest-digest"`
+		} `json:"image"`
+		Identity struct {
+			Reference string `json:"docker-reference"`
+		} `json:"identity"`
+	} `json:"critical"`
+	Optional struct {
+		Timestamp int64 `json:"timestamp"`
+	} `json:"optional"`
+
+	// key is the fingerprint of the key which made the signature.
+	key string
+}
+
+// created returns when the signature was created, the zero time if it
+// doesn't say.
+func (s signedPayload) created() time.Time {
+	if s.Optional.Timestamp == 0 {
+		return time.Time{}
+	}
+	return time.Unix(s.Optional.Timestamp, 0)
+}
+
+// signaturesByKeyring verifies the signatures of img with keyring, imported
+// in k, and returns the contents of those made with it for the manifest of
+// img.
+func signaturesByKeyring(k *keyrings, img types.Image, keyring []byte) ([]signedPayload, error) {
+	m, _, err := img.Manifest()
+	if err != nil {
+		return nil, err
+	}
+	digest, err := manifest.Digest(m)
+	if err != nil {
+		return nil, err
+	}
+	sigs, err := img.Signatures()
+	if err != nil {
+		return nil, err
+	}
+	home := k.home(keyring)
+	var payloads []signedPayload
+	for _, sig := range sigs {
+		contents, key, err := home.verify(sig)
+		if err != nil {
+			continue
+		}
+		p := signedPayload{key: key}
+		if err := json.Unmarshal(contents, &p); err != nil {
+			continue
+		}
+		if p.Critical.Image.Digest == digest {
+			payloads = append(payloads, p)
+		}
+	}
+	return payloads, nil
+}
+
+// errSignatureStale rejects images whose newest signature is older than
+// the maximum signature age.
+type errSignatureStale struct {
+	created time.Time
+	maxAge  time.Duration
+}
+
+func (e errSignatureStale) Error() string {
+	if e.created.IsZero() {
+		return fmt.Sprintf("no timestamped signature, signatures must be newer than %s", e.maxAge)
+	}
+	return fmt.Sprintf("newest signature was created %s, signatures must be newer than %s", e.created.UTC().Format(time.RFC3339), e.maxAge)
+}
+
+// checkSignatureAge rejects img if none of its signatures made with the
+// keys of the policy scope applying to it is newer than maxAge. Scopes
+// without signedBy requirements aren't checked.
+func checkSignatureAge(k *keyrings, policy *signature.Policy, img types.Image, maxAge time.Duration) error {
+	_, reqs := policyScope(policy, img.Reference())
+	keyrings, err := signedByKeys(reqs)
+	if err != nil || len(keyrings) == 0 {
+		return err
+	}
+	var newest time.Time
+	for _, keyring := range keyrings {
+		payloads, err := signaturesByKeyring(k, img, keyring)
+		if err != nil {
+			return err
+		}
+		for _, p := range payloads {
+			if p.created().After(newest) {
+				newest = p.created()
+			}
+		}
+	}
+	if newest.IsZero() || time.Since(newest) > maxAge {
+		return errSignatureStale{created: newest, maxAge: maxAge}
+	}
+	return nil
+}
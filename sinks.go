@@ -0,0 +1,341 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+const (
+	sinkQueueSize   = 1024
+	sinkDialTimeout = 5 * time.Second
+
+	defaultSinkBatchSize = 100
+	defaultSinkLinger    = time.Second
+	sinkMaxBackoff       = 30 * time.Second
+)
+
+// auditSinkConf configures an audit sink publishing decisions to an event
+// bus, syslog or the journal.
+type auditSinkConf struct {
+	// Type is the kind of sink: nats, kafka-rest, syslog or journald.
+	Type string `yaml:"type"`
+	// Address is host:port for nats, the REST proxy URL for kafka-rest,
+	// udp://host:port, tcp://host:port, tls://host:port or unix:///path
+	// for syslog (unix:///dev/log by default) and the journal socket for
+	// journald.
+	Address string `yaml:"address"`
+	// Topic is the NATS subject or Kafka topic records are published to.
+	Topic string `yaml:"topic"`
+	// Schema is the record encoding: json (the default) or avro.
+	Schema string `yaml:"schema"`
+	// Facility is the syslog facility of the syslog and journald records,
+	// authpriv by default.
+	Facility string `yaml:"facility"`
+	// BatchSize is how many records nats and kafka-rest publish at once,
+	// 100 by default, and Linger how long a batch waits to fill up, 1s by
+	// default.
+	BatchSize int           `yaml:"batch-size"`
+	Linger    time.Duration `yaml:"linger"`
+	// QueueSize is how many records are queued while the sink is slow or
+	// unreachable, 1024 by default.
+	QueueSize int `yaml:"queue-size"`
+	// MaxBlock is how long requests may be held up waiting for room in a
+	// full queue before their record is dropped. By default records are
+	// dropped right away.
+	MaxBlock time.Duration `yaml:"max-block"`
+}
+
+func newAuditSink(c auditSinkConf) (auditSink, error) {
+	switch c.Schema {
+	case "", "json", "avro":
+	default:
+		return nil, fmt.Errorf("audit sink %q: unknown schema %q", c.Type, c.Schema)
+	}
+	if c.BatchSize < 0 || c.QueueSize < 0 || c.Linger < 0 || c.MaxBlock < 0 {
+		return nil, fmt.Errorf("audit sink %q: batch-size, queue-size, linger and max-block must be positive", c.Type)
+	}
+	var s auditSink
+	switch c.Type {
+	case "nats", "kafka-rest":
+		if c.Address == "" || c.Topic == "" {
+			return nil, fmt.Errorf("audit sink %q: address and topic are required", c.Type)
+		}
+		if c.Type == "nats" {
+			return newBatchingSink(&natsSink{conf: c}, c), nil
+		}
+		return newBatchingSink(&kafkaRESTSink{conf: c, client: &http.Client{Timeout: 10 * time.Second}}, c), nil
+	case "syslog", "journald":
+		facility, err := syslogFacility(c.Facility)
+		if err != nil {
+			return nil, fmt.Errorf("audit sink %q: %v", c.Type, err)
+		}
+		if c.Type == "syslog" {
+			s, err = newSyslogSink(c.Address, facility)
+		} else {
+			s, err = newJournaldSink(c.Address, facility)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("audit sink %q: %v", c.Type, err)
+		}
+	default:
+		return nil, fmt.Errorf("unknown audit sink type %q", c.Type)
+	}
+	return newAsyncSink(s), nil
+}
+
+// asyncSink hands records to a slower sink from a background goroutine, so
+// that publishing never delays authorization. Records are dropped when the
+// queue is full.
+type asyncSink struct {
+	sink  auditSink
+	queue chan auditRecord
+}
+
+func newAsyncSink(s auditSink) *asyncSink {
+	a := &asyncSink{sink: s, queue: make(chan auditRecord, sinkQueueSize)}
+	go a.run()
+	return a
+}
+
+func (a *asyncSink) send(rec *auditRecord) error {
+	select {
+	case a.queue <- *rec:
+		return nil
+	default:
+		return fmt.Errorf("audit sink queue full, dropping record for %s", rec.URI)
+	}
+}
+
+func (a *asyncSink) run() {
+	for rec := range a.queue {
+		if err := a.sink.send(&rec); err != nil {
+			logrus.Errorf("unable to publish audit record: %v", err)
+		}
+	}
+}
+
+// batchPublisher publishes batches of records to an event bus, all of them
+// or none.
+type batchPublisher interface {
+	publishBatch(recs []auditRecord) error
+}
+
+// batchingSink publishes records in batches from a background goroutine,
+// at least once: failed batches are retried until they're published, with
+// an exponential backoff. Meanwhile records queue up, and once the queue is
+// full requests wait up to MaxBlock for room before their record is
+// dropped.
+type batchingSink struct {
+	pub      batchPublisher
+	queue    chan auditRecord
+	size     int
+	linger   time.Duration
+	maxBlock time.Duration
+}
+
+func newBatchingSink(pub batchPublisher, c auditSinkConf) *batchingSink {
+	s := &batchingSink{pub: pub, size: c.BatchSize, linger: c.Linger, maxBlock: c.MaxBlock}
+	if s.size == 0 {
+		s.size = defaultSinkBatchSize
+	}
+	if s.linger == 0 {
+		s.linger = defaultSinkLinger
+	}
+	queueSize := c.QueueSize
+	if queueSize == 0 {
+		queueSize = sinkQueueSize
+	}
+	s.queue = make(chan auditRecord, queueSize)
+	go s.run()
+	return s
+}
+
+func (s *batchingSink) send(rec *auditRecord) error {
+	select {
+	case s.queue <- *rec:
+		return nil
+	default:
+	}
+	if s.maxBlock > 0 {
+		timer := time.NewTimer(s.maxBlock)
+		defer timer.Stop()
+		select {
+		case s.queue <- *rec:
+			return nil
+		case <-timer.C:
+		}
+	}
+	return fmt.Errorf("audit sink queue full, dropping record for %s", rec.URI)
+}
+
+func (s *batchingSink) run() {
+	batch := make([]auditRecord, 0, s.size)
+	ticker := time.NewTicker(s.linger)
+	defer ticker.Stop()
+	for {
+		select {
+		case rec := <-s.queue:
+			batch = append(batch, rec)
+			if len(batch) < s.size {
+				continue
+			}
+		case <-ticker.C:
+			if len(batch) == 0 {
+				continue
+			}
+		}
+		s.publish(batch)
+		batch = batch[:0]
+	}
+}
+
+// errRejected is returned by publishers when retrying is pointless, e.g.
+// when the records are refused.
+type errRejected struct {
+	error
+}
+
+// publish publishes batch, retrying until it succeeds or is rejected.
+func (s *batchingSink) publish(batch []auditRecord) {
+	backoff := time.Second
+	for {
+		err := s.pub.publishBatch(batch)
+		if err == nil {
+			return
+		}
+		if _, ok := err.(errRejected); ok {
+			logrus.Errorf("dropping %d rejected audit records: %v", len(batch), err)
+			return
+		}
+		logrus.Errorf("unable to publish %d audit records, retrying in %s: %v", len(batch), backoff, err)
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > sinkMaxBackoff {
+			backoff = sinkMaxBackoff
+		}
+	}
+}
+
+// natsSink publishes records to a NATS subject using the plain text NATS
+// client protocol.
+type natsSink struct {
+	conf auditSinkConf
+
+	mu   sync.Mutex
+	conn net.Conn
+	w    *bufio.Writer
+}
+
+func (s *natsSink) publishBatch(recs []auditRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conn == nil {
+		if err := s.connect(); err != nil {
+			return err
+		}
+	}
+	for i := range recs {
+		payload, err := encodeRecord(s.conf.Schema, &recs[i])
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(s.w, "PUB %s %d\r\n", s.conf.Topic, len(payload))
+		s.w.Write(payload)
+		s.w.WriteString("\r\n")
+	}
+	if err := s.w.Flush(); err != nil {
+		// Reconnect on the next record.
+		s.conn.Close()
+		s.conn = nil
+		return err
+	}
+	return nil
+}
+
+// connect dials the server and sends CONNECT. The server INFO and any
+// PING are consumed by a reader goroutine which answers PINGs.
+// Must be called with s.mu held.
+func (s *natsSink) connect() error {
+	conn, err := net.DialTimeout("tcp", s.conf.Address, sinkDialTimeout)
+	if err != nil {
+		return err
+	}
+	s.conn = conn
+	s.w = bufio.NewWriter(conn)
+	s.w.WriteString("CONNECT {\"verbose\":false,\"pedantic\":false,\"name\":\"" + pluginName + "\"}\r\n")
+	if err := s.w.Flush(); err != nil {
+		conn.Close()
+		s.conn = nil
+		return err
+	}
+	go s.readLoop(conn)
+	return nil
+}
+
+func (s *natsSink) readLoop(conn net.Conn) {
+	r := bufio.NewReader(conn)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		switch {
+		case strings.HasPrefix(line, "PING"):
+			s.mu.Lock()
+			if s.conn == conn {
+				s.w.WriteString("PONG\r\n")
+				s.w.Flush()
+			}
+			s.mu.Unlock()
+		case strings.HasPrefix(line, "-ERR"):
+			logrus.Errorf("nats audit sink: %s", strings.TrimSpace(line))
+		}
+	}
+}
+
+// kafkaRESTSink produces records to a Kafka topic through a Kafka REST
+// proxy. With the avro schema the proxy encodes the records with
+// auditAvroSchema and registers it in the schema registry.
+type kafkaRESTSink struct {
+	conf   auditSinkConf
+	client *http.Client
+}
+
+func (s *kafkaRESTSink) publishBatch(recs []auditRecord) error {
+	records := make([]interface{}, len(recs))
+	for i := range recs {
+		records[i] = map[string]interface{}{"value": avroValue(&recs[i])}
+	}
+	body := map[string]interface{}{"records": records}
+	contentType := "application/vnd.kafka.json.v2+json"
+	if s.conf.Schema == "avro" {
+		body["value_schema"] = auditAvroSchema
+		contentType = "application/vnd.kafka.avro.v2+json"
+	}
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	url := strings.TrimSuffix(s.conf.Address, "/") + "/topics/" + s.conf.Topic
+	resp, err := s.client.Post(url, contentType, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		err := fmt.Errorf("kafka rest proxy %s answered %s", url, resp.Status)
+		if resp.StatusCode/100 == 4 && resp.StatusCode != http.StatusRequestTimeout && resp.StatusCode != http.StatusTooManyRequests {
+			return errRejected{err}
+		}
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"sync/atomic"
+
+	"github.com/containers/image/signature"
+	"github.com/projectatomic/container-trust-plugin/pkg/trust"
+)
+
+// snapshot is a consistent view of everything a request is evaluated
+// against. A snapshot is never modified once published: reloading builds a
+// brand new one and swaps it in, so a request which grabbed a snapshot at
+// its start never observes a half-applied change.
+type snapshot struct {
+	config   conf
+	policy   *signature.Policy
+	approved *approvedDigests
+	digests  *digestLists
+	webhook  *webhook
+	// candidate is the policy evaluated alongside policy to find out how
+	// it would decide, nil if there's none.
+	candidate *signature.Policy
+	// contexts and candidateContexts evaluate policy and candidate.
+	contexts          *policyContexts
+	candidateContexts *policyContexts
+	// keyrings are the GPG homes signatures are verified with.
+	keyrings *keyrings
+	// fingerprint identifies the configuration and the policies.
+	fingerprint string
+}
+
+// snapshotHolder publishes the current snapshot to concurrent readers.
+type snapshotHolder struct {
+	v atomic.Value
+}
+
+func (h *snapshotHolder) load() *snapshot {
+	s, _ := h.v.Load().(*snapshot)
+	return s
+}
+
+func (h *snapshotHolder) store(s *snapshot) {
+	h.v.Store(s)
+}
+
+// loadSnapshot reads the plugin configuration and the signature policy from
+// disk and returns them as a new snapshot.
+func loadSnapshot() (*snapshot, error) {
+	config, err := loadConfig(*flConfig)
+	if err != nil {
+		return nil, err
+	}
+	policy, err := loadPolicy(policyPaths(config))
+	if err != nil {
+		return nil, err
+	}
+	if err := trust.NormalizePolicyScopes(policy); err != nil {
+		return nil, err
+	}
+	var candidate *signature.Policy
+	if config.CandidatePolicy != "" {
+		if candidate, err = signature.NewPolicyFromFile(config.CandidatePolicy); err != nil {
+			return nil, err
+		}
+		if err := trust.NormalizePolicyScopes(candidate); err != nil {
+			return nil, err
+		}
+	}
+	if config.TeamsManifest != "" {
+		m, err := loadTeamsManifest(config.TeamsManifest)
+		if err != nil {
+			return nil, err
+		}
+		if err := compileTeams(policy, m); err != nil {
+			return nil, err
+		}
+		if candidate != nil {
+			if err := compileTeams(candidate, m); err != nil {
+				return nil, err
+			}
+		}
+	}
+	var approved *approvedDigests
+	if config.ApprovedDigests != nil {
+		if approved, err = loadApprovedDigests(*config.ApprovedDigests); err != nil {
+			return nil, err
+		}
+	}
+	digests, err := loadDigestLists(config.Digests)
+	if err != nil {
+		return nil, err
+	}
+	var hook *webhook
+	if config.Webhook != nil {
+		if hook, err = newWebhook(*config.Webhook); err != nil {
+			return nil, err
+		}
+	}
+	snap := &snapshot{config: config, policy: policy, approved: approved, digests: digests, webhook: hook, candidate: candidate, keyrings: newKeyrings()}
+	snap.contexts = newPolicyContexts(policy)
+	if candidate != nil {
+		snap.candidateContexts = newPolicyContexts(candidate)
+	}
+	snap.fingerprint = fingerprint(snap)
+	return snap, nil
+}
+
+// fingerprint returns the SHA-256 of the configuration and the policies of
+// s, so that hosts running the same ones can be told apart from the others.
+func fingerprint(s *snapshot) string {
+	h := sha256.New()
+	enc := json.NewEncoder(h)
+	enc.Encode(s.config)
+	enc.Encode(s.policy)
+	enc.Encode(s.candidate)
+	return "sha256:" + hex.EncodeToString(h.Sum(nil))
+}
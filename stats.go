@@ -0,0 +1,181 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"expvar"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// statsSink is an audit sink counting the decisions since startup, for a
+// quick look at what the plugin has been doing without a metrics stack.
+type statsSink struct {
+	mu        sync.Mutex
+	since     time.Time
+	endpoints map[string]uint64
+	allowed   uint64
+	denied    uint64
+	// overridden counts the denials which weren't enforced.
+	overridden uint64
+	denials    map[string]uint64
+	autopulls  uint64
+	latency    float64
+}
+
+func newStatsSink() *statsSink {
+	return &statsSink{since: time.Now(), endpoints: make(map[string]uint64), denials: make(map[string]uint64)}
+}
+
+func (s *statsSink) send(rec *auditRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	endpoint := rec.endpoint
+	if endpoint == "" {
+		endpoint = "other"
+	}
+	s.endpoints[endpoint]++
+	s.latency += rec.LatencyMS
+	switch {
+	case rec.Allowed:
+		s.allowed++
+	case rec.Code == codeAutoPulled:
+		// The plugin pulled the image itself, the request is only turned
+		// down to keep the daemon from pulling the tag.
+		s.autopulls++
+	default:
+		s.denied++
+		reason := rec.Code
+		if reason == "" {
+			reason = "other"
+		}
+		s.denials[reason]++
+		if rec.Mode != "" {
+			s.overridden++
+		}
+	}
+	return nil
+}
+
+// statsSummary is the summary of the counters served on /stats.
+type statsSummary struct {
+	Since  time.Time `json:"since"`
+	Uptime string    `json:"uptime"`
+	// Intercepted counts the requests verified, per endpoint.
+	Intercepted map[string]uint64 `json:"intercepted"`
+	Allowed     uint64            `json:"allowed"`
+	Denied      uint64            `json:"denied"`
+	// Overridden counts the denials let through by the enforcement mode,
+	// user exemptions or break-glass grants.
+	Overridden uint64 `json:"overridden"`
+	// Denials counts the denials per error code.
+	Denials   map[string]uint64 `json:"denials"`
+	AutoPulls uint64            `json:"autopulls"`
+	// CacheHits and CacheMisses count the images served from the prefetch
+	// cache and those fetched from their registry.
+	CacheHits   uint64 `json:"cache_hits"`
+	CacheMisses uint64 `json:"cache_misses"`
+	// VerdictHits counts the images allowed from the verification cache.
+	VerdictHits uint64 `json:"verdict_hits"`
+	// AverageLatencyMS is the average time taken to decide, in
+	// milliseconds.
+	AverageLatencyMS float64 `json:"average_latency_ms"`
+	// UnqualifiedPulls counts the pulls of unqualified names per
+	// repository, QuotaDenials the denials because of a quota per scope.
+	UnqualifiedPulls map[string]uint64 `json:"unqualified_pulls"`
+	QuotaDenials     map[string]uint64 `json:"quota_denials"`
+}
+
+// statsSummary returns the summary of the counters of p.
+func (p *trustPlugin) statsSummary() statsSummary {
+	sum := p.stats.summary()
+	sum.CacheHits, sum.CacheMisses = p.prefetch.cacheStats()
+	sum.VerdictHits = p.verdicts.hitCount()
+	sum.UnqualifiedPulls = expvarCounts(unqualifiedPulls)
+	sum.QuotaDenials = expvarCounts(quotaDenials)
+	return sum
+}
+
+// expvarCounts returns the counters of m.
+func expvarCounts(m *expvar.Map) map[string]uint64 {
+	counts := make(map[string]uint64)
+	m.Do(func(kv expvar.KeyValue) {
+		if n, ok := kv.Value.(*expvar.Int); ok {
+			counts[kv.Key] = uint64(n.Value())
+		}
+	})
+	return counts
+}
+
+func (s *statsSink) summary() statsSummary {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sum := statsSummary{
+		Since:       s.since.UTC(),
+		Uptime:      time.Since(s.since).String(),
+		Intercepted: make(map[string]uint64, len(s.endpoints)),
+		Allowed:     s.allowed,
+		Denied:      s.denied,
+		Overridden:  s.overridden,
+		Denials:     make(map[string]uint64, len(s.denials)),
+		AutoPulls:   s.autopulls,
+	}
+	var total uint64
+	for e, n := range s.endpoints {
+		sum.Intercepted[e] = n
+		total += n
+	}
+	for code, n := range s.denials {
+		sum.Denials[code] = n
+	}
+	if total > 0 {
+		sum.AverageLatencyMS = s.latency / float64(total)
+	}
+	return sum
+}
+
+// runStats prints the counters of the running plugin, read from its admin
+// API.
+func runStats(args []string) error {
+	fs := flag.NewFlagSet("stats", flag.ContinueOnError)
+	asJSON := fs.Bool("json", false, "Print the counters as JSON")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	cfg, err := loadConfig(*flConfig)
+	if err != nil {
+		return err
+	}
+	if cfg.Admin == nil {
+		return errors.New("stats: the admin API isn't enabled")
+	}
+	var sum statsSummary
+	if err := adminGet(*cfg.Admin, "/stats", &sum); err != nil {
+		return fmt.Errorf("stats: %v", err)
+	}
+	if *asJSON {
+		return json.NewEncoder(os.Stdout).Encode(sum)
+	}
+	fmt.Printf("since %s (%s)\n", sum.Since.Format(time.RFC3339), sum.Uptime)
+	fmt.Printf("allowed %d, denied %d (%d not enforced), autopulled %d\n", sum.Allowed, sum.Denied, sum.Overridden, sum.AutoPulls)
+	fmt.Printf("average latency %.1fms, cache hits %d, misses %d, verdict hits %d\n", sum.AverageLatencyMS, sum.CacheHits, sum.CacheMisses, sum.VerdictHits)
+	for _, c := range []struct {
+		title  string
+		counts map[string]uint64
+	}{{"intercepted", sum.Intercepted}, {"denials", sum.Denials}, {"unqualified pulls", sum.UnqualifiedPulls}, {"quota denials", sum.QuotaDenials}} {
+		keys := make([]string, 0, len(c.counts))
+		for k := range c.counts {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		fmt.Printf("%s:\n", c.title)
+		for _, k := range keys {
+			fmt.Printf("  %-32s %d\n", k, c.counts[k])
+		}
+	}
+	return nil
+}
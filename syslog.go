@@ -0,0 +1,241 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultSyslogAddress  = "unix:///dev/log"
+	defaultJournalAddress = "/run/systemd/journal/socket"
+	// syslogSDID is the SD-ID of the structured data of the syslog
+	// records, under the enterprise number reserved for documentation
+	// (RFC 5612).
+	syslogSDID = "decision@32473"
+
+	syslogSeverityWarning = 4
+	syslogSeverityInfo    = 6
+)
+
+var syslogFacilities = map[string]int{
+	"kern": 0, "user": 1, "daemon": 3, "auth": 4, "syslog": 5, "authpriv": 10,
+	"local0": 16, "local1": 17, "local2": 18, "local3": 19,
+	"local4": 20, "local5": 21, "local6": 22, "local7": 23,
+}
+
+// syslogFacility returns the code of the facility name, authpriv by
+// default.
+func syslogFacility(name string) (int, error) {
+	if name == "" {
+		name = "authpriv"
+	}
+	f, ok := syslogFacilities[name]
+	if !ok {
+		return 0, fmt.Errorf("unknown facility %q", name)
+	}
+	return f, nil
+}
+
+// recordSeverity is warning for denials, info otherwise.
+func recordSeverity(rec *auditRecord) int {
+	if rec.Allowed {
+		return syslogSeverityInfo
+	}
+	return syslogSeverityWarning
+}
+
+// recordSummary is the human readable message of rec.
+func recordSummary(rec *auditRecord) string {
+	decision := "allowed"
+	if !rec.Allowed {
+		decision = "denied"
+	}
+	subject := rec.Reference
+	if subject == "" {
+		subject = rec.Method + " " + rec.URI
+	}
+	msg := decision + " " + subject
+	if rec.Message != "" {
+		msg += ": " + rec.Message
+	}
+	return msg
+}
+
+// recordFields are the fields of rec, empty ones left out, for the
+// structured data of syslog and journal records.
+func recordFields(rec *auditRecord) [][2]string {
+	var fields [][2]string
+	for _, f := range [][2]string{
+		{"id", rec.ID},
+		{"phase", rec.Phase},
+		{"user", rec.User},
+		{"authn", rec.AuthN},
+		{"profile", rec.Profile},
+		{"method", rec.Method},
+		{"uri", rec.URI},
+		{"reference", rec.Reference},
+		{"digest", rec.Digest},
+		{"allowed", strconv.FormatBool(rec.Allowed)},
+		{"code", rec.Code},
+		{"mode", rec.Mode},
+		{"policy_scope", rec.PolicyScope},
+		{"override_by", rec.OverrideBy},
+		{"override_reason", rec.OverrideReason},
+		{"latency_ms", strconv.FormatFloat(rec.LatencyMS, 'f', 3, 64)},
+	} {
+		if f[1] != "" {
+			fields = append(fields, f)
+		}
+	}
+	return fields
+}
+
+// syslogSink sends records to a syslog server in the RFC 5424 format, the
+// fields of the records as structured data. Records sent over TCP and TLS
+// are framed by octet counting (RFC 6587).
+type syslogSink struct {
+	network  string
+	address  string
+	facility int
+	hostname string
+
+	mu   sync.Mutex
+	conn net.Conn
+}
+
+func newSyslogSink(address string, facility int) (*syslogSink, error) {
+	if address == "" {
+		address = defaultSyslogAddress
+	}
+	u, err := url.Parse(address)
+	if err != nil {
+		return nil, err
+	}
+	s := &syslogSink{network: u.Scheme, address: u.Host, facility: facility}
+	switch u.Scheme {
+	case "udp", "tcp", "tls":
+	case "unix":
+		s.network, s.address = "unixgram", u.Path
+	default:
+		return nil, fmt.Errorf("address must be udp://, tcp://, tls:// or unix://, not %q", address)
+	}
+	if s.hostname, err = os.Hostname(); err != nil {
+		s.hostname = "-"
+	}
+	return s, nil
+}
+
+// format returns rec as an RFC 5424 message.
+func (s *syslogSink) format(rec *auditRecord) []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "<%d>1 %s %s %s %d decision [%s", s.facility*8+recordSeverity(rec),
+		rec.Time.Format(time.RFC3339Nano), s.hostname, pluginName, os.Getpid(), syslogSDID)
+	escape := strings.NewReplacer(`\`, `\\`, `"`, `\"`, `]`, `\]`)
+	for _, f := range recordFields(rec) {
+		fmt.Fprintf(&b, ` %s="%s"`, f[0], escape.Replace(f[1]))
+	}
+	b.WriteString("] ")
+	b.WriteString(recordSummary(rec))
+	return b.Bytes()
+}
+
+func (s *syslogSink) send(rec *auditRecord) error {
+	msg := s.format(rec)
+	if s.network == "tcp" || s.network == "tls" {
+		msg = append([]byte(strconv.Itoa(len(msg))+" "), msg...)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conn == nil {
+		if err := s.connect(); err != nil {
+			return err
+		}
+	}
+	if _, err := s.conn.Write(msg); err != nil {
+		// Reconnect on the next record.
+		s.conn.Close()
+		s.conn = nil
+		return err
+	}
+	return nil
+}
+
+// connect dials the server. Must be called with s.mu held.
+func (s *syslogSink) connect() error {
+	var err error
+	if s.network == "tls" {
+		s.conn, err = tls.DialWithDialer(&net.Dialer{Timeout: sinkDialTimeout}, "tcp", s.address, &tls.Config{})
+	} else {
+		s.conn, err = net.DialTimeout(s.network, s.address, sinkDialTimeout)
+	}
+	return err
+}
+
+// journaldSink sends records to the journal with its native protocol, the
+// fields of the records as TRUST_* fields.
+type journaldSink struct {
+	facility int
+
+	mu   sync.Mutex
+	conn *net.UnixConn
+	addr *net.UnixAddr
+}
+
+func newJournaldSink(address string, facility int) (*journaldSink, error) {
+	if address == "" {
+		address = defaultJournalAddress
+	}
+	return &journaldSink{facility: facility, addr: &net.UnixAddr{Name: address, Net: "unixgram"}}, nil
+}
+
+// format returns rec as a journal entry.
+func (s *journaldSink) format(rec *auditRecord) []byte {
+	var b bytes.Buffer
+	field := func(name, value string) {
+		if !strings.Contains(value, "\n") {
+			b.WriteString(name + "=" + value + "\n")
+			return
+		}
+		// Values with newlines are sent with their length.
+		b.WriteString(name + "\n")
+		binary.Write(&b, binary.LittleEndian, uint64(len(value)))
+		b.WriteString(value + "\n")
+	}
+	field("MESSAGE", recordSummary(rec))
+	field("PRIORITY", strconv.Itoa(recordSeverity(rec)))
+	field("SYSLOG_FACILITY", strconv.Itoa(s.facility))
+	field("SYSLOG_IDENTIFIER", pluginName)
+	for _, f := range recordFields(rec) {
+		field("TRUST_"+strings.ToUpper(f[0]), f[1])
+	}
+	return b.Bytes()
+}
+
+func (s *journaldSink) send(rec *auditRecord) error {
+	entry := s.format(rec)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conn == nil {
+		conn, err := net.DialUnix("unixgram", nil, s.addr)
+		if err != nil {
+			return err
+		}
+		s.conn = conn
+	}
+	if _, err := s.conn.Write(entry); err != nil {
+		// Reconnect on the next record, the journal may have restarted.
+		s.conn.Close()
+		s.conn = nil
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/docker/distribution/digest"
+	"github.com/docker/docker/reference"
+	"github.com/projectatomic/container-trust-plugin/pkg/trust"
+)
+
+var defaultTagApprovalsPath = filepath.Join(stateDir, "tag-approvals.json")
+
+const (
+	// Tag immutability modes: pulls of tags which moved since they were
+	// pinned are logged and allowed, or denied unless the move was
+	// approved.
+	tagImmutabilityWarn   = "warn"
+	tagImmutabilityStrict = "strict"
+)
+
+// tagImmutabilityConf configures how pulls of tags resolving to another
+// digest than the one they were pinned to are handled.
+type tagImmutabilityConf struct {
+	// Mode is warn or strict. Moved tags are pinned again silently by
+	// default.
+	Mode string `yaml:"mode"`
+	// Approvals is the path of the moves approved with approve-tag.
+	Approvals string `yaml:"approvals"`
+}
+
+func (c tagImmutabilityConf) approvals() string {
+	if c.Approvals == "" {
+		return defaultTagApprovalsPath
+	}
+	return c.Approvals
+}
+
+// readTagApprovals returns the approved digests by tag.
+func readTagApprovals(path string) (map[string]string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var approvals map[string]string
+	if err := json.Unmarshal(data, &approvals); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return approvals, nil
+}
+
+// checkTagMove handles a pull of ref verified as dgst when ref is pinned to
+// another digest.
+func (p *trustPlugin) checkTagMove(cfg tagImmutabilityConf, ref reference.Named, dgst string, rec *auditRecord) *trustError {
+	pinned, ok := p.pins.get(ref)
+	if !ok || pinned.Digest == dgst || cfg.Mode == "" {
+		return nil
+	}
+	rec.log().WithFields(logrus.Fields{
+		"audit":     "tag-moved",
+		"reference": ref.String(),
+		"pinned":    pinned.Digest,
+		"digest":    dgst,
+	}).Warn("tag resolves to another digest than the one it was pinned to")
+	if cfg.Mode == tagImmutabilityWarn {
+		rec.Warning = fmt.Sprintf("%s moved from %s to %s", ref, pinned.Digest, dgst)
+		return nil
+	}
+	approvals, err := readTagApprovals(cfg.approvals())
+	if err != nil {
+		return wrapError(codeInternal, err)
+	}
+	if approvals[pinKey(ref)] == dgst {
+		return nil
+	}
+	return newTrustError(codeTagMoved, "%s was pinned to %s and now resolves to %s, the move must be approved with 'container-trust-plugin approve-tag --image %s --digest %s'", ref, pinned.Digest, dgst, ref, dgst)
+}
+
+// runApproveTag approves the move of a tag to a new digest.
+func runApproveTag(args []string) error {
+	fs := flag.NewFlagSet("approve-tag", flag.ContinueOnError)
+	image := fs.String("image", "", "Tag whose move is approved")
+	dgst := fs.String("digest", "", "Digest the tag may now resolve to")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *image == "" || *dgst == "" {
+		return errors.New("usage: approve-tag --image IMAGE:TAG --digest DIGEST")
+	}
+	ref, err := trust.ParseImageReference(*image)
+	if err != nil {
+		return err
+	}
+	key := pinKey(ref)
+	if key == "" {
+		return fmt.Errorf("%s isn't a tag", *image)
+	}
+	if _, err := digest.ParseDigest(*dgst); err != nil {
+		return err
+	}
+	snap, err := loadSnapshot()
+	if err != nil {
+		return err
+	}
+	path := snap.config.TagImmutability.approvals()
+	approvals, err := readTagApprovals(path)
+	if err != nil {
+		return err
+	}
+	if approvals == nil {
+		approvals = make(map[string]string)
+	}
+	approvals[key] = *dgst
+	data, err := json.MarshalIndent(approvals, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
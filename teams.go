@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/containers/image/signature"
+	"github.com/projectatomic/container-trust-plugin/pkg/trust"
+	"gopkg.in/yaml.v2"
+)
+
+// teamsManifest declares which team owns which image namespaces and the
+// keyring their images must be signed with, e.g.:
+//
+//	teams:
+//	- name: payments
+//	  keyring: /etc/pki/containers/payments.gpg
+//	  namespaces:
+//	  - registry.corp/teams/payments/*
+type teamsManifest struct {
+	Teams []team `yaml:"teams"`
+}
+
+type team struct {
+	Name       string   `yaml:"name"`
+	Keyring    string   `yaml:"keyring"`
+	Namespaces []string `yaml:"namespaces"`
+}
+
+func loadTeamsManifest(path string) (*teamsManifest, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var m teamsManifest
+	if err := yaml.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return &m, nil
+}
+
+// compileTeams adds a "docker" transport scope to policy for every namespace
+// in the manifest, requiring images there to be signed by the owning team.
+// Scopes already present in policy are never overridden: a conflict is an
+// error so that hand written policy and the manifest can't silently diverge.
+func compileTeams(policy *signature.Policy, m *teamsManifest) error {
+	if policy.Transports == nil {
+		policy.Transports = make(map[string]signature.PolicyTransportScopes)
+	}
+	scopes := policy.Transports["docker"]
+	if scopes == nil {
+		scopes = make(signature.PolicyTransportScopes)
+		policy.Transports["docker"] = scopes
+	}
+	owners := make(map[string]string)
+	for _, t := range m.Teams {
+		if t.Name == "" || t.Keyring == "" {
+			return fmt.Errorf("team %q: name and keyring are required", t.Name)
+		}
+		req, err := signature.NewPRSignedByKeyPath(signature.SBKeyTypeGPGKeys, t.Keyring, signature.NewPRMMatchRepository())
+		if err != nil {
+			return fmt.Errorf("team %q: %v", t.Name, err)
+		}
+		for _, ns := range t.Namespaces {
+			scope := trust.NormalizeScope(strings.TrimSuffix(strings.TrimSuffix(ns, "*"), "/"))
+			if scope == "" {
+				return fmt.Errorf("team %q: invalid namespace %q", t.Name, ns)
+			}
+			if owner, ok := owners[scope]; ok {
+				return fmt.Errorf("namespace %q is claimed by both %q and %q", scope, owner, t.Name)
+			}
+			if _, ok := scopes[scope]; ok {
+				return fmt.Errorf("team %q: namespace %q is already configured in the signature policy", t.Name, scope)
+			}
+			owners[scope] = t.Name
+			scopes[scope] = signature.PolicyRequirements{req}
+		}
+	}
+	return nil
+}
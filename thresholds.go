@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/containers/image/types"
+	"github.com/docker/docker/reference"
+	"github.com/projectatomic/container-trust-plugin/pkg/trust"
+)
+
+// signatureThreshold requires the images of Repositories to be signed by at
+// least Required of Keys, on top of the policy.
+type signatureThreshold struct {
+	// Repositories are repository patterns, as in repositories.
+	Repositories []string `yaml:"repositories"`
+	// Keys are the paths of the GPG keyrings of the signers. Each signing
+	// key counts once, however many keyrings hold it.
+	Keys     []string `yaml:"keys"`
+	Required int      `yaml:"required"`
+}
+
+func (t signatureThreshold) validate() error {
+	if len(t.Repositories) == 0 {
+		return fmt.Errorf("signature-thresholds: repositories are required")
+	}
+	if t.Required <= 0 || t.Required > len(t.Keys) {
+		return fmt.Errorf("signature-thresholds: %s: required must be between 1 and the number of keys, %d", strings.Join(t.Repositories, ","), len(t.Keys))
+	}
+	return nil
+}
+
+func (t signatureThreshold) applies(ref reference.Named) bool {
+	for _, pattern := range t.Repositories {
+		if matchRepository(pattern, ref.FullName()) {
+			return true
+		}
+	}
+	return false
+}
+
+// errThresholdNotMet rejects images signed by fewer keys than required.
+type errThresholdNotMet struct {
+	signers, required int
+}
+
+func (e errThresholdNotMet) Error() string {
+	return fmt.Sprintf("signed by %d of the required %d keys", e.signers, e.required)
+}
+
+// checkThresholds rejects img, pulled as ref, unless it's signed by enough
+// distinct keys, told apart by fingerprint, for every threshold applying to
+// ref.
+func checkThresholds(k *keyrings, thresholds []signatureThreshold, ref reference.Named, img types.Image) error {
+	for _, t := range thresholds {
+		if !t.applies(ref) {
+			continue
+		}
+		signers := make(map[string]bool)
+		for _, path := range t.Keys {
+			keyring, err := ioutil.ReadFile(path)
+			if err != nil {
+				return err
+			}
+			payloads, err := signaturesByKeyring(k, img, keyring)
+			if err != nil {
+				return err
+			}
+			for _, p := range payloads {
+				if signedFor(p, ref) {
+					signers[p.key] = true
+				}
+			}
+		}
+		if len(signers) < t.Required {
+			return errThresholdNotMet{signers: len(signers), required: t.Required}
+		}
+	}
+	return nil
+}
+
+// signedFor tells whether the signature p claims to be about the
+// repository of ref.
+func signedFor(p signedPayload, ref reference.Named) bool {
+	claimed, err := trust.ParseNormalizedReference(p.Critical.Identity.Reference)
+	return err == nil && claimed.FullName() == ref.FullName()
+}
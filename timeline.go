@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"time"
+
+	dockerclient "github.com/docker/engine-api/client"
+	"github.com/docker/engine-api/types"
+	"github.com/docker/engine-api/types/filters"
+	"github.com/projectatomic/container-trust-plugin/pkg/trust"
+	"golang.org/x/net/context"
+)
+
+// defaultTimelineSince is how far back timelines look by default.
+const defaultTimelineSince = 7 * 24 * time.Hour
+
+// timelineEntry is a single event in the life of a digest on this host.
+type timelineEntry struct {
+	Time      time.Time `json:"time"`
+	Event     string    `json:"event"`
+	Container string    `json:"container,omitempty"`
+	User      string    `json:"user,omitempty"`
+	Reference string    `json:"reference,omitempty"`
+	Detail    string    `json:"detail,omitempty"`
+}
+
+// daemonEvent is the subset of a docker event we need.
+type daemonEvent struct {
+	Type     string `json:"Type"`
+	Action   string `json:"Action"`
+	TimeNano int64  `json:"timeNano"`
+	Actor    struct {
+		ID string `json:"ID"`
+	} `json:"Actor"`
+}
+
+// buildTimeline joins the decisions recorded for digest with the lifecycle
+// of the containers running it, since the given time, in time order.
+func buildTimeline(ctx context.Context, client *dockerclient.Client, records []auditRecord, digest string, since time.Time) ([]timelineEntry, error) {
+	var entries []timelineEntry
+	names := make(map[string]bool)
+	for _, rec := range records {
+		if rec.Digest != digest || rec.Time.Before(since) {
+			continue
+		}
+		event := "denied"
+		if rec.Allowed {
+			event = "verified"
+		}
+		if rec.Phase == phaseResponse {
+			event = "pulled"
+		}
+		entries = append(entries, timelineEntry{Time: rec.Time, Event: event, User: rec.User, Reference: rec.Reference, Detail: rec.Code})
+		if rec.Reference != "" {
+			names[rec.Reference] = true
+		}
+	}
+
+	// Find the local images of the digest through any of the names it was
+	// pulled as, then the containers created from them.
+	images, err := localImages(ctx, client, names, digest)
+	if err != nil {
+		return nil, err
+	}
+	if len(images) > 0 {
+		containers, err := client.ContainerList(ctx, types.ContainerListOptions{All: true})
+		if err != nil {
+			return nil, err
+		}
+		for _, c := range containers {
+			if !images[c.ImageID] {
+				continue
+			}
+			events, err := containerEvents(ctx, client, c.ID, since)
+			if err != nil {
+				return nil, err
+			}
+			entries = append(entries, events...)
+		}
+	}
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].Time.Before(entries[j].Time) })
+	return entries, nil
+}
+
+// localImages returns the IDs of the local image of digest, found through
+// any of the names it was pulled as, and of the images built from it
+// without adding layers, such as the tags AutoPull labels.
+func localImages(ctx context.Context, client *dockerclient.Client, names map[string]bool, digest string) (map[string]bool, error) {
+	var img types.ImageInspect
+	found := false
+	for name := range names {
+		ref, err := trust.ParseNormalizedReference(name)
+		if err != nil {
+			continue
+		}
+		if img, _, err = client.ImageInspectWithRaw(ctx, ref.FullName()+"@"+digest, false); err == nil {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return nil, nil
+	}
+	ids := map[string]bool{img.ID: true}
+	all, err := client.ImageList(ctx, types.ImageListOptions{All: true})
+	if err != nil {
+		return nil, err
+	}
+	for _, i := range all {
+		if i.ID == img.ID || (i.ParentID != img.ID && i.Labels[labelDigest] != digest) {
+			continue
+		}
+		// Labels can be forged, only images with the very same layers
+		// count.
+		child, _, err := client.ImageInspectWithRaw(ctx, i.ID, false)
+		if err == nil && sameLayers(child.RootFS.Layers, img.RootFS.Layers) {
+			ids[i.ID] = true
+		}
+	}
+	return ids, nil
+}
+
+// containerEvents returns the lifecycle events of a container since the
+// given time, up to now.
+func containerEvents(ctx context.Context, client *dockerclient.Client, id string, since time.Time) ([]timelineEntry, error) {
+	f := filters.NewArgs()
+	f.Add("type", "container")
+	f.Add("container", id)
+	rc, err := client.Events(ctx, types.EventsOptions{
+		Since:   fmt.Sprintf("%d", since.Unix()),
+		Until:   fmt.Sprintf("%d", time.Now().Unix()),
+		Filters: f,
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	var entries []timelineEntry
+	dec := json.NewDecoder(rc)
+	for {
+		var ev daemonEvent
+		if err := dec.Decode(&ev); err != nil {
+			if err == io.EOF {
+				return entries, nil
+			}
+			return nil, err
+		}
+		entries = append(entries, timelineEntry{
+			Time:      time.Unix(0, ev.TimeNano).UTC(),
+			Event:     ev.Action,
+			Container: ev.Actor.ID,
+		})
+	}
+}
+
+// readAuditRecords reads all the records of an audit log.
+func readAuditRecords(path string) ([]auditRecord, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var records []auditRecord
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		var rec auditRecord
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", path, line, err)
+		}
+		records = append(records, rec)
+	}
+	return records, scanner.Err()
+}
+
+// runTimeline prints the forensic timeline of a digest on this host.
+func runTimeline(args []string) error {
+	fs := flag.NewFlagSet("timeline", flag.ContinueOnError)
+	digest := fs.String("digest", "", "Digest to build the timeline of")
+	logPath := fs.String("log", "", "Audit log to read decisions from")
+	since := fs.Duration("since", defaultTimelineSince, "How far back to look")
+	asJSON := fs.Bool("json", false, "Print the timeline as JSON")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *digest == "" || *logPath == "" {
+		return errors.New("--digest and --log are required")
+	}
+	records, err := readAuditRecords(*logPath)
+	if err != nil {
+		return err
+	}
+	client, err := newDockerClient(*flDockerHost, *flCertPath, *flTLSVerify)
+	if err != nil {
+		return err
+	}
+	entries, err := buildTimeline(context.Background(), client, records, *digest, time.Now().Add(-*since))
+	if err != nil {
+		return err
+	}
+	if *asJSON {
+		return json.NewEncoder(os.Stdout).Encode(entries)
+	}
+	for _, e := range entries {
+		fmt.Printf("%s\t%s", e.Time.Format(time.RFC3339), e.Event)
+		if e.Container != "" {
+			fmt.Printf("\tcontainer=%s", e.Container)
+		}
+		if e.Reference != "" {
+			fmt.Printf("\treference=%s", e.Reference)
+		}
+		if e.User != "" {
+			fmt.Printf("\tuser=%s", e.User)
+		}
+		if e.Detail != "" {
+			fmt.Printf("\t%s", e.Detail)
+		}
+		fmt.Println()
+	}
+	return nil
+}
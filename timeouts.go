@@ -0,0 +1,171 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/containers/image/types"
+	"golang.org/x/net/context"
+)
+
+const (
+	defaultRegistryTimeout   = 30 * time.Second
+	defaultSignaturesTimeout = 30 * time.Second
+	defaultDaemonTimeout     = 30 * time.Second
+	defaultAutoPullTimeout   = 10 * time.Minute
+)
+
+// timeoutsConf bounds the network operations a decision waits for, so that
+// a hung registry or daemon denies the request instead of hanging the
+// client.
+type timeoutsConf struct {
+	// Decision bounds the whole decision, stages included. Unbounded by
+	// default, see client-timeout.
+	Decision time.Duration `yaml:"decision"`
+	// Registry bounds each manifest fetch, 30s by default.
+	Registry time.Duration `yaml:"registry"`
+	// Signatures bounds each retrieval of the signatures of an image, 30s
+	// by default.
+	Signatures time.Duration `yaml:"signatures"`
+	// Daemon bounds each call to the docker API, 30s by default.
+	Daemon time.Duration `yaml:"daemon"`
+	// AutoPull bounds pulling and tagging an image by AutoPull, 10m by
+	// default.
+	AutoPull time.Duration `yaml:"autopull"`
+}
+
+func (c timeoutsConf) validate() error {
+	for _, d := range []time.Duration{c.Decision, c.Registry, c.Signatures, c.Daemon, c.AutoPull} {
+		if d < 0 {
+			return fmt.Errorf("timeouts: %s can't be negative", d)
+		}
+	}
+	return nil
+}
+
+func orDefault(d, def time.Duration) time.Duration {
+	if d == 0 {
+		return def
+	}
+	return d
+}
+
+func (c timeoutsConf) registry() time.Duration {
+	return orDefault(c.Registry, defaultRegistryTimeout)
+}
+
+func (c timeoutsConf) signatures() time.Duration {
+	return orDefault(c.Signatures, defaultSignaturesTimeout)
+}
+
+func (c timeoutsConf) daemon() time.Duration {
+	return orDefault(c.Daemon, defaultDaemonTimeout)
+}
+
+func (c timeoutsConf) autoPull() time.Duration {
+	return orDefault(c.AutoPull, defaultAutoPullTimeout)
+}
+
+// decisionContext returns the context the network operations of a decision
+// run under.
+func (c timeoutsConf) decisionContext() (context.Context, context.CancelFunc) {
+	if c.Decision > 0 {
+		return context.WithTimeout(context.Background(), c.Decision)
+	}
+	return context.WithCancel(context.Background())
+}
+
+// daemonContext returns the context of a docker API call made for the
+// decision running under ctx.
+func (c timeoutsConf) daemonContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(ctx, c.daemon())
+}
+
+// timedOut returns the denial of a stage which didn't complete before ctx
+// was done, or err if ctx isn't.
+func timedOut(ctx context.Context, stage string, err error) error {
+	switch ctx.Err() {
+	case context.DeadlineExceeded:
+		return newTrustError(codeTimeout, "%s timed out", stage)
+	case context.Canceled:
+		return newTrustError(codeTimeout, "%s canceled", stage)
+	}
+	return err
+}
+
+// within runs fn for at most d and while ctx isn't done. The registry client
+// doesn't take a context, so fn is left running in the background when it
+// doesn't complete in time, and must not share its results until it
+// returns.
+func within(ctx context.Context, d time.Duration, stage string, fn func() error) error {
+	ctx, cancel := context.WithTimeout(ctx, d)
+	defer cancel()
+	done := make(chan error, 1)
+	go func() { done <- fn() }()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return timedOut(ctx, stage, ctx.Err())
+	}
+}
+
+// deadlineImage bounds the registry accesses of an image.
+type deadlineImage struct {
+	types.Image
+	ctx      context.Context
+	timeouts timeoutsConf
+}
+
+// withDeadlines wraps img so that fetching its manifest, its configuration
+// and its signatures gives up after the configured timeouts or once ctx is
+// done.
+func withDeadlines(ctx context.Context, img types.Image, c timeoutsConf) types.Image {
+	return &deadlineImage{Image: img, ctx: ctx, timeouts: c}
+}
+
+func (i *deadlineImage) Manifest() ([]byte, string, error) {
+	type manifest struct {
+		m        []byte
+		mimeType string
+	}
+	var res manifest
+	stage := "fetching the manifest of " + i.Reference().DockerReference().String()
+	err := within(i.ctx, i.timeouts.registry(), stage, func() error {
+		m, mimeType, err := i.Image.Manifest()
+		res = manifest{m, mimeType}
+		return err
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	return res.m, res.mimeType, nil
+}
+
+func (i *deadlineImage) Inspect() (*types.ImageInspectInfo, error) {
+	var info *types.ImageInspectInfo
+	stage := "fetching the configuration of " + i.Reference().DockerReference().String()
+	err := within(i.ctx, i.timeouts.registry(), stage, func() error {
+		var err error
+		info, err = i.Image.Inspect()
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+func (i *deadlineImage) Signatures() ([][]byte, error) {
+	var sigs [][]byte
+	stage := "fetching the signatures of " + i.Reference().DockerReference().String()
+	err := within(i.ctx, i.timeouts.signatures(), stage, func() error {
+		var err error
+		sigs, err = i.Image.Signatures()
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return sigs, nil
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/containers/image/signature"
+	"github.com/containers/image/types"
+	"github.com/docker/docker/reference"
+)
+
+var defaultTOFUStorePath = filepath.Join(stateDir, "tofu.json")
+
+// tofuConf enables trust on first use: the keys which signed the first
+// verified image of a repository are recorded, and later images of the
+// repository must be signed by one of them.
+type tofuConf struct {
+	// Store is the path of the database of the recorded keys.
+	Store string `yaml:"store"`
+}
+
+func (c tofuConf) store() string {
+	if c.Store == "" {
+		return defaultTOFUStorePath
+	}
+	return c.Store
+}
+
+// tofuEntry records the keys a repository was first seen signed with.
+type tofuEntry struct {
+	Keys      []string  `json:"keys"`
+	FirstSeen time.Time `json:"first_seen"`
+}
+
+// tofuStore is the database of the keys recorded per repository, persisted
+// as a JSON file.
+type tofuStore struct {
+	path string
+
+	mu    sync.Mutex
+	repos map[string]tofuEntry
+}
+
+func newTOFUStore(path string) (*tofuStore, error) {
+	s := &tofuStore{path: path, repos: make(map[string]tofuEntry)}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return s, nil
+		}
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &s.repos); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return s, nil
+}
+
+// errKeyChanged rejects images signed by other keys than the ones first
+// recorded for their repository.
+type errKeyChanged struct {
+	repo     string
+	recorded []string
+	signers  []string
+}
+
+func (e errKeyChanged) Error() string {
+	return fmt.Sprintf("%s was first seen signed by %s, now by %s", e.repo, strings.Join(e.recorded, ", "), strings.Join(e.signers, ", "))
+}
+
+// check rejects img, pulled as ref and allowed by policy, unless it's
+// signed by a key recorded for the repository of ref. The signers of the
+// first image of a repository are recorded. Scopes without signedBy
+// requirements aren't checked.
+func (s *tofuStore) check(k *keyrings, policy *signature.Policy, ref reference.Named, img types.Image) error {
+	_, reqs := policyScope(policy, img.Reference())
+	keyrings, err := signedByKeys(reqs)
+	if err != nil || len(keyrings) == 0 {
+		return err
+	}
+	var signers []string
+	for _, keyring := range keyrings {
+		payloads, err := signaturesByKeyring(k, img, keyring)
+		if err != nil {
+			return err
+		}
+		for _, p := range payloads {
+			if signedFor(p, ref) {
+				signers = append(signers, p.key)
+			}
+		}
+	}
+	if len(signers) == 0 {
+		return nil
+	}
+	repo := ref.FullName()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.repos[repo]
+	if !ok {
+		s.repos[repo] = tofuEntry{Keys: signers, FirstSeen: time.Now().UTC()}
+		return s.save()
+	}
+	for _, k := range e.Keys {
+		for _, signer := range signers {
+			if k == signer {
+				return nil
+			}
+		}
+	}
+	return errKeyChanged{repo: repo, recorded: e.Keys, signers: signers}
+}
+
+// save writes the database to a temporary file and renames it over the old
+// one, unless it's only kept in memory, without a path. Must be called with
+// s.mu held.
+func (s *tofuStore) save() error {
+	if s.path == "" {
+		return nil
+	}
+	data, err := json.Marshal(s.repos)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(s.path), 0700); err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
+
+// len returns how many repositories have keys recorded.
+func (s *tofuStore) len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.repos)
+}
@@ -0,0 +1,409 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/containers/image/types"
+	"github.com/docker/go-plugins-helpers/authorization"
+)
+
+const (
+	defaultTracingServiceName = "container-trust-plugin"
+	tracingTimeout            = 10 * time.Second
+	tracingFlushInterval      = 5 * time.Second
+	tracingBatchSize          = 512
+	tracingQueueSize          = 2048
+
+	// OTLP span kinds and status codes.
+	spanKindInternal = 1
+	spanKindServer   = 2
+	spanKindClient   = 3
+	spanStatusError  = 2
+)
+
+// tracingConf exports spans of the verification of requests over OTLP/HTTP.
+type tracingConf struct {
+	// Endpoint is the base URL of the OTLP/HTTP receiver, spans are posted
+	// as JSON to its /v1/traces.
+	Endpoint string `yaml:"endpoint"`
+	// Headers are added to the export requests, e.g. for authentication.
+	Headers map[string]string `yaml:"headers"`
+	// ServiceName is the service.name of the spans, container-trust-plugin
+	// by default.
+	ServiceName string `yaml:"service-name"`
+	// SampleRatio is the share of the requests traced, all by default.
+	// Requests carrying a sampled W3C traceparent are always traced.
+	SampleRatio *float64 `yaml:"sample-ratio"`
+}
+
+func (c tracingConf) validate() error {
+	if !strings.HasPrefix(c.Endpoint, "https://") && !strings.HasPrefix(c.Endpoint, "http://") {
+		return fmt.Errorf("tracing: invalid endpoint %q", c.Endpoint)
+	}
+	if c.SampleRatio != nil && (*c.SampleRatio < 0 || *c.SampleRatio > 1) {
+		return fmt.Errorf("tracing: sample-ratio must be between 0 and 1")
+	}
+	return nil
+}
+
+// tracer batches finished spans and exports them in the background. A nil
+// tracer traces nothing.
+type tracer struct {
+	// dropped counts the spans dropped since the last export because the
+	// queue was full.
+	dropped uint64
+
+	conf   tracingConf
+	url    string
+	client *http.Client
+	queue  chan *span
+}
+
+func newTracer(c tracingConf) *tracer {
+	if c.ServiceName == "" {
+		c.ServiceName = defaultTracingServiceName
+	}
+	t := &tracer{
+		conf:   c,
+		url:    strings.TrimSuffix(c.Endpoint, "/") + "/v1/traces",
+		client: &http.Client{Timeout: tracingTimeout},
+		queue:  make(chan *span, tracingQueueSize),
+	}
+	go t.run()
+	return t
+}
+
+// span is a timed operation of a trace. Its methods do nothing on a nil
+// span, so that untraced requests go through the same code.
+type span struct {
+	tracer  *tracer
+	traceID [16]byte
+	id      [8]byte
+	parent  [8]byte
+	name    string
+	kind    int
+	start   time.Time
+	end     time.Time
+
+	mu    sync.Mutex
+	attrs map[string]interface{}
+	err   string
+}
+
+// startRequest starts the root span of req, continuing the trace of its
+// traceparent header if any. It returns nil if the request isn't sampled.
+func (t *tracer) startRequest(req authorization.Request) *span {
+	if t == nil {
+		return nil
+	}
+	s := &span{tracer: t, name: "AuthZReq", kind: spanKindServer, start: time.Now()}
+	traceID, parent, sampled, ok := parseTraceparent(requestHeader(req, "traceparent"))
+	if ok {
+		if !sampled {
+			return nil
+		}
+		s.traceID, s.parent = traceID, parent
+	} else {
+		if !t.sample() {
+			return nil
+		}
+		rand.Read(s.traceID[:])
+	}
+	rand.Read(s.id[:])
+	s.set("http.method", req.RequestMethod)
+	s.set("http.target", req.RequestURI)
+	if req.User != "" {
+		s.set("enduser.id", req.User)
+	}
+	if id := requestHeader(req, "X-Request-Id"); id != "" {
+		s.set("docker.request_id", id)
+	}
+	return s
+}
+
+func (t *tracer) sample() bool {
+	if t.conf.SampleRatio == nil {
+		return true
+	}
+	var b [8]byte
+	rand.Read(b[:])
+	return float64(binary.BigEndian.Uint64(b[:])>>11)/(1<<53) < *t.conf.SampleRatio
+}
+
+// parseTraceparent parses a W3C traceparent header,
+// 00-<trace id>-<parent id>-<flags>.
+func parseTraceparent(h string) (traceID [16]byte, parent [8]byte, sampled, ok bool) {
+	parts := strings.Split(strings.TrimSpace(h), "-")
+	if len(parts) != 4 || len(parts[0]) != 2 || parts[0] == "ff" || len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return
+	}
+	if _, err := hex.Decode(traceID[:], []byte(parts[1])); err != nil || traceID == [16]byte{} {
+		return
+	}
+	if _, err := hex.Decode(parent[:], []byte(parts[2])); err != nil || parent == [8]byte{} {
+		return
+	}
+	flags, err := strconv.ParseUint(parts[3], 16, 8)
+	if err != nil {
+		return
+	}
+	return traceID, parent, flags&1 == 1, true
+}
+
+// child starts a span of the trace of s, as a child of s.
+func (s *span) child(name string) *span {
+	return s.childOfKind(name, spanKindInternal)
+}
+
+// client starts a child span for a call to a remote service.
+func (s *span) client(name string) *span {
+	return s.childOfKind(name, spanKindClient)
+}
+
+func (s *span) childOfKind(name string, kind int) *span {
+	if s == nil {
+		return nil
+	}
+	c := &span{tracer: s.tracer, traceID: s.traceID, parent: s.id, name: name, kind: kind, start: time.Now()}
+	rand.Read(c.id[:])
+	return c
+}
+
+// set sets the attribute key of s.
+func (s *span) set(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.attrs == nil {
+		s.attrs = make(map[string]interface{})
+	}
+	s.attrs[key] = value
+}
+
+// finish ends s, failed with err if not nil, and queues it for export.
+func (s *span) finish(err error) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.end = time.Now()
+	if err != nil {
+		s.err = err.Error()
+	}
+	s.mu.Unlock()
+	s.tracer.enqueue(s)
+}
+
+// finishResponse ends the root span s with the decision res.
+func (s *span) finishResponse(res authorization.Response) {
+	if s == nil {
+		return
+	}
+	s.set("trust.allowed", res.Allow)
+	if res.Allow {
+		s.finish(nil)
+		return
+	}
+	code, msg := splitCode(res.Err)
+	if code != "" {
+		s.set("trust.code", code)
+	}
+	s.finish(fmt.Errorf("%s", msg))
+}
+
+func (t *tracer) enqueue(s *span) {
+	select {
+	case t.queue <- s:
+	default:
+		atomic.AddUint64(&t.dropped, 1)
+	}
+}
+
+func (t *tracer) run() {
+	ticker := time.NewTicker(tracingFlushInterval)
+	defer ticker.Stop()
+	var batch []*span
+	for {
+		select {
+		case s := <-t.queue:
+			batch = append(batch, s)
+			if len(batch) < tracingBatchSize {
+				continue
+			}
+		case <-ticker.C:
+			if len(batch) == 0 {
+				continue
+			}
+		}
+		if n := atomic.SwapUint64(&t.dropped, 0); n > 0 {
+			logrus.Warnf("tracing: queue full, dropped %d spans", n)
+		}
+		if err := t.export(batch); err != nil {
+			logrus.Errorf("tracing: unable to export %d spans: %v", len(batch), err)
+		}
+		batch = nil
+	}
+}
+
+// OTLP/HTTP JSON encoding of spans.
+type (
+	otlpTraces struct {
+		ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+	}
+	otlpResourceSpans struct {
+		Resource   otlpResource     `json:"resource"`
+		ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+	}
+	otlpResource struct {
+		Attributes []otlpAttribute `json:"attributes"`
+	}
+	otlpScopeSpans struct {
+		Scope otlpScope  `json:"scope"`
+		Spans []otlpSpan `json:"spans"`
+	}
+	otlpScope struct {
+		Name    string `json:"name"`
+		Version string `json:"version"`
+	}
+	otlpSpan struct {
+		TraceID      string          `json:"traceId"`
+		SpanID       string          `json:"spanId"`
+		ParentSpanID string          `json:"parentSpanId,omitempty"`
+		Name         string          `json:"name"`
+		Kind         int             `json:"kind"`
+		Start        string          `json:"startTimeUnixNano"`
+		End          string          `json:"endTimeUnixNano"`
+		Attributes   []otlpAttribute `json:"attributes,omitempty"`
+		Status       otlpStatus      `json:"status"`
+	}
+	otlpStatus struct {
+		Code    int    `json:"code,omitempty"`
+		Message string `json:"message,omitempty"`
+	}
+	otlpAttribute struct {
+		Key   string                 `json:"key"`
+		Value map[string]interface{} `json:"value"`
+	}
+)
+
+func otlpAttr(key string, v interface{}) otlpAttribute {
+	switch v := v.(type) {
+	case bool:
+		return otlpAttribute{Key: key, Value: map[string]interface{}{"boolValue": v}}
+	case int:
+		return otlpAttribute{Key: key, Value: map[string]interface{}{"intValue": strconv.Itoa(v)}}
+	case float64:
+		return otlpAttribute{Key: key, Value: map[string]interface{}{"doubleValue": v}}
+	}
+	return otlpAttribute{Key: key, Value: map[string]interface{}{"stringValue": fmt.Sprint(v)}}
+}
+
+func (t *tracer) export(batch []*span) error {
+	resource := []otlpAttribute{otlpAttr("service.name", t.conf.ServiceName), otlpAttr("service.version", version)}
+	if host, err := os.Hostname(); err == nil {
+		resource = append(resource, otlpAttr("host.name", host))
+	}
+	spans := make([]otlpSpan, 0, len(batch))
+	for _, s := range batch {
+		s.mu.Lock()
+		o := otlpSpan{
+			TraceID: hex.EncodeToString(s.traceID[:]),
+			SpanID:  hex.EncodeToString(s.id[:]),
+			Name:    s.name,
+			Kind:    s.kind,
+			Start:   strconv.FormatInt(s.start.UnixNano(), 10),
+			End:     strconv.FormatInt(s.end.UnixNano(), 10),
+		}
+		if s.parent != [8]byte{} {
+			o.ParentSpanID = hex.EncodeToString(s.parent[:])
+		}
+		for k, v := range s.attrs {
+			o.Attributes = append(o.Attributes, otlpAttr(k, v))
+		}
+		if s.err != "" {
+			o.Status = otlpStatus{Code: spanStatusError, Message: s.err}
+		}
+		s.mu.Unlock()
+		spans = append(spans, o)
+	}
+	body, err := json.Marshal(otlpTraces{ResourceSpans: []otlpResourceSpans{{
+		Resource:   otlpResource{Attributes: resource},
+		ScopeSpans: []otlpScopeSpans{{Scope: otlpScope{Name: pluginName, Version: version}, Spans: spans}},
+	}}})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", t.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range t.conf.Headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("%s answered %s", t.url, resp.Status)
+	}
+	return nil
+}
+
+// tracedImage traces the first, uncached, retrieval of the manifest and of
+// the signatures of an image.
+type tracedImage struct {
+	types.Image
+	span *span
+
+	manifestOnce, signaturesOnce sync.Once
+}
+
+// traceImage wraps img to trace its registry accesses under s.
+func traceImage(img types.Image, s *span) types.Image {
+	if s == nil {
+		return img
+	}
+	return &tracedImage{Image: img, span: s}
+}
+
+func (i *tracedImage) Manifest() ([]byte, string, error) {
+	var s *span
+	i.manifestOnce.Do(func() {
+		s = i.span.client("registry.manifest")
+		s.set("image.reference", i.Reference().StringWithinTransport())
+	})
+	m, mimeType, err := i.Image.Manifest()
+	s.set("image.manifest_type", mimeType)
+	s.finish(err)
+	return m, mimeType, err
+}
+
+func (i *tracedImage) Signatures() ([][]byte, error) {
+	var s *span
+	i.signaturesOnce.Do(func() {
+		s = i.span.client("registry.signatures")
+		s.set("image.reference", i.Reference().StringWithinTransport())
+	})
+	sigs, err := i.Image.Signatures()
+	s.set("image.signatures", len(sigs))
+	s.finish(err)
+	return sigs, err
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"expvar"
+	"fmt"
+
+	"github.com/docker/docker/reference"
+)
+
+// How pulls of unqualified image names are handled.
+const (
+	unqualifiedAllow = "allow"
+	// unqualifiedNudge allows the pull, if otherwise compliant, with a
+	// warning naming the fully qualified equivalent.
+	unqualifiedNudge = "nudge"
+	unqualifiedDeny  = "deny"
+)
+
+// unqualifiedPulls counts pulls of unqualified names per repository.
+var unqualifiedPulls = expvar.NewMap("unqualified_pulls")
+
+// qualifiedName returns the fully qualified equivalent of ref.
+func qualifiedName(ref reference.Named) string {
+	switch r := ref.(type) {
+	case reference.Canonical:
+		return r.FullName() + "@" + r.Digest().String()
+	case reference.NamedTagged:
+		return r.FullName() + ":" + r.Tag()
+	}
+	return ref.FullName()
+}
+
+// checkUnqualified applies the configured mode to a pull of the unqualified
+// ref, returning either a denial or a warning to attach to the response.
+func checkUnqualified(mode string, ref reference.Named) (warning string, err error) {
+	unqualifiedPulls.Add(ref.Name(), 1)
+	switch mode {
+	case unqualifiedDeny:
+		return "", newTrustError(codeUnqualified, "unqualified image names aren't allowed, pull %s instead", qualifiedName(ref))
+	case unqualifiedNudge:
+		return fmt.Sprintf("warning: %s is an unqualified image name, unqualified names will be refused in the future, use %s", ref, qualifiedName(ref)), nil
+	}
+	return "", nil
+}
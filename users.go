@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/docker/go-plugins-helpers/authorization"
+)
+
+// usersConf maps the users the daemon authenticated to policy profiles.
+type usersConf struct {
+	// Groups lists the members of groups of users.
+	Groups map[string][]string `yaml:"groups"`
+	// Profiles are the policy profiles, by name.
+	Profiles map[string]userProfile `yaml:"profiles"`
+	// Assign maps users, and groups prefixed with @, to profiles.
+	Assign map[string]string `yaml:"assign"`
+	// Default is the profile of the users not assigned one, if any.
+	Default string `yaml:"default"`
+}
+
+// userProfile exempts users from or subjects them to some checks.
+type userProfile struct {
+	// AllowUnsigned allows images the signature policy rejects.
+	AllowUnsigned bool `yaml:"allow-unsigned"`
+	// RequireDigest denies pulls by tag.
+	RequireDigest bool `yaml:"require-digest"`
+}
+
+// Mode of audit records of denials lifted by a user profile.
+const modeExempt = "exempt"
+
+// profile returns the name and the profile of user: the one assigned to
+// the user, else to the first of the user's groups, in name order, having
+// one, else the default.
+func (c usersConf) profile(user string) (string, userProfile, bool) {
+	name, ok := c.Assign[user]
+	if !ok && user != "" {
+		groups := make([]string, 0, len(c.Groups))
+		for g := range c.Groups {
+			groups = append(groups, g)
+		}
+		sort.Strings(groups)
+		for _, g := range groups {
+			if n, assigned := c.Assign["@"+g]; assigned && contains(c.Groups[g], user) {
+				name, ok = n, true
+				break
+			}
+		}
+	}
+	if !ok {
+		name = c.Default
+	}
+	p, ok := c.Profiles[name]
+	return name, p, ok
+}
+
+func (c usersConf) validate() error {
+	for u, name := range c.Assign {
+		if _, ok := c.Profiles[name]; !ok {
+			return fmt.Errorf("users: %s is assigned unknown profile %q", u, name)
+		}
+		if g := strings.TrimPrefix(u, "@"); g != u {
+			if _, ok := c.Groups[g]; !ok {
+				return fmt.Errorf("users: unknown group %q", g)
+			}
+		}
+	}
+	if _, ok := c.Profiles[c.Default]; c.Default != "" && !ok {
+		return fmt.Errorf("users: unknown default profile %q", c.Default)
+	}
+	return nil
+}
+
+// isPolicyDenial tells whether code is the one of a denial by the
+// signature policy.
+func isPolicyDenial(code string) bool {
+	switch code {
+	case codeNoSignature, codeKeyUntrusted, codeSignatureInvalid, codeIdentityMismatch,
+		codeRejected, codeDenied, codePolicyError:
+		return true
+	}
+	return false
+}
+
+// userExemption lets through the request denied by res if the signature
+// policy denied it and the profile of the user allows unsigned images.
+func userExemption(cfg usersConf, req authorization.Request, rec *auditRecord, res authorization.Response) (authorization.Response, bool) {
+	if res.Allow {
+		return res, false
+	}
+	name, profile, ok := cfg.profile(req.User)
+	if !ok || !profile.AllowUnsigned {
+		return res, false
+	}
+	msg := res.Err
+	if msg == "" {
+		msg = res.Msg
+	}
+	if code, _ := splitCode(msg); !isPolicyDenial(code) {
+		return res, false
+	}
+	rec.Mode = modeExempt
+	rec.Warning = fmt.Sprintf("allowed for user %s by profile %s: %s", req.User, name, msg)
+	return authorization.Response{Allow: true}, true
+}
+
+func contains(list []string, s string) bool {
+	for _, e := range list {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
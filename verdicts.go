@@ -0,0 +1,131 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/containers/image/manifest"
+	"github.com/containers/image/types"
+	"github.com/docker/docker/reference"
+)
+
+const defaultVerdictCacheMaxEntries = 10000
+
+// verdictCacheConf caches the images the policy allowed, by digest, so that
+// pulling the same image again doesn't fetch and verify its signatures.
+type verdictCacheConf struct {
+	// TTL is how long an image stays allowed without being verified again.
+	TTL time.Duration `yaml:"ttl"`
+	// MaxEntries bounds the cache, 10000 entries by default.
+	MaxEntries int `yaml:"max-entries"`
+}
+
+func (c verdictCacheConf) validate() error {
+	if c.TTL <= 0 {
+		return fmt.Errorf("verification-cache: ttl must be positive")
+	}
+	if c.MaxEntries < 0 {
+		return fmt.Errorf("verification-cache: max-entries must be positive")
+	}
+	return nil
+}
+
+// verdictCache records until when the images allowed by the policy stay
+// allowed, keyed by reference, digest and fingerprint of the snapshot they
+// were verified against, since policies may match tags. It's purged whenever the snapshot is reloaded.
+type verdictCache struct {
+	mu      sync.Mutex
+	expires map[string]time.Time
+	hits    uint64
+}
+
+func newVerdictCache() *verdictCache {
+	return &verdictCache{expires: make(map[string]time.Time)}
+}
+
+// key returns the key of img, pulled as ref and verified against snap, ""
+// if caching is disabled or the digest of img is unknown.
+func (c *verdictCache) key(snap *snapshot, ref reference.Named, img types.Image) string {
+	if snap.config.VerificationCache == nil {
+		return ""
+	}
+	m, _, err := img.Manifest()
+	if err != nil {
+		return ""
+	}
+	digest, err := manifest.Digest(m)
+	if err != nil {
+		return ""
+	}
+	return ref.String() + " " + digest + " " + snap.fingerprint
+}
+
+// allowed tells whether the image of key was allowed less than the TTL ago.
+func (c *verdictCache) allowed(key string) bool {
+	if key == "" {
+		return false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	exp, ok := c.expires[key]
+	if !ok {
+		return false
+	}
+	if time.Now().After(exp) {
+		delete(c.expires, key)
+		return false
+	}
+	c.hits++
+	return true
+}
+
+// add records that the image of key was allowed, evicting expired entries,
+// or arbitrary ones, once the cache is full.
+func (c *verdictCache) add(conf *verdictCacheConf, key string) {
+	if key == "" || conf == nil {
+		return
+	}
+	max := conf.MaxEntries
+	if max == 0 {
+		max = defaultVerdictCacheMaxEntries
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.expires) >= max {
+		now := time.Now()
+		for k, exp := range c.expires {
+			if now.After(exp) {
+				delete(c.expires, k)
+			}
+		}
+		for k := range c.expires {
+			if len(c.expires) < max {
+				break
+			}
+			delete(c.expires, k)
+		}
+	}
+	c.expires[key] = time.Now().Add(conf.TTL)
+}
+
+// purge forgets every verdict.
+func (c *verdictCache) purge() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.expires = make(map[string]time.Time)
+}
+
+// hitCount returns how many images were allowed from the cache.
+func (c *verdictCache) hitCount() uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.hits
+}
+
+// len returns how many verdicts are cached.
+func (c *verdictCache) len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.expires)
+}
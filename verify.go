@@ -0,0 +1,77 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/projectatomic/container-trust-plugin/pkg/trust"
+)
+
+// verifyResult is the outcome of the verify command.
+type verifyResult struct {
+	Reference string `json:"reference"`
+	Allowed   bool   `json:"allowed"`
+	Digest    string `json:"digest,omitempty"`
+	Code      string `json:"code,omitempty"`
+	Message   string `json:"message,omitempty"`
+}
+
+// verifyReference takes the decision a pull of image would get.
+func verifyReference(snap *snapshot, image string, plat trust.Platform) verifyResult {
+	result := verifyResult{Reference: image}
+	ref, err := trust.ParseImageReference(image)
+	if err != nil {
+		result.Code, result.Message = codeInvalidReference, err.Error()
+		return result
+	}
+	result.Reference = ref.String()
+	p := newOfflinePlugin()
+	p.snapshots.store(snap)
+	setupProxy(func() conf { return snap.config })
+	ctx, cancel := snap.config.Timeouts.decisionContext()
+	defer cancel()
+	dgst, terr := p.verifyImageFor(ctx, snap, ref, plat, nil)
+	if terr != nil {
+		result.Code, result.Message = terr.Code, terr.Msg
+		return result
+	}
+	result.Allowed = true
+	result.Digest = dgst
+	return result
+}
+
+// runVerify verifies an image against the policy without a daemon, for CI
+// pipelines. It prints the result as JSON and fails if the image is denied.
+func runVerify(args []string) error {
+	fs := flag.NewFlagSet("verify", flag.ContinueOnError)
+	platform := fs.String("platform", "", "Platform to verify the manifest of, os/arch[/variant], defaults to this host")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return errors.New("usage: verify [--platform os/arch] IMAGE")
+	}
+	plat := trust.HostPlatform()
+	if *platform != "" {
+		var err error
+		if plat, err = trust.ParsePlatform(*platform); err != nil {
+			return err
+		}
+	}
+	snap, err := loadSnapshot()
+	if err != nil {
+		return err
+	}
+	defer snap.keyrings.remove()
+	result := verifyReference(snap, fs.Arg(0), plat)
+	if err := json.NewEncoder(os.Stdout).Encode(result); err != nil {
+		return err
+	}
+	if !result.Allowed {
+		return fmt.Errorf("%s denied: %s", result.Reference, result.Code)
+	}
+	return nil
+}
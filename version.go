@@ -0,0 +1,7 @@
+package main
+
+// version and gitCommit identify the build, set with -ldflags -X.
+var (
+	version   = "dev"
+	gitCommit = ""
+)
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/docker/go-plugins-helpers/authorization"
+)
+
+const defaultWebhookTimeout = 5 * time.Second
+
+// webhookConf configures an external decision point consulted for every
+// image the plugin takes a decision on.
+type webhookConf struct {
+	// URL is the HTTPS endpoint decision requests are posted to.
+	URL string `yaml:"url"`
+	// Timeout is how long to wait for an answer, 5s by default.
+	Timeout time.Duration `yaml:"timeout"`
+	// FailOpen keeps the decision of the plugin when the endpoint can't be
+	// reached or fails. By default the request is denied.
+	FailOpen bool `yaml:"fail-open"`
+	// OverrideDenials lets the endpoint allow the images the plugin denied.
+	// By default it's only consulted on the allowed ones, which it may
+	// deny.
+	OverrideDenials bool `yaml:"override-denials"`
+	// CACert is the CA the endpoint certificate is verified with, the
+	// system CAs by default. Cert and Key are the client certificate
+	// presented to it, if any.
+	CACert string `yaml:"ca-cert"`
+	Cert   string `yaml:"cert"`
+	Key    string `yaml:"key"`
+}
+
+// webhookRequest is the decision request posted to the endpoint.
+type webhookRequest struct {
+	Image     string           `json:"image"`
+	Digest    string           `json:"digest,omitempty"`
+	User      string           `json:"user,omitempty"`
+	Method    string           `json:"method"`
+	URI       string           `json:"uri"`
+	Signature webhookSignature `json:"signature"`
+}
+
+// webhookSignature is the outcome of the verification by the plugin.
+type webhookSignature struct {
+	Verified bool   `json:"verified"`
+	Code     string `json:"code,omitempty"`
+	Message  string `json:"message,omitempty"`
+}
+
+// webhookResponse is the answer of the endpoint, which is enforced.
+type webhookResponse struct {
+	Allow  bool   `json:"allow"`
+	Reason string `json:"reason"`
+}
+
+type webhook struct {
+	conf   webhookConf
+	client *http.Client
+}
+
+func newWebhook(c webhookConf) (*webhook, error) {
+	if !strings.HasPrefix(c.URL, "https://") {
+		return nil, fmt.Errorf("webhook: url must be https")
+	}
+	tlsc := &tls.Config{}
+	if c.CACert != "" {
+		pem, err := ioutil.ReadFile(c.CACert)
+		if err != nil {
+			return nil, fmt.Errorf("webhook: %v", err)
+		}
+		tlsc.RootCAs = x509.NewCertPool()
+		if !tlsc.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("webhook: no certificate in %s", c.CACert)
+		}
+	}
+	if c.Cert != "" || c.Key != "" {
+		cert, err := tls.LoadX509KeyPair(c.Cert, c.Key)
+		if err != nil {
+			return nil, fmt.Errorf("webhook: %v", err)
+		}
+		tlsc.Certificates = []tls.Certificate{cert}
+	}
+	timeout := c.Timeout
+	if timeout <= 0 {
+		timeout = defaultWebhookTimeout
+	}
+	return &webhook{conf: c, client: &http.Client{
+		Timeout:   timeout,
+		Transport: &http.Transport{TLSClientConfig: tlsc, Proxy: defaultTransportProxy},
+	}}, nil
+}
+
+// decide hands the decision res of the plugin on the image of rec to the
+// endpoint and returns its answer. AutoPulls are done already and pass
+// through, as do denials unless override-denials is set.
+func (w *webhook) decide(req authorization.Request, rec *auditRecord, res authorization.Response) authorization.Response {
+	msg := res.Err
+	if msg == "" {
+		msg = res.Msg
+	}
+	if code, _ := splitCode(msg); code == codeAutoPulled {
+		return res
+	}
+	if !res.Allow && !w.conf.OverrideDenials {
+		return res
+	}
+	wreq := webhookRequest{
+		Image:     rec.Reference,
+		Digest:    rec.Digest,
+		User:      req.User,
+		Method:    req.RequestMethod,
+		URI:       req.RequestURI,
+		Signature: webhookSignature{Verified: res.Allow},
+	}
+	if !res.Allow {
+		wreq.Signature.Code, wreq.Signature.Message = splitCode(res.Err)
+	}
+	wres, err := w.post(wreq)
+	if err != nil {
+		if w.conf.FailOpen {
+			rec.log().WithField("audit", "webhook-fail-open").Warnf("webhook: keeping the decision of the plugin on %s: %v", rec.Reference, err)
+			return res
+		}
+		return newTrustError(codeWebhookError, "decision point unavailable: %v", err).response()
+	}
+	if !wres.Allow {
+		return newTrustError(codeWebhookDenied, "denied by the decision point: %s", wres.Reason).response()
+	}
+	if !res.Allow {
+		rec.log().WithField("audit", "webhook-override").Warnf("webhook: allowing %s denied by the plugin: %s", rec.Reference, res.Err)
+	}
+	return authorization.Response{Allow: true}
+}
+
+func (w *webhook) post(wreq webhookRequest) (*webhookResponse, error) {
+	data, err := json.Marshal(wreq)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := w.client.Post(w.conf.URL, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s answered %s", w.conf.URL, resp.Status)
+	}
+	var wres webhookResponse
+	if err := json.NewDecoder(resp.Body).Decode(&wres); err != nil {
+		return nil, fmt.Errorf("invalid answer from %s: %v", w.conf.URL, err)
+	}
+	return &wres, nil
+}